@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// joinHostPort joins a host and a port, an ipv6 host goes in brackets
+func joinHostPort(host string, port uint) string {
+	return net.JoinHostPort(host, fmt.Sprint(port))
+}
+
+// trimBrackets strips the brackets of an ipv6 host, e.g. [fd00::1]
+func trimBrackets(host string) string {
+	if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+		return host[1 : len(host)-1]
+	}
+	return host
+}
+
+// splitHostPort splits host[:port], the port is empty without one. An ipv6
+// host needs brackets with a port, without one they are optional.
+func splitHostPort(s string) (string, string) {
+	if host, port, err := net.SplitHostPort(s); err == nil {
+		return host, port
+	}
+	// a bare ipv6 address has colons but no port
+	if net.ParseIP(trimBrackets(s)) != nil {
+		return trimBrackets(s), ""
+	}
+	if i := strings.LastIndex(s, ":"); i != -1 {
+		return s[:i], s[i+1:]
+	}
+	return s, ""
+}
+
+// splitColons splits at the colons outside of brackets, so ipv6 addresses
+// in brackets stay in one piece, e.g. in port mappings
+func splitColons(s string) []string {
+	var parts []string
+	depth, start := 0, 0
+	for i, c := range s {
+		switch c {
+		case '[':
+			depth++
+		case ']':
+			depth--
+		case ':':
+			if depth == 0 {
+				parts = append(parts, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// socatAddress is the socat address connecting to a target over tcp or udp,
+// socat needs TCP6 or UDP6 for an ipv6 host
+func socatAddress(protocol string, target string) string {
+	kind := strings.ToUpper(protocol)
+	if host, _, err := net.SplitHostPort(target); err == nil {
+		if ip := net.ParseIP(host); ip != nil && ip.To4() == nil {
+			kind += "6"
+		}
+	}
+	return fmt.Sprintf("%s:%s", kind, target)
+}
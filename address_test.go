@@ -0,0 +1,97 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitHostPort(t *testing.T) {
+	tests := []struct {
+		in   string
+		host string
+		port string
+	}{
+		{"db", "db", ""},
+		{"db:5432", "db", "5432"},
+		{"db:", "db", ""},
+		{":5432", "", "5432"},
+		{"10.0.0.1:80", "10.0.0.1", "80"},
+		{"fd00::1", "fd00::1", ""},
+		{"[fd00::1]", "fd00::1", ""},
+		{"[fd00::1]:80", "fd00::1", "80"},
+		{"[fd00::1]:", "fd00::1", ""},
+		{"::1", "::1", ""},
+		{"", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			host, port := splitHostPort(tt.in)
+			if host != tt.host || port != tt.port {
+				t.Errorf("splitHostPort(%q) = %q, %q, want %q, %q", tt.in, host, port, tt.host, tt.port)
+			}
+		})
+	}
+}
+
+func TestSplitColons(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+	}{
+		{"5432", []string{"5432"}},
+		{"5432:db:5432", []string{"5432", "db", "5432"}},
+		{"::", []string{"", "", ""}},
+		{"5432::5432", []string{"5432", "", "5432"}},
+		{"[::1]:5432:[fd00::1]:5432", []string{"[::1]", "5432", "[fd00::1]", "5432"}},
+		{"5432:[fd00::1]:", []string{"5432", "[fd00::1]", ""}},
+		{"", []string{""}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			if got := splitColons(tt.in); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("splitColons(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSocatAddress(t *testing.T) {
+	tests := []struct {
+		protocol string
+		target   string
+		want     string
+	}{
+		{PROTOCOL_TCP, "db:5432", "TCP:db:5432"},
+		{PROTOCOL_TCP, "10.0.0.1:5432", "TCP:10.0.0.1:5432"},
+		{PROTOCOL_TCP, "[fd00::1]:5432", "TCP6:[fd00::1]:5432"},
+		{PROTOCOL_UDP, "[fd00::a]:53", "UDP6:[fd00::a]:53"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.target, func(t *testing.T) {
+			if got := socatAddress(tt.protocol, tt.target); got != tt.want {
+				t.Errorf("socatAddress(%q, %q) = %q, want %q", tt.protocol, tt.target, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDialAddress(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"127.0.0.1", "127.0.0.1"},
+		{"127.0.0.2", "127.0.0.2"},
+		{"0.0.0.0", LOOPBACK_ADDRESS},
+		{"::", "::1"},
+		{"::1", "::1"},
+		{"192.168.1.10", "192.168.1.10"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			if got := dialAddress(tt.in); got != tt.want {
+				t.Errorf("dialAddress(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
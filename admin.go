@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+)
+
+// adminOptions configure the local admin endpoint of long running instances
+type adminOptions struct {
+	address string
+	pprof   bool
+}
+
+// serveAdmin starts the admin endpoint in the background. It serves /healthz
+// and, if enabled, the pprof handlers under /debug/pprof/.
+func serveAdmin(opts adminOptions) error {
+	if opts.address == "" {
+		if opts.pprof {
+			return fmt.Errorf("--pprof needs an --admin-address")
+		}
+		return nil
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, _ *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	if opts.pprof {
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	}
+
+	listener, err := net.Listen("tcp", opts.address)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Admin endpoint listening on http://%s\n", listener.Addr())
+	go http.Serve(listener, mux)
+	return nil
+}
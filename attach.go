@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	apiv1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilrand "k8s.io/apimachinery/pkg/util/rand"
+)
+
+// the relay container injected into a pod listens on a port of this range on
+// the localhost of the pod, a port the pod uses already is unlikely
+const ATTACH_PORT_BASE = 40000
+const ATTACH_PORT_RANGE = 10000
+const ATTACH_POLL_INTERVAL = time.Second
+
+// ephemeralSecurity is the security context of an ephemeral container, the
+// pod it joins may run as root, so it runs as nobody by itself
+func ephemeralSecurity() *apiv1.SecurityContext {
+	security := containerSecurity()
+	user, nonRoot := int64(RUN_AS_USER), true
+	security.RunAsUser, security.RunAsGroup, security.RunAsNonRoot = &user, &user, &nonRoot
+	security.SeccompProfile = &apiv1.SeccompProfile{Type: apiv1.SeccompProfileTypeRuntimeDefault}
+	return security
+}
+
+// attachContainer is the ephemeral relay container injected into a pod, it
+// shares the network namespace of the pod. Ephemeral containers have no
+// probes, lifecycle or resources.
+func attachContainer(name string, opts relayOptions, port int) apiv1.EphemeralContainer {
+	return apiv1.EphemeralContainer{
+		EphemeralContainerCommon: apiv1.EphemeralContainerCommon{
+			Name:  name,
+			Image: opts.podImage,
+			Args: []string{
+				fmt.Sprintf("TCP-LISTEN:%d,fork,bind=%s", port, LOOPBACK_ADDRESS),
+				socatAddress(PROTOCOL_TCP, opts.target()),
+			},
+			ImagePullPolicy: opts.imagePullPolicy,
+			SecurityContext: ephemeralSecurity(),
+		},
+	}
+}
+
+// existingPod resolves the pod of a flag like --attach, pod/<name>,
+// deploy/<name>, sts/<name> or just the name of a pod
+func existingPod(rc *relayClient, namespace string, flag string, target string) (*apiv1.Pod, error) {
+	t, ok := parseKubeTarget(target)
+	if !ok {
+		t = kubeTarget{kind: "pod", name: target}
+	}
+	if t.kind == "svc" {
+		return nil, fmt.Errorf("--%s needs a pod, deploy or sts, not %q", flag, target)
+	}
+	return targetPod(rc.clientset, namespace, t)
+}
+
+// serveAttached injects a relay container into a pod and forwards to it, the
+// relay reaches the localhost of the pod and other hosts see its connections
+// come from the pod. An ephemeral container can't be removed, socat in it is
+// stopped once the relay ends.
+func serveAttached(rc *relayClient, namespace string, opts relayOptions, policy retryPolicy, ready func(uint) error) error {
+	pod, err := existingPod(rc, namespace, "attach", opts.attach)
+	if err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%s-%s", POD_NAME, utilrand.String(5))
+	port := ATTACH_PORT_BASE + utilrand.Intn(ATTACH_PORT_RANGE)
+	pod.Spec.EphemeralContainers = append(pod.Spec.EphemeralContainers, attachContainer(name, opts, port))
+	_, err = rc.clientset.CoreV1().Pods(namespace).UpdateEphemeralContainers(context.TODO(), pod.Name, pod, metav1.UpdateOptions{})
+	// the pod exists, so not found is about the subresource
+	if k8serrors.IsNotFound(err) && !strings.Contains(err.Error(), pod.Name) {
+		return &relayError{
+			Code:       "EphemeralContainersUnsupported",
+			Reason:     "The cluster doesn't support ephemeral containers",
+			Suggestion: "ephemeral containers need kubernetes 1.23 or later",
+			exitCode:   1,
+		}
+	}
+	if err != nil {
+		return withExitCode(err, EXIT_POD_CREATE)
+	}
+	opts.log.printf("Attached relay container %q to pod %q\n", name, pod.Name)
+	var once sync.Once
+	stop := func() {
+		once.Do(func() { stopAttached(rc, namespace, pod.Name, name, opts.log) })
+	}
+	opts.shutdown.atExit(stop)
+	defer stop()
+
+	if err := waitAttached(rc, namespace, pod.Name, name, opts.waitTimeout); err != nil {
+		return withExitCode(err, EXIT_POD_START)
+	}
+	opts.targetPod = pod.Name
+	return withExitCode(servePod(rc, namespace, opts, port, policy, ready), EXIT_FORWARD_LOST)
+}
+
+// waitAttached waits for the injected relay container to run
+func waitAttached(rc *relayClient, namespace string, pod string, container string, timeout time.Duration) error {
+	if timeout <= 0 {
+		timeout = WAIT_TIMEOUT
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		p, err := rc.clientset.CoreV1().Pods(namespace).Get(context.TODO(), pod, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		for _, s := range p.Status.EphemeralContainerStatuses {
+			if s.Name != container {
+				continue
+			}
+			if s.State.Running != nil {
+				return nil
+			}
+			if t := s.State.Terminated; t != nil {
+				err := fmt.Errorf("relay container %q in pod %q stopped: %s (exit code %d)", container, pod, t.Reason, t.ExitCode)
+				if logs := containerLogs(rc.clientset, p, container, false); logs != "" {
+					err = fmt.Errorf("%w: %s", err, logs)
+				}
+				return err
+			}
+			if w := s.State.Waiting; w != nil && (w.Reason == "ImagePullBackOff" || w.Reason == "ErrImagePull" || w.Reason == "ErrImageNeverPull") {
+				return fmt.Errorf("relay container %q in pod %q cannot pull its image: %s", container, pod, w.Message)
+			}
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("relay container %q in pod %q is not running within %s", container, pod, timeout)
+		}
+		time.Sleep(ATTACH_POLL_INTERVAL)
+	}
+}
+
+// stopAttached stops socat in the injected relay container, its handlers end
+// it on a signal although it is pid 1
+func stopAttached(rc *relayClient, namespace string, pod string, container string, log *logger) {
+	err := execContainer(rc, namespace, pod, container, []string{"kill", "1"}, nil, io.Discard)
+	if err != nil {
+		log.printf("Cannot stop relay container %q in pod %q: %s\n", container, pod, err)
+		return
+	}
+	log.printf("Stopped relay container %q in pod %q\n", container, pod)
+}
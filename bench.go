@@ -0,0 +1,341 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"sort"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/urfave/cli/v2"
+	apiv1 "k8s.io/api/core/v1"
+)
+
+const BENCH_NAME = POD_NAME + "-bench"
+const BENCH_MODE_ECHO = "echo"
+const BENCH_MODE_DISCARD = "discard"
+
+// the bench pod echoes on one port and discards on the next
+const BENCH_ECHO_PORT = RELAY_PORT
+const BENCH_DISCARD_PORT = RELAY_PORT + 1
+
+type benchOptions struct {
+	mode        string
+	connections int
+	duration    time.Duration
+	size        int
+	podImage    string
+	baseline    bool
+	log         *logger
+}
+
+// benchResult is the load of one run, latencies are sorted
+type benchResult struct {
+	bytes      int64
+	elapsed    time.Duration
+	connect    []time.Duration
+	roundTrips []time.Duration
+	errors     int
+}
+
+// benchPod runs socat echoing and discarding what it receives, so a run
+// measures the tunnel and not a target
+func benchPod(opts benchOptions) *apiv1.Pod {
+	container := func(name string, args ...string) apiv1.Container {
+		return apiv1.Container{
+			Name:            name,
+			Image:           opts.podImage,
+			Args:            args,
+			SecurityContext: containerSecurity(),
+		}
+	}
+	return relayPod(BENCH_NAME, newInstance(BENCH_NAME), time.Second,
+		container(BENCH_MODE_ECHO, fmt.Sprintf("TCP-LISTEN:%d,fork,reuseaddr", BENCH_ECHO_PORT), "PIPE"),
+		container(BENCH_MODE_DISCARD, "-u", fmt.Sprintf("TCP-LISTEN:%d,fork,reuseaddr", BENCH_DISCARD_PORT), "OPEN:/dev/null"))
+}
+
+// runBench puts load on an address for the duration. Echo connections send
+// messages of the size and wait for each to come back, discard connections
+// only send.
+func runBench(address string, opts benchOptions) benchResult {
+	var mu sync.Mutex
+	var result benchResult
+	var wg sync.WaitGroup
+	start := time.Now()
+	deadline := start.Add(opts.duration)
+	for i := 0; i < opts.connections; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			connect, roundTrips, n, err := benchConnection(address, opts, deadline)
+			mu.Lock()
+			defer mu.Unlock()
+			result.bytes += n
+			if err != nil {
+				result.errors++
+				return
+			}
+			result.connect = append(result.connect, connect)
+			result.roundTrips = append(result.roundTrips, roundTrips...)
+		}()
+	}
+	wg.Wait()
+	result.elapsed = time.Since(start)
+	sort.Slice(result.connect, func(i, j int) bool { return result.connect[i] < result.connect[j] })
+	sort.Slice(result.roundTrips, func(i, j int) bool { return result.roundTrips[i] < result.roundTrips[j] })
+	return result
+}
+
+// benchConnection is the load of one connection, its connect latency lasts
+// until the first byte came back through the relay, or until it is open in
+// discard mode
+func benchConnection(address string, opts benchOptions, deadline time.Time) (time.Duration, []time.Duration, int64, error) {
+	start := time.Now()
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		return 0, nil, 0, err
+	}
+	defer conn.Close()
+	message := make([]byte, opts.size)
+	if opts.mode == BENCH_MODE_DISCARD {
+		connect := time.Since(start)
+		var n int64
+		conn.SetWriteDeadline(deadline)
+		for time.Now().Before(deadline) {
+			written, err := conn.Write(message)
+			n += int64(written)
+			if err != nil {
+				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+					break
+				}
+				return connect, nil, n, err
+			}
+		}
+		return connect, nil, n, nil
+	}
+
+	conn.SetDeadline(deadline.Add(opts.duration))
+	echo := make([]byte, opts.size)
+	if _, err := conn.Write(message[:1]); err != nil {
+		return 0, nil, 0, err
+	}
+	if _, err := io.ReadFull(conn, echo[:1]); err != nil {
+		return 0, nil, 0, err
+	}
+	connect := time.Since(start)
+	var roundTrips []time.Duration
+	var n int64
+	for time.Now().Before(deadline) {
+		// large messages would fill the buffers before they come back, so the
+		// echo is read while the message is written
+		sent := time.Now()
+		written := make(chan error, 1)
+		go func() {
+			_, err := conn.Write(message)
+			written <- err
+		}()
+		if _, err := io.ReadFull(conn, echo); err != nil {
+			return connect, roundTrips, n, err
+		}
+		if err := <-written; err != nil {
+			return connect, roundTrips, n, err
+		}
+		roundTrips = append(roundTrips, time.Since(sent))
+		n += int64(opts.size)
+	}
+	return connect, roundTrips, n, nil
+}
+
+// serveBench echoes or discards on a local listener, the baseline of a run
+// without the tunnel
+func serveBench(mode string) (net.Listener, error) {
+	listener, err := net.Listen("tcp", net.JoinHostPort(LOOPBACK_ADDRESS, "0"))
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if mode == BENCH_MODE_DISCARD {
+					io.Copy(io.Discard, conn)
+				} else {
+					io.Copy(conn, conn)
+				}
+			}()
+		}
+	}()
+	return listener, nil
+}
+
+// percentile of sorted durations, p between 0 and 100
+func percentile(sorted []time.Duration, p int) string {
+	if len(sorted) == 0 {
+		return "-"
+	}
+	i := (len(sorted)*p + 99) / 100
+	if i > 0 {
+		i--
+	}
+	return sorted[i].Round(10 * time.Microsecond).String()
+}
+
+func throughput(bytes int64, elapsed time.Duration) string {
+	return fmt.Sprintf("%.1f MiB/s", float64(bytes)/elapsed.Seconds()/(1<<20))
+}
+
+func printBench(w io.Writer, rows []string, results []benchResult) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "\tTHROUGHPUT\tCONNECT P50\tP90\tP99\tROUND TRIP P50\tP90\tP99\tERRORS")
+	for i, r := range results {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%d\n", rows[i], throughput(r.bytes, r.elapsed),
+			percentile(r.connect, 50), percentile(r.connect, 90), percentile(r.connect, 99),
+			percentile(r.roundTrips, 50), percentile(r.roundTrips, 90), percentile(r.roundTrips, 99), r.errors)
+	}
+	return tw.Flush()
+}
+
+// bench starts a bench pod and puts load through a forward to it, with
+// baseline the same load goes to a local server first
+func bench(kube *kubeOptions, opts benchOptions) error {
+	var rows []string
+	var results []benchResult
+	if opts.baseline {
+		listener, err := serveBench(opts.mode)
+		if err != nil {
+			return err
+		}
+		opts.log.printf("Running the baseline against a local %s server for %s\n", opts.mode, opts.duration)
+		rows, results = append(rows, "local"), append(results, runBench(listener.Addr().String(), opts))
+		listener.Close()
+	}
+
+	namespace, rc, err := connect(kube)
+	if err != nil {
+		return err
+	}
+	defaults, err := rc.clusterDefaults()
+	if err != nil {
+		return err
+	}
+	if !defaults.allows(namespace) {
+		return namespaceNotAllowed(namespace, defaults)
+	}
+
+	ctrlc := make(chan os.Signal, 1)
+	signal.Notify(ctrlc, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	go func() {
+		<-ctrlc
+		cleanupOwned(rc.clientset, namespace, opts.log)
+		recordTelemetryExit(errInterrupted)
+		os.Exit(1)
+	}()
+
+	name, err := createPod(rc.clientset, namespace, benchPod(opts), defaults, opts.log)
+	if err != nil {
+		return withExitCode(err, EXIT_POD_CREATE)
+	}
+	defer cleanup(rc.clientset, namespace, name, opts.log)
+	if err := wait(rc, namespace, name, WAIT_FOR_RUNNING, SCHEDULE_TIMEOUT, WAIT_TIMEOUT, opts.log); err != nil {
+		reportStartup(rc.clientset, namespace, name, opts.log)
+		return withExitCode(err, EXIT_POD_START)
+	}
+
+	port := BENCH_ECHO_PORT
+	if opts.mode == BENCH_MODE_DISCARD {
+		port = BENCH_DISCARD_PORT
+	}
+	var tunnel *benchResult
+	stop := make(chan struct{})
+	err = forwardUntil(rc, namespace, name, 0, port, stop, func(localPort uint) error {
+		defer close(stop)
+		opts.log.printf("Running %d %s connections through the tunnel for %s\n", opts.connections, opts.mode, opts.duration)
+		result := runBench(net.JoinHostPort(LOOPBACK_ADDRESS, fmt.Sprint(localPort)), opts)
+		tunnel = &result
+		return nil
+	})
+	if err == nil && tunnel == nil {
+		err = fmt.Errorf("the forward to the bench pod ended before the run")
+	}
+	if err != nil {
+		return withExitCode(err, EXIT_FORWARD_LOST)
+	}
+	rows, results = append(rows, "tunnel"), append(results, *tunnel)
+	return printBench(os.Stdout, rows, results)
+}
+
+func benchCommand(kube *kubeOptions) *cli.Command {
+	opts := benchOptions{log: &logger{out: os.Stderr}}
+	var quiet bool
+
+	return &cli.Command{
+		Name:  "bench",
+		Usage: "measure throughput and latency through a tunnel to a pod that echoes or discards",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:        "mode",
+				Usage:       "echo to measure round trips, or discard to measure upload throughput only",
+				Value:       BENCH_MODE_ECHO,
+				Destination: &opts.mode,
+			},
+			&cli.IntFlag{
+				Name:        "connections",
+				Aliases:     []string{"c"},
+				Usage:       "number of concurrent connections",
+				Value:       8,
+				Destination: &opts.connections,
+			},
+			&cli.DurationFlag{
+				Name:        "duration",
+				Aliases:     []string{"d"},
+				Usage:       "how long to put load on the tunnel",
+				Value:       10 * time.Second,
+				Destination: &opts.duration,
+			},
+			&cli.IntFlag{
+				Name:        "size",
+				Usage:       "bytes per message",
+				Value:       16 * 1024,
+				Destination: &opts.size,
+			},
+			&cli.BoolFlag{
+				Name:        "baseline",
+				Usage:       "run the same load against a local server first, to compare",
+				Destination: &opts.baseline,
+			},
+			&cli.StringFlag{
+				Name:        "pod-image",
+				Usage:       "image of the bench pod, it needs socat",
+				Value:       POD_IMAGE,
+				Destination: &opts.podImage,
+			},
+			&cli.BoolFlag{
+				Name:        "quiet",
+				Aliases:     []string{"q"},
+				Usage:       "do not print progress to stderr",
+				Destination: &quiet,
+			},
+		},
+		Action: func(c *cli.Context) error {
+			if opts.mode != BENCH_MODE_ECHO && opts.mode != BENCH_MODE_DISCARD {
+				return fmt.Errorf("unknown --mode %q, use %s or %s", opts.mode, BENCH_MODE_ECHO, BENCH_MODE_DISCARD)
+			}
+			if opts.connections <= 0 || opts.size <= 0 || opts.duration <= 0 {
+				return fmt.Errorf("--connections, --size and --duration need positive values")
+			}
+			if quiet {
+				opts.log.out = io.Discard
+			}
+			return bench(kube, opts)
+		},
+	}
+}
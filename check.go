@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/urfave/cli/v2"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/tools/remotecommand"
+)
+
+const CHECK_NAME = POD_NAME + "-check"
+
+// socat logs with microseconds, these lines frame the connect to the target
+const SOCAT_LOG_TIME = "2006/01/02 15:04:05.000000"
+const SOCAT_CONNECTING = " N opening connection to "
+const SOCAT_CONNECTED = " N successfully connected "
+
+type checkOptions struct {
+	target   string
+	timeout  time.Duration
+	newPod   bool
+	podImage string
+	log      *logger
+}
+
+// checkResult is a connect from the relay pod, the address is the one the
+// target resolved to
+type checkResult struct {
+	address string
+	elapsed time.Duration
+	err     string
+}
+
+// reusablePod is a running relay pod of this user with socat in its relay
+// container, the newest one
+func reusablePod(rc *relayClient, namespace string) (string, bool) {
+	selector := labels.SelectorFromSet(map[string]string{
+		LABEL_MANAGED_BY: POD_NAME,
+		LABEL_USER:       currentUser(),
+		LABEL_HOST:       currentHost(),
+	})
+	list, err := rc.clientset.CoreV1().Pods(namespace).List(context.TODO(), metav1.ListOptions{LabelSelector: selector.String()})
+	if err != nil {
+		return "", false
+	}
+	var newest *apiv1.Pod
+	for i, pod := range list.Items {
+		if pod.Status.Phase != apiv1.PodRunning || pod.DeletionTimestamp != nil {
+			continue
+		}
+		for _, c := range pod.Spec.Containers {
+			// the go relay image has no socat
+			if c.Name == CONTAINER_NAME && !strings.HasPrefix(c.Image, GO_RELAY_IMAGE) {
+				if newest == nil || newest.CreationTimestamp.Before(&pod.CreationTimestamp) {
+					newest = &list.Items[i]
+				}
+			}
+		}
+	}
+	if newest == nil {
+		return "", false
+	}
+	return newest.Name, true
+}
+
+// probePod idles, connects are exec'd into it
+func probePod(name string, image string, target string) *apiv1.Pod {
+	container := apiv1.Container{
+		Name:            CONTAINER_NAME,
+		Image:           image,
+		Args:            []string{fmt.Sprintf("TCP-LISTEN:%d,fork", RELAY_PORT), "OPEN:/dev/null"},
+		SecurityContext: containerSecurity(),
+	}
+	manifest := relayPod(name, newInstance(name), time.Second, container)
+	manifest.Annotations = map[string]string{ANNOTATION_TARGET: target}
+	return manifest
+}
+
+// probeFrom is the relay pod to exec connects into, a running relay pod of
+// this user if there is one, else a new probe pod that done deletes again
+func probeFrom(rc *relayClient, namespace string, manifest *apiv1.Pod, newPod bool, log *logger) (string, func(), error) {
+	if !newPod {
+		if name, ok := reusablePod(rc, namespace); ok {
+			log.printf("Connecting from relay pod %q\n", name)
+			return name, func() {}, nil
+		}
+	}
+	defaults, err := rc.clusterDefaults()
+	if err != nil {
+		return "", nil, err
+	}
+	if !defaults.allows(namespace) {
+		return "", nil, namespaceNotAllowed(namespace, defaults)
+	}
+	ctrlc := make(chan os.Signal, 1)
+	signal.Notify(ctrlc, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	go func() {
+		<-ctrlc
+		cleanupOwned(rc.clientset, namespace, log)
+		recordTelemetryExit(errInterrupted)
+		os.Exit(1)
+	}()
+
+	name, err := createPod(rc.clientset, namespace, manifest, defaults, log)
+	if err != nil {
+		signal.Stop(ctrlc)
+		return "", nil, withExitCode(err, EXIT_POD_CREATE)
+	}
+	done := func() {
+		cleanup(rc.clientset, namespace, name, log)
+		signal.Stop(ctrlc)
+	}
+	if err := wait(rc, namespace, name, WAIT_FOR_RUNNING, SCHEDULE_TIMEOUT, WAIT_TIMEOUT, log); err != nil {
+		reportStartup(rc.clientset, namespace, name, log)
+		done()
+		return "", nil, withExitCode(err, EXIT_POD_START)
+	}
+	return name, done, nil
+}
+
+// connectFrom runs socat in the relay container of a pod, it connects to the
+// target and closes right away. The time is taken from the log of socat, an
+// exec takes longer than most connects.
+func connectFrom(rc *relayClient, namespace string, pod string, opts checkOptions) (checkResult, error) {
+	timeout := strconv.FormatFloat(opts.timeout.Seconds(), 'f', -1, 64)
+	executor, err := executor(rc, namespace, pod, &apiv1.PodExecOptions{
+		Container: CONTAINER_NAME,
+		Command: []string{"socat", "-d", "-d", "-lu", "-u", "OPEN:/dev/null",
+			fmt.Sprintf("%s,connect-timeout=%s", socatAddress(PROTOCOL_TCP, opts.target), timeout)},
+		Stdout: true,
+		Stderr: true,
+	})
+	if err != nil {
+		return checkResult{}, err
+	}
+	stderr := new(bytes.Buffer)
+	start := time.Now()
+	err = executor.Stream(remotecommand.StreamOptions{Stdout: io.Discard, Stderr: stderr})
+	result := parseSocatLog(stderr.String())
+	if result.elapsed == 0 {
+		result.elapsed = time.Since(start)
+	}
+	if err != nil && result.err == "" {
+		// e.g. the exec itself failed
+		return result, fmt.Errorf("%w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return result, nil
+}
+
+// parseSocatLog picks the address, the time of the connect and the error from
+// the log of socat -d -d -lu
+func parseSocatLog(log string) checkResult {
+	var result checkResult
+	var connecting time.Time
+	for _, line := range strings.Split(log, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		at, err := time.ParseInLocation(SOCAT_LOG_TIME, fields[0]+" "+fields[1], time.Local)
+		switch {
+		case strings.Contains(line, SOCAT_CONNECTING):
+			result.address = fields[len(fields)-1]
+			if err == nil {
+				connecting = at
+			}
+		case strings.Contains(line, SOCAT_CONNECTED):
+			if err == nil && !connecting.IsZero() {
+				result.elapsed = at.Sub(connecting)
+			}
+		case result.err == "" && strings.Contains(line, " E "):
+			result.err = line[strings.Index(line, " E ")+3:]
+			if err == nil && !connecting.IsZero() {
+				result.elapsed = at.Sub(connecting)
+			}
+		}
+	}
+	return result
+}
+
+// check connects to the target from a relay pod once
+func check(kube *kubeOptions, opts checkOptions) error {
+	namespace, rc, err := connect(kube)
+	if err != nil {
+		return err
+	}
+
+	name, done, err := probeFrom(rc, namespace, probePod(CHECK_NAME, opts.podImage, opts.target), opts.newPod, opts.log)
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	result, err := connectFrom(rc, namespace, name, opts)
+	if err != nil {
+		return err
+	}
+	target := opts.target
+	if result.address != "" && result.address != opts.target {
+		target = fmt.Sprintf("%s (%s)", opts.target, result.address)
+	}
+	if result.err != "" {
+		return &relayError{
+			Code:       "TargetUnreachable",
+			Reason:     fmt.Sprintf("%s is unreachable from the cluster after %s: %s", target, round(result.elapsed), result.err),
+			Resource:   fmt.Sprintf("pods/%s", name),
+			Suggestion: "check the host and port, the endpoints behind a service and network policies of the namespace",
+			exitCode:   EXIT_ERROR,
+		}
+	}
+	fmt.Printf("%s is reachable from the cluster, connected in %s\n", target, round(result.elapsed))
+	return nil
+}
+
+func checkCommand(kube *kubeOptions) *cli.Command {
+	opts := checkOptions{log: &logger{out: os.Stderr}}
+	var quiet bool
+
+	return &cli.Command{
+		Name:      "check",
+		Usage:     "test once whether a cluster host accepts tcp connections from inside the cluster",
+		ArgsUsage: "<host>:<port>",
+		Flags: []cli.Flag{
+			&cli.DurationFlag{
+				Name:        "timeout",
+				Usage:       "how long to wait for the target to accept",
+				Value:       5 * time.Second,
+				Destination: &opts.timeout,
+			},
+			&cli.BoolFlag{
+				Name:        "new-pod",
+				Usage:       "check from a new relay pod, instead of a running one of yours",
+				Destination: &opts.newPod,
+			},
+			&cli.StringFlag{
+				Name:        "pod-image",
+				Usage:       "image of a new relay pod, it needs socat",
+				Value:       POD_IMAGE,
+				Destination: &opts.podImage,
+			},
+			&cli.BoolFlag{
+				Name:        "quiet",
+				Aliases:     []string{"q"},
+				Usage:       "do not print progress to stderr",
+				Destination: &quiet,
+			},
+		},
+		Action: func(c *cli.Context) error {
+			if !c.Args().Present() {
+				return fmt.Errorf("missing target")
+			}
+			opts.target = c.Args().First()
+			host, port, err := net.SplitHostPort(opts.target)
+			if err != nil || host == "" {
+				return fmt.Errorf("invalid target %q, expected <host>:<port>", opts.target)
+			}
+			if p, err := strconv.ParseUint(port, 10, 16); err != nil || p == 0 {
+				return fmt.Errorf("invalid port %q in target %q", port, opts.target)
+			}
+			if opts.timeout <= 0 {
+				return fmt.Errorf("--timeout needs a positive duration")
+			}
+			if quiet {
+				opts.log.out = io.Discard
+			}
+			return check(kube, opts)
+		},
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseSocatLog(t *testing.T) {
+	tests := []struct {
+		name string
+		log  string
+		want checkResult
+	}{
+		{
+			name: "connected",
+			log: "2024/05/01 10:00:00.100000 socat[12] N opening connection to AF=2 10.96.0.10:5432\n" +
+				"2024/05/01 10:00:00.101250 socat[12] N successfully connected from local address AF=2 10.244.1.5:40000\n" +
+				"2024/05/01 10:00:00.101300 socat[12] N exiting with status 0\n",
+			want: checkResult{address: "10.96.0.10:5432", elapsed: 1250 * time.Microsecond},
+		},
+		{
+			name: "refused",
+			log: "2024/05/01 10:00:00.100000 socat[12] N opening connection to AF=2 10.96.0.10:5432\n" +
+				"2024/05/01 10:00:00.100500 socat[12] E connect(5, AF=2 10.96.0.10:5432, 16): Connection refused\n" +
+				"2024/05/01 10:00:00.100600 socat[12] N exit(1)\n",
+			want: checkResult{address: "10.96.0.10:5432", elapsed: 500 * time.Microsecond, err: "connect(5, AF=2 10.96.0.10:5432, 16): Connection refused"},
+		},
+		{
+			name: "first error wins",
+			log: "2024/05/01 10:00:00.100000 socat[12] N opening connection to AF=2 10.96.0.10:5432\n" +
+				"2024/05/01 10:00:05.100000 socat[12] E connecting to AF=2 10.96.0.10:5432: Operation timed out\n" +
+				"2024/05/01 10:00:05.100100 socat[12] E exit(1)\n",
+			want: checkResult{address: "10.96.0.10:5432", elapsed: 5 * time.Second, err: "connecting to AF=2 10.96.0.10:5432: Operation timed out"},
+		},
+		{
+			name: "unresolved",
+			log:  "2024/05/01 10:00:00.100000 socat[12] E getaddrinfo(\"postgres.data.svc\", \"NULL\", {0x20,2,1,6}, {}): Name does not resolve\n",
+			want: checkResult{err: "getaddrinfo(\"postgres.data.svc\", \"NULL\", {0x20,2,1,6}, {}): Name does not resolve"},
+		},
+		{
+			name: "crlf and blank lines",
+			log: "\r\n2024/05/01 10:00:00.100000 socat[12] N opening connection to AF=2 10.96.0.10:5432\r\n\r\n" +
+				"2024/05/01 10:00:00.102000 socat[12] N successfully connected from local address AF=2 10.244.1.5:40000\r\n",
+			want: checkResult{address: "10.96.0.10:5432", elapsed: 2 * time.Millisecond},
+		},
+		{
+			name: "no timestamps",
+			log:  "socat[12] N opening connection to AF=2 10.96.0.10:5432\nsocat[12] N successfully connected from local address AF=2 10.244.1.5:40000\n",
+			want: checkResult{address: "10.96.0.10:5432"},
+		},
+		{
+			name: "empty",
+			log:  "",
+			want: checkResult{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseSocatLog(tt.log); got != tt.want {
+				t.Errorf("parseSocatLog() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/httpstream"
+	spdystream "k8s.io/apimachinery/pkg/util/httpstream/spdy"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/transport/spdy"
+)
+
+const LABEL_MANAGED_BY = "app.kubernetes.io/managed-by"
+
+// spdy pings keep idle port-forwards from being cut by load balancers in
+// front of the api server, which often drop connections idle for a minute
+const KEEPALIVE_INTERVAL = 5 * time.Second
+
+// relayClient is shared by all tunnels of a process. Credentials and tls config
+// are loaded once and relay pods are observed by one informer per namespace,
+// instead of a watch per tunnel.
+type relayClient struct {
+	config    *rest.Config
+	clientset kubernetes.Interface
+	tlsConfig *tls.Config
+
+	debugStreams bool
+	// transport of port-forwards, spdyOnly is set once a websocket upgrade
+	// failed in auto mode
+	transport string
+	spdyOnly  int32
+	// keepalive is the period of spdy pings on port-forwards, 0 disables them
+	keepalive time.Duration
+
+	mu       sync.Mutex
+	watchers map[string]*podWatcher
+	defaults *clusterDefaults
+	stop     chan struct{}
+}
+
+func newRelayClient(config *rest.Config, clientset kubernetes.Interface) (*relayClient, error) {
+	tlsConfig, err := rest.TLSConfigFor(config)
+	if err != nil {
+		return nil, err
+	}
+	return &relayClient{
+		config:    config,
+		clientset: clientset,
+		tlsConfig: tlsConfig,
+		watchers:  map[string]*podWatcher{},
+		stop:      make(chan struct{}),
+		keepalive: KEEPALIVE_INTERVAL,
+	}, nil
+}
+
+func (rc *relayClient) proxy() func(*http.Request) (*url.URL, error) {
+	if rc.config.Proxy != nil {
+		return rc.config.Proxy
+	}
+	return http.ProxyFromEnvironment
+}
+
+// roundTripper returns a transport for a single spdy connection, a spdy round
+// tripper keeps its upgraded connection, so only the tls config is shared.
+func (rc *relayClient) roundTripper() (http.RoundTripper, spdy.Upgrader, error) {
+	proxy := rc.proxy()
+	upgrader := spdystream.NewRoundTripperWithConfig(spdystream.RoundTripperConfig{
+		TLS:             rc.tlsConfig,
+		FollowRedirects: true,
+		Proxier:         proxy,
+		PingPeriod:      rc.keepalive,
+	})
+	wrapper, err := rest.HTTPWrappersForConfig(rc.config, upgrader)
+	if err != nil {
+		return nil, nil, err
+	}
+	return wrapper, upgrader, nil
+}
+
+// clusterDefaults loads the admin defaults for relay pods once
+func (rc *relayClient) clusterDefaults() (*clusterDefaults, error) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if rc.defaults != nil {
+		return rc.defaults, nil
+	}
+	defaults, err := loadClusterDefaults(rc)
+	if err != nil {
+		return nil, err
+	}
+	rc.defaults = defaults
+	return defaults, nil
+}
+
+func (rc *relayClient) dialer(u *url.URL) (httpstream.Dialer, error) {
+	transport, upgrader, err := rc.roundTripper()
+	if err != nil {
+		return nil, err
+	}
+	var dialer httpstream.Dialer = spdy.NewDialer(upgrader, &http.Client{Transport: transport}, http.MethodPost, u)
+	// the websocket upgrade dials the api server itself, not through a proxy
+	proxied, _ := rc.proxy()(&http.Request{URL: u})
+	switch {
+	case rc.transport == TRANSPORT_WEBSOCKET:
+		dialer = websocketDialer{rc: rc, url: u}
+	case rc.transport == TRANSPORT_AUTO && proxied == nil:
+		dialer = fallbackDialer{websocket: websocketDialer{rc: rc, url: u}, spdy: dialer, rc: rc}
+	}
+	if rc.debugStreams {
+		return debugDialer{Dialer: dialer, rc: rc, url: u.Path}, nil
+	}
+	return dialer, nil
+}
+
+// podURL is the url of a pod subresource like exec or portforward
+func (rc *relayClient) podURL(namespace string, name string, subresource string) *url.URL {
+	return rc.clientset.CoreV1().RESTClient().Post().
+		Resource("pods").
+		Namespace(namespace).
+		Name(name).
+		SubResource(subresource).
+		URL()
+}
+
+// podWatcher fans out updates of relay pods in a namespace to subscribers
+type podWatcher struct {
+	mu      sync.Mutex
+	indexer cache.Indexer
+	subs    map[string][]chan *v1.Pod
+	errs    map[chan *v1.Pod]chan error
+}
+
+// fail passes errors the informer would retry forever, like missing permissions, to subscribers
+func (w *podWatcher) fail(_ *cache.Reflector, err error) {
+	if !k8serrors.IsForbidden(err) && !k8serrors.IsUnauthorized(err) {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, errs := range w.errs {
+		select {
+		case errs <- err:
+		default:
+		}
+	}
+}
+
+func (w *podWatcher) dispatch(obj interface{}) {
+	w.publish(obj, false)
+}
+
+// deleted passes the final state of a deleted pod as deleting, a forced
+// deletion doesn't set the timestamp
+func (w *podWatcher) deleted(obj interface{}) {
+	w.publish(obj, true)
+}
+
+func (w *podWatcher) publish(obj interface{}, deleted bool) {
+	pod, ok := obj.(*v1.Pod)
+	if !ok {
+		tombstone, ok := obj.(cache.DeletedFinalStateUnknown)
+		if !ok {
+			return
+		}
+		if pod, ok = tombstone.Obj.(*v1.Pod); !ok {
+			return
+		}
+	}
+	if deleted && pod.DeletionTimestamp == nil {
+		pod = pod.DeepCopy()
+		now := metav1.Now()
+		pod.DeletionTimestamp = &now
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, ch := range w.subs[pod.Name] {
+		offer(ch, pod)
+	}
+}
+
+// offer replaces a pending update, subscribers only care about the latest state
+func offer(ch chan *v1.Pod, pod *v1.Pod) {
+	select {
+	case <-ch:
+	default:
+	}
+	select {
+	case ch <- pod:
+	default:
+	}
+}
+
+func (rc *relayClient) podWatcher(namespace string) *podWatcher {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if w, ok := rc.watchers[namespace]; ok {
+		return w
+	}
+
+	factory := informers.NewSharedInformerFactoryWithOptions(rc.clientset, 0,
+		informers.WithNamespace(namespace),
+		informers.WithTweakListOptions(func(o *metav1.ListOptions) {
+			o.LabelSelector = fmt.Sprintf("%s=%s", LABEL_MANAGED_BY, POD_NAME)
+		}),
+	)
+	informer := factory.Core().V1().Pods().Informer()
+	w := &podWatcher{
+		indexer: informer.GetIndexer(),
+		subs:    map[string][]chan *v1.Pod{},
+		errs:    map[chan *v1.Pod]chan error{},
+	}
+	informer.SetWatchErrorHandler(w.fail)
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    w.dispatch,
+		UpdateFunc: func(_, obj interface{}) { w.dispatch(obj) },
+		DeleteFunc: w.deleted,
+	})
+	factory.Start(rc.stop)
+	rc.watchers[namespace] = w
+	return w
+}
+
+// watchPod subscribes to the updates of a relay pod, starting with its current
+// state if it is known already. cancel ends the subscription.
+func (rc *relayClient) watchPod(namespace string, name string) (<-chan *v1.Pod, <-chan error, func()) {
+	w := rc.podWatcher(namespace)
+	ch := make(chan *v1.Pod, 1)
+	errs := make(chan error, 1)
+
+	w.mu.Lock()
+	w.subs[name] = append(w.subs[name], ch)
+	w.errs[ch] = errs
+	if obj, ok, _ := w.indexer.GetByKey(fmt.Sprintf("%s/%s", namespace, name)); ok {
+		offer(ch, obj.(*v1.Pod))
+	}
+	w.mu.Unlock()
+
+	cancel := func() {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		delete(w.errs, ch)
+		subs := w.subs[name]
+		for i, c := range subs {
+			if c == ch {
+				w.subs[name] = append(subs[:i], subs[i+1:]...)
+				break
+			}
+		}
+		if len(w.subs[name]) == 0 {
+			delete(w.subs, name)
+		}
+	}
+	return ch, errs, cancel
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/yaml"
+)
+
+// tunnelConfig is a tunnel as declared in the config file
+type tunnelConfig struct {
+	Name         string `json:"name"`
+	Group        string `json:"group,omitempty"`
+	Namespace    string `json:"namespace,omitempty"`
+	ClusterHost  string `json:"clusterHost"`
+	ClusterPort  uint   `json:"clusterPort,omitempty"`
+	LocalPort    uint   `json:"localPort"`
+	LocalAddress string `json:"localAddress,omitempty"`
+	PodImage     string `json:"podImage,omitempty"`
+	Engine       string `json:"engine,omitempty"`
+	Protocol     string `json:"protocol,omitempty"`
+	WaitFor      string `json:"waitFor,omitempty"`
+	ProbeCommand string `json:"probeCommand,omitempty"`
+	Retries      int    `json:"retries,omitempty"`
+	// pod options, they override the pod flags of the command line
+	ServiceAccount  string `json:"serviceAccount,omitempty"`
+	PriorityClass   string `json:"priorityClass,omitempty"`
+	RuntimeClass    string `json:"runtimeClass,omitempty"`
+	ImagePullPolicy string `json:"imagePullPolicy,omitempty"`
+	MaxLifetime     string `json:"maxLifetime,omitempty"`
+
+	// pod are the pod flags of the command line a tunnel inherits, e.g. of -L
+	// mappings
+	pod *relayOptions
+}
+
+type relayConfig struct {
+	Tunnels []tunnelConfig `json:"tunnels"`
+}
+
+func defaultConfigPath() (string, error) {
+	dir, err := configDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "config.yaml"), nil
+}
+
+func loadConfig(path string) (*relayConfig, error) {
+	if path == "" {
+		var err error
+		path, err = defaultConfigPath()
+		if err != nil {
+			return nil, err
+		}
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var config relayConfig
+	if err := yaml.UnmarshalStrict(data, &config); err != nil {
+		return nil, fmt.Errorf("invalid config %s: %w", path, err)
+	}
+	names := map[string]bool{}
+	for _, t := range config.Tunnels {
+		if errs := validation.IsDNS1123Label(t.podName()); len(errs) != 0 {
+			return nil, fmt.Errorf("invalid tunnel name %q in %s: %s", t.Name, path, errs[0])
+		}
+		if names[t.Name] {
+			return nil, fmt.Errorf("duplicate tunnel %q in %s", t.Name, path)
+		}
+		names[t.Name] = true
+		if t.ClusterHost == "" || t.LocalPort == 0 {
+			return nil, fmt.Errorf("tunnel %q in %s needs a clusterHost and a localPort", t.Name, path)
+		}
+		if t.LocalAddress != "" && net.ParseIP(trimBrackets(t.LocalAddress)) == nil {
+			return nil, fmt.Errorf("invalid localAddress %q of tunnel %q in %s", t.LocalAddress, t.Name, path)
+		}
+		if t.Protocol != "" {
+			if err := validateProtocol(t.Protocol); err != nil {
+				return nil, fmt.Errorf("tunnel %q in %s: %w", t.Name, path, err)
+			}
+		}
+		if t.WaitFor != "" {
+			if err := validateWaitFor(t.WaitFor); err != nil {
+				return nil, fmt.Errorf("tunnel %q in %s: %w", t.Name, path, err)
+			}
+		}
+		if _, err := parsePullPolicy(t.ImagePullPolicy); err != nil {
+			return nil, fmt.Errorf("tunnel %q in %s: %w", t.Name, path, err)
+		}
+		if t.MaxLifetime != "" {
+			if d, err := time.ParseDuration(t.MaxLifetime); err != nil || d <= 0 {
+				return nil, fmt.Errorf("invalid maxLifetime %q of tunnel %q in %s", t.MaxLifetime, t.Name, path)
+			}
+		}
+		if t.Engine != "" {
+			if err := validateEngine(t.Engine); err != nil {
+				return nil, fmt.Errorf("tunnel %q in %s: %w", t.Name, path, err)
+			}
+			if t.Engine != ENGINE_GO_RELAY && t.Protocol == PROTOCOL_UDP {
+				return nil, fmt.Errorf("tunnel %q in %s: udp needs engine go-relay, socat can't keep the boundaries of datagrams", t.Name, path)
+			}
+		}
+	}
+	return &config, nil
+}
+
+// all returns every tunnel of the config, regardless of its group
+func (c *relayConfig) all() ([]tunnelConfig, error) {
+	if len(c.Tunnels) == 0 {
+		return nil, fmt.Errorf("no tunnels in config")
+	}
+	return c.Tunnels, nil
+}
+
+func (c *relayConfig) group(name string) ([]tunnelConfig, error) {
+	var tunnels []tunnelConfig
+	for _, t := range c.Tunnels {
+		if t.Group == name {
+			tunnels = append(tunnels, t)
+		}
+	}
+	if len(tunnels) == 0 {
+		return nil, fmt.Errorf("no tunnels in group %q", name)
+	}
+	return tunnels, nil
+}
+
+func (t tunnelConfig) podName() string {
+	return fmt.Sprintf("%s-%s", POD_NAME, t.Name)
+}
+
+// samePod tells whether two tunnels ask for the same pod, apart from their
+// containers
+func (t tunnelConfig) samePod(other tunnelConfig) bool {
+	return t.ServiceAccount == other.ServiceAccount && t.PriorityClass == other.PriorityClass &&
+		t.RuntimeClass == other.RuntimeClass && t.MaxLifetime == other.MaxLifetime && t.WaitFor == other.WaitFor
+}
+
+// withPodOptions copies the pod flags of base into the options, with how to
+// wait for and retry the pod unless the tunnel sets its own
+func (opts relayOptions) withPodOptions(base relayOptions) relayOptions {
+	opts.resources = base.resources
+	opts.labels, opts.annotations = base.labels, base.annotations
+	opts.nodeSelector, opts.tolerations, opts.affinity = base.nodeSelector, base.tolerations, base.affinity
+	opts.imagePullSecrets, opts.imagePullPolicy = base.imagePullSecrets, base.imagePullPolicy
+	opts.serviceAccount, opts.priorityClass, opts.runtimeClass = base.serviceAccount, base.priorityClass, base.runtimeClass
+	opts.podOverrides = base.podOverrides
+	opts.maxLifetime = base.maxLifetime
+	opts.drainTimeout, opts.scheduleTimeout, opts.waitTimeout = base.drainTimeout, base.scheduleTimeout, base.waitTimeout
+	opts.retryBackoff = base.retryBackoff
+	if opts.waitFor == "" {
+		opts.waitFor, opts.probeCommand = base.waitFor, base.probeCommand
+	}
+	if opts.retries == 0 {
+		opts.retries = base.retries
+	}
+	return opts
+}
+
+func (t tunnelConfig) options() relayOptions {
+	opts := relayOptions{
+		name:         t.podName(),
+		namespace:    t.Namespace,
+		localPort:    t.LocalPort,
+		clusterHost:  trimBrackets(t.ClusterHost),
+		clusterPort:  t.ClusterPort,
+		podImage:     t.PodImage,
+		engine:       t.Engine,
+		localAddress: trimBrackets(t.LocalAddress),
+		protocol:     t.Protocol,
+		waitFor:      t.WaitFor,
+		probeCommand: t.ProbeCommand,
+		retries:      t.Retries,
+	}
+	if t.pod != nil {
+		opts = opts.withPodOptions(*t.pod)
+	}
+	if t.ServiceAccount != "" {
+		opts.serviceAccount = t.ServiceAccount
+	}
+	if t.PriorityClass != "" {
+		opts.priorityClass = t.PriorityClass
+	}
+	if t.RuntimeClass != "" {
+		opts.runtimeClass = t.RuntimeClass
+	}
+	if t.ImagePullPolicy != "" {
+		opts.imagePullPolicy = apiv1.PullPolicy(t.ImagePullPolicy)
+	}
+	if t.MaxLifetime != "" {
+		opts.maxLifetime, _ = time.ParseDuration(t.MaxLifetime)
+	}
+	if opts.clusterPort == 0 {
+		opts.clusterPort = 80
+	}
+	if opts.engine == "" {
+		opts.engine = ENGINE_SOCAT
+		if opts.protocol == PROTOCOL_UDP {
+			opts.engine = ENGINE_GO_RELAY
+		}
+	}
+	if opts.podImage == "" {
+		opts.podImage = POD_IMAGE
+		if opts.engine == ENGINE_GO_RELAY {
+			opts.podImage = goRelayImage()
+		}
+	}
+	if opts.localAddress == "" {
+		opts.localAddress = LOOPBACK_ADDRESS
+	}
+	if opts.protocol == "" {
+		opts.protocol = PROTOCOL_TCP
+	}
+	if opts.waitFor == "" {
+		opts.waitFor = WAIT_FOR_RUNNING
+	}
+	return opts
+}
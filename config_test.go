@@ -0,0 +1,83 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadConfigPodOptions(t *testing.T) {
+	tests := []struct {
+		name   string
+		tunnel string
+		err    string
+	}{
+		{"valid", "serviceAccount: relay\n  imagePullPolicy: Always\n  maxLifetime: 8h", ""},
+		{"pull policy", "imagePullPolicy: Sometimes", "invalid"},
+		{"lifetime", "maxLifetime: forever", "invalid maxLifetime"},
+		{"negative lifetime", "maxLifetime: -1h", "invalid maxLifetime"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.yaml")
+			config := "tunnels:\n- name: db\n  clusterHost: db\n  localPort: 5432\n  " + tt.tunnel + "\n"
+			if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			_, err := loadConfig(path)
+			checkError(t, err, tt.err)
+		})
+	}
+}
+
+func TestTunnelOptionsPodFlags(t *testing.T) {
+	pod := relayOptions{
+		labels:         map[string]string{"team": "payments"},
+		serviceAccount: "relay",
+		priorityClass:  "low",
+		maxLifetime:    time.Hour,
+	}
+	tunnel := tunnelConfig{Name: "db", ClusterHost: "db", LocalPort: 5432, ServiceAccount: "db-relay", MaxLifetime: "8h", pod: &pod}
+	o := tunnel.options()
+	if o.labels["team"] != "payments" || o.priorityClass != "low" {
+		t.Errorf("the pod flags are not inherited: labels %v, priority class %q", o.labels, o.priorityClass)
+	}
+	if o.serviceAccount != "db-relay" || o.maxLifetime != 8*time.Hour {
+		t.Errorf("the tunnel does not override the pod flags: service account %q, max lifetime %s", o.serviceAccount, o.maxLifetime)
+	}
+}
+
+func TestTunnelOptionsWaitFlags(t *testing.T) {
+	pod := relayOptions{
+		waitFor:         WAIT_FOR_CONDITION,
+		retries:         3,
+		retryBackoff:    2 * time.Second,
+		drainTimeout:    time.Minute,
+		scheduleTimeout: 5 * time.Minute,
+		waitTimeout:     10 * time.Minute,
+	}
+	tests := []struct {
+		name    string
+		tunnel  tunnelConfig
+		waitFor string
+		retries int
+	}{
+		{"inherited", tunnelConfig{}, WAIT_FOR_CONDITION, 3},
+		{"own wait", tunnelConfig{WaitFor: WAIT_FOR_NONE}, WAIT_FOR_NONE, 3},
+		{"own retries", tunnelConfig{Retries: 7}, WAIT_FOR_CONDITION, 7},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tunnel := tt.tunnel
+			tunnel.Name, tunnel.ClusterHost, tunnel.LocalPort, tunnel.pod = "db", "db", 5432, &pod
+			o := tunnel.options()
+			if o.waitFor != tt.waitFor || o.retries != tt.retries {
+				t.Errorf("wait for %q with %d retries, want %q with %d", o.waitFor, o.retries, tt.waitFor, tt.retries)
+			}
+			if o.retryBackoff != pod.retryBackoff || o.drainTimeout != pod.drainTimeout || o.scheduleTimeout != pod.scheduleTimeout || o.waitTimeout != pod.waitTimeout {
+				t.Errorf("the timeouts are not inherited: %+v", o)
+			}
+		})
+	}
+}
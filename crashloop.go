@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// relayOwned tells whether a container of a pod is one of the relay. All
+// containers of a relay pod are, e.g. the failover or group tunnel ones, in
+// other pods only the relay container is.
+func relayOwned(pod *v1.Pod, container string) bool {
+	if pod.Labels[LABEL_MANAGED_BY] == POD_NAME {
+		return true
+	}
+	return container == CONTAINER_NAME || strings.HasPrefix(container, CONTAINER_NAME+"-failover-")
+}
+
+// crashLoopError returns an error when a relay container is crash looping,
+// e.g. because of bad socat arguments or a cluster host that does not resolve.
+func crashLoopError(client kubernetes.Interface, pod *v1.Pod) error {
+	for _, cs := range pod.Status.ContainerStatuses {
+		if !relayOwned(pod, cs.Name) || cs.State.Waiting == nil || cs.State.Waiting.Reason != "CrashLoopBackOff" {
+			continue
+		}
+
+		reason := fmt.Sprintf("Container %q of pod %q is crash looping", cs.Name, pod.Name)
+		if t := cs.LastTerminationState.Terminated; t != nil {
+			reason += fmt.Sprintf(", exited with %d", t.ExitCode)
+			if msg := strings.TrimSpace(t.Message); msg != "" {
+				reason += fmt.Sprintf(": %s", msg)
+			}
+		}
+		if line := lastLogLine(client, pod, cs.Name); line != "" {
+			reason += fmt.Sprintf("\nlast log line: %s", line)
+		}
+		return &relayError{
+			Code:       "PodCrashLoop",
+			Reason:     reason,
+			Resource:   fmt.Sprintf("pods/%s", pod.Name),
+			Suggestion: "check the pod image and the cluster host and port",
+			exitCode:   EXIT_CRASH_LOOP,
+		}
+	}
+	return nil
+}
+
+func lastLogLine(client kubernetes.Interface, pod *v1.Pod, container string) string {
+	tail := int64(1)
+	logs, err := client.CoreV1().Pods(pod.Namespace).GetLogs(pod.Name, &v1.PodLogOptions{
+		Container: container,
+		Previous:  true,
+		TailLines: &tail,
+	}).DoRaw(context.TODO())
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(logs))
+}
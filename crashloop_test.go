@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestCrashLoopError(t *testing.T) {
+	crashing := func(name string) v1.ContainerStatus {
+		return v1.ContainerStatus{
+			Name:                 name,
+			State:                v1.ContainerState{Waiting: &v1.ContainerStateWaiting{Reason: "CrashLoopBackOff"}},
+			LastTerminationState: v1.ContainerState{Terminated: &v1.ContainerStateTerminated{ExitCode: 1}},
+		}
+	}
+	running := func(name string) v1.ContainerStatus {
+		return v1.ContainerStatus{Name: name, State: v1.ContainerState{Running: &v1.ContainerStateRunning{}}}
+	}
+	relay := map[string]string{LABEL_MANAGED_BY: POD_NAME}
+
+	tests := []struct {
+		name     string
+		labels   map[string]string
+		statuses []v1.ContainerStatus
+		err      string
+	}{
+		{"running", relay, []v1.ContainerStatus{running(CONTAINER_NAME), running(CONTAINER_NAME + "-failover-1")}, ""},
+		{"relay container", relay, []v1.ContainerStatus{crashing(CONTAINER_NAME)}, `Container "socat"`},
+		{"failover container", relay, []v1.ContainerStatus{running(CONTAINER_NAME), crashing(CONTAINER_NAME + "-failover-2")}, `Container "socat-failover-2"`},
+		{"group tunnel container", relay, []v1.ContainerStatus{running("orders-db"), crashing("orders-cache")}, `Container "orders-cache"`},
+		{"attached to another pod", nil, []v1.ContainerStatus{crashing("app"), running(CONTAINER_NAME)}, ""},
+		{"failover in another pod", nil, []v1.ContainerStatus{crashing(CONTAINER_NAME + "-failover-1")}, `Container "socat-failover-1"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := &v1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Name: "kube-relay-x7k2p", Namespace: "default", Labels: tt.labels},
+				Status:     v1.PodStatus{ContainerStatuses: tt.statuses},
+			}
+			err := crashLoopError(fake.NewSimpleClientset(pod), pod)
+			checkError(t, err, tt.err)
+		})
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// well-known ConfigMap in which cluster admins can shape relay pods
+const DEFAULTS_NAMESPACE = "kube-public"
+const DEFAULTS_NAME = "kube-relay-defaults"
+
+// clusterDefaults are organization wide defaults for relay pods
+type clusterDefaults struct {
+	image             string
+	registry          string
+	securityContext   *v1.SecurityContext
+	labels            map[string]string
+	allowedNamespaces []string
+}
+
+// loadClusterDefaults reads the defaults ConfigMap, a missing or unreadable
+// ConfigMap means there are no defaults.
+func loadClusterDefaults(rc *relayClient) (*clusterDefaults, error) {
+	cm, err := rc.clientset.CoreV1().ConfigMaps(DEFAULTS_NAMESPACE).Get(context.TODO(), DEFAULTS_NAME, metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) || k8serrors.IsForbidden(err) {
+		return &clusterDefaults{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	source := fmt.Sprintf("ConfigMap %s/%s", DEFAULTS_NAMESPACE, DEFAULTS_NAME)
+	d := &clusterDefaults{
+		image:    cm.Data["image"],
+		registry: strings.TrimSuffix(cm.Data["registry"], "/"),
+	}
+	if s := cm.Data["securityContext"]; s != "" {
+		d.securityContext = &v1.SecurityContext{}
+		if err := yaml.UnmarshalStrict([]byte(s), d.securityContext); err != nil {
+			return nil, fmt.Errorf("invalid securityContext in %s: %w", source, err)
+		}
+	}
+	if s := cm.Data["labels"]; s != "" {
+		if err := yaml.UnmarshalStrict([]byte(s), &d.labels); err != nil {
+			return nil, fmt.Errorf("invalid labels in %s: %w", source, err)
+		}
+	}
+	for _, ns := range strings.Split(cm.Data["allowedNamespaces"], ",") {
+		if ns = strings.TrimSpace(ns); ns != "" {
+			d.allowedNamespaces = append(d.allowedNamespaces, ns)
+		}
+	}
+	return d, nil
+}
+
+func (d *clusterDefaults) allows(namespace string) bool {
+	if len(d.allowedNamespaces) == 0 {
+		return true
+	}
+	for _, ns := range d.allowedNamespaces {
+		if ns == namespace {
+			return true
+		}
+	}
+	return false
+}
+
+// podImage picks the admin image unless one was chosen explicitly and moves
+// images without a registry host to the admin registry.
+func (d *clusterDefaults) podImage(image string) string {
+	if image == POD_IMAGE && d.image != "" {
+		image = d.image
+	}
+	if d.registry == "" {
+		return image
+	}
+	parts := strings.SplitN(image, "/", 2)
+	if len(parts) == 2 && (strings.ContainsAny(parts[0], ".:") || parts[0] == "localhost") {
+		return image
+	}
+	return fmt.Sprintf("%s/%s", d.registry, image)
+}
+
+// mergeSecurity is a copy of the security context of a container with the
+// fields the admin sets replaced, the others like the dropped capabilities
+// stay as they are
+func mergeSecurity(base *v1.SecurityContext, admin *v1.SecurityContext) *v1.SecurityContext {
+	merged := &v1.SecurityContext{}
+	if base != nil {
+		merged = base.DeepCopy()
+	}
+	admin = admin.DeepCopy()
+	if admin.Capabilities != nil {
+		if merged.Capabilities == nil {
+			merged.Capabilities = &v1.Capabilities{}
+		}
+		if admin.Capabilities.Add != nil {
+			merged.Capabilities.Add = admin.Capabilities.Add
+		}
+		if admin.Capabilities.Drop != nil {
+			merged.Capabilities.Drop = admin.Capabilities.Drop
+		}
+	}
+	if admin.Privileged != nil {
+		merged.Privileged = admin.Privileged
+	}
+	if admin.SELinuxOptions != nil {
+		merged.SELinuxOptions = admin.SELinuxOptions
+	}
+	if admin.WindowsOptions != nil {
+		merged.WindowsOptions = admin.WindowsOptions
+	}
+	if admin.RunAsUser != nil {
+		merged.RunAsUser = admin.RunAsUser
+	}
+	if admin.RunAsGroup != nil {
+		merged.RunAsGroup = admin.RunAsGroup
+	}
+	if admin.RunAsNonRoot != nil {
+		merged.RunAsNonRoot = admin.RunAsNonRoot
+	}
+	if admin.ReadOnlyRootFilesystem != nil {
+		merged.ReadOnlyRootFilesystem = admin.ReadOnlyRootFilesystem
+	}
+	if admin.AllowPrivilegeEscalation != nil {
+		merged.AllowPrivilegeEscalation = admin.AllowPrivilegeEscalation
+	}
+	if admin.ProcMount != nil {
+		merged.ProcMount = admin.ProcMount
+	}
+	if admin.SeccompProfile != nil {
+		merged.SeccompProfile = admin.SeccompProfile
+	}
+	return merged
+}
+
+func (d *clusterDefaults) apply(pod *v1.Pod) {
+	for i := range pod.Spec.Containers {
+		c := &pod.Spec.Containers[i]
+		c.Image = d.podImage(c.Image)
+		if d.securityContext != nil {
+			c.SecurityContext = mergeSecurity(c.SecurityContext, d.securityContext)
+		}
+	}
+	for k, v := range d.labels {
+		if _, ok := pod.Labels[k]; !ok {
+			pod.Labels[k] = v
+		}
+	}
+}
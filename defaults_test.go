@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+)
+
+func TestClusterDefaultsSecurity(t *testing.T) {
+	tests := []struct {
+		name  string
+		admin string
+		check func(c *v1.SecurityContext) bool
+	}{
+		{"user", "runAsUser: 10001", func(c *v1.SecurityContext) bool {
+			return *c.RunAsUser == 10001 && !*c.AllowPrivilegeEscalation && c.Capabilities.Drop[0] == "ALL"
+		}},
+		{"read only root", "readOnlyRootFilesystem: true\nseccompProfile:\n  type: RuntimeDefault", func(c *v1.SecurityContext) bool {
+			return *c.ReadOnlyRootFilesystem && c.SeccompProfile.Type == v1.SeccompProfileTypeRuntimeDefault && c.Capabilities.Drop[0] == "ALL"
+		}},
+		{"added capability", "capabilities:\n  add: [NET_BIND_SERVICE]", func(c *v1.SecurityContext) bool {
+			return c.Capabilities.Add[0] == "NET_BIND_SERVICE" && c.Capabilities.Drop[0] == "ALL"
+		}},
+		{"escalation", "allowPrivilegeEscalation: true", func(c *v1.SecurityContext) bool {
+			return *c.AllowPrivilegeEscalation && c.Capabilities.Drop[0] == "ALL"
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			admin := &v1.SecurityContext{}
+			if err := yaml.UnmarshalStrict([]byte(tt.admin), admin); err != nil {
+				t.Fatal(err)
+			}
+			d := &clusterDefaults{securityContext: admin}
+			pod := relayPod(POD_NAME, "x", 0, v1.Container{Name: "a", SecurityContext: containerSecurity()}, v1.Container{Name: "b", SecurityContext: containerSecurity()})
+			d.apply(pod)
+			a, b := pod.Spec.Containers[0].SecurityContext, pod.Spec.Containers[1].SecurityContext
+			if !tt.check(a) || !tt.check(b) {
+				t.Errorf("unexpected security context %+v", a)
+			}
+			if a == b || a == admin || a.Capabilities == b.Capabilities {
+				t.Errorf("the containers share a security context")
+			}
+		})
+	}
+}
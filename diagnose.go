@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	v1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// podFailure tells whether a lost forward is the fault of the relay pod, i.e.
+// the pod is gone or its relay container stopped. It returns nil if the pod is
+// fine, then the connection to the api server dropped.
+func podFailure(client kubernetes.Interface, namespace string, name string) error {
+	resource := fmt.Sprintf("pods/%s", name)
+	pod, err := client.CoreV1().Pods(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		return deletedError(name)
+	}
+	if err != nil {
+		// the api server can't be asked, which hints at the connection
+		return nil
+	}
+	if err := stoppedError(pod); err != nil {
+		return err
+	}
+	for _, cs := range pod.Status.ContainerStatuses {
+		if w := cs.State.Waiting; w != nil {
+			return &relayError{
+				Code:       "PodNotRunning",
+				Reason:     fmt.Sprintf("Container %q of relay pod %q is waiting: %s", cs.Name, name, w.Reason),
+				Resource:   resource,
+				Suggestion: "inspect the pod with kubectl describe",
+				exitCode:   STATUS_POD_NOT_RUNNING,
+			}
+		}
+		if t := cs.State.Terminated; t != nil {
+			return &relayError{
+				Code:       "PodNotRunning",
+				Reason:     fmt.Sprintf("Container %q of relay pod %q stopped: %s (exit code %d)", cs.Name, name, t.Reason, t.ExitCode),
+				Resource:   resource,
+				Suggestion: "inspect the pod with kubectl describe, e.g. for OOM kills",
+				exitCode:   STATUS_POD_NOT_RUNNING,
+			}
+		}
+	}
+	if pod.Status.Phase != v1.PodRunning {
+		return &relayError{
+			Code:       "PodNotRunning",
+			Reason:     fmt.Sprintf("Relay pod %q is %s", name, pod.Status.Phase),
+			Resource:   resource,
+			Suggestion: "inspect the pod with kubectl describe",
+			exitCode:   STATUS_POD_NOT_RUNNING,
+		}
+	}
+	return nil
+}
+
+func deletedError(name string) error {
+	return &relayError{
+		Code:       "PodMissing",
+		Reason:     fmt.Sprintf("Relay pod %q was deleted", name),
+		Resource:   fmt.Sprintf("pods/%s", name),
+		Suggestion: "check for evictions, node drains or cleanups of the namespace and start the relay again",
+		exitCode:   STATUS_POD_MISSING,
+	}
+}
+
+// stoppedError tells whether a pod is done for good, i.e. it is deleting,
+// expired, evicted or its containers ended, with the reason of its status
+func stoppedError(pod *v1.Pod) error {
+	resource := fmt.Sprintf("pods/%s", pod.Name)
+	if pod.DeletionTimestamp != nil {
+		return deletedError(pod.Name)
+	}
+	if pod.Status.Phase == v1.PodFailed && pod.Status.Reason == "DeadlineExceeded" {
+		return &relayError{
+			Code:       "PodExpired",
+			Reason:     fmt.Sprintf("Relay pod %q reached its maximum lifetime", pod.Name),
+			Resource:   resource,
+			Suggestion: "start the relay again or raise --max-lifetime",
+			exitCode:   STATUS_POD_NOT_RUNNING,
+		}
+	}
+	// evicted or preempted pods stay around as failed, they are gone for good
+	if pod.Status.Phase == v1.PodFailed && pod.Status.Reason != "" {
+		return &relayError{
+			Code:       "PodMissing",
+			Reason:     fmt.Sprintf("Relay pod %q was stopped by its node: %s", pod.Name, pod.Status.Reason),
+			Resource:   resource,
+			Suggestion: "check for evictions, node drains or cleanups of the namespace and start the relay again",
+			exitCode:   STATUS_POD_MISSING,
+		}
+	}
+	if pod.Status.Phase != v1.PodFailed && pod.Status.Phase != v1.PodSucceeded {
+		return nil
+	}
+	reason := fmt.Sprintf("Relay pod %q is %s", pod.Name, pod.Status.Phase)
+	for _, cs := range pod.Status.ContainerStatuses {
+		if t := cs.State.Terminated; t != nil {
+			reason = fmt.Sprintf("Container %q of relay pod %q stopped: %s (exit code %d)", cs.Name, pod.Name, t.Reason, t.ExitCode)
+			break
+		}
+	}
+	return &relayError{
+		Code:       "PodNotRunning",
+		Reason:     reason,
+		Resource:   resource,
+		Suggestion: "inspect the pod with kubectl describe",
+		exitCode:   STATUS_POD_NOT_RUNNING,
+	}
+}
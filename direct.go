@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/tools/cache"
+)
+
+const DIRECT_DIAL_TIMEOUT = time.Second
+
+// directReachable tells whether the cluster host accepts connections from this
+// machine, like on kind, minikube or docker-desktop clusters or with cluster
+// ips routed through a vpn.
+func directReachable(target string) bool {
+	conn, err := net.DialTimeout("tcp", target, DIRECT_DIAL_TIMEOUT)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+// serveDirect proxies the local port to the cluster host without a relay pod,
+// until the relay is stopped
+func serveDirect(opts relayOptions, ready func(uint) error) error {
+	tunnel, err := listenLocal(opts, []string{opts.target()})
+	if err != nil {
+		return err
+	}
+	defer tunnel.close()
+	opts.shutdown.register(tunnel)
+	for _, addr := range tunnel.addresses() {
+		opts.log.printf("Forwarding from %s -> %s directly, bypassing the relay pod\n", addr, opts.target())
+	}
+	tunnel.metrics = registerMetrics(opts.name, opts.target())
+	tunnel.setUpstream(0, opts.target())
+	if ready != nil {
+		if err := ready(tunnel.port); err != nil {
+			return err
+		}
+	}
+	<-opts.stop
+	return nil
+}
+
+// servePod forwards the local port straight to a target pod, which needs no
+// relay pod in between. The relay ends once the pod is deleting or stopped,
+// forwards to it would only fail from then on.
+func servePod(rc *relayClient, namespace string, opts relayOptions, remotePort int, policy retryPolicy, ready func(uint) error) error {
+	pod := newPodRef(rc, namespace, opts.targetPod, opts.log, nil)
+	defer pod.close()
+	if opts.stop != nil {
+		finished := make(chan struct{})
+		defer close(finished)
+		go func() {
+			select {
+			case <-opts.stop:
+				pod.end()
+			case <-finished:
+			}
+		}()
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	var mu sync.Mutex
+	var gone error
+	watchTargetPod(rc, namespace, opts.targetPod, stop, func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		gone = err
+		pod.end()
+	})
+
+	err := serveTunnel(rc, pod, []int{remotePort}, opts, policy, ready)
+	mu.Lock()
+	defer mu.Unlock()
+	if gone != nil {
+		return gone
+	}
+	return err
+}
+
+// watchTargetPod calls gone once as soon as a pod the relay didn't create is
+// deleting or stopped, until stop is closed. The informer of the relay client
+// only sees relay pods.
+func watchTargetPod(rc *relayClient, namespace string, name string, stop <-chan struct{}, gone func(error)) {
+	var once sync.Once
+	end := func(obj interface{}, deleted bool) {
+		p, ok := obj.(*v1.Pod)
+		if !ok || (!deleted && stoppedError(p) == nil) {
+			return
+		}
+		once.Do(func() {
+			gone(&relayError{
+				Code:       "TargetPodGone",
+				Reason:     fmt.Sprintf("Target pod %q is gone", name),
+				Resource:   fmt.Sprintf("pods/%s", name),
+				Suggestion: "start the relay again, a deploy/ or sts/ target picks another ready pod",
+				exitCode:   STATUS_POD_MISSING,
+			})
+		})
+	}
+	factory := informers.NewSharedInformerFactoryWithOptions(rc.clientset, 0,
+		informers.WithNamespace(namespace),
+		informers.WithTweakListOptions(func(o *metav1.ListOptions) {
+			o.FieldSelector = fmt.Sprintf("metadata.name=%s", name)
+		}),
+	)
+	informer := factory.Core().V1().Pods().Informer()
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(obj interface{}) { end(obj, false) },
+		UpdateFunc: func(_, obj interface{}) { end(obj, false) },
+		DeleteFunc: func(obj interface{}) { end(obj, true) },
+	})
+	factory.Start(stop)
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const DNS_UPSTREAM = "kube-dns.kube-system:53"
+const DNS_SUFFIX = "svc.cluster.local"
+const DNS_TIMEOUT = 5 * time.Second
+
+const DNS_RCODE_SERVFAIL = 2
+const DNS_RCODE_REFUSED = 5
+
+// dnsOptions configure the local resolver for cluster names
+type dnsOptions struct {
+	address  string
+	upstream string
+	suffixes []string
+}
+
+// dnsQuestion returns the name of the first question of a dns message
+func dnsQuestion(msg []byte) (string, error) {
+	if len(msg) < 12 || binary.BigEndian.Uint16(msg[4:6]) == 0 {
+		return "", fmt.Errorf("no question")
+	}
+	var labels []string
+	for i := 12; ; {
+		if i >= len(msg) {
+			return "", fmt.Errorf("truncated question")
+		}
+		n := int(msg[i])
+		if n == 0 {
+			break
+		}
+		if n&0xc0 != 0 || i+1+n > len(msg) {
+			return "", fmt.Errorf("invalid question")
+		}
+		labels = append(labels, string(msg[i+1:i+1+n]))
+		i += 1 + n
+	}
+	return strings.ToLower(strings.Join(labels, ".")), nil
+}
+
+// dnsError answers a query with an error code
+func dnsError(query []byte, rcode byte) []byte {
+	reply := append([]byte{}, query...)
+	reply[2] |= 0x80
+	reply[3] = reply[3]&0xf0 | rcode
+	return reply
+}
+
+// dnsRelay passes queries to the cluster dns over a single tcp connection from
+// the relay pod. Queries get their own ids, so queries of several clients can
+// be in flight at once.
+type dnsRelay struct {
+	rc        *relayClient
+	namespace string
+	pod       string
+	upstream  string
+	log       *logger
+
+	mu      sync.Mutex
+	conn    io.WriteCloser
+	nextID  uint16
+	pending map[uint16]chan []byte
+}
+
+// connection starts socat in the relay pod towards the cluster dns, unless it
+// runs already.
+func (r *dnsRelay) connection() io.Writer {
+	if r.conn != nil {
+		return r.conn
+	}
+	stdinReader, stdinWriter := io.Pipe()
+	stdoutReader, stdoutWriter := io.Pipe()
+	r.conn = stdinWriter
+	go func() {
+		command := []string{"socat", "-", socatAddress(PROTOCOL_TCP, r.upstream)}
+		err := execStream(r.rc, r.namespace, r.pod, command, stdinReader, stdoutWriter)
+		if err != nil {
+			r.log.printf("DNS relay failed: %s\n", err)
+		}
+		stdinReader.CloseWithError(io.ErrClosedPipe)
+		stdoutWriter.CloseWithError(io.EOF)
+	}()
+	go r.receive(stdinWriter, stdoutReader)
+	return r.conn
+}
+
+// receive dispatches the replies of a connection, once it ends pending
+// queries fail and the next query starts a new one.
+func (r *dnsRelay) receive(conn io.WriteCloser, replies io.Reader) {
+	for {
+		length := make([]byte, 2)
+		if _, err := io.ReadFull(replies, length); err != nil {
+			break
+		}
+		reply := make([]byte, binary.BigEndian.Uint16(length))
+		if _, err := io.ReadFull(replies, reply); err != nil || len(reply) < 2 {
+			break
+		}
+		r.mu.Lock()
+		if ch, ok := r.pending[binary.BigEndian.Uint16(reply)]; ok {
+			select {
+			case ch <- reply:
+			default:
+			}
+		}
+		r.mu.Unlock()
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	conn.Close()
+	if r.conn == conn {
+		r.conn = nil
+	}
+	for id, ch := range r.pending {
+		close(ch)
+		delete(r.pending, id)
+	}
+}
+
+func (r *dnsRelay) resolve(query []byte) []byte {
+	ch := make(chan []byte, 1)
+	r.mu.Lock()
+	r.nextID++
+	id := r.nextID
+	r.pending[id] = ch
+	msg := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(msg, uint16(len(query)))
+	copy(msg[2:], query)
+	binary.BigEndian.PutUint16(msg[2:], id)
+	_, err := r.connection().Write(msg)
+	r.mu.Unlock()
+
+	var reply []byte
+	if err == nil {
+		select {
+		case reply = <-ch:
+		case <-time.After(DNS_TIMEOUT):
+		}
+	}
+	r.mu.Lock()
+	delete(r.pending, id)
+	r.mu.Unlock()
+	if reply == nil {
+		return dnsError(query, DNS_RCODE_SERVFAIL)
+	}
+	// the client gets its own id back
+	copy(reply[:2], query[:2])
+	return reply
+}
+
+// serveDNS answers queries for names with one of the suffixes through the
+// cluster dns, other names are refused. Closing the returned connection stops
+// the resolver.
+func serveDNS(rc *relayClient, namespace string, pod string, opts dnsOptions, log *logger) (io.Closer, error) {
+	conn, err := net.ListenPacket("udp", opts.address)
+	if err != nil {
+		return nil, err
+	}
+	log.printf("Resolving *.%s on %s\n", strings.Join(opts.suffixes, ", *."), conn.LocalAddr())
+	relay := &dnsRelay{
+		rc:        rc,
+		namespace: namespace,
+		pod:       pod,
+		upstream:  opts.upstream,
+		log:       log,
+		pending:   map[uint16]chan []byte{},
+	}
+	go func() {
+		buf := make([]byte, UDP_MAX_DATAGRAM)
+		for {
+			n, client, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			query := append([]byte{}, buf[:n]...)
+			go func() {
+				name, err := dnsQuestion(query)
+				if err != nil {
+					return
+				}
+				if !hasDNSSuffix(name, opts.suffixes) {
+					conn.WriteTo(dnsError(query, DNS_RCODE_REFUSED), client)
+					return
+				}
+				conn.WriteTo(relay.resolve(query), client)
+			}()
+		}
+	}()
+	return conn, nil
+}
+
+func hasDNSSuffix(name string, suffixes []string) bool {
+	for _, suffix := range suffixes {
+		suffix = strings.Trim(strings.ToLower(suffix), ".")
+		if name == suffix || strings.HasSuffix(name, "."+suffix) {
+			return true
+		}
+	}
+	return false
+}
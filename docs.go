@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/urfave/cli/v2"
+)
+
+// writeDocs renders the man page and the cli reference from the command and
+// flag definitions of the app.
+func writeDocs(app *cli.App, dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	man, err := app.ToMan()
+	if err != nil {
+		return err
+	}
+	markdown, err := app.ToMarkdown()
+	if err != nil {
+		return err
+	}
+	// urfave/cli renders the man page in section 8
+	for name, content := range map[string]string{
+		fmt.Sprintf("%s.8", app.Name): man,
+		"reference.md":                markdown,
+	} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			return err
+		}
+		fmt.Printf("Wrote %s\n", path)
+	}
+	return nil
+}
+
+func docsCommand() *cli.Command {
+	var dir string
+
+	return &cli.Command{
+		Name:   "docs",
+		Usage:  "generate the man page and the cli reference",
+		Hidden: true,
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:        "dir",
+				Value:       "docs",
+				Usage:       "output directory",
+				TakesFile:   true,
+				Destination: &dir,
+			},
+		},
+		Action: func(c *cli.Context) error {
+			return writeDocs(c.App, dir)
+		},
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const DRAIN_TIMEOUT = 30 * time.Second
+const DRAIN_POLL_INTERVAL = time.Second
+const DRAIN_SLACK = 10 * time.Second
+
+// the preStop hook holds off SIGTERM while forked socat processes still carry
+// connections, the listening parent is the one left.
+const DRAIN_SCRIPT = `while [ "$(cat /proc/[0-9]*/comm 2>/dev/null | grep -c '^socat$')" -gt 1 ]; do sleep 1; done`
+
+func drainLifecycle() *apiv1.Lifecycle {
+	return &apiv1.Lifecycle{
+		PreStop: &apiv1.LifecycleHandler{
+			Exec: &apiv1.ExecAction{Command: []string{"sh", "-c", DRAIN_SCRIPT}},
+		},
+	}
+}
+
+func terminationGrace(timeout time.Duration) *int64 {
+	if timeout <= 0 {
+		timeout = DRAIN_TIMEOUT
+	}
+	seconds := int64(timeout / time.Second)
+	return &seconds
+}
+
+// activeDeadline is the deadline after which kubelet stops a pod, rounded up
+// to whole seconds, a zero lifetime means none
+func activeDeadline(lifetime time.Duration) *int64 {
+	if lifetime <= 0 {
+		return nil
+	}
+	seconds := int64((lifetime + time.Second - 1) / time.Second)
+	return &seconds
+}
+
+// waitForDrain blocks until a deleted pod is gone, i.e. its connections are
+// drained or its grace period is over.
+func waitForDrain(client kubernetes.Interface, namespace string, name string, log *logger) {
+	reported := false
+	for {
+		pod, err := client.CoreV1().Pods(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+		if err != nil || pod.DeletionTimestamp == nil {
+			return
+		}
+		// the deletion timestamp is the end of the grace period
+		if time.Now().After(pod.DeletionTimestamp.Add(DRAIN_SLACK)) {
+			return
+		}
+		if !reported {
+			log.printf("Waiting for pod %q to drain its connections\n", name)
+			reported = true
+		}
+		time.Sleep(DRAIN_POLL_INTERVAL)
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// dryRun prints the manifest of the relay pod instead of creating it, as yaml
+// or json. It doesn't talk to the cluster, so cluster defaults, resolvers and
+// --near placement are not part of the manifest.
+func dryRun(kube *kubeOptions, opts relayOptions, format string) error {
+	namespace := opts.namespace
+	if namespace == "" {
+		// only the kubeconfig is read for the namespace, no client is set up
+		var err error
+		if namespace, _, err = clientConfig(kube); err != nil {
+			return err
+		}
+	}
+	if opts.instance == "" {
+		opts.instance = newInstance(opts.name)
+	}
+	manifest, err := relayManifest(opts)
+	if err != nil {
+		return err
+	}
+	manifest.TypeMeta = metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"}
+	manifest.Namespace = namespace
+
+	var data []byte
+	if format == "json" {
+		data, err = json.MarshalIndent(manifest, "", "  ")
+		data = append(data, '\n')
+	} else {
+		data, err = yaml.Marshal(manifest)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(data)
+	return err
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+type endpoint struct {
+	host string
+	port uint
+}
+
+func (e endpoint) String() string {
+	return joinHostPort(e.host, e.port)
+}
+
+// readyEndpoints are the ready endpoints of a service port in its endpoint
+// slices, ordered by address. An endpoint without a ready condition counts
+// as ready, as the api asks for.
+func readyEndpoints(slices []*discoveryv1.EndpointSlice, port string) []endpoint {
+	var ready []endpoint
+	for _, slice := range slices {
+		for _, p := range slice.Ports {
+			if p.Port == nil || (p.Name == nil && port != "") || (p.Name != nil && *p.Name != port) {
+				continue
+			}
+			for _, e := range slice.Endpoints {
+				if e.Conditions.Ready != nil && !*e.Conditions.Ready {
+					continue
+				}
+				for _, address := range e.Addresses {
+					ready = append(ready, endpoint{address, uint(*p.Port)})
+				}
+			}
+		}
+	}
+	sort.Slice(ready, func(i, j int) bool { return ready[i].String() < ready[j].String() })
+	return ready
+}
+
+func serviceSelector(service string) string {
+	return fmt.Sprintf("%s=%s", discoveryv1.LabelServiceName, service)
+}
+
+// serviceEndpoints returns the ready endpoints of a service port
+func serviceEndpoints(client kubernetes.Interface, namespace string, service string, port *v1.ServicePort) ([]endpoint, error) {
+	list, err := client.DiscoveryV1().EndpointSlices(namespace).List(context.TODO(), metav1.ListOptions{LabelSelector: serviceSelector(service)})
+	if err != nil {
+		return nil, err
+	}
+	slices := make([]*discoveryv1.EndpointSlice, len(list.Items))
+	for i := range list.Items {
+		slices[i] = &list.Items[i]
+	}
+	ready := readyEndpoints(slices, port.Name)
+	if len(ready) == 0 {
+		return nil, fmt.Errorf("service %q has no ready endpoints", service)
+	}
+	return ready, nil
+}
+
+// endpointWatcher follows the ready endpoints of a service port through its
+// endpoint slices, so a relay to the pods of a service keeps up with them
+// rolling or scaling. With balance connections go round-robin to the
+// endpoints, otherwise to the first one.
+type endpointWatcher struct {
+	service string
+	balance bool
+	log     *logger
+	next    uint32
+
+	mu        sync.Mutex
+	endpoints []endpoint
+	changed   chan struct{}
+}
+
+// watchEndpoints starts following the endpoints of a service port, it fails
+// if the service has no ready endpoints to begin with
+func watchEndpoints(rc *relayClient, namespace string, service string, port *v1.ServicePort, balance bool, log *logger) (*endpointWatcher, error) {
+	endpoints, err := serviceEndpoints(rc.clientset, namespace, service, port)
+	if err != nil {
+		return nil, err
+	}
+	w := &endpointWatcher{
+		service:   service,
+		balance:   balance,
+		log:       log,
+		endpoints: endpoints,
+		changed:   make(chan struct{}),
+	}
+
+	factory := informers.NewSharedInformerFactoryWithOptions(rc.clientset, 0,
+		informers.WithNamespace(namespace),
+		informers.WithTweakListOptions(func(o *metav1.ListOptions) {
+			o.LabelSelector = serviceSelector(service)
+		}),
+	)
+	informer := factory.Discovery().V1().EndpointSlices().Informer()
+	indexer := informer.GetIndexer()
+	update := func(interface{}) {
+		var slices []*discoveryv1.EndpointSlice
+		for _, obj := range indexer.List() {
+			slices = append(slices, obj.(*discoveryv1.EndpointSlice))
+		}
+		w.update(readyEndpoints(slices, port.Name))
+	}
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    update,
+		UpdateFunc: func(_, obj interface{}) { update(obj) },
+		DeleteFunc: update,
+	})
+	factory.Start(rc.stop)
+	return w, nil
+}
+
+func (w *endpointWatcher) update(endpoints []endpoint) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if fmt.Sprint(endpoints) == fmt.Sprint(w.endpoints) {
+		return
+	}
+	w.endpoints = endpoints
+	close(w.changed)
+	w.changed = make(chan struct{})
+	if len(endpoints) == 0 {
+		w.log.printf("Service %q has no ready endpoints, holding new connections\n", w.service)
+		return
+	}
+	var addresses []string
+	for _, e := range endpoints {
+		addresses = append(addresses, e.String())
+	}
+	w.log.printf("Endpoints of service %q changed to %s\n", w.service, strings.Join(addresses, ", "))
+}
+
+// pick returns the endpoint for a new connection, waiting up to timeout for
+// one while the service has none ready
+func (w *endpointWatcher) pick(timeout time.Duration) (endpoint, error) {
+	deadline := time.After(timeout)
+	for {
+		w.mu.Lock()
+		endpoints, changed := w.endpoints, w.changed
+		w.mu.Unlock()
+
+		if len(endpoints) != 0 {
+			if !w.balance {
+				return endpoints[0], nil
+			}
+			return endpoints[(atomic.AddUint32(&w.next, 1)-1)%uint32(len(endpoints))], nil
+		}
+		select {
+		case <-changed:
+		case <-deadline:
+			return endpoint{}, fmt.Errorf("service %q has no ready endpoints within %s", w.service, timeout)
+		}
+	}
+}
+
+// handleEndpoint passes a connection to an endpoint of the service through
+// socat exec'd in the relay pod, so every connection goes to an endpoint that
+// is ready right now
+func (t *tunnelListener) handleEndpoint(client net.Conn) {
+	e, err := t.endpoints.pick(t.queueTimeout)
+	if err != nil {
+		t.metrics.drop()
+		println("dropped connection from", client.RemoteAddr().String()+":", err.Error())
+		return
+	}
+	t.metrics.opened()
+	counted := &countingConn{Conn: client}
+	err = t.exec([]string{"socat", "-", socatAddress(PROTOCOL_TCP, e.String())}, counted)
+	t.metrics.closed(atomic.LoadInt64(&counted.read), atomic.LoadInt64(&counted.written))
+	if err != nil {
+		t.log.printf("Connection to %s failed: %s\n", e, err)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+const ENGINE_SOCAT = "socat"
+const ENGINE_GO_RELAY = "go-relay"
+
+// the go relay image runs kube-relay itself as the relay server, it is built
+// from the Dockerfile of this repo
+const GO_RELAY_IMAGE = "mkulke/kube-relay"
+
+func validateEngine(engine string) error {
+	switch engine {
+	case ENGINE_SOCAT, ENGINE_GO_RELAY:
+		return nil
+	}
+	return fmt.Errorf("unknown engine %q, use %s or %s", engine, ENGINE_SOCAT, ENGINE_GO_RELAY)
+}
+
+// goRelayImage is the go relay image matching this release
+func goRelayImage() string {
+	if version == "dev" {
+		return GO_RELAY_IMAGE + ":latest"
+	}
+	return fmt.Sprintf("%s:%s", GO_RELAY_IMAGE, version)
+}
+
+// goRelayContainer runs the go relay server instead of socat. One server
+// serves all targets on consecutive ports from port, it drains its
+// connections on SIGTERM by itself.
+func goRelayContainer(name string, port int, targets []relayOptions) apiv1.Container {
+	opts := targets[0]
+	args := []string{"relay-server"}
+	for i, t := range targets {
+		target := t.target()
+		if t.protocol == PROTOCOL_UDP {
+			target = PROTOCOL_UDP + ":" + target
+		}
+		args = append(args, "--target", fmt.Sprintf("%d=%s", port+i, target))
+	}
+	if opts.mux {
+		args = append(args, "--mux-port", fmt.Sprint(opts.muxPort()))
+	}
+	// the go relay containers of a group pod share its localhost
+	if control := opts.controlPort() + port - opts.relayPort(); control != RELAY_CONTROL_PORT {
+		args = append(args, "--control-port", fmt.Sprint(control))
+	}
+	probe := &apiv1.TCPSocketAction{Port: intstr.FromInt(port)}
+	// the localhost of the node is shared with all its processes, they may
+	// read the metrics but not move the targets
+	if opts.hostNetwork {
+		args = append(args, "--bind", LOOPBACK_ADDRESS, "--read-only")
+		probe.Host = LOOPBACK_ADDRESS
+	}
+	container := apiv1.Container{
+		Name:            name,
+		Image:           opts.podImage,
+		Args:            args,
+		ImagePullPolicy: opts.imagePullPolicy,
+		Resources:       opts.resources,
+		SecurityContext: containerSecurity(),
+	}
+	if opts.waitFor == WAIT_FOR_CONDITION {
+		container.ReadinessProbe = &apiv1.Probe{
+			ProbeHandler:  apiv1.ProbeHandler{TCPSocket: probe},
+			PeriodSeconds: 1,
+		}
+	}
+	return container
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/urfave/cli/v2"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// exit codes of a relay, so scripts can tell what went wrong
+const (
+	EXIT_ERROR        = 1
+	EXIT_AUTH         = 2
+	EXIT_POD_CREATE   = 3
+	EXIT_FORWARD_LOST = 4
+	EXIT_CRASH_LOOP   = 5
+	EXIT_POD_START    = 6
+)
+
+// stageError tells at which stage of a relay an error happened, the stage
+// decides the exit code
+type stageError struct {
+	error
+	exitCode int
+}
+
+func (e *stageError) Unwrap() error {
+	return e.error
+}
+
+func withExitCode(err error, exitCode int) error {
+	if err == nil {
+		return nil
+	}
+	return &stageError{err, exitCode}
+}
+
+// relayError is an error that can be presented to a user or to a wrapping tool,
+// it carries the exit code the process should terminate with.
+type relayError struct {
+	Code       string `json:"code"`
+	Reason     string `json:"reason"`
+	Resource   string `json:"resource,omitempty"`
+	Suggestion string `json:"suggestion,omitempty"`
+	exitCode   int
+}
+
+func (e *relayError) Error() string {
+	return e.Reason
+}
+
+func (e *relayError) ExitCode() int {
+	return e.exitCode
+}
+
+var apiSuggestions = map[metav1.StatusReason]string{
+	metav1.StatusReasonUnauthorized:  "refresh the credentials of your kubeconfig context",
+	metav1.StatusReasonForbidden:     "ask a cluster admin for the required permissions",
+	metav1.StatusReasonNotFound:      "check the namespace and the name of the resource",
+	metav1.StatusReasonAlreadyExists: "another relay is active in this namespace, stop it or delete the pod",
+	metav1.StatusReasonTimeout:       "the api server is slow to respond, try again",
+}
+
+// asRelayError presents an error to the user. Its exit code is the one of its
+// stage, unless the credentials are at fault or the pod crash loops, which
+// have codes of their own.
+func asRelayError(err error) *relayError {
+	rErr := presentError(err)
+	auth := k8serrors.IsUnauthorized(err) || k8serrors.IsForbidden(err)
+	var sErr *stageError
+	if errors.As(err, &sErr) && !auth && rErr.Code != "PodCrashLoop" {
+		rErr.exitCode = sErr.exitCode
+	}
+	return rErr
+}
+
+func presentError(err error) *relayError {
+	var rErr *relayError
+	if errors.As(err, &rErr) {
+		// a copy, the exit code may change
+		presented := *rErr
+		return &presented
+	}
+
+	var status k8serrors.APIStatus
+	if errors.As(err, &status) {
+		s := status.Status()
+		rErr = &relayError{
+			Code:       string(s.Reason),
+			Reason:     s.Message,
+			Suggestion: apiSuggestions[s.Reason],
+			exitCode:   EXIT_ERROR,
+		}
+		if s.Reason == metav1.StatusReasonUnauthorized || s.Reason == metav1.StatusReasonForbidden {
+			rErr.exitCode = EXIT_AUTH
+		}
+		if s.Details != nil {
+			rErr.Resource = fmt.Sprintf("%s/%s", s.Details.Kind, s.Details.Name)
+		}
+		if rErr.Code == "" {
+			rErr.Code = string(metav1.StatusReasonUnknown)
+		}
+		if code, suggestion := apiHint(s); suggestion != "" {
+			if code != "" {
+				rErr.Code = code
+			}
+			rErr.Suggestion = suggestion
+		}
+		return rErr
+	}
+
+	rErr = &relayError{Code: "Error", Reason: err.Error(), exitCode: EXIT_ERROR}
+	var exitErr cli.ExitCoder
+	if errors.As(err, &exitErr) {
+		rErr.exitCode = exitErr.ExitCode()
+	}
+	return rErr
+}
+
+func printJSONError(w io.Writer, err error) int {
+	rErr := asRelayError(err)
+	json.NewEncoder(w).Encode(rErr)
+	return rErr.exitCode
+}
+
+// printHint prints an error with its suggestion, it tells whether there was one
+func printHint(w io.Writer, err error) (int, bool) {
+	rErr := asRelayError(err)
+	if rErr.Suggestion == "" {
+		return 0, false
+	}
+	fmt.Fprintf(w, "%s\nhint: %s\n", rErr.Reason, rErr.Suggestion)
+	return rErr.exitCode, true
+}
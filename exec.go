@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/remotecommand"
+)
+
+// executor prepares an exec in a container of a pod
+func executor(rc *relayClient, namespace string, pod string, options *v1.PodExecOptions) (remotecommand.Executor, error) {
+	req := rc.clientset.CoreV1().RESTClient().Post().
+		Resource("pods").
+		Namespace(namespace).
+		Name(pod).
+		SubResource("exec").
+		VersionedParams(options, scheme.ParameterCodec)
+
+	transport, upgrader, err := rc.roundTripper()
+	if err != nil {
+		return nil, err
+	}
+	return remotecommand.NewSPDYExecutorForTransports(transport, upgrader, http.MethodPost, req.URL())
+}
+
+// execStream runs a command in the relay container and wires its stdin and
+// stdout to the given streams, it returns when the command exits.
+func execStream(rc *relayClient, namespace string, pod string, command []string, stdin io.Reader, stdout io.Writer) error {
+	return execContainer(rc, namespace, pod, CONTAINER_NAME, command, stdin, stdout)
+}
+
+// execContainer is execStream in another container of the pod
+func execContainer(rc *relayClient, namespace string, pod string, container string, command []string, stdin io.Reader, stdout io.Writer) error {
+	executor, err := executor(rc, namespace, pod, &v1.PodExecOptions{
+		Container: container,
+		Command:   command,
+		Stdin:     stdin != nil,
+		Stdout:    true,
+		Stderr:    true,
+	})
+	if err != nil {
+		return err
+	}
+	stderr := new(bytes.Buffer)
+	err = executor.Stream(remotecommand.StreamOptions{Stdin: stdin, Stdout: stdout, Stderr: stderr})
+	if err != nil && stderr.Len() != 0 {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return err
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// consecutive refused connections that open the circuit of a target
+const CIRCUIT_THRESHOLD = 3
+
+// time after a failover until the primary target is tried again
+const CIRCUIT_COOLDOWN = 30 * time.Second
+
+// targets are the primary cluster host followed by the failover hosts, given
+// as host or host:port.
+func (opts relayOptions) targets() []relayOptions {
+	targets := []relayOptions{opts}
+	for _, f := range opts.failover {
+		t := opts
+		host, p := splitHostPort(f)
+		t.clusterHost = host
+		if port, err := strconv.ParseUint(p, 10, 16); err == nil {
+			t.clusterPort = uint(port)
+		} else {
+			t.clusterHost = trimBrackets(f)
+		}
+		targets = append(targets, t)
+	}
+	return targets
+}
+
+func (opts relayOptions) target() string {
+	if opts.remoteSocket != "" {
+		return SOCKET_PREFIX + opts.remoteSocket
+	}
+	return joinHostPort(opts.clusterHost, opts.clusterPort)
+}
+
+// breaker moves a tunnel to the next target once the active one keeps
+// refusing connections. After a cooldown a single connection probes the
+// primary target again and closes the circuit if it succeeds.
+type breaker struct {
+	rc      *relayClient
+	pod     *podRef
+	targets []relayOptions
+	log     *logger
+
+	mu       sync.Mutex
+	active   int
+	failures int
+	openedAt time.Time
+}
+
+func newBreaker(rc *relayClient, pod *podRef, targets []relayOptions, log *logger) *breaker {
+	return &breaker{rc: rc, pod: pod, targets: targets, log: log}
+}
+
+func (b *breaker) pick() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.active != 0 && time.Since(b.openedAt) > CIRCUIT_COOLDOWN {
+		b.openedAt = time.Now()
+		return 0
+	}
+	return b.active
+}
+
+func (b *breaker) failed(target int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if target != b.active {
+		return
+	}
+	b.failures++
+	if b.failures < CIRCUIT_THRESHOLD || b.active == len(b.targets)-1 {
+		return
+	}
+	b.switchTo(b.active+1, fmt.Sprintf("%d refused connections", b.failures))
+}
+
+func (b *breaker) succeeded(target int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if target < b.active {
+		b.switchTo(target, "it accepts connections again")
+	} else if target == b.active {
+		b.failures = 0
+	}
+}
+
+// switchTo makes a target active and records an event on the relay pod
+func (b *breaker) switchTo(target int, reason string) {
+	message := fmt.Sprintf("Failing over from %s to %s, %s", b.targets[b.active].target(), b.targets[target].target(), reason)
+	b.log.printf("%s\n", message)
+	b.active, b.failures, b.openedAt = target, 0, time.Now()
+	go b.event(message)
+}
+
+func (b *breaker) event(message string) {
+	name, _, _ := b.pod.current()
+	podEvent(b.rc, b.pod.namespace, name, "Failover", message)
+}
+
+// podEvent records a warning event on a relay pod, so the relay shows up in
+// kubectl describe and kubectl get events
+func podEvent(rc *relayClient, namespace string, name string, reason string, message string) {
+	pods := rc.clientset.CoreV1().Pods(namespace)
+	pod, err := pods.Get(context.TODO(), name, metav1.GetOptions{})
+	if err != nil {
+		return
+	}
+	now := metav1.Now()
+	rc.clientset.CoreV1().Events(namespace).Create(context.TODO(), &v1.Event{
+		ObjectMeta: metav1.ObjectMeta{GenerateName: fmt.Sprintf("%s.", name)},
+		InvolvedObject: v1.ObjectReference{
+			Kind:       "Pod",
+			APIVersion: "v1",
+			Namespace:  namespace,
+			Name:       pod.Name,
+			UID:        pod.UID,
+		},
+		Reason:         reason,
+		Message:        message,
+		Type:           v1.EventTypeWarning,
+		Source:         v1.EventSource{Component: POD_NAME},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+	}, metav1.CreateOptions{})
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// targetFilter picks the targets of a bulk forward. A pattern is a glob over
+// the target host or, if it contains one of "=!(", a label selector over the
+// service of the target.
+type targetFilter struct {
+	include []string
+	exclude []string
+}
+
+func newTargetFilter(include []string, exclude []string) (*targetFilter, error) {
+	for _, pattern := range append(append([]string{}, include...), exclude...) {
+		if isSelector(pattern) {
+			if _, err := labels.Parse(pattern); err != nil {
+				return nil, fmt.Errorf("invalid label selector %q: %w", pattern, err)
+			}
+		} else if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid glob %q: %w", pattern, err)
+		}
+	}
+	return &targetFilter{include: include, exclude: exclude}, nil
+}
+
+func isSelector(pattern string) bool {
+	return strings.ContainsAny(pattern, "=!(")
+}
+
+// admits tells whether a target passes the filter, it is included if it
+// matches any include pattern (or there are none) and no exclude pattern.
+func (f *targetFilter) admits(rc *relayClient, namespace string, host string) (bool, error) {
+	var serviceLabels labels.Set
+	var looked, found bool
+	match := func(pattern string) (bool, error) {
+		if !isSelector(pattern) {
+			ok, _ := path.Match(pattern, host)
+			return ok, nil
+		}
+		if !looked {
+			var err error
+			serviceLabels, found, err = targetLabels(rc, namespace, host)
+			if err != nil {
+				return false, err
+			}
+			looked = true
+		}
+		// a target without a service matches no selector
+		if !found {
+			return false, nil
+		}
+		selector, _ := labels.Parse(pattern)
+		return selector.Matches(serviceLabels), nil
+	}
+
+	included := len(f.include) == 0
+	for _, pattern := range f.include {
+		ok, err := match(pattern)
+		if err != nil {
+			return false, err
+		}
+		if ok {
+			included = true
+			break
+		}
+	}
+	if !included {
+		return false, nil
+	}
+	for _, pattern := range f.exclude {
+		ok, err := match(pattern)
+		if err != nil || ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// targetLabels are the labels of the service a host like <svc>[.<ns>[.svc...]]
+// names, it tells whether there is such a service.
+func targetLabels(rc *relayClient, namespace string, host string) (labels.Set, bool, error) {
+	parts := strings.Split(host, ".")
+	if len(parts) > 1 {
+		namespace = parts[1]
+	}
+	svc, err := rc.clientset.CoreV1().Services(namespace).Get(context.TODO(), parts[0], metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return labels.Set(svc.Labels), true, nil
+}
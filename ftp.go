@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const FTP_DATA_TIMEOUT = 30 * time.Second
+
+var pasvPattern = regexp.MustCompile(`\((\d+),(\d+),(\d+),(\d+),(\d+),(\d+)\)`)
+var epsvPattern = regexp.MustCompile(`\(\|\|\|(\d+)\|\)`)
+
+// ftpProxy relays an ftp control connection and rewrites passive mode replies,
+// the negotiated data connections are opened from the relay pod on demand.
+// Like most ftp clients it ignores the address of PASV replies and connects to
+// the control host, servers behind NAT often announce addresses nobody can reach.
+// The rewritten replies announce the address the client reached the proxy on.
+type ftpProxy struct {
+	rc           *relayClient
+	namespace    string
+	pod          string
+	host         string
+	upstream     string
+	localAddress string
+}
+
+func (p *ftpProxy) serve(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go p.handle(conn)
+	}
+}
+
+func (p *ftpProxy) handle(client net.Conn) {
+	defer client.Close()
+	server, err := net.Dial("tcp", p.upstream)
+	if err != nil {
+		println("ftp control connection failed:", err.Error())
+		return
+	}
+	defer server.Close()
+
+	go func() {
+		io.Copy(server, client)
+		server.(*net.TCPConn).CloseWrite()
+	}()
+
+	local := client.LocalAddr().(*net.TCPAddr).IP
+	reader := bufio.NewReader(server)
+	for {
+		line, err := reader.ReadString('\n')
+		if len(line) != 0 {
+			if _, wErr := io.WriteString(client, p.rewrite(line, local)); wErr != nil {
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (p *ftpProxy) rewrite(line string, local net.IP) string {
+	switch {
+	case strings.HasPrefix(line, "227"):
+		m := pasvPattern.FindStringSubmatch(line)
+		if m == nil {
+			return line
+		}
+		p1, _ := strconv.Atoi(m[5])
+		p2, _ := strconv.Atoi(m[6])
+		localPort, err := p.openData(p1*256 + p2)
+		if err != nil {
+			println("ftp data connection failed:", err.Error())
+			return line
+		}
+		ip := local.To4()
+		if ip == nil {
+			// a PASV reply has no room for an ipv6 address, the extended one
+			// carries the port alone
+			return fmt.Sprintf("229 Entering Extended Passive Mode (|||%d|)\r\n", localPort)
+		}
+		return fmt.Sprintf("227 Entering Passive Mode (%d,%d,%d,%d,%d,%d).\r\n", ip[0], ip[1], ip[2], ip[3], localPort/256, localPort%256)
+	case strings.HasPrefix(line, "229"):
+		m := epsvPattern.FindStringSubmatch(line)
+		if m == nil {
+			return line
+		}
+		port, _ := strconv.Atoi(m[1])
+		localPort, err := p.openData(port)
+		if err != nil {
+			println("ftp data connection failed:", err.Error())
+			return line
+		}
+		return strings.Replace(line, m[0], fmt.Sprintf("(|||%d|)", localPort), 1)
+	}
+	return line
+}
+
+// openData listens on an ephemeral local port for the data connection a client
+// opens after a passive mode reply and relays it through the relay pod.
+func (p *ftpProxy) openData(port int) (int, error) {
+	listener, err := net.Listen("tcp", joinHostPort(p.localAddress, 0))
+	if err != nil {
+		return 0, err
+	}
+
+	go func() {
+		defer listener.Close()
+		listener.(*net.TCPListener).SetDeadline(time.Now().Add(FTP_DATA_TIMEOUT))
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		target := net.JoinHostPort(p.host, strconv.Itoa(port))
+		command := []string{"socat", "-", socatAddress(PROTOCOL_TCP, target)}
+		err = execStream(p.rc, p.namespace, p.pod, command, conn, conn)
+		if err != nil {
+			println("ftp data connection failed:", err.Error())
+		}
+	}()
+	return listener.Addr().(*net.TCPAddr).Port, nil
+}
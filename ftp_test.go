@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net"
+	"regexp"
+	"testing"
+)
+
+func TestFTPRewrite(t *testing.T) {
+	tests := []struct {
+		name  string
+		line  string
+		local string
+		want  string
+	}{
+		{"pasv", "227 Entering Passive Mode (10,0,3,7,195,80).\r\n", "127.0.0.1",
+			`^227 Entering Passive Mode \(127,0,0,1,\d+,\d+\)\.\r\n$`},
+		{"pasv over ipv6", "227 Entering Passive Mode (10,0,3,7,195,80).\r\n", "::1",
+			`^229 Entering Extended Passive Mode \(\|\|\|\d+\|\)\r\n$`},
+		{"pasv of a mapped address", "227 Entering Passive Mode (10,0,3,7,195,80).\r\n", "::ffff:127.0.0.1",
+			`^227 Entering Passive Mode \(127,0,0,1,\d+,\d+\)\.\r\n$`},
+		{"epsv", "229 Entering Extended Passive Mode (|||50000|)\r\n", "127.0.0.1",
+			`^229 Entering Extended Passive Mode \(\|\|\|\d+\|\)\r\n$`},
+		{"pasv without address", "227 Entering Passive Mode\r\n", "127.0.0.1",
+			`^227 Entering Passive Mode\r\n$`},
+		{"epsv without port", "229 Entering Extended Passive Mode\r\n", "127.0.0.1",
+			`^229 Entering Extended Passive Mode\r\n$`},
+		{"other reply", "230 Login successful (1,2,3,4,5,6).\r\n", "127.0.0.1",
+			`^230 Login successful \(1,2,3,4,5,6\)\.\r\n$`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// no data connection is opened, the listener times out again
+			p := &ftpProxy{host: "ftp.data.svc", localAddress: LOOPBACK_ADDRESS}
+			got := p.rewrite(tt.line, net.ParseIP(tt.local))
+			if !regexp.MustCompile(tt.want).MatchString(got) {
+				t.Errorf("rewrite(%q) = %q, want a match of %q", tt.line, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,479 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/urfave/cli/v2"
+	v1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// UP_BATCH_SIZE is how many relay pods of a group start at a time by default
+const UP_BATCH_SIZE = 5
+
+// groupStatus prints the state of all tunnels of a group whenever one changes
+type groupStatus struct {
+	mu       sync.Mutex
+	group    string
+	tunnels  []tunnelConfig
+	states   map[string]string
+	loggers  map[string]*logger
+	session  *session
+	shutdown *shutdown
+}
+
+func newGroupStatus(group string, tunnels []tunnelConfig) *groupStatus {
+	states := map[string]string{}
+	var names []string
+	for _, t := range tunnels {
+		states[t.Name] = "starting"
+		names = append(names, t.Name)
+	}
+	return &groupStatus{
+		group:    group,
+		tunnels:  tunnels,
+		states:   states,
+		loggers:  tunnelLoggers(names),
+		session:  newSession(),
+		shutdown: &shutdown{},
+	}
+}
+
+func (g *groupStatus) set(name string, state string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.states[name] = state
+
+	up := 0
+	for _, s := range g.states {
+		if s == "up" {
+			up++
+		}
+	}
+	if g.group == "" {
+		fmt.Printf("%d/%d tunnels up\n", up, len(g.tunnels))
+	} else {
+		fmt.Printf("Group %q: %d/%d tunnels up\n", g.group, up, len(g.tunnels))
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	for _, t := range g.tunnels {
+		opts := t.options()
+		fmt.Fprintf(w, "  %s\t%s -> %s\t%s\n", t.Name, joinHostPort(opts.localAddress, opts.localPort), opts.target(), g.states[t.Name])
+	}
+	w.Flush()
+}
+
+// logger returns the logger of a tunnel
+func (g *groupStatus) logger(name string) *logger {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.loggers[name]
+}
+
+// current returns the tunnels of the group
+func (g *groupStatus) current() []tunnelConfig {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.tunnels
+}
+
+// update replaces the tunnels of the group after a reload, the states of
+// the tunnels that stay are kept
+func (g *groupStatus) update(tunnels []tunnelConfig) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	states := map[string]string{}
+	var names []string
+	for _, t := range tunnels {
+		states[t.Name] = "starting"
+		if state, ok := g.states[t.Name]; ok {
+			states[t.Name] = state
+		}
+		names = append(names, t.Name)
+	}
+	g.tunnels, g.states, g.loggers = tunnels, states, tunnelLoggers(names)
+}
+
+// finish records how a tunnel ended, it tells whether the tunnel failed
+func (g *groupStatus) finish(name string, err error) bool {
+	if err != nil {
+		g.set(name, fmt.Sprintf("failed: %s", err))
+		return true
+	}
+	g.set(name, "stopped")
+	return false
+}
+
+// upOptions control how the relay pods of a group are created. With reload
+// the tunnels are read again on SIGHUP, or when the file at watch changes.
+type upOptions struct {
+	batchSize     int
+	singlePod     bool
+	loopbackAlias bool
+	watchConfig   bool
+	reload        func() ([]tunnelConfig, error)
+	watch         string
+	drainTimeout  time.Duration
+	// pod are the pod flags of the command line, the tunnels inherit them
+	pod *relayOptions
+}
+
+// up starts the tunnels of a group, or all tunnels of the config without one
+func up(kube *kubeOptions, configPath string, group string, opts upOptions) error {
+	if configPath == "" {
+		var err error
+		if configPath, err = defaultConfigPath(); err != nil {
+			return err
+		}
+	}
+	load := func() ([]tunnelConfig, error) {
+		config, err := loadConfig(configPath)
+		if err != nil {
+			return nil, err
+		}
+		var tunnels []tunnelConfig
+		if group == "" {
+			tunnels, err = config.all()
+		} else {
+			tunnels, err = config.group(group)
+		}
+		for i := range tunnels {
+			tunnels[i].pod = opts.pod
+		}
+		return tunnels, err
+	}
+	tunnels, err := load()
+	if err != nil {
+		return err
+	}
+	opts.reload = load
+	if opts.watchConfig {
+		opts.watch = configPath
+	}
+	return upTunnels(kube, group, tunnels, opts)
+}
+
+// prepareTunnels gives the tunnels their loopback aliases
+func prepareTunnels(tunnels []tunnelConfig, loopbackAliases bool) error {
+	for i := range tunnels {
+		t := &tunnels[i]
+		if loopbackAliases && t.LocalAddress == "" {
+			var err error
+			if t.LocalAddress, err = loopbackAlias(i); err != nil {
+				return err
+			}
+		}
+		if err := ensureLoopbackAlias(t.options().localAddress); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// upTunnels runs the tunnels of a group until all of them ended
+func upTunnels(kube *kubeOptions, group string, tunnels []tunnelConfig, opts upOptions) error {
+	namespace, rc, err := connect(kube)
+	if err != nil {
+		return err
+	}
+	if err := prepareTunnels(tunnels, opts.loopbackAlias); err != nil {
+		return err
+	}
+	for _, t := range tunnels {
+		o := t.options()
+		if _, err := checkLocalPort(o.localAddress, o.localPort, false); err != nil {
+			return fmt.Errorf("tunnel %q: %w", t.Name, err)
+		}
+	}
+
+	status := newGroupStatus(group, tunnels)
+	ctrlc := make(chan os.Signal, 1)
+	signal.Notify(ctrlc, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctrlc
+		println("received sigterm, draining connections, again to exit right away...")
+		go func() {
+			<-ctrlc
+			os.Exit(1)
+		}()
+		status.session.keep()
+		status.shutdown.drain(opts.drainTimeout, nil)
+		status.shutdown.cleanup()
+		var drained sync.WaitGroup
+		namespaces := map[string]bool{}
+		for _, t := range status.current() {
+			namespaces[tunnelNamespace(t, namespace)] = true
+		}
+		for ns := range namespaces {
+			drained.Add(1)
+			go func(ns string) {
+				defer drained.Done()
+				cleanupOwned(rc.clientset, ns, nil)
+			}(ns)
+		}
+		drained.Wait()
+		recordTelemetryExit(errInterrupted)
+		os.Exit(1)
+	}()
+
+	var failed []bool
+	if opts.singlePod {
+		if opts.reload != nil {
+			ignoreReloads()
+		}
+		failed, err = upSinglePod(rc, namespace, group, tunnels, status)
+		if err != nil {
+			return err
+		}
+	} else {
+		runner := newTunnelRunner(rc, namespace, status, opts.batchSize)
+		for _, t := range tunnels {
+			runner.start(t)
+		}
+		if opts.reload != nil {
+			stop, err := watchReloads(opts, runner)
+			if err != nil {
+				return err
+			}
+			defer stop()
+		}
+		failed = runner.wait()
+	}
+
+	count := 0
+	for _, f := range failed {
+		if f {
+			count++
+		}
+	}
+	if count != 0 && group == "" {
+		return fmt.Errorf("%d of %d tunnels failed", count, len(failed))
+	}
+	if count != 0 {
+		return fmt.Errorf("%d of %d tunnels in group %q failed", count, len(failed), group)
+	}
+	return nil
+}
+
+// upSinglePod relays all tunnels through one pod with a socat container per
+// tunnel, which needs a single pod creation and a single quota slot.
+func upSinglePod(rc *relayClient, namespace string, group string, tunnels []tunnelConfig, status *groupStatus) ([]bool, error) {
+	ns := tunnelNamespace(tunnels[0], namespace)
+	var containers []v1.Container
+	for i, t := range tunnels {
+		if tunnelNamespace(t, namespace) != ns {
+			return nil, fmt.Errorf("tunnels of group %q span several namespaces, a single pod needs one", group)
+		}
+		if !tunnels[0].samePod(t) {
+			return nil, fmt.Errorf("tunnels of group %q set different pod options, a single pod needs the same", group)
+		}
+		containers = append(containers, relayContainer(t.Name, t.options(), RELAY_PORT+i))
+	}
+	// the tunnels share how the pod is waited for, see samePod
+	first := tunnels[0].options()
+	name := groupPodName(group)
+	if errs := validation.IsDNS1123Label(name); len(errs) != 0 {
+		return nil, fmt.Errorf("invalid group name %q: %s", group, errs[0])
+	}
+	defaults, err := rc.clusterDefaults()
+	if err != nil {
+		return nil, err
+	}
+	if !defaults.allows(ns) {
+		return nil, namespaceNotAllowed(ns, defaults)
+	}
+
+	instance := newInstance(name)
+	manifest, err := applyPodOptions(relayPod(groupPodName(group), instance, first.drainTimeout, containers...), first)
+	if err != nil {
+		return nil, err
+	}
+	create := func() (string, error) {
+		name, err := createPod(rc.clientset, ns, manifest.DeepCopy(), defaults, nil)
+		if err != nil {
+			return name, withExitCode(err, EXIT_POD_CREATE)
+		}
+		if first.waitFor == WAIT_FOR_NONE {
+			return name, nil
+		}
+		if err := wait(rc, ns, name, first.waitFor, first.scheduleTimeout, first.waitTimeout, nil); err != nil {
+			reportStartup(rc.clientset, ns, name, nil)
+			return name, withExitCode(err, EXIT_POD_START)
+		}
+		return name, nil
+	}
+	name, err = create()
+	if name == "" {
+		return nil, err
+	}
+	pod := newPodRef(rc, ns, name, nil, func(old string) (string, error) {
+		cleanup(rc.clientset, ns, old, nil)
+		return create()
+	})
+	defer func() {
+		current, _, _ := pod.current()
+		cleanup(rc.clientset, ns, current, nil)
+	}()
+	if err != nil {
+		return nil, err
+	}
+	defer pod.close()
+
+	var wg sync.WaitGroup
+	failed := make([]bool, len(tunnels))
+	for i, t := range tunnels {
+		wg.Add(1)
+		go func(i int, t tunnelConfig) {
+			defer wg.Done()
+			o := t.options()
+			o.log = status.logger(t.Name)
+			o.shutdown = status.shutdown
+			key := fmt.Sprintf("%s/%s/%s", ns, name, t.Name)
+			// without waiting the forward is retried until the pod accepts it
+			policy := retryPolicy{retries: o.retries, backoff: o.retryBackoff, log: o.log}
+			if o.waitFor == WAIT_FOR_NONE && policy.retries < READY_PROBE_ATTEMPTS {
+				policy = retryPolicy{retries: READY_PROBE_ATTEMPTS, backoff: READY_PROBE_INTERVAL, log: o.log}
+			}
+			err := serveTunnel(rc, pod, []int{RELAY_PORT + i}, o, policy, func(port uint) error {
+				if o.waitFor == WAIT_FOR_PROBE {
+					if err := probeTunnel(o.localAddress, port, o.probeCommand, o.log); err != nil {
+						return err
+					}
+				}
+				status.session.add(key, sessionTunnel(o, ns, port))
+				status.set(t.Name, "up")
+				return nil
+			})
+			status.session.remove(key)
+			failed[i] = status.finish(t.Name, err)
+		}(i, t)
+	}
+	wg.Wait()
+	return failed, nil
+}
+
+func groupPodName(group string) string {
+	return fmt.Sprintf("%s-group-%s", POD_NAME, group)
+}
+
+// down deletes the relay pods of a group, or of all tunnels without one, e.g.
+// to stop tunnels started in another shell
+func down(kube *kubeOptions, configPath string, group string) error {
+	config, err := loadConfig(configPath)
+	if err != nil {
+		return err
+	}
+	tunnels, err := config.group(group)
+	if group == "" {
+		tunnels, err = config.all()
+	}
+	if err != nil {
+		return err
+	}
+	namespace, rc, err := connect(kube)
+	if err != nil {
+		return err
+	}
+
+	if group != "" {
+		err = deletePod(rc, tunnelNamespace(tunnels[0], namespace), groupPodName(group), false)
+		if err != nil {
+			return err
+		}
+	}
+	for _, t := range tunnels {
+		err := deletePod(rc, tunnelNamespace(t, namespace), t.podName(), true)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deletePod deletes the own relay pods generated from a name
+func deletePod(rc *relayClient, namespace string, name string, report bool) error {
+	pods, err := ownPods(rc.clientset, namespace, name)
+	if err != nil {
+		return err
+	}
+	if len(pods) == 0 && report {
+		fmt.Printf("Pod %q is not running\n", name)
+	}
+	for _, pod := range pods {
+		err := rc.clientset.CoreV1().Pods(namespace).Delete(context.TODO(), pod.Name, metav1.DeleteOptions{})
+		if k8serrors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Delete pod %q\n", pod.Name)
+	}
+	return nil
+}
+
+func tunnelNamespace(t tunnelConfig, namespace string) string {
+	if t.Namespace != "" {
+		return t.Namespace
+	}
+	return namespace
+}
+
+func upCommand(kube *kubeOptions, configPath *string, pod *relayOptions) *cli.Command {
+	opts := upOptions{pod: pod}
+	return &cli.Command{
+		Name:      "up",
+		Usage:     "start all tunnels of a group from the config file, or all of them without a group",
+		ArgsUsage: "[<group>]",
+		Flags: []cli.Flag{
+			&cli.IntFlag{
+				Name:        "batch-size",
+				Value:       UP_BATCH_SIZE,
+				Usage:       "number of relay pods starting at a time",
+				Destination: &opts.batchSize,
+			},
+			&cli.BoolFlag{
+				Name:        "loopback-alias",
+				Usage:       "give every tunnel its own loopback address (127.0.0.2, 127.0.0.3, ...)",
+				Destination: &opts.loopbackAlias,
+			},
+			&cli.BoolFlag{
+				Name:        "single-pod",
+				Usage:       "relay all tunnels of the group through one pod",
+				Destination: &opts.singlePod,
+			},
+			&cli.BoolFlag{
+				Name:        "watch-config",
+				Usage:       "reload the config file when it changes, like on SIGHUP",
+				Destination: &opts.watchConfig,
+			},
+		},
+		Action: func(c *cli.Context) error {
+			if err := parsePodFlags(c, opts.pod); err != nil {
+				return err
+			}
+			opts.drainTimeout = opts.pod.drainTimeout
+			return up(kube, *configPath, c.Args().First(), opts)
+		},
+	}
+}
+
+func downCommand(kube *kubeOptions, configPath *string) *cli.Command {
+	return &cli.Command{
+		Name:      "down",
+		Usage:     "delete the relay pods of a group from the config file, or of all tunnels without a group",
+		ArgsUsage: "[<group>]",
+		Action: func(c *cli.Context) error {
+			return down(kube, *configPath, c.Args().First())
+		},
+	}
+}
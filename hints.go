@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var forbiddenPattern = regexp.MustCompile(`User "([^"]*)" cannot (\S+) resource "([^"]+)" in API group "([^"]*)"(?: in the namespace "([^"]+)")?`)
+var webhookPattern = regexp.MustCompile(`admission webhook "([^"]+)" denied the request: (.*)`)
+
+// apiHint explains common api failures, it returns a code and a suggestion for
+// the status or empty strings if there is nothing to add.
+func apiHint(s metav1.Status) (string, string) {
+	switch {
+	case strings.Contains(s.Message, "failed quota") && strings.Contains(s.Message, "must specify"):
+		return "ResourcesRequired", "the namespace quota requires resources, set them with --cpu-request, --cpu-limit, --memory-request and --memory-limit"
+	case strings.Contains(s.Message, "exceeded quota"):
+		return "QuotaExceeded", "the namespace quota is exhausted, free up resources or try --namespace-fallback"
+	case strings.Contains(s.Message, "no PriorityClass with name"):
+		return "PriorityClassMissing", "the priority class doesn't exist, list them with kubectl get priorityclasses and correct --priority-class"
+	case strings.Contains(s.Message, "RuntimeClass") && strings.Contains(s.Message, "not found"):
+		return "RuntimeClassMissing", "the runtime class doesn't exist, list them with kubectl get runtimeclasses and correct --runtime-class"
+	case webhookPattern.MatchString(s.Message):
+		m := webhookPattern.FindStringSubmatch(s.Message)
+		return "AdmissionDenied", fmt.Sprintf("the admission webhook %q rejected the relay pod (%s), ask its owners or adjust the pod via cluster defaults", m[1], m[2])
+	case s.Reason == metav1.StatusReasonForbidden && forbiddenPattern.MatchString(s.Message):
+		return "", rbacHint(forbiddenPattern.FindStringSubmatch(s.Message))
+	}
+	return "", ""
+}
+
+// rbacHint names the rule a cluster admin has to grant
+func rbacHint(m []string) string {
+	user, verb, resource, group, namespace := m[1], m[2], m[3], m[4], m[5]
+	if group != "" {
+		resource = fmt.Sprintf("%s.%s", resource, group)
+	}
+	if namespace == "" {
+		return fmt.Sprintf("ask a cluster admin to grant: kubectl create clusterrole kube-relay --verb=%s --resource=%s && kubectl create clusterrolebinding kube-relay --clusterrole=kube-relay --user=%s", verb, resource, user)
+	}
+	return fmt.Sprintf("ask a cluster admin to grant: kubectl create role kube-relay -n %s --verb=%s --resource=%s && kubectl create rolebinding kube-relay -n %s --role=kube-relay --user=%s", namespace, verb, resource, namespace, user)
+}
+
+// schedulingHint explains why a pending relay pod has no node
+func schedulingHint(pod *v1.Pod) string {
+	message := unschedulableMessage(pod)
+	if message == "" {
+		return ""
+	}
+	return fmt.Sprintf("Pod %q cannot be scheduled: %s\nNo node matches the relay pod, check taints, node selectors and free capacity, or ask a cluster admin\n", pod.Name, message)
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+)
+
+const PROXY_HTTP = "http"
+
+// HTTP_PROXY_MAX_HEADER bounds the request of a proxy client
+const HTTP_PROXY_MAX_HEADER = 8 << 10
+
+// httpConnectHandshake reads a CONNECT request. The header is read byte by
+// byte, so no data the client sends after it is lost.
+func httpConnectHandshake(client net.Conn) (string, []byte, error) {
+	var header []byte
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(header, []byte("\r\n\r\n")) {
+		if len(header) >= HTTP_PROXY_MAX_HEADER {
+			return "", nil, fmt.Errorf("request header too large")
+		}
+		if _, err := io.ReadFull(client, b); err != nil {
+			return "", nil, err
+		}
+		header = append(header, b[0])
+	}
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(header)))
+	if err != nil {
+		return "", nil, err
+	}
+	if req.Method != http.MethodConnect {
+		client.Write([]byte("HTTP/1.1 405 Method Not Allowed\r\nAllow: CONNECT\r\nConnection: close\r\n\r\n"))
+		return "", nil, fmt.Errorf("unsupported method %s, only CONNECT is proxied", req.Method)
+	}
+	if _, _, err := net.SplitHostPort(req.Host); err != nil {
+		client.Write([]byte("HTTP/1.1 400 Bad Request\r\nConnection: close\r\n\r\n"))
+		return "", nil, fmt.Errorf("invalid target %q: %w", req.Host, err)
+	}
+	return req.Host, []byte("HTTP/1.1 200 Connection established\r\n\r\n"), nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// imagePullError returns an error once kubelet backs off pulling the image of a
+// relay container, e.g. because a mirror is down or a registry is not allowed.
+func imagePullError(pod *v1.Pod) error {
+	for _, cs := range pod.Status.ContainerStatuses {
+		// with pull policy Never a missing image is not retried
+		if cs.State.Waiting == nil || (cs.State.Waiting.Reason != "ImagePullBackOff" && cs.State.Waiting.Reason != "ErrImageNeverPull") {
+			continue
+		}
+		return &relayError{
+			Code:       "ImagePullBackOff",
+			Reason:     fmt.Sprintf("Pod %q cannot pull image %q: %s", pod.Name, cs.Image, cs.State.Waiting.Message),
+			Resource:   fmt.Sprintf("pods/%s", pod.Name),
+			Suggestion: "check the image name and registry access, e.g. --image-pull-secret, or add a fallback with another --pod-image",
+			exitCode:   EXIT_POD_START,
+		}
+	}
+	return nil
+}
+
+// parsePullPolicy validates an image pull policy, empty leaves the choice to
+// the cluster
+func parsePullPolicy(policy string) (v1.PullPolicy, error) {
+	switch p := v1.PullPolicy(policy); p {
+	case "", v1.PullAlways, v1.PullIfNotPresent, v1.PullNever:
+		return p, nil
+	}
+	return "", fmt.Errorf("invalid image pull policy %q, expected %s, %s or %s", policy, v1.PullAlways, v1.PullIfNotPresent, v1.PullNever)
+}
+
+// pullSecrets refers to the secrets kubelet pulls the relay image with, e.g.
+// from a private registry mirror
+func pullSecrets(names []string) []v1.LocalObjectReference {
+	var refs []v1.LocalObjectReference
+	for _, name := range names {
+		refs = append(refs, v1.LocalObjectReference{Name: name})
+	}
+	return refs
+}
+
+func isImagePullError(err error) bool {
+	var rErr *relayError
+	return errors.As(err, &rErr) && rErr.Code == "ImagePullBackOff"
+}
+
+// switchImage points the relay containers of a pod to another image, the image
+// of a container can be changed in place, so the pod keeps its name and node.
+func switchImage(rc *relayClient, namespace string, name string, image string, log *logger) error {
+	defaults, err := rc.clusterDefaults()
+	if err != nil {
+		return err
+	}
+	image = defaults.podImage(image)
+	pods := rc.clientset.CoreV1().Pods(namespace)
+	pod, err := pods.Get(context.TODO(), name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	for i := range pod.Spec.Containers {
+		pod.Spec.Containers[i].Image = image
+	}
+	if _, err := pods.Update(context.TODO(), pod, metav1.UpdateOptions{}); err != nil {
+		return err
+	}
+	log.printf("Falling back to image %q\n", image)
+	return nil
+}
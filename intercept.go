@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/urfave/cli/v2"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+)
+
+// ANNOTATION_INTERCEPTED keeps the original selector of an intercepted service,
+// so it can be restored after a crash.
+const ANNOTATION_INTERCEPTED = "kube-relay/intercepted-selector"
+
+// servicePort picks the port of a service by port number, or the first one
+func servicePort(svc *v1.Service, port uint) (*v1.ServicePort, error) {
+	for i, p := range svc.Spec.Ports {
+		if port == 0 || uint(p.Port) == port {
+			return &svc.Spec.Ports[i], nil
+		}
+	}
+	return nil, fmt.Errorf("service %q has no port %d", svc.Name, port)
+}
+
+// redirectService points the selector of a service at the relay pod of an
+// instance, the original selector is kept in an annotation.
+func redirectService(client kubernetes.Interface, namespace string, service string, instance string) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		services := client.CoreV1().Services(namespace)
+		svc, err := services.Get(context.TODO(), service, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if _, ok := svc.Annotations[ANNOTATION_INTERCEPTED]; ok {
+			return fmt.Errorf("service %q is intercepted already, restore it with intercept --restore", service)
+		}
+		original, err := json.Marshal(svc.Spec.Selector)
+		if err != nil {
+			return err
+		}
+		if svc.Annotations == nil {
+			svc.Annotations = map[string]string{}
+		}
+		svc.Annotations[ANNOTATION_INTERCEPTED] = string(original)
+		svc.Spec.Selector = map[string]string{LABEL_INSTANCE: instance}
+		_, err = services.Update(context.TODO(), svc, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+// restoreService puts back the selector an intercept replaced
+func restoreService(client kubernetes.Interface, namespace string, service string) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		services := client.CoreV1().Services(namespace)
+		svc, err := services.Get(context.TODO(), service, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		original, ok := svc.Annotations[ANNOTATION_INTERCEPTED]
+		if !ok {
+			return nil
+		}
+		var selector map[string]string
+		if err := json.Unmarshal([]byte(original), &selector); err != nil {
+			return fmt.Errorf("invalid selector in annotation %s of service %q: %w", ANNOTATION_INTERCEPTED, service, err)
+		}
+		delete(svc.Annotations, ANNOTATION_INTERCEPTED)
+		svc.Spec.Selector = selector
+		if _, err := services.Update(context.TODO(), svc, metav1.UpdateOptions{}); err != nil {
+			return err
+		}
+		fmt.Printf("Restored the selector of service %q\n", service)
+		return nil
+	})
+}
+
+// intercept delivers the traffic of a service to the local port. A reverse
+// relay pod listens on the target port of the service, which is pointed at
+// the pod once it is up and restored on exit.
+func intercept(kube *kubeOptions, opts relayOptions, service string, port uint) error {
+	namespace, rc, err := connect(kube)
+	if err != nil {
+		return err
+	}
+	svc, err := rc.clientset.CoreV1().Services(namespace).Get(context.TODO(), service, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	p, err := servicePort(svc, port)
+	if err != nil {
+		return err
+	}
+	if p.TargetPort.IntValue() == 0 {
+		return fmt.Errorf("named target port %q of service %q is not supported, intercept needs a number", p.TargetPort.String(), service)
+	}
+	opts.name = fmt.Sprintf("%s-intercept-%s", POD_NAME, service)
+	opts.instance = newInstance(opts.name)
+	opts.reverse = true
+	opts.clusterPort = uint(p.TargetPort.IntValue())
+
+	// the service is restored first, so no new connections arrive while the
+	// open ones drain
+	opts.shutdown = &shutdown{}
+	ctrlc := make(chan os.Signal, 1)
+	signal.Notify(ctrlc, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctrlc
+		println("received sigterm, draining connections, again to exit right away...")
+		go func() {
+			<-ctrlc
+			os.Exit(1)
+		}()
+		if err := restoreService(rc.clientset, namespace, service); err != nil {
+			println("failed to restore service:", err.Error())
+		}
+		opts.shutdown.drain(opts.drainTimeout, nil)
+		opts.shutdown.cleanup()
+		cleanupOwned(rc.clientset, namespace, nil)
+		recordTelemetryExit(errInterrupted)
+		os.Exit(1)
+	}()
+
+	redirected := false
+	err = relay(rc, namespace, opts, func(uint) error {
+		if err := redirectService(rc.clientset, namespace, service, opts.instance); err != nil {
+			return err
+		}
+		redirected = true
+		fmt.Printf("Intercepting service %q port %d -> %s\n", service, p.Port, joinHostPort(opts.localAddress, opts.localPort))
+		return nil
+	})
+	if redirected {
+		if rErr := restoreService(rc.clientset, namespace, service); rErr != nil && err == nil {
+			err = rErr
+		}
+	}
+	return err
+}
+
+func interceptCommand(kube *kubeOptions) *cli.Command {
+	opts := relayOptions{localAddress: LOOPBACK_ADDRESS, podImage: POD_IMAGE, waitFor: WAIT_FOR_RUNNING}
+	var port uint
+	var restore bool
+	return &cli.Command{
+		Name:      "intercept",
+		Usage:     "deliver the traffic of a service to a local port until exit",
+		ArgsUsage: "<service>",
+		Flags: []cli.Flag{
+			&cli.UintFlag{
+				Name:        "local-port",
+				Aliases:     []string{"l"},
+				Usage:       "local tcp port receiving the traffic",
+				Destination: &opts.localPort,
+			},
+			&cli.UintFlag{
+				Name:        "port",
+				Usage:       "service port to intercept, 0 for the first one",
+				Destination: &port,
+			},
+			&cli.DurationFlag{
+				Name:        "drain-timeout",
+				Value:       DRAIN_TIMEOUT,
+				Usage:       "how long open connections may finish on exit, after the service is restored",
+				Destination: &opts.drainTimeout,
+			},
+			&cli.BoolFlag{
+				Name:        "restore",
+				Usage:       "restore the selector of a service after a crashed intercept",
+				Destination: &restore,
+			},
+		},
+		Action: func(c *cli.Context) error {
+			if !c.Args().Present() {
+				return fmt.Errorf("missing service")
+			}
+			if restore {
+				namespace, rc, err := connect(kube)
+				if err != nil {
+					return err
+				}
+				return restoreService(rc.clientset, namespace, c.Args().First())
+			}
+			if opts.localPort == 0 {
+				return fmt.Errorf("missing --local-port")
+			}
+			return intercept(kube, opts, c.Args().First(), port)
+		},
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// SERVICE_ACCOUNT_DIR is where a pod finds the credentials of its service account
+const SERVICE_ACCOUNT_DIR = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// kubeOptions are the global flags shaping how the api server is reached
+type kubeOptions struct {
+	apiResolve   []string
+	debugStreams bool
+	transport    string
+	keepalive    time.Duration
+	namespace    string
+	kubeconfig   string
+	context      string
+}
+
+// inCluster tells whether kube-relay runs in a pod without a kubeconfig at
+// hand, e.g. as a ci job, so the service account of the pod is used
+func inCluster(opts *kubeOptions) bool {
+	if opts.kubeconfig != "" || opts.context != "" || os.Getenv(clientcmd.RecommendedConfigPathEnvVar) != "" {
+		return false
+	}
+	if _, err := os.Stat(clientcmd.RecommendedHomeFile); err == nil {
+		return false
+	}
+	if os.Getenv("KUBERNETES_SERVICE_HOST") == "" {
+		return false
+	}
+	_, err := os.Stat(filepath.Join(SERVICE_ACCOUNT_DIR, "token"))
+	return err == nil
+}
+
+// inClusterNamespace is the namespace of the pod kube-relay runs in, unless
+// another one is given
+func inClusterNamespace(namespace string) string {
+	if namespace != "" {
+		return namespace
+	}
+	data, err := os.ReadFile(filepath.Join(SERVICE_ACCOUNT_DIR, "namespace"))
+	if err != nil || strings.TrimSpace(string(data)) == "" {
+		return metav1.NamespaceDefault
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// apiResolveOverrides parses host=ip pairs
+func apiResolveOverrides(pairs []string) (map[string]string, error) {
+	overrides := map[string]string{}
+	for _, pair := range pairs {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || net.ParseIP(parts[1]) == nil {
+			return nil, fmt.Errorf("invalid api resolve override %q, expected host=ip", pair)
+		}
+		overrides[parts[0]] = parts[1]
+	}
+	return overrides, nil
+}
+
+// resolveAPIHost points the config at a fixed ip for the api server hostname,
+// the hostname is kept as tls server name so certificate verification still works.
+func resolveAPIHost(config *rest.Config, pairs []string) error {
+	overrides, err := apiResolveOverrides(pairs)
+	if err != nil || len(overrides) == 0 {
+		return err
+	}
+
+	host := config.Host
+	if !strings.Contains(host, "://") {
+		host = "https://" + host
+	}
+	u, err := url.Parse(host)
+	if err != nil {
+		return err
+	}
+	ip, ok := overrides[u.Hostname()]
+	if !ok {
+		return nil
+	}
+	if config.TLSClientConfig.ServerName == "" {
+		config.TLSClientConfig.ServerName = u.Hostname()
+	}
+	if port := u.Port(); port != "" {
+		u.Host = net.JoinHostPort(ip, port)
+	} else {
+		u.Host = ip
+		if strings.Contains(ip, ":") {
+			u.Host = "[" + ip + "]"
+		}
+	}
+	config.Host = u.String()
+	return nil
+}
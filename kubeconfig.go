@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+)
+
+const KUBECONFIG_NAME = "kube-relay"
+
+// writeTunnelKubeconfig writes a kubeconfig for an api server reached through
+// the tunnel. The cluster host is set as tls server name, so the certificate of
+// the api server is verified against its real name instead of localhost.
+func writeTunnelKubeconfig(path string, localAddress string, localPort uint, clusterHost string, caFile string) error {
+	cluster := clientcmdapi.NewCluster()
+	cluster.Server = "https://" + joinHostPort(dialAddress(localAddress), localPort)
+	cluster.TLSServerName = clusterHost
+	if caFile != "" {
+		ca, err := os.ReadFile(caFile)
+		if err != nil {
+			return err
+		}
+		cluster.CertificateAuthorityData = ca
+	}
+
+	context := clientcmdapi.NewContext()
+	context.Cluster = KUBECONFIG_NAME
+	context.AuthInfo = KUBECONFIG_NAME
+
+	config := clientcmdapi.NewConfig()
+	config.Clusters[KUBECONFIG_NAME] = cluster
+	config.AuthInfos[KUBECONFIG_NAME] = clientcmdapi.NewAuthInfo()
+	config.Contexts[KUBECONFIG_NAME] = context
+	config.CurrentContext = KUBECONFIG_NAME
+
+	err := clientcmd.WriteToFile(*config, path)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Wrote kubeconfig %s\n", path)
+	return nil
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// kubeTarget is a target in the syntax of kubectl port-forward, svc/<name>,
+// pod/<name>, deploy/<name> or sts/<name> with an optional port number or name
+type kubeTarget struct {
+	kind string
+	name string
+	port string
+}
+
+func parseKubeTarget(s string) (kubeTarget, bool) {
+	parts := strings.SplitN(s, "/", 2)
+	if len(parts) != 2 {
+		return kubeTarget{}, false
+	}
+	t := kubeTarget{name: parts[1]}
+	switch parts[0] {
+	case "svc", "service", "services":
+		t.kind = "svc"
+	case "pod", "pods":
+		t.kind = "pod"
+	case "deploy", "deployment", "deployments":
+		t.kind = "deploy"
+	case "sts", "statefulset", "statefulsets":
+		t.kind = "sts"
+	default:
+		return kubeTarget{}, false
+	}
+	if i := strings.LastIndex(t.name, ":"); i != -1 {
+		t.name, t.port = t.name[:i], t.name[i+1:]
+	}
+	return t, t.name != ""
+}
+
+// resolveKubeTarget resolves a service to its cluster ip and a pod to its pod
+// ip, named ports to their numbers. Without a port the only port of the
+// object is taken, or defaultPort if the object has it.
+func resolveKubeTarget(client kubernetes.Interface, namespace string, t kubeTarget, defaultPort uint) (string, uint, error) {
+	if t.kind != "svc" {
+		pod, err := targetPod(client, namespace, t)
+		if err != nil {
+			return "", 0, err
+		}
+		return resolvePodTarget(pod, t, defaultPort)
+	}
+	svc, port, err := targetServicePort(client, namespace, t, defaultPort)
+	if err != nil {
+		return "", 0, err
+	}
+	if svc.Spec.ClusterIP != "" && svc.Spec.ClusterIP != v1.ClusterIPNone {
+		return svc.Spec.ClusterIP, uint(port.Port), nil
+	}
+	// a headless service has no cluster ip, one of its endpoints takes over
+	endpoints, err := serviceEndpoints(client, namespace, t.name, port)
+	if err != nil {
+		return "", 0, err
+	}
+	return endpoints[0].host, endpoints[0].port, nil
+}
+
+// targetServicePort finds the port of a service a target refers to
+func targetServicePort(client kubernetes.Interface, namespace string, t kubeTarget, defaultPort uint) (*v1.Service, *v1.ServicePort, error) {
+	svc, err := client.CoreV1().Services(namespace).Get(context.TODO(), t.name, metav1.GetOptions{})
+	if err != nil {
+		return nil, nil, err
+	}
+	var names []string
+	for i, p := range svc.Spec.Ports {
+		if t.port == p.Name || t.port == fmt.Sprint(p.Port) || (t.port == "" && (len(svc.Spec.Ports) == 1 || uint(p.Port) == defaultPort)) {
+			return svc, &svc.Spec.Ports[i], nil
+		}
+		names = append(names, servicePortName(p))
+	}
+	return nil, nil, missingPort(fmt.Sprintf("service %q", t.name), t.port, names)
+}
+
+func servicePortName(p v1.ServicePort) string {
+	if p.Name != "" {
+		return p.Name
+	}
+	return fmt.Sprint(p.Port)
+}
+
+// targetPod is the pod of a pod, deploy or sts target
+func targetPod(client kubernetes.Interface, namespace string, t kubeTarget) (*v1.Pod, error) {
+	if t.kind == "pod" {
+		return client.CoreV1().Pods(namespace).Get(context.TODO(), t.name, metav1.GetOptions{})
+	}
+	return workloadPod(client, namespace, t)
+}
+
+// workloadPod picks a ready pod of a deployment or statefulset, the first by
+// name. sts/<name>-<ordinal> picks that pod of the statefulset.
+func workloadPod(client kubernetes.Interface, namespace string, t kubeTarget) (*v1.Pod, error) {
+	var selector *metav1.LabelSelector
+	if t.kind == "deploy" {
+		deployment, err := client.AppsV1().Deployments(namespace).Get(context.TODO(), t.name, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		selector = deployment.Spec.Selector
+	} else {
+		sts, err := client.AppsV1().StatefulSets(namespace).Get(context.TODO(), t.name, metav1.GetOptions{})
+		if k8serrors.IsNotFound(err) {
+			if i := strings.LastIndex(t.name, "-"); i != -1 {
+				if _, aErr := strconv.Atoi(t.name[i+1:]); aErr == nil {
+					return ordinalPod(client, namespace, t.name[:i], t.name)
+				}
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		selector = sts.Spec.Selector
+	}
+	s, err := metav1.LabelSelectorAsSelector(selector)
+	if err != nil {
+		return nil, err
+	}
+	pods, err := client.CoreV1().Pods(namespace).List(context.TODO(), metav1.ListOptions{LabelSelector: s.String()})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(pods.Items, func(i, j int) bool { return pods.Items[i].Name < pods.Items[j].Name })
+	for i := range pods.Items {
+		if pod := &pods.Items[i]; pod.DeletionTimestamp == nil && podReady(pod) {
+			return pod, nil
+		}
+	}
+	return nil, fmt.Errorf("%s/%s has no ready pods", t.kind, t.name)
+}
+
+// ordinalPod gets a pod of a statefulset by its name, e.g. kafka-0
+func ordinalPod(client kubernetes.Interface, namespace string, sts string, name string) (*v1.Pod, error) {
+	if _, err := client.AppsV1().StatefulSets(namespace).Get(context.TODO(), sts, metav1.GetOptions{}); err != nil {
+		return nil, err
+	}
+	pod, err := client.CoreV1().Pods(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	if !podReady(pod) {
+		return nil, fmt.Errorf("pod %q of statefulset %q is not ready", name, sts)
+	}
+	return pod, nil
+}
+
+func resolvePodTarget(pod *v1.Pod, t kubeTarget, defaultPort uint) (string, uint, error) {
+	if pod.Status.PodIP == "" {
+		return "", 0, fmt.Errorf("pod %q has no ip yet, it is %s", pod.Name, pod.Status.Phase)
+	}
+	if port, err := strconv.ParseUint(t.port, 10, 16); err == nil && port != 0 {
+		return pod.Status.PodIP, uint(port), nil
+	}
+	var ports []v1.ContainerPort
+	var names []string
+	for _, c := range pod.Spec.Containers {
+		for _, p := range c.Ports {
+			ports = append(ports, p)
+			if p.Name != "" {
+				names = append(names, p.Name)
+			} else {
+				names = append(names, fmt.Sprint(p.ContainerPort))
+			}
+		}
+	}
+	for _, p := range ports {
+		if (t.port != "" && t.port == p.Name) || (t.port == "" && (len(ports) == 1 || uint(p.ContainerPort) == defaultPort)) {
+			return pod.Status.PodIP, uint(p.ContainerPort), nil
+		}
+	}
+	// a pod that declares no ports still listens on the default port
+	if t.port == "" && len(ports) == 0 {
+		return pod.Status.PodIP, defaultPort, nil
+	}
+	return "", 0, missingPort(fmt.Sprintf("pod %q", pod.Name), t.port, names)
+}
+
+func missingPort(object string, port string, names []string) error {
+	if port == "" {
+		return fmt.Errorf("%s has several ports, pick one of %s", object, strings.Join(names, ", "))
+	}
+	return fmt.Errorf("%s has no port %q, it has %s", object, port, strings.Join(names, ", "))
+}
+
+// resolveKubeTargets replaces kubectl style targets of a relay, including its
+// failover targets, with the addresses they point to. A service without a
+// cluster ip and any service with balance are followed instead, connections
+// go to its endpoints as they change. A pod, also of a deploy or sts, is
+// forwarded to without a relay pod.
+func resolveKubeTargets(rc *relayClient, namespace string, opts *relayOptions) error {
+	if t, ok := parseKubeTarget(opts.clusterHost); ok && t.kind == "svc" && len(opts.failover) == 0 && opts.protocol != PROTOCOL_UDP && !opts.ftp && opts.attach == "" && opts.via == "" && opts.engine != ENGINE_GO_RELAY {
+		svc, port, err := targetServicePort(rc.clientset, namespace, t, opts.clusterPort)
+		if err != nil {
+			return err
+		}
+		if opts.balance || svc.Spec.ClusterIP == "" || svc.Spec.ClusterIP == v1.ClusterIPNone {
+			opts.endpoints, err = watchEndpoints(rc, namespace, t.name, port, opts.balance, opts.log)
+			if err != nil {
+				return err
+			}
+			opts.clusterHost, opts.clusterPort = t.name, uint(port.Port)
+			opts.log.printf("Following the endpoints of service %q\n", t.name)
+			return nil
+		}
+	}
+	if opts.balance {
+		return fmt.Errorf("--balance needs a svc/<name> target")
+	}
+	// a pod is forwarded to directly, socat in a relay pod adds nothing
+	if t, ok := parseKubeTarget(opts.clusterHost); ok && t.kind != "svc" && len(opts.failover) == 0 && opts.protocol != PROTOCOL_UDP && !opts.ftp && !opts.reverse && opts.dns.address == "" && opts.attach == "" && opts.via == "" {
+		pod, err := targetPod(rc.clientset, namespace, t)
+		if err != nil {
+			return err
+		}
+		host, port, err := resolvePodTarget(pod, t, opts.clusterPort)
+		if err != nil {
+			return err
+		}
+		opts.log.printf("Forwarding %s to pod %q directly, without a relay pod\n", opts.clusterHost, pod.Name)
+		opts.clusterHost, opts.clusterPort, opts.targetPod = host, port, pod.Name
+		return nil
+	}
+	if t, ok := parseKubeTarget(opts.clusterHost); ok {
+		host, port, err := resolveKubeTarget(rc.clientset, namespace, t, opts.clusterPort)
+		if err != nil {
+			return err
+		}
+		opts.log.printf("Resolved %s to %s\n", opts.clusterHost, joinHostPort(host, port))
+		opts.clusterHost, opts.clusterPort = host, port
+	}
+	for i, f := range opts.failover {
+		t, ok := parseKubeTarget(f)
+		if !ok {
+			continue
+		}
+		host, port, err := resolveKubeTarget(rc.clientset, namespace, t, opts.clusterPort)
+		if err != nil {
+			return err
+		}
+		opts.failover[i] = joinHostPort(host, port)
+		opts.log.printf("Resolved %s to %s\n", f, opts.failover[i])
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/urfave/cli/v2"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/duration"
+)
+
+// list prints the relay pods of everyone in a namespace, or in all of them
+func list(kube *kubeOptions, allNamespaces bool) error {
+	namespace, rc, err := connect(kube)
+	if err != nil {
+		return err
+	}
+	if allNamespaces {
+		namespace = metav1.NamespaceAll
+	}
+	selector := fmt.Sprintf("%s=%s", LABEL_MANAGED_BY, POD_NAME)
+	pods, err := rc.clientset.CoreV1().Pods(namespace).List(context.TODO(), metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return err
+	}
+	if len(pods.Items) == 0 {
+		fmt.Println("No relay pods found")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAMESPACE\tNAME\tOWNER\tTARGET\tSTATUS\tAGE")
+	for _, pod := range pods.Items {
+		owner := "-"
+		if user := pod.Labels[LABEL_USER]; user != "" {
+			owner = fmt.Sprintf("%s@%s", user, pod.Labels[LABEL_HOST])
+		}
+		target := pod.Annotations[ANNOTATION_TARGET]
+		if target == "" {
+			target = "-"
+		}
+		age := duration.HumanDuration(time.Since(pod.CreationTimestamp.Time))
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", pod.Namespace, pod.Name, owner, target, pod.Status.Phase, age)
+	}
+	return w.Flush()
+}
+
+func listCommand(kube *kubeOptions) *cli.Command {
+	var allNamespaces bool
+
+	return &cli.Command{
+		Name:  "list",
+		Usage: "list the relay pods of everyone in the namespace, with their owner and target",
+		Flags: []cli.Flag{
+			&cli.BoolFlag{
+				Name:        "all-namespaces",
+				Aliases:     []string{"A"},
+				Usage:       "list the relay pods of all namespaces",
+				Destination: &allNamespaces,
+			},
+		},
+		Action: func(c *cli.Context) error {
+			return list(kube, allNamespaces)
+		},
+	}
+}
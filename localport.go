@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+)
+
+const LOOPBACK_ADDRESS = "127.0.0.1"
+const PRIVILEGED_PORTS = 1024
+const FALLBACK_PORT_OFFSET = 10000
+
+// parseLocalAddress checks the address the local side listens on, localhost
+// stands for the loopback address
+func parseLocalAddress(address string) (string, error) {
+	if address == "localhost" {
+		return LOOPBACK_ADDRESS, nil
+	}
+	address = trimBrackets(address)
+	if net.ParseIP(address) == nil {
+		return "", fmt.Errorf("invalid address %q, expected localhost or an ip", address)
+	}
+	return address, nil
+}
+
+// dialAddress is where a listener on the address is reached locally, one on
+// all addresses is reached on loopback
+func dialAddress(address string) string {
+	ip := net.ParseIP(address)
+	switch {
+	case ip == nil || !ip.IsUnspecified():
+		return address
+	case ip.To4() == nil:
+		return "::1"
+	}
+	return LOOPBACK_ADDRESS
+}
+
+func tryListen(address string, port uint) error {
+	listener, err := net.Listen("tcp", net.JoinHostPort(address, fmt.Sprint(port)))
+	if err != nil {
+		return err
+	}
+	return listener.Close()
+}
+
+// checkLocalPort verifies the local port can be bound before any pod is created.
+// A privileged port fails with a precise error, or is swapped for an unprivileged
+// one when fallback is set.
+func checkLocalPort(address string, port uint, fallback bool) (uint, error) {
+	err := tryListen(address, port)
+	if err == nil {
+		return port, nil
+	}
+
+	if errors.Is(err, syscall.EADDRINUSE) {
+		return 0, &relayError{
+			Code:       "LocalPortInUse",
+			Reason:     fmt.Sprintf("Local port %d is already in use on %s", port, address),
+			Suggestion: "pick another port with --local-port",
+			exitCode:   1,
+		}
+	}
+	if !errors.Is(err, syscall.EACCES) || port >= PRIVILEGED_PORTS {
+		return 0, err
+	}
+
+	exe, _ := os.Executable()
+	if !fallback {
+		return 0, &relayError{
+			Code:   "PrivilegedPort",
+			Reason: fmt.Sprintf("Binding local port %d requires privileges", port),
+			Suggestion: fmt.Sprintf(
+				"run as root, allow it with 'sudo setcap cap_net_bind_service=+ep %s' or use --privileged-port-fallback",
+				exe,
+			),
+			exitCode: 1,
+		}
+	}
+
+	candidate := port + FALLBACK_PORT_OFFSET
+	if tryListen(address, candidate) != nil {
+		candidate = 0
+		listener, err := net.Listen("tcp", net.JoinHostPort(address, "0"))
+		if err != nil {
+			return 0, err
+		}
+		candidate = uint(listener.Addr().(*net.TCPAddr).Port)
+		listener.Close()
+	}
+	fmt.Printf("Local port %d requires privileges, using %d instead, point your client at localhost:%d\n", port, candidate, candidate)
+	return candidate, nil
+}
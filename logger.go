@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/term"
+)
+
+var logColors = []string{"36", "33", "32", "35", "34", "31"}
+
+var logMu sync.Mutex
+
+// logger prints the output of a tunnel. With several tunnels every line is
+// prefixed with the aligned and, on a terminal, colored tunnel name, like
+// docker-compose does. A nil logger prints plain lines to stdout.
+type logger struct {
+	prefix string
+	out    io.Writer
+}
+
+// tunnelLoggers creates the prefixed loggers of tunnels running side by side
+func tunnelLoggers(names []string) map[string]*logger {
+	width := 0
+	for _, name := range names {
+		if len(name) > width {
+			width = len(name)
+		}
+	}
+	loggers := map[string]*logger{}
+	for i, name := range names {
+		loggers[name] = newLogger(name, i, width)
+	}
+	return loggers
+}
+
+// newLogger creates the logger of the i-th tunnel, padding its name to width
+func newLogger(name string, i int, width int) *logger {
+	prefix := fmt.Sprintf("%-*s |", width, name)
+	if term.IsTerminal(int(os.Stdout.Fd())) && os.Getenv("NO_COLOR") == "" {
+		prefix = fmt.Sprintf("\033[%sm%s\033[0m", logColors[i%len(logColors)], prefix)
+	}
+	return &logger{prefix: prefix}
+}
+
+func (l *logger) prefixed() bool {
+	return l != nil && l.prefix != ""
+}
+
+// writer is where the logger prints, stdout unless out is set
+func (l *logger) writer() io.Writer {
+	if l == nil || l.out == nil {
+		return os.Stdout
+	}
+	return l.out
+}
+
+func (l *logger) printf(format string, a ...interface{}) {
+	if !l.prefixed() {
+		fmt.Fprintf(l.writer(), format, a...)
+		return
+	}
+	text := strings.TrimSuffix(fmt.Sprintf(format, a...), "\n")
+	logMu.Lock()
+	defer logMu.Unlock()
+	for _, line := range strings.Split(text, "\n") {
+		fmt.Fprintf(l.writer(), "%s %s\n", l.prefix, line)
+	}
+}
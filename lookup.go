@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/urfave/cli/v2"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const LOOKUP_NAME = POD_NAME + "-dns"
+
+var lookupTypes = map[string]dnsmessage.Type{
+	"A":     dnsmessage.TypeA,
+	"AAAA":  dnsmessage.TypeAAAA,
+	"CNAME": dnsmessage.TypeCNAME,
+	"MX":    dnsmessage.TypeMX,
+	"NS":    dnsmessage.TypeNS,
+	"PTR":   dnsmessage.TypePTR,
+	"SOA":   dnsmessage.TypeSOA,
+	"SRV":   dnsmessage.TypeSRV,
+	"TXT":   dnsmessage.TypeTXT,
+}
+
+type lookupOptions struct {
+	name     string
+	types    []dnsmessage.Type
+	server   string
+	newPod   bool
+	podImage string
+	log      *logger
+}
+
+// resolvConf is what a pod resolves names with
+type resolvConf struct {
+	nameservers []string
+	search      []string
+	ndots       int
+}
+
+func parseResolvConf(s string) resolvConf {
+	conf := resolvConf{ndots: 1}
+	for _, line := range strings.Split(s, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		switch fields[0] {
+		case "nameserver":
+			conf.nameservers = append(conf.nameservers, fields[1])
+		case "search":
+			conf.search = fields[1:]
+		case "options":
+			for _, o := range fields[1:] {
+				if n, err := strconv.Atoi(strings.TrimPrefix(o, "ndots:")); strings.HasPrefix(o, "ndots:") && err == nil {
+					conf.ndots = n
+				}
+			}
+		}
+	}
+	return conf
+}
+
+// candidates are the names a pod tries for a name, in order, like its resolver
+// does with the search domains
+func (c resolvConf) candidates(name string) []string {
+	if strings.HasSuffix(name, ".") {
+		return []string{name}
+	}
+	var names []string
+	dots := strings.Count(name, ".")
+	if dots >= c.ndots {
+		names = append(names, name+".")
+	}
+	for _, s := range c.search {
+		names = append(names, fmt.Sprintf("%s.%s.", name, strings.Trim(s, ".")))
+	}
+	if dots < c.ndots {
+		names = append(names, name+".")
+	}
+	return names
+}
+
+// query asks the cluster dns for one type of records of a name
+func query(relay *dnsRelay, name string, kind dnsmessage.Type) (dnsmessage.Message, error) {
+	qname, err := dnsmessage.NewName(name)
+	if err != nil {
+		return dnsmessage.Message{}, err
+	}
+	msg := dnsmessage.Message{
+		Header:    dnsmessage.Header{RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: qname, Type: kind, Class: dnsmessage.ClassINET}},
+	}
+	packed, err := msg.Pack()
+	if err != nil {
+		return dnsmessage.Message{}, err
+	}
+	var reply dnsmessage.Message
+	err = reply.Unpack(relay.resolve(packed))
+	return reply, err
+}
+
+// rcodeName is the name dig shows for a response code
+func rcodeName(rcode dnsmessage.RCode) string {
+	switch rcode {
+	case dnsmessage.RCodeNameError:
+		return "NXDOMAIN"
+	case dnsmessage.RCodeServerFailure:
+		return "SERVFAIL"
+	case dnsmessage.RCodeRefused:
+		return "REFUSED"
+	}
+	return strings.ToUpper(strings.TrimPrefix(rcode.String(), "RCode"))
+}
+
+// recordData is the data column of a record, in the notation of dig
+func recordData(body dnsmessage.ResourceBody) string {
+	switch b := body.(type) {
+	case *dnsmessage.AResource:
+		return net.IP(b.A[:]).String()
+	case *dnsmessage.AAAAResource:
+		return net.IP(b.AAAA[:]).String()
+	case *dnsmessage.CNAMEResource:
+		return b.CNAME.String()
+	case *dnsmessage.MXResource:
+		return fmt.Sprintf("%d %s", b.Pref, b.MX)
+	case *dnsmessage.NSResource:
+		return b.NS.String()
+	case *dnsmessage.PTRResource:
+		return b.PTR.String()
+	case *dnsmessage.SOAResource:
+		return fmt.Sprintf("%s %s %d", b.NS, b.MBox, b.Serial)
+	case *dnsmessage.SRVResource:
+		return fmt.Sprintf("%d %d %d %s", b.Priority, b.Weight, b.Port, b.Target)
+	case *dnsmessage.TXTResource:
+		return strconv.Quote(strings.Join(b.TXT, ""))
+	}
+	return body.GoString()
+}
+
+// lookup resolves a name with the cluster dns from a relay pod, with the
+// nameserver and search domains of the pod, and locally to compare
+func lookup(kube *kubeOptions, opts lookupOptions) error {
+	namespace, rc, err := connect(kube)
+	if err != nil {
+		return err
+	}
+	name, done, err := probeFrom(rc, namespace, probePod(LOOKUP_NAME, opts.podImage, opts.name), opts.newPod, opts.log)
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	out := new(bytes.Buffer)
+	if err := execStream(rc, namespace, name, []string{"cat", "/etc/resolv.conf"}, nil, out); err != nil {
+		return err
+	}
+	conf := parseResolvConf(out.String())
+	server := opts.server
+	if server == "" && len(conf.nameservers) != 0 {
+		server = net.JoinHostPort(conf.nameservers[0], "53")
+	}
+	if server == "" {
+		server = DNS_UPSTREAM
+	}
+	relay := &dnsRelay{
+		rc:        rc,
+		namespace: namespace,
+		pod:       name,
+		upstream:  server,
+		log:       opts.log,
+		pending:   map[uint16]chan []byte{},
+	}
+
+	var found string
+	var answers []dnsmessage.Resource
+	rcode := dnsmessage.RCodeNameError
+	for _, candidate := range conf.candidates(opts.name) {
+		for _, kind := range opts.types {
+			reply, err := query(relay, candidate, kind)
+			if err != nil {
+				return err
+			}
+			if reply.RCode != dnsmessage.RCodeSuccess {
+				if reply.RCode != dnsmessage.RCodeNameError {
+					rcode = reply.RCode
+				}
+				continue
+			}
+			// the name exists, records of other types may still be missing
+			found, rcode = candidate, dnsmessage.RCodeSuccess
+			answers = append(answers, reply.Answers...)
+		}
+		if found != "" {
+			break
+		}
+	}
+
+	if found != "" {
+		fmt.Printf("%s resolves in the cluster as %s through %s\n", opts.name, found, server)
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "NAME\tTYPE\tTTL\tDATA")
+		seen := map[string]bool{}
+		for _, a := range answers {
+			kind := strings.TrimPrefix(a.Header.Type.String(), "Type")
+			line := fmt.Sprintf("%s\t%s\t%d\t%s\n", a.Header.Name, kind, a.Header.TTL, recordData(a.Body))
+			// a cname comes with the answers of every type
+			if !seen[line] {
+				seen[line] = true
+				fmt.Fprint(w, line)
+			}
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+	}
+
+	local, localErr := net.DefaultResolver.LookupHost(context.TODO(), opts.name)
+	if localErr != nil {
+		fmt.Printf("Locally it does not resolve: %s\n", localErr)
+	} else {
+		fmt.Printf("Locally it resolves to %s\n", strings.Join(local, ", "))
+	}
+
+	if found == "" {
+		return &relayError{
+			Code:       "NameNotResolved",
+			Reason:     fmt.Sprintf("%s does not resolve in the cluster through %s: %s", opts.name, server, rcodeName(rcode)),
+			Resource:   fmt.Sprintf("pods/%s", name),
+			Suggestion: "check the name and namespace, names of services are <service>.<namespace>.svc",
+			exitCode:   EXIT_ERROR,
+		}
+	}
+	return nil
+}
+
+func dnsCommand(kube *kubeOptions) *cli.Command {
+	opts := lookupOptions{log: &logger{out: os.Stderr}}
+	var quiet bool
+
+	return &cli.Command{
+		Name:      "dns",
+		Usage:     "resolve a name with the cluster dns from a relay pod and print its records",
+		ArgsUsage: "<name>",
+		Flags: []cli.Flag{
+			&cli.StringSliceFlag{
+				Name:    "type",
+				Aliases: []string{"t"},
+				Usage:   "record types to query, e.g. SRV or TXT, repeat it for several",
+				Value:   cli.NewStringSlice("A", "AAAA"),
+			},
+			&cli.StringFlag{
+				Name:        "server",
+				Usage:       "nameserver to ask, <host:port>, the one of the relay pod by default",
+				Destination: &opts.server,
+			},
+			&cli.BoolFlag{
+				Name:        "new-pod",
+				Usage:       "resolve from a new relay pod, instead of a running one of yours",
+				Destination: &opts.newPod,
+			},
+			&cli.StringFlag{
+				Name:        "pod-image",
+				Usage:       "image of a new relay pod, it needs socat",
+				Value:       POD_IMAGE,
+				Destination: &opts.podImage,
+			},
+			&cli.BoolFlag{
+				Name:        "quiet",
+				Aliases:     []string{"q"},
+				Usage:       "do not print progress to stderr",
+				Destination: &quiet,
+			},
+		},
+		Action: func(c *cli.Context) error {
+			if !c.Args().Present() {
+				return fmt.Errorf("missing name")
+			}
+			opts.name = c.Args().First()
+			for _, t := range c.StringSlice("type") {
+				kind, ok := lookupTypes[strings.ToUpper(t)]
+				if !ok {
+					return fmt.Errorf("unknown record type %q", t)
+				}
+				opts.types = append(opts.types, kind)
+			}
+			if opts.server != "" {
+				if _, _, err := net.SplitHostPort(opts.server); err != nil {
+					return fmt.Errorf("invalid --server %q, expected <host>:<port>", opts.server)
+				}
+			}
+			if quiet {
+				opts.log.out = io.Discard
+			}
+			return lookup(kube, opts)
+		},
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+)
+
+// loopbackAlias is the address of the i-th tunnel, so every tunnel can keep
+// the natural port of its service.
+func loopbackAlias(i int) (string, error) {
+	if i > 252 {
+		return "", fmt.Errorf("too many tunnels for loopback aliases")
+	}
+	return fmt.Sprintf("127.0.0.%d", i+2), nil
+}
+
+// ensureLoopbackAlias makes an alias address bindable. Linux routes all of
+// 127.0.0.0/8 to lo, macOS needs an alias on lo0, which is added with sudo.
+func ensureLoopbackAlias(address string) error {
+	if address == LOOPBACK_ADDRESS || runtime.GOOS != "darwin" {
+		return nil
+	}
+	if listener, err := net.Listen("tcp", net.JoinHostPort(address, "0")); err == nil {
+		return listener.Close()
+	}
+	fmt.Printf("Adding loopback alias %s to lo0, this needs sudo\n", address)
+	cmd := exec.Command("sudo", "ifconfig", "lo0", "alias", address, "up")
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("adding loopback alias %s: %w", address, err)
+	}
+	return nil
+}
@@ -4,167 +4,872 @@ import (
 	"bytes"
 	"context"
 	"fmt"
-	"net/http"
-	"net/url"
+	"net"
 	"os"
 	"os/signal"
+	"runtime"
 	"strings"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/urfave/cli/v2"
 	apiv1 "k8s.io/api/core/v1"
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
 	"k8s.io/client-go/tools/portforward"
-	"k8s.io/client-go/transport/spdy"
 )
 
 const POD_NAME = "kube-relay"
 const POD_IMAGE = "alpine/socat:1.8.0.0"
+const CONTAINER_NAME = "socat"
+const RELAY_PORT = 9000
 
-func forward(namespace string, config *rest.Config, localPort uint) error {
-	roundTripper, upgrader, err := spdy.RoundTripperFor(config)
+// forward blocks while forwarding the local port to the relay pod, a local port
+// of 0 picks a free one for an internal hop, which is passed to ready once the
+// forward is up. An error returned by ready ends the forward. A lost
+// connection to the pod ends it without an error.
+func forward(rc *relayClient, namespace string, name string, localPort uint, remotePort int, ready func(uint) error) error {
+	return forwardUntil(rc, namespace, name, localPort, remotePort, nil, ready)
+}
+
+// forwardUntil is forward that also ends without an error once stop is closed
+func forwardUntil(rc *relayClient, namespace string, name string, localPort uint, remotePort int, stop <-chan struct{}, ready func(uint) error) error {
+	dialer, err := rc.dialer(rc.podURL(namespace, name, "portforward"))
 	if err != nil {
 		return err
 	}
 
-	path := fmt.Sprintf("/api/v1/namespaces/%s/pods/%s/portforward", namespace, POD_NAME)
-	hostIP := strings.TrimLeft(config.Host, "htps:/")
-	serverURL := url.URL{Scheme: "https", Path: path, Host: hostIP}
-
-	dialer := spdy.NewDialer(upgrader, &http.Client{Transport: roundTripper}, http.MethodPost, &serverURL)
-
 	stopChan, readyChan := make(chan struct{}, 1), make(chan struct{}, 1)
 	out, errOut := new(bytes.Buffer), new(bytes.Buffer)
 
-	ports := fmt.Sprintf("%d:9000", localPort)
+	ports := fmt.Sprintf("%d:%d", localPort, remotePort)
 	forwarder, err := portforward.New(dialer, []string{ports}, stopChan, readyChan, out, errOut)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
+	var readyErr error
+	var stopOnce sync.Once
+	forwarding, announced := make(chan struct{}), make(chan struct{})
 	go func() {
-		for range readyChan { // Kubernetes will close this channel when it has something to tell us.
+		select {
+		case <-stop:
+			stopOnce.Do(func() { close(stopChan) })
+		case <-forwarding:
 		}
-		if len(errOut.String()) != 0 {
-			panic(errOut.String())
-		} else if len(out.String()) != 0 {
+	}()
+	go func() {
+		defer close(announced)
+		select {
+		case <-readyChan: // Kubernetes will close this channel when it has something to tell us.
+		case <-forwarding:
+			return
+		}
+		// e.g. one of ipv4 and ipv6 loopback failed to listen, the other one is up
+		if errOut.Len() != 0 {
+			rc.streamLog("forward to port %d: %s", remotePort, strings.TrimSpace(errOut.String()))
+		}
+		if out.Len() != 0 && localPort != 0 {
 			print(out.String())
 		}
+		if ready != nil {
+			ports, err := forwarder.GetPorts()
+			if err != nil || len(ports) == 0 {
+				readyErr = fmt.Errorf("forward to port %d is not listening: %s", remotePort, strings.TrimSpace(errOut.String()))
+			} else {
+				readyErr = ready(uint(ports[0].Local))
+			}
+			if readyErr != nil {
+				stopOnce.Do(func() { close(stopChan) })
+			}
+		}
 	}()
 
-	return forwarder.ForwardPorts()
+	err = forwarder.ForwardPorts()
+	close(forwarding)
+	<-announced
+	if readyErr != nil {
+		return readyErr
+	}
+	return err
+}
+
+// relayContainer runs socat listening on port and relaying to the cluster host
+func relayContainer(name string, opts relayOptions, port int) apiv1.Container {
+	if opts.engine == ENGINE_GO_RELAY {
+		return goRelayContainer(name, port, []relayOptions{opts})
+	}
+	container := apiv1.Container{
+		Name:  name,
+		Image: opts.podImage,
+		Args: []string{
+			fmt.Sprintf("TCP-LISTEN:%d,fork", port),
+			socatAddress(PROTOCOL_TCP, opts.target()),
+		},
+		ImagePullPolicy: opts.imagePullPolicy,
+		Resources:       opts.resources,
+		SecurityContext: containerSecurity(),
+	}
+	// proxies and relays following the endpoints of a service exec socat per
+	// connection, the relay container only idles
+	if opts.proxy != "" || opts.endpoints != nil {
+		container.Args[1] = "OPEN:/dev/null"
+	}
+	if opts.reverse {
+		container.Args = reverseArgs(port, opts.clusterPort)
+		container.Ports = []apiv1.ContainerPort{{ContainerPort: int32(opts.clusterPort)}}
+	}
+	if opts.remoteSocket != "" {
+		container.Args[1] = fmt.Sprintf("UNIX-CONNECT:%s", opts.remoteSocket)
+	}
+	if opts.waitFor == WAIT_FOR_CONDITION {
+		container.ReadinessProbe = &apiv1.Probe{
+			ProbeHandler:  apiv1.ProbeHandler{TCPSocket: &apiv1.TCPSocketAction{Port: intstr.FromInt(port)}},
+			PeriodSeconds: 1,
+		}
+	}
+	if opts.hostNetwork {
+		hostListen(&container)
+	}
+	container.Lifecycle = drainLifecycle()
+	return container
 }
 
-func spawn(client kubernetes.Interface, namespace string, host string, port uint, image string) (string, error) {
-	manifest := &apiv1.Pod{
+// relayPod is the manifest of a relay pod, its name is generated from name so
+// relays of several users or shells don't collide
+func relayPod(name string, instance string, drainTimeout time.Duration, containers ...apiv1.Container) *apiv1.Pod {
+	labels := ownerLabels()
+	labels[LABEL_NAME] = labelValue(name)
+	labels[LABEL_INSTANCE] = instance
+	// socat needs no api access
+	automount := false
+	return &apiv1.Pod{
 		ObjectMeta: metav1.ObjectMeta{
-			Name: POD_NAME,
+			GenerateName: name + "-",
+			Labels:       labels,
 		},
 		Spec: apiv1.PodSpec{
-			Containers: []apiv1.Container{
-				{
-					Name:  "socat",
-					Image: image,
-					Args: []string{
-						"TCP-LISTEN:9000,fork",
-						fmt.Sprintf("TCP:%s:%d", host, port),
-					},
-				},
-			},
+			Containers:                    containers,
+			TerminationGracePeriodSeconds: terminationGrace(drainTimeout),
+			SecurityContext:               podSecurity(),
+			AutomountServiceAccountToken:  &automount,
 		},
 	}
+}
+
+// relayManifest is the relay pod of the options
+func relayManifest(opts relayOptions) (*apiv1.Pod, error) {
+	port := opts.relayPort()
+	containers := []apiv1.Container{relayContainer(CONTAINER_NAME, opts, port)}
+	for i, t := range opts.targets()[1:] {
+		containers = append(containers, relayContainer(fmt.Sprintf("%s-failover-%d", CONTAINER_NAME, i+1), t, port+i+1))
+	}
+	// the go relay server serves the failover targets too
+	if opts.engine == ENGINE_GO_RELAY {
+		containers = []apiv1.Container{goRelayContainer(CONTAINER_NAME, port, opts.targets())}
+	}
+	manifest := relayPod(opts.name, opts.instance, opts.drainTimeout, containers...)
+	if opts.proxy == "" && !opts.reverse {
+		manifest.Labels[LABEL_TARGET] = labelValue(opts.target())
+		manifest.Annotations = map[string]string{ANNOTATION_TARGET: opts.target()}
+	}
+	if opts.reverse {
+		allowPort(manifest, opts.clusterPort)
+	}
+	if opts.remoteSocket != "" {
+		mountSocket(manifest, opts.remoteSocket)
+	}
+	manifest.Spec.NodeName = opts.node
+	if opts.hostNetwork {
+		hostNetwork(manifest)
+	}
+	return applyPodOptions(manifest, opts)
+}
+
+// applyPodOptions sets the pod flags of the options on a relay pod, its
+// labels, annotations, placement and the rest of the spec
+func applyPodOptions(manifest *apiv1.Pod, opts relayOptions) (*apiv1.Pod, error) {
+	for k, v := range opts.labels {
+		manifest.Labels[k] = v
+	}
+	for k, v := range opts.annotations {
+		if manifest.Annotations == nil {
+			manifest.Annotations = map[string]string{}
+		}
+		manifest.Annotations[k] = v
+	}
+	manifest.Spec.ActiveDeadlineSeconds = activeDeadline(opts.maxLifetime)
+	manifest.Spec.Affinity = opts.affinity
+	manifest.Spec.ImagePullSecrets = pullSecrets(opts.imagePullSecrets)
+	manifest.Spec.ServiceAccountName = opts.serviceAccount
+	manifest.Spec.PriorityClassName = opts.priorityClass
+	if opts.runtimeClass != "" {
+		manifest.Spec.RuntimeClassName = &opts.runtimeClass
+	}
+	manifest.Spec.NodeSelector = opts.nodeSelector
+	manifest.Spec.Tolerations = opts.tolerations
+	return opts.podOverrides.apply(manifest)
+}
+
+// podSpec is the spec of the relay pod, as far as it can be built
+func (opts relayOptions) podSpec() *apiv1.PodSpec {
+	manifest, err := relayManifest(opts)
+	if err != nil {
+		return &apiv1.PodSpec{}
+	}
+	return &manifest.Spec
+}
+
+func spawn(client kubernetes.Interface, namespace string, opts relayOptions, defaults *clusterDefaults) (string, error) {
+	manifest, err := relayManifest(opts)
+	if err != nil {
+		return "", err
+	}
+	return createPod(client, namespace, manifest, defaults, opts.log)
+}
+
+func createPod(client kubernetes.Interface, namespace string, manifest *apiv1.Pod, defaults *clusterDefaults, log *logger) (string, error) {
+	defaults.apply(manifest)
 	result, err := client.CoreV1().Pods(namespace).Create(context.TODO(), manifest, metav1.CreateOptions{})
 	if err != nil {
 		return "", err
 	}
 	name := result.GetObjectMeta().GetName()
-	fmt.Printf("Created pod %q\n", name)
+	log.printf("Created pod %q\n", name)
 	return name, nil
 }
 
-func cleanup(client kubernetes.Interface, namespace string) {
-	fmt.Printf("Delete pod %q\n", POD_NAME)
-	client.CoreV1().Pods(namespace).Delete(context.TODO(), POD_NAME, metav1.DeleteOptions{})
+// cleanup deletes the relay pod and waits while it drains its connections
+func cleanup(client kubernetes.Interface, namespace string, name string, log *logger) {
+	log.printf("Delete pod %q\n", name)
+	err := client.CoreV1().Pods(namespace).Delete(context.TODO(), name, metav1.DeleteOptions{})
+	if err == nil {
+		waitForDrain(client, namespace, name, log)
+	}
 }
 
-func wait(client kubernetes.Interface, namespace string, name string) error {
-	selector := fmt.Sprintf("metadata.name=%s", name)
-	podWatch, err := client.CoreV1().Pods(namespace).Watch(context.TODO(), metav1.ListOptions{FieldSelector: selector})
-	if err != nil {
-		return err
+// wait blocks until the relay pod is ready in the given mode, it fails if the
+// pod stays unschedulable for longer than scheduleTimeout.
+func wait(rc *relayClient, namespace string, name string, mode string, scheduleTimeout time.Duration, timeout time.Duration, log *logger) error {
+	updates, errs, cancel := rc.watchPod(namespace, name)
+	defer cancel()
+	if scheduleTimeout <= 0 {
+		scheduleTimeout = SCHEDULE_TIMEOUT
+	}
+	var expired <-chan time.Time
+	if timeout > 0 {
+		expired = time.After(timeout)
 	}
 
-	for event := range podWatch.ResultChan() {
-		p, ok := event.Object.(*v1.Pod)
-		if !ok {
-			return fmt.Errorf("unexpected type")
-		}
-		if p.Status.Phase == "Running" {
-			fmt.Printf("Pod %q is running\n", p.Name)
-			break
+	var pullProgress *progress
+	var lastHint string
+	var unschedulable <-chan time.Time
+	defer func() {
+		if pullProgress != nil {
+			pullProgress.stop()
 		}
+	}()
 
+	var p *v1.Pod
+	for {
+		select {
+		case err := <-errs:
+			return err
+		case <-unschedulable:
+			return unschedulableError(rc.clientset, p, scheduleTimeout)
+		case <-expired:
+			return startupTimeout(name, p, timeout)
+		case p = <-updates:
+		}
+		if pullProgress == nil {
+			pullProgress = startProgress(rc.clientset, namespace, name, p.UID, log)
+		}
+		pullProgress.observe(p)
+		if err := crashLoopError(rc.clientset, p); err != nil {
+			return err
+		}
+		if err := imagePullError(p); err != nil {
+			return err
+		}
+		if err := stoppedError(p); err != nil {
+			return err
+		}
+		if hint := schedulingHint(p); hint != "" {
+			if hint != lastHint {
+				pullProgress.printf("%s", hint)
+				lastHint = hint
+			}
+			if unschedulable == nil {
+				unschedulable = time.After(scheduleTimeout)
+			}
+		} else {
+			unschedulable = nil
+		}
+		if podReady(p) {
+			pullProgress.printf("Pod %q is %s (%s)\n", p.Name, readyState(mode), pullProgress.elapsed())
+			return nil
+		}
 	}
-	return nil
 }
 
-func run(localPort uint, clusterHost string, clusterPort uint, podImage string) error {
+// clientConfig loads the current context of the kubeconfig, in a pod without
+// one the service account of the pod
+func clientConfig(opts *kubeOptions) (string, *rest.Config, error) {
+	if inCluster(opts) {
+		config, err := rest.InClusterConfig()
+		if err != nil {
+			return "", nil, err
+		}
+		return inClusterNamespace(opts.namespace), config, nil
+	}
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	rules.ExplicitPath = opts.kubeconfig
 	kubeconfig := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
-		clientcmd.NewDefaultClientConfigLoadingRules(),
-		&clientcmd.ConfigOverrides{},
+		rules,
+		&clientcmd.ConfigOverrides{
+			CurrentContext: opts.context,
+			Context:        clientcmdapi.Context{Namespace: opts.namespace},
+		},
 	)
 
 	namespace, _, err := kubeconfig.Namespace()
 	if err != nil {
-		return err
+		return "", nil, err
 	}
 
 	// use the current context in kubeconfig
 	config, err := kubeconfig.ClientConfig()
 	if err != nil {
-		return err
+		return "", nil, err
+	}
+	return namespace, config, nil
+}
+
+func connect(opts *kubeOptions) (string, *relayClient, error) {
+	namespace, config, err := clientConfig(opts)
+	if err != nil {
+		return "", nil, err
+	}
+	err = resolveAPIHost(config, opts.apiResolve)
+	if err != nil {
+		return "", nil, err
 	}
 
 	// create the clientset
 	clientset, err := kubernetes.NewForConfig(config)
 	if err != nil {
+		return "", nil, err
+	}
+	rc, err := newRelayClient(config, clientset)
+	if err != nil {
+		return "", nil, err
+	}
+	if opts.debugStreams {
+		rc.enableStreamDebugging()
+	}
+	rc.transport, rc.keepalive = opts.transport, opts.keepalive
+	return namespace, rc, nil
+}
+
+// relayOptions describe a single relay
+type relayOptions struct {
+	name              string
+	namespace         string
+	localPort         uint
+	clusterHost       string
+	balance           bool
+	endpoints         *endpointWatcher
+	targetPod         string
+	clusterPort       uint
+	podImage          string
+	engine            string
+	mux               bool
+	streamPool        int
+	token             string
+	imageFallback     []string
+	resolver          string
+	ftp               bool
+	writeKubeconfig   string
+	kubeconfigCA      string
+	portFallback      bool
+	waitFor           string
+	probeCommand      string
+	namespaceFallback []string
+	createNamespace   bool
+	deleteNamespace   bool
+	retries           int
+	retryBackoff      time.Duration
+	drainTimeout      time.Duration
+	maxLifetime       time.Duration
+	waitTimeout       time.Duration
+	queueTimeout      time.Duration
+	localAddress      string
+	localSocket       string
+	localPipe         string
+	remoteSocket      string
+	node              string
+	hostNetwork       bool
+	hostPort          int
+	attach            string
+	via               string
+	viaContainer      string
+	disruptionBudget  bool
+	scheduleTimeout   time.Duration
+	near              string
+	affinity          *apiv1.Affinity
+	imagePullPolicy   apiv1.PullPolicy
+	serviceAccount    string
+	priorityClass     string
+	runtimeClass      string
+	labels            map[string]string
+	annotations       map[string]string
+	imagePullSecrets  []string
+	nodeSelector      map[string]string
+	tolerations       []apiv1.Toleration
+	failover          []string
+	log               *logger
+	session           *session
+	shutdown          *shutdown
+	stop              <-chan struct{}
+	direct            bool
+	protocol          string
+	proxy             string
+	reverse           bool
+	service           string
+	routes            []string
+	dns               dnsOptions
+	noRecreate        bool
+	instance          string
+	dryRun            string
+	podOverrides      *podOverrides
+	resources         apiv1.ResourceRequirements
+	command           []string
+}
+
+func run(kube *kubeOptions, opts relayOptions) error {
+	if opts.hostNetwork && opts.hostPort == 0 {
+		opts.hostPort = pickHostPort(len(opts.targets()))
+	}
+	if opts.dryRun != "" {
+		return dryRun(kube, opts, opts.dryRun)
+	}
+	namespace, rc, err := connect(kube)
+	if err != nil {
+		return err
+	}
+
+	if opts.resolver != "" {
+		target, err := resolveTarget(opts.resolver, opts.clusterHost)
+		if err != nil {
+			return err
+		}
+		opts.clusterHost = target.Host
+		if target.Port != 0 {
+			opts.clusterPort = target.Port
+		}
+		if target.Namespace != "" {
+			namespace = target.Namespace
+		}
+		fmt.Printf("Resolved target to %s in namespace %q\n", opts.target(), namespace)
+	}
+	targetNamespace := namespace
+	if opts.namespace != "" {
+		targetNamespace = opts.namespace
+	}
+	if err := resolveKubeTargets(rc, targetNamespace, &opts); err != nil {
 		return err
 	}
+	// a token is for a shared relay server, which relay pods of its own are not
+	if opts.token != "" && opts.targetPod == "" {
+		return fmt.Errorf("--token needs a pod/, deploy/ or sts/ target running a shared go relay server")
+	}
+
+	// a reverse relay connects to the local port instead of listening on it
+	if opts.localSocket != "" {
+		if err := checkLocalSocket(opts.localSocket); err != nil {
+			return err
+		}
+	} else if !opts.reverse && opts.localPipe == "" {
+		opts.localPort, err = checkLocalPort(opts.localAddress, opts.localPort, opts.portFallback)
+		if err != nil {
+			return err
+		}
+	}
+
+	if opts.near != "" {
+		ns := namespace
+		if opts.namespace != "" {
+			ns = opts.namespace
+		}
+		opts.affinity, err = nearAffinity(rc.clientset, ns, opts.near)
+		if err != nil {
+			return err
+		}
+	}
+
+	createdNamespace := false
+	if opts.createNamespace {
+		createdNamespace, err = ensureNamespace(rc.clientset, namespace)
+		if err != nil {
+			return err
+		}
+	}
+	removeNamespace := func() {
+		if createdNamespace && opts.deleteNamespace {
+			deleteNamespace(rc.clientset, namespace)
+		}
+	}
+	defer removeNamespace()
+
+	teardown := func() {
+		cleanupOwned(rc.clientset, namespace, opts.log)
+		for _, ns := range opts.namespaceFallback {
+			cleanupOwned(rc.clientset, ns, opts.log)
+		}
+		if opts.writeKubeconfig != "" {
+			os.Remove(opts.writeKubeconfig)
+		}
+		if opts.proxy == PROXY_ROUTE {
+			removeRoutes(opts.localPort)
+		}
+		removeNamespace()
+	}
 
+	// a wrapped command is not a session, the relay ends with it
+	var ready func(uint) error
+	if len(opts.command) != 0 {
+		ready = wrapCommand(opts.command, opts.localAddress, func(code int) {
+			teardown()
+			if code == 0 {
+				recordTelemetryExit(nil)
+			} else {
+				recordTelemetryExit(fmt.Errorf("the command exited with code %d", code))
+			}
+			os.Exit(code)
+		})
+	} else {
+		opts.session = newSession()
+	}
+	opts.shutdown = &shutdown{}
 	ctrlc := make(chan os.Signal, 1)
 	signal.Notify(ctrlc, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		<-ctrlc
-		println("received sigterm, triggering cleanup...")
-		cleanup(clientset, namespace)
+		println("received sigterm, draining connections, again to exit right away...")
+		go func() {
+			<-ctrlc
+			os.Exit(1)
+		}()
+		opts.session.keep()
+		opts.shutdown.drain(opts.drainTimeout, opts.log)
+		opts.shutdown.cleanup()
+		teardown()
+		recordTelemetryExit(errInterrupted)
 		os.Exit(1)
 	}()
 
-	name, err := spawn(clientset, namespace, clusterHost, clusterPort, podImage)
-	defer cleanup(clientset, namespace)
+	return relay(rc, namespace, opts, ready)
+}
+
+// relay creates the relay pod and blocks while forwarding to it, the pod is
+// deleted when the forward ends. ready is called once the tunnel is ready.
+func relay(rc *relayClient, namespace string, opts relayOptions, ready func(uint) error) error {
+	if opts.namespace != "" {
+		namespace = opts.namespace
+	}
+	if opts.instance == "" {
+		opts.instance = newInstance(opts.name)
+	}
+
+	var sessionKey string
+	tunnelReady := func(port uint) error {
+		if opts.waitFor == WAIT_FOR_PROBE {
+			if err := probeTunnel(opts.localAddress, port, opts.probeCommand, opts.log); err != nil {
+				return err
+			}
+		}
+		if opts.proxy == "" && !opts.reverse && opts.localSocket == "" && opts.localPipe == "" {
+			opts.session.add(sessionKey, sessionTunnel(opts, namespace, port))
+		}
+		if ready != nil {
+			return ready(port)
+		}
+		return nil
+	}
+
+	if opts.direct && opts.dns.address == "" && !opts.ftp && opts.proxy == "" && !opts.reverse && opts.protocol != PROTOCOL_UDP && len(opts.failover) == 0 && opts.endpoints == nil && directReachable(opts.target()) {
+		sessionKey = fmt.Sprintf("direct/%s", opts.name)
+		defer opts.session.remove(sessionKey)
+		return serveDirect(opts, tunnelReady)
+	}
+	if opts.targetPod != "" {
+		sessionKey = fmt.Sprintf("%s/%s", namespace, opts.targetPod)
+		defer opts.session.remove(sessionKey)
+		policy := retryPolicy{retries: opts.retries, backoff: opts.retryBackoff, log: opts.log}
+		return withExitCode(servePod(rc, namespace, opts, int(opts.clusterPort), policy, tunnelReady), EXIT_FORWARD_LOST)
+	}
+	if opts.via != "" {
+		sessionKey = fmt.Sprintf("%s/%s", namespace, opts.via)
+		defer opts.session.remove(sessionKey)
+		return withExitCode(serveVia(rc, namespace, opts, tunnelReady), EXIT_FORWARD_LOST)
+	}
+	if opts.attach != "" {
+		sessionKey = fmt.Sprintf("%s/%s", namespace, opts.attach)
+		defer opts.session.remove(sessionKey)
+		policy := retryPolicy{retries: opts.retries, backoff: opts.retryBackoff, log: opts.log}
+		return serveAttached(rc, namespace, opts, policy, tunnelReady)
+	}
+
+	err := checkNodes(rc.clientset, opts.podSpec())
 	if err != nil {
 		return err
 	}
-	err = wait(clientset, namespace, name)
-	if err != nil {
+	policy := retryPolicy{retries: opts.retries, backoff: opts.retryBackoff, log: opts.log}
+	var name string
+	primary := namespace
+	err = policy.do("create the relay pod", func() error {
+		var err error
+		namespace, name, err = spawnWithFallback(rc, primary, opts)
 		return err
+	})
+	if err != nil {
+		return withExitCode(err, EXIT_POD_CREATE)
 	}
-	err = forward(namespace, config, localPort)
+	var pod *podRef
+	defer func() {
+		current := name
+		if pod != nil {
+			current, _, _ = pod.current()
+		}
+		cleanup(rc.clientset, namespace, current, opts.log)
+	}()
+	sessionKey = fmt.Sprintf("%s/%s", namespace, name)
+	defer opts.session.remove(sessionKey)
+	// prepare readies a new relay pod, the first one as well as replacements
+	prepare := func(name string) error {
+		if opts.disruptionBudget {
+			err := createDisruptionBudget(rc.clientset, namespace, name, opts.log)
+			if err != nil {
+				return err
+			}
+		}
+		if opts.reverse && opts.service != "" {
+			err := createReverseService(rc.clientset, namespace, name, opts.service, opts.clusterPort, opts.log)
+			if err != nil {
+				return err
+			}
+		}
+		if opts.waitFor == WAIT_FOR_NONE {
+			return nil
+		}
+		images := opts.imageFallback
+		for {
+			err := policy.do("wait for the relay pod", func() error {
+				return wait(rc, namespace, name, opts.waitFor, opts.scheduleTimeout, opts.waitTimeout, opts.log)
+			})
+			if len(images) == 0 || !isImagePullError(err) {
+				if err != nil {
+					reportStartup(rc.clientset, namespace, name, opts.log)
+				}
+				return err
+			}
+			opts.log.printf("%s\n", err)
+			if err := switchImage(rc, namespace, name, images[0], opts.log); err != nil {
+				return err
+			}
+			// a replacement starts with the image that worked
+			opts.podImage, images = images[0], images[1:]
+			opts.imageFallback = images
+		}
+	}
+	if err = prepare(name); err != nil {
+		return withExitCode(err, EXIT_POD_START)
+	}
+	if opts.writeKubeconfig != "" {
+		err = writeTunnelKubeconfig(opts.writeKubeconfig, opts.localAddress, opts.localPort, opts.clusterHost, opts.kubeconfigCA)
+		if err != nil {
+			return err
+		}
+		defer os.Remove(opts.writeKubeconfig)
+	}
+	if opts.dns.address != "" {
+		resolver, err := serveDNS(rc, namespace, name, opts.dns, opts.log)
+		if err != nil {
+			return err
+		}
+		defer resolver.Close()
+	}
+
+	// without waiting the forward is retried until the pod accepts it
+	forwardPolicy := policy
+	if opts.waitFor == WAIT_FOR_NONE && forwardPolicy.retries < READY_PROBE_ATTEMPTS {
+		forwardPolicy = retryPolicy{retries: READY_PROBE_ATTEMPTS, backoff: READY_PROBE_INTERVAL, log: opts.log}
+	}
+
+	if opts.proxy != "" {
+		return withExitCode(serveProxy(rc, namespace, name, opts, tunnelReady), EXIT_FORWARD_LOST)
+	}
+	if opts.ftp {
+		err := forwardPolicy.do("establish the forward", func() error {
+			established := false
+			err := forwardFTP(rc, namespace, name, opts.localAddress, opts.localPort, opts.relayPort(), opts.clusterHost, func(port uint) error {
+				established = true
+				return tunnelReady(port)
+			})
+			if err != nil && established {
+				return permanentError{err}
+			}
+			return err
+		})
+		return withExitCode(err, EXIT_FORWARD_LOST)
+	}
+
+	// an evicted or deleted relay pod is replaced by one of the same instance,
+	// the objects it owns go with it and are created again
+	var respawn func(string) (string, error)
+	if !opts.noRecreate {
+		respawn = func(old string) (string, error) {
+			cleanup(rc.clientset, namespace, old, opts.log)
+			if opts.disruptionBudget {
+				rc.clientset.PolicyV1().PodDisruptionBudgets(namespace).Delete(context.TODO(), old, metav1.DeleteOptions{})
+			}
+			if opts.reverse && opts.service != "" {
+				rc.clientset.CoreV1().Services(namespace).Delete(context.TODO(), opts.service, metav1.DeleteOptions{})
+			}
+			var name string
+			err := policy.do("recreate the relay pod", func() error {
+				defaults, err := rc.clusterDefaults()
+				if err != nil {
+					return err
+				}
+				name, err = spawn(rc.clientset, namespace, opts, defaults)
+				return err
+			})
+			if err != nil {
+				return "", err
+			}
+			return name, prepare(name)
+		}
+	}
+	pod = newPodRef(rc, namespace, name, opts.log, respawn)
+	defer pod.close()
+	// closing stop ends the relay, e.g. as a reload removed its tunnel
+	if opts.stop != nil {
+		finished := make(chan struct{})
+		defer close(finished)
+		go func() {
+			select {
+			case <-opts.stop:
+				pod.end()
+			case <-finished:
+			}
+		}()
+	}
+
+	if opts.reverse {
+		return withExitCode(serveReverse(rc, pod, opts, forwardPolicy, tunnelReady), EXIT_FORWARD_LOST)
+	}
+	var remotePorts []int
+	for i := range opts.targets() {
+		remotePorts = append(remotePorts, opts.relayPort()+i)
+	}
+	return withExitCode(serveTunnel(rc, pod, remotePorts, opts, forwardPolicy, tunnelReady), EXIT_FORWARD_LOST)
+}
+
+// forwardFTP forwards the control port to a free local port and serves an ftp
+// aware proxy in front of it on the requested local port.
+func forwardFTP(rc *relayClient, namespace string, name string, localAddress string, localPort uint, remotePort int, clusterHost string, ready func(uint) error) error {
+	listener, err := net.Listen("tcp", joinHostPort(localAddress, localPort))
 	if err != nil {
 		return err
 	}
+	defer listener.Close()
+
+	proxy := &ftpProxy{
+		rc:           rc,
+		namespace:    namespace,
+		pod:          name,
+		host:         clusterHost,
+		localAddress: localAddress,
+	}
+	return forward(rc, namespace, name, 0, remotePort, func(port uint) error {
+		proxy.upstream = fmt.Sprintf("127.0.0.1:%d", port)
+		fmt.Printf("FTP proxy listening on %s\n", listener.Addr())
+		go proxy.serve(listener)
+		if ready != nil {
+			return ready(localPort)
+		}
+		return nil
+	})
+}
+
+// parsePodFlags parses the flags of the relay pod which take more than a
+// destination, the -L mappings and the tunnels of a config file share them
+func parsePodFlags(c *cli.Context, opts *relayOptions) error {
+	opts.imagePullSecrets = c.StringSlice("image-pull-secret")
+	var err error
+	if opts.imagePullPolicy, err = parsePullPolicy(c.String("image-pull-policy")); err != nil {
+		return err
+	}
+	if opts.labels, err = parseLabels(c.StringSlice("label")); err != nil {
+		return err
+	}
+	if opts.annotations, err = parseAnnotations(c.StringSlice("annotation")); err != nil {
+		return err
+	}
+	if opts.nodeSelector, err = parseNodeSelector(c.StringSlice("node-selector")); err != nil {
+		return err
+	}
+	for _, t := range c.StringSlice("toleration") {
+		toleration, err := parseToleration(t)
+		if err != nil {
+			return err
+		}
+		opts.tolerations = append(opts.tolerations, toleration)
+	}
+	if path := c.String("affinity"); path != "" {
+		if opts.affinity, err = loadAffinity(path); err != nil {
+			return err
+		}
+	}
+	resources := relayResources{}
+	for _, f := range resourceFlags {
+		resources[f.flag] = c.String(f.flag)
+	}
+	if opts.resources, err = resources.requirements(); err != nil {
+		return err
+	}
+	if path := c.String("pod-overrides"); path != "" {
+		if opts.podOverrides, err = loadPodOverrides(path); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
 func main() {
-	var localPort uint
-	var clusterPort uint
-	var clusterHost string
-	var podImage string
+	opts := relayOptions{name: POD_NAME, localAddress: LOOPBACK_ADDRESS}
+	var output string
+	var configPath string
+	var apiResolve cli.StringSlice
+	var namespaceFallback cli.StringSlice
+	var readStdin bool
+	var loopbackAliases bool
+	var include, exclude cli.StringSlice
+	var mappings cli.StringSlice
+	var routes cli.StringSlice
+	var dnsSuffixes cli.StringSlice
+	var admin adminOptions
+	statsd := statsdOptions{}
+	var clusterHosts cli.StringSlice
+	var podImages cli.StringSlice
+	kube := &kubeOptions{}
 
 	app := &cli.App{
 		Flags: []cli.Flag{
@@ -173,40 +878,694 @@ func main() {
 				Aliases:     []string{"l"},
 				Value:       1999,
 				Usage:       "local tcp port",
-				Destination: &localPort,
+				Destination: &opts.localPort,
+			},
+			&cli.StringFlag{
+				Name:        "address",
+				Value:       LOOPBACK_ADDRESS,
+				Usage:       "local address to listen on, e.g. 0.0.0.0 to share the tunnel with other machines",
+				Destination: &opts.localAddress,
+			},
+			&cli.StringFlag{
+				Name:        "local-socket",
+				Usage:       "listen on a unix socket at this path instead of a local port",
+				Destination: &opts.localSocket,
 			},
 			&cli.StringFlag{
+				Name:        "local-pipe",
+				Usage:       "listen on a windows named pipe of this name instead of a local port, e.g. kube-relay-db",
+				Destination: &opts.localPipe,
+			},
+			&cli.BoolFlag{
+				Name:        "privileged-port-fallback",
+				Usage:       "use an unprivileged local port if the requested one needs privileges",
+				Destination: &opts.portFallback,
+			},
+			&cli.StringSliceFlag{
 				Name:        "cluster-host",
 				Aliases:     []string{"ch"},
-				Usage:       "cluster host",
-				Destination: &clusterHost,
-				Required:    true,
+				Usage:       "cluster host, repeat it for failover targets in priority order (host, host:port, <svc|pod|deploy|sts>/<name>[:<port>] or unix:<path> on the node)",
+				Destination: &clusterHosts,
+			},
+			&cli.StringFlag{
+				Name:        "node",
+				Usage:       "run the relay pod on this node, e.g. for unix:<path> targets or node-local daemons",
+				Destination: &opts.node,
+			},
+			&cli.StringFlag{
+				Name:        "attach",
+				Usage:       "inject the relay as an ephemeral container into this pod (<name>, pod/<name>, deploy/<name> or sts/<name>) to relay from its network namespace, the cluster host defaults to its localhost",
+				Destination: &opts.attach,
+			},
+			&cli.StringFlag{
+				Name:        "engine",
+				Usage:       "relay server in the relay pod: socat, or go-relay for json connection logs, metrics and target updates",
+				Value:       ENGINE_SOCAT,
+				Destination: &opts.engine,
+			},
+			&cli.BoolFlag{
+				Name:        "mux",
+				Usage:       "carry all connections as streams of one forward to the go relay server, for clients opening many short connections",
+				Destination: &opts.mux,
+			},
+			&cli.IntFlag{
+				Name:        "stream-pool",
+				Usage:       "keep this many connections through the port-forward open ahead of time, so new connections skip the stream setup",
+				Destination: &opts.streamPool,
+			},
+			&cli.StringFlag{
+				Name:        "token",
+				Usage:       "access token of a shared go relay server, sent on every connection to a pod/, deploy/ or sts/ target",
+				EnvVars:     []string{TOKEN_ENV},
+				Destination: &opts.token,
+			},
+			&cli.StringFlag{
+				Name:        "via",
+				Usage:       "relay through socat or nc exec'd in this existing pod (<name>, pod/<name>, deploy/<name> or sts/<name>) instead of a relay pod, it needs pods/exec only",
+				Destination: &opts.via,
+			},
+			&cli.StringFlag{
+				Name:        "via-container",
+				Usage:       "container of the --via pod to exec in, defaults to its default container",
+				Destination: &opts.viaContainer,
+			},
+			&cli.BoolFlag{
+				Name:        "host-network",
+				Usage:       "run the relay pod in the network of its node, to reach daemons bound to the node ip or its localhost",
+				Destination: &opts.hostNetwork,
+			},
+			&cli.BoolFlag{
+				Name:        "balance",
+				Usage:       "spread connections round-robin across the ready endpoints of a svc/<name> target",
+				Destination: &opts.balance,
+			},
+			&cli.StringSliceFlag{
+				Name:        "L",
+				Usage:       "port mapping [address:]local-port:host:port like ssh, repeat it to relay several targets through one pod",
+				Destination: &mappings,
+			},
+			&cli.StringFlag{
+				Name:        "protocol",
+				Value:       PROTOCOL_TCP,
+				Usage:       "protocol of the cluster host, tcp or udp",
+				Destination: &opts.protocol,
 			},
 			&cli.UintFlag{
 				Name:        "cluster-port",
 				Aliases:     []string{"cp"},
 				Value:       80,
 				Usage:       "cluster tcp port",
-				Destination: &clusterPort,
+				Destination: &opts.clusterPort,
 			},
-			&cli.StringFlag{
+			&cli.StringSliceFlag{
 				Name:        "pod-image",
 				Aliases:     []string{"p"},
-				Value:       POD_IMAGE,
-				Usage:       "socat oci image",
-				Destination: &podImage,
+				Usage:       fmt.Sprintf("socat oci image, repeat it for fallbacks if pulling fails (default: %s)", POD_IMAGE),
+				Destination: &podImages,
+			},
+			&cli.StringFlag{
+				Name:  "image-pull-policy",
+				Usage: "when to pull the oci image, Always, IfNotPresent or Never",
+			},
+			&cli.StringSliceFlag{
+				Name:  "image-pull-secret",
+				Usage: "secret to pull the oci image with, repeatable",
+			},
+			&cli.StringFlag{
+				Name:        "wait-for",
+				Value:       WAIT_FOR_RUNNING,
+				Usage:       "when the tunnel is ready: pod running, pod ready condition, a probe through the tunnel or none",
+				Destination: &opts.waitFor,
+			},
+			&cli.StringFlag{
+				Name:        "probe-command",
+				Usage:       "application level check for --wait-for probe, gets the local port in KUBE_RELAY_PORT",
+				Destination: &opts.probeCommand,
+			},
+			&cli.BoolFlag{
+				Name:        "ftp",
+				Usage:       "relay ftp, opening tunnels for passive mode data connections",
+				Destination: &opts.ftp,
+			},
+			&cli.StringFlag{
+				Name:        "write-kubeconfig",
+				Usage:       "write a kubeconfig for an api server target reached through the relay, removed on exit",
+				TakesFile:   true,
+				Destination: &opts.writeKubeconfig,
+			},
+			&cli.StringFlag{
+				Name:        "kubeconfig-ca",
+				Usage:       "ca certificate of the api server target for --write-kubeconfig",
+				TakesFile:   true,
+				Destination: &opts.kubeconfigCA,
+			},
+			&cli.BoolFlag{
+				Name:  "socks",
+				Usage: "serve a SOCKS5 proxy on the local port, connections to any host are made from the relay pod",
+			},
+			&cli.BoolFlag{
+				Name:  "http-proxy",
+				Usage: "serve an HTTP CONNECT proxy on the local port, connections to any host are made from the relay pod",
+			},
+			&cli.StringSliceFlag{
+				Name:        "route",
+				Usage:       "redirect tcp connections to a cidr like the service or pod cidr through the relay pod with iptables, tcp only and no tun device (linux, needs sudo), repeatable",
+				Destination: &routes,
+			},
+			&cli.StringFlag{
+				Name:        "dns",
+				Usage:       "serve a dns resolver on this udp address (e.g. 127.0.0.1:5353) answering cluster names through the relay pod",
+				Destination: &opts.dns.address,
 			},
+			&cli.StringSliceFlag{
+				Name:        "dns-suffix",
+				Usage:       "suffix of the names --dns resolves, repeatable (default: " + DNS_SUFFIX + ")",
+				Destination: &dnsSuffixes,
+			},
+			&cli.StringFlag{
+				Name:        "dns-server",
+				Usage:       "cluster dns server queried from the relay pod",
+				Value:       DNS_UPSTREAM,
+				Destination: &opts.dns.upstream,
+			},
+			&cli.BoolFlag{
+				Name:        "reverse",
+				Usage:       "expose the local port in the cluster on the cluster port of the relay pod, like ssh -R",
+				Destination: &opts.reverse,
+			},
+			&cli.StringFlag{
+				Name:        "service",
+				Usage:       "service for the cluster port of a --reverse relay",
+				Destination: &opts.service,
+			},
+			&cli.StringFlag{
+				Name:        "service-account",
+				Usage:       "service account of the relay pod, its token is not mounted",
+				Destination: &opts.serviceAccount,
+			},
+			&cli.StringSliceFlag{
+				Name:  "label",
+				Usage: "extra label <key>=<value> of the relay pod, repeatable",
+			},
+			&cli.StringSliceFlag{
+				Name:  "annotation",
+				Usage: "extra annotation <key>=<value> of the relay pod, repeatable",
+			},
+			&cli.StringFlag{
+				Name:        "priority-class",
+				Usage:       "priority class of the relay pod, e.g. so it is not preempted mid-session",
+				Destination: &opts.priorityClass,
+			},
+			&cli.StringFlag{
+				Name:        "runtime-class",
+				Usage:       "runtime class of the relay pod, e.g. gvisor or kata",
+				Destination: &opts.runtimeClass,
+			},
+			&cli.StringSliceFlag{
+				Name:  "node-selector",
+				Usage: "node label <key>=<value> the relay pod has to be scheduled on, repeatable",
+			},
+			&cli.StringSliceFlag{
+				Name:  "toleration",
+				Usage: "taint the relay pod tolerates, <key>[=<value>][:<effect>] like kubectl taint, repeatable",
+			},
+			&cli.StringFlag{
+				Name:      "affinity",
+				Usage:     "yaml or json file with the affinity of the relay pod",
+				TakesFile: true,
+			},
+			&cli.StringFlag{
+				Name:  "cpu-request",
+				Usage: "cpu request of the relay containers, e.g. 10m",
+			},
+			&cli.StringFlag{
+				Name:  "cpu-limit",
+				Usage: "cpu limit of the relay containers, e.g. 100m",
+			},
+			&cli.StringFlag{
+				Name:  "memory-request",
+				Usage: "memory request of the relay containers, e.g. 16Mi",
+			},
+			&cli.StringFlag{
+				Name:  "memory-limit",
+				Usage: "memory limit of the relay containers, e.g. 64Mi",
+			},
+			&cli.StringFlag{
+				Name:      "pod-overrides",
+				Usage:     "patch file for the relay pod, a strategic merge patch or a json patch, as yaml or json",
+				TakesFile: true,
+			},
+			&cli.BoolFlag{
+				Name:  "dry-run",
+				Usage: "print the relay pod manifest instead of creating it, as yaml or with -o json as json",
+			},
+			&cli.BoolFlag{
+				Name:        "no-recreate",
+				Usage:       "end the relay when its pod is evicted or deleted instead of recreating it",
+				Destination: &opts.noRecreate,
+			},
+			&cli.BoolFlag{
+				Name:        "direct",
+				Usage:       "bypass the relay pod if the cluster host is reachable from this machine, e.g. on kind or minikube",
+				Destination: &opts.direct,
+			},
+			&cli.BoolFlag{
+				Name:        "stdin",
+				Usage:       "read newline-delimited targets (host:port [local-port]) from stdin",
+				Destination: &readStdin,
+			},
+			&cli.BoolFlag{
+				Name:        "loopback-alias",
+				Usage:       "give every tunnel from --stdin its own loopback address (127.0.0.2, 127.0.0.3, ...)",
+				Destination: &loopbackAliases,
+			},
+			&cli.StringSliceFlag{
+				Name:        "include",
+				Usage:       "only forward targets from --stdin matching a glob or a service label selector, repeatable",
+				Destination: &include,
+			},
+			&cli.StringSliceFlag{
+				Name:        "exclude",
+				Usage:       "skip targets from --stdin matching a glob or a service label selector, repeatable",
+				Destination: &exclude,
+			},
+			&cli.StringFlag{
+				Name:        "resolver",
+				Usage:       "executable resolving the cluster host as a logical target name",
+				Destination: &opts.resolver,
+			},
+			&cli.StringFlag{
+				Name:        "kubeconfig",
+				Usage:       "path of the kubeconfig instead of $KUBECONFIG or ~/.kube/config",
+				EnvVars:     []string{"KUBE_RELAY_KUBECONFIG"},
+				TakesFile:   true,
+				Destination: &kube.kubeconfig,
+			},
+			&cli.StringFlag{
+				Name:        "context",
+				Usage:       "kubeconfig context instead of the current one",
+				EnvVars:     []string{"KUBE_RELAY_CONTEXT"},
+				Destination: &kube.context,
+			},
+			&cli.StringFlag{
+				Name:        "namespace",
+				Aliases:     []string{"n"},
+				Usage:       "namespace of the relay pod instead of the one of the kubeconfig context",
+				EnvVars:     []string{"KUBE_RELAY_NAMESPACE"},
+				Destination: &kube.namespace,
+			},
+			&cli.StringSliceFlag{
+				Name:        "api-resolve",
+				Usage:       "resolve the api server hostname to an ip (host=ip), repeatable",
+				Destination: &apiResolve,
+			},
+			&cli.StringSliceFlag{
+				Name:        "namespace-fallback",
+				Usage:       "namespaces to try in order if the relay pod is forbidden or over quota in the primary one",
+				Destination: &namespaceFallback,
+			},
+			&cli.IntFlag{
+				Name:        "retries",
+				Usage:       "how often pod creation, readiness wait and forward establishment are re-attempted",
+				Destination: &opts.retries,
+			},
+			&cli.DurationFlag{
+				Name:        "retry-backoff",
+				Value:       RETRY_BACKOFF,
+				Usage:       "initial delay between attempts, doubling after each one",
+				Destination: &opts.retryBackoff,
+			},
+			&cli.DurationFlag{
+				Name:        "queue-timeout",
+				Value:       QUEUE_TIMEOUT,
+				Usage:       "how long new connections are held while the forward is re-established",
+				Destination: &opts.queueTimeout,
+			},
+			&cli.StringFlag{
+				Name:        "near",
+				Usage:       "place the relay on the node or zone of a pod (pod/<name>, svc/<name>)",
+				Destination: &opts.near,
+			},
+			&cli.DurationFlag{
+				Name:        "schedule-timeout",
+				Value:       SCHEDULE_TIMEOUT,
+				Usage:       "how long the relay pod may stay unschedulable",
+				Destination: &opts.scheduleTimeout,
+			},
+			&cli.DurationFlag{
+				Name:        "wait-timeout",
+				Value:       WAIT_TIMEOUT,
+				Usage:       "how long to wait for the relay pod to become ready, 0 waits forever",
+				Destination: &opts.waitTimeout,
+			},
+			&cli.BoolFlag{
+				Name:        "pdb",
+				Usage:       "protect the relay pod from node drains with a pod disruption budget",
+				Destination: &opts.disruptionBudget,
+			},
+			&cli.DurationFlag{
+				Name:        "drain-timeout",
+				Value:       DRAIN_TIMEOUT,
+				Usage:       "how long the relay pod may finish active connections on teardown",
+				Destination: &opts.drainTimeout,
+			},
+			&cli.DurationFlag{
+				Name:        "max-lifetime",
+				Usage:       "let the cluster stop the relay pod after this long, even if kube-relay can't clean it up",
+				Destination: &opts.maxLifetime,
+			},
+			&cli.BoolFlag{
+				Name:        "create-namespace",
+				Usage:       "create the relay namespace if it doesn't exist",
+				Destination: &opts.createNamespace,
+			},
+			&cli.BoolFlag{
+				Name:        "delete-namespace",
+				Usage:       "delete the namespace on exit if it was created by --create-namespace",
+				Destination: &opts.deleteNamespace,
+			},
+			&cli.StringFlag{
+				Name:        "config",
+				Usage:       "config file describing tunnels (default: kube-relay/config.yaml in the user config dir)",
+				TakesFile:   true,
+				Destination: &configPath,
+			},
+			&cli.StringFlag{
+				Name:        "admin-address",
+				Usage:       "serve a local admin endpoint on host:port, e.g. 127.0.0.1:6060",
+				Destination: &admin.address,
+			},
+			&cli.BoolFlag{
+				Name:        "pprof",
+				Usage:       "expose pprof profiles on the admin endpoint",
+				Destination: &admin.pprof,
+			},
+			&cli.BoolFlag{
+				Name:        "debug-streams",
+				Usage:       "log the lifecycle and errors of port-forward connections and streams",
+				Destination: &kube.debugStreams,
+			},
+			&cli.StringFlag{
+				Name:        "transport",
+				Usage:       "transport of port-forwards: auto (websocket, spdy if the api server lacks it), websocket or spdy",
+				Value:       TRANSPORT_AUTO,
+				EnvVars:     []string{"KUBE_RELAY_TRANSPORT"},
+				Destination: &kube.transport,
+			},
+			&cli.DurationFlag{
+				Name:        "keepalive-interval",
+				Usage:       "interval of pings on port-forwards, keeping idle tunnels from being cut by load balancers, 0 disables them",
+				Value:       KEEPALIVE_INTERVAL,
+				Destination: &kube.keepalive,
+			},
+			&cli.StringFlag{
+				Name:        "statsd-address",
+				Usage:       "push tunnel metrics to a StatsD agent on host:port",
+				Destination: &statsd.address,
+			},
+			&cli.StringFlag{
+				Name:        "statsd-prefix",
+				Value:       "kube_relay",
+				Usage:       "prefix of the pushed metric names",
+				Destination: &statsd.prefix,
+			},
+			&cli.BoolFlag{
+				Name:        "dogstatsd",
+				Usage:       "tag metrics with tunnel and target in DogStatsD format",
+				Destination: &statsd.dogstatsd,
+			},
+			&cli.StringFlag{
+				Name:        "output",
+				Aliases:     []string{"o"},
+				Value:       "text",
+				Usage:       "output format of errors (text or json) and of --dry-run manifests (yaml or json)",
+				Destination: &output,
+			},
+		},
+		Name:      "kube-relay",
+		Usage:     "access tcp ports in a kubernetes cluster via a pod relay (locally)",
+		ArgsUsage: "[-- <command> [args...]]",
+		Version:   version,
+		Before: func(c *cli.Context) error {
+			trackTelemetry(c)
+			kube.apiResolve = apiResolve.Value()
+			if err := validateTransport(kube.transport); err != nil {
+				return err
+			}
+			if kube.keepalive < 0 {
+				return fmt.Errorf("--keepalive-interval needs a positive interval or 0")
+			}
+			if err := startStatsd(statsd); err != nil {
+				return err
+			}
+			return serveAdmin(admin)
+		},
+		// errors are recorded here as they exit, successful runs after
+		After: func(c *cli.Context) error {
+			recordTelemetryExit(nil)
+			return nil
+		},
+		ExitErrHandler: func(c *cli.Context, err error) {
+			if err == nil {
+				return
+			}
+			recordTelemetry(c, err)
+			if output == "json" {
+				os.Exit(printJSONError(os.Stderr, err))
+			}
+			if code, ok := printHint(os.Stderr, err); ok {
+				os.Exit(code)
+			}
+			rErr := asRelayError(err)
+			if rErr.Reason != "" {
+				fmt.Fprintln(os.Stderr, rErr.Reason)
+			}
+			os.Exit(rErr.exitCode)
+		},
+		Commands: []*cli.Command{
+			statusCommand(kube, &configPath),
+			upCommand(kube, &configPath, &opts),
+			downCommand(kube, &configPath),
+			resumeCommand(kube),
+			exportCommand(),
+			selfUpdateCommand(),
+			tokenCommand(),
+			telemetryCommand(),
+			shellCommand(kube),
+			listCommand(kube),
+			pruneCommand(kube),
+			interceptCommand(kube),
+			stdioCommand(kube),
+			benchCommand(kube),
+			pingCommand(kube),
+			checkCommand(kube),
+			scanCommand(kube),
+			dnsCommand(kube),
+			relayServerCommand(),
+			docsCommand(),
 		},
-		Name:  "kube-relay",
-		Usage: "access tcp ports in a kubernetes cluster via a pod relay (locally)",
 		Action: func(c *cli.Context) error {
-			err := run(localPort, clusterHost, clusterPort, podImage)
+			if hosts := clusterHosts.Value(); len(hosts) != 0 {
+				opts.clusterHost, opts.failover = trimBrackets(hosts[0]), hosts[1:]
+			}
+			if opts.attach != "" {
+				if opts.clusterHost == "" {
+					opts.clusterHost = LOOPBACK_ADDRESS
+				}
+				if len(opts.failover) != 0 || opts.ftp || opts.balance || opts.protocol == PROTOCOL_UDP || opts.node != "" || opts.hostNetwork || strings.HasPrefix(opts.clusterHost, SOCKET_PREFIX) {
+					return fmt.Errorf("--attach excludes failover targets, --ftp, --balance, udp, --node, --host-network and unix:<path> targets")
+				}
+			}
+			if err := validateEngine(opts.engine); err != nil {
+				return err
+			}
+			// socat can't tell the framed datagrams of the forward apart
+			if opts.protocol == PROTOCOL_UDP {
+				if c.IsSet("engine") && opts.engine != ENGINE_GO_RELAY {
+					return fmt.Errorf("udp needs --engine go-relay, socat can't keep the boundaries of datagrams through the forward")
+				}
+				opts.engine = ENGINE_GO_RELAY
+			}
+			opts.podImage = POD_IMAGE
+			if opts.engine == ENGINE_GO_RELAY {
+				opts.podImage = goRelayImage()
+			}
+			if images := podImages.Value(); len(images) != 0 {
+				opts.podImage, opts.imageFallback = images[0], images[1:]
+			}
+			if socket, ok := socketTarget(opts.clusterHost); ok {
+				if err := validateSocketPath(socket); err != nil {
+					return err
+				}
+				if len(opts.failover) != 0 || opts.ftp || opts.balance || opts.protocol == PROTOCOL_UDP {
+					return fmt.Errorf("a unix:<path> target excludes failover targets, --ftp, --balance and udp")
+				}
+				opts.remoteSocket = socket
+			}
+			if len(opts.failover) != 0 && opts.ftp {
+				return fmt.Errorf("--ftp doesn't support failover targets")
+			}
+			if opts.balance && (len(opts.failover) != 0 || opts.ftp || opts.protocol == PROTOCOL_UDP) {
+				return fmt.Errorf("--balance excludes failover targets, --ftp and udp")
+			}
+			if err := validateWaitFor(opts.waitFor); err != nil {
+				return err
+			}
+			if err := validateProtocol(opts.protocol); err != nil {
+				return err
+			}
+			if opts.protocol == PROTOCOL_UDP && opts.ftp {
+				return fmt.Errorf("--ftp needs tcp")
+			}
+			opts.namespaceFallback = namespaceFallback.Value()
+			var err error
+			if opts.localAddress, err = parseLocalAddress(opts.localAddress); err != nil {
+				return err
+			}
+			if ip := net.ParseIP(opts.localAddress); !ip.IsLoopback() {
+				println("listening on", opts.localAddress+", the tunnel is reachable from other machines")
+			}
+			if err := parsePodFlags(c, &opts); err != nil {
+				return err
+			}
+			if opts.affinity != nil && opts.near != "" {
+				return fmt.Errorf("--affinity and --near exclude each other")
+			}
+			if opts.node != "" && (opts.near != "" || opts.affinity != nil || len(opts.nodeSelector) != 0) {
+				return fmt.Errorf("--node excludes --near, --affinity and --node-selector")
+			}
+			if c.Bool("dry-run") {
+				if readStdin || len(mappings.Value()) != 0 || len(c.Args().Slice()) != 0 {
+					return fmt.Errorf("--dry-run renders a single relay pod, it excludes --stdin, -L and a command")
+				}
+				opts.dryRun = output
+			}
+			// kube-relay [flags] -- <command> runs the command while the tunnel is up
+			if opts.command = c.Args().Slice(); len(opts.command) != 0 {
+				if readStdin || len(mappings.Value()) != 0 {
+					return fmt.Errorf("a command needs a single tunnel, it excludes --stdin and -L")
+				}
+				opts.log = &logger{out: os.Stderr}
+			}
+			if opts.dns.address != "" {
+				if readStdin || len(mappings.Value()) != 0 {
+					return fmt.Errorf("--dns needs a single relay pod, it excludes --stdin and -L")
+				}
+				if opts.dns.suffixes = dnsSuffixes.Value(); len(opts.dns.suffixes) == 0 {
+					opts.dns.suffixes = []string{DNS_SUFFIX}
+				}
+			}
+			if len(mappings.Value()) != 0 {
+				if opts.localSocket != "" || opts.localPipe != "" {
+					return fmt.Errorf("--local-socket and --local-pipe need a single tunnel, they exclude -L")
+				}
+				if opts.via != "" {
+					return fmt.Errorf("--via needs a single tunnel, it excludes -L")
+				}
+				if opts.mux {
+					return fmt.Errorf("--mux needs a single tunnel, it excludes -L")
+				}
+				if opts.token != "" {
+					return fmt.Errorf("--token needs a single tunnel, it excludes -L")
+				}
+				tunnels, err := mappingTunnels(mappings.Value(), opts)
+				if err != nil {
+					return err
+				}
+				return upTunnels(kube, MAPPING_GROUP, tunnels, upOptions{singlePod: true, drainTimeout: opts.drainTimeout})
+			}
+			if c.Bool("socks") && c.Bool("http-proxy") {
+				return fmt.Errorf("--socks and --http-proxy exclude each other")
+			}
+			if c.Bool("socks") {
+				opts.proxy = PROXY_SOCKS
+			}
+			if c.Bool("http-proxy") {
+				opts.proxy = PROXY_HTTP
+			}
+			if opts.routes = routes.Value(); len(opts.routes) != 0 {
+				if opts.proxy != "" {
+					return fmt.Errorf("--route excludes the other proxies")
+				}
+				if err := validateRoutes(opts.routes); err != nil {
+					return err
+				}
+				opts.proxy = PROXY_ROUTE
+			}
+			if opts.localSocket != "" && opts.localPipe != "" {
+				return fmt.Errorf("--local-socket and --local-pipe exclude each other")
+			}
+			if opts.localPipe != "" && runtime.GOOS != "windows" {
+				return fmt.Errorf("--local-pipe is only supported on windows, use --local-socket")
+			}
+			if (opts.localSocket != "" || opts.localPipe != "") && (opts.proxy != "" || opts.ftp || opts.reverse || opts.protocol == PROTOCOL_UDP || opts.waitFor == WAIT_FOR_PROBE || len(opts.command) != 0 || readStdin) {
+				return fmt.Errorf("--local-socket and --local-pipe need a single tcp tunnel, they exclude proxies, --ftp, --reverse, udp, --wait-for probe, --stdin and a command")
+			}
+			if opts.engine == ENGINE_GO_RELAY && (opts.attach != "" || opts.via != "" || opts.proxy != "" || opts.ftp || opts.reverse || opts.balance || opts.dns.address != "" || opts.remoteSocket != "") {
+				return fmt.Errorf("--engine go-relay relays to fixed targets, it excludes --attach, --via, proxies, --ftp, --reverse, --balance, --dns and unix:<path> targets")
+			}
+			if opts.mux && (opts.engine != ENGINE_GO_RELAY || len(opts.failover) != 0) {
+				return fmt.Errorf("--mux needs --engine go-relay and excludes failover targets")
+			}
+			if opts.streamPool < 0 {
+				return fmt.Errorf("--stream-pool needs a positive size")
+			}
+			if opts.token != "" {
+				if err := validateToken(opts.token); err != nil {
+					return err
+				}
+				if readStdin || opts.clusterHost == "" {
+					return fmt.Errorf("--token needs a single pod/, deploy/ or sts/ target, it excludes --stdin and --config")
+				}
+			}
+			if opts.streamPool != 0 && (opts.mux || opts.via != "" || opts.proxy != "" || opts.reverse || opts.balance || opts.ftp || opts.protocol == PROTOCOL_UDP) {
+				return fmt.Errorf("--stream-pool excludes --mux, --via, proxies, --reverse, --balance, --ftp and udp")
+			}
+			if opts.viaContainer != "" && opts.via == "" {
+				return fmt.Errorf("--via-container needs --via")
+			}
+			if opts.via != "" && (opts.attach != "" || opts.proxy != "" || opts.ftp || opts.reverse || opts.balance || opts.dns.address != "" || opts.protocol == PROTOCOL_UDP || len(opts.failover) != 0 || opts.node != "" || opts.hostNetwork || opts.remoteSocket != "" || opts.dryRun != "" || readStdin) {
+				return fmt.Errorf("--via relays tcp to a single cluster host without a relay pod, it excludes --attach, proxies, --ftp, --reverse, --balance, --dns, udp, failover targets, --node, --host-network, unix:<path> targets, --dry-run and --stdin")
+			}
+			if opts.reverse {
+				if opts.proxy != "" || opts.ftp || opts.protocol == PROTOCOL_UDP || len(opts.failover) != 0 {
+					return fmt.Errorf("--reverse relays tcp connections from the cluster port")
+				}
+				return run(kube, opts)
+			}
+			if opts.proxy != "" {
+				if opts.ftp || opts.protocol == PROTOCOL_UDP || len(opts.failover) != 0 {
+					return fmt.Errorf("a proxy connects to the hosts of its clients over tcp")
+				}
+				return run(kube, opts)
+			}
+			// a config file alone brings up all of its tunnels
+			if opts.clusterHost == "" && !readStdin && c.IsSet("config") {
+				if opts.dryRun != "" {
+					return fmt.Errorf("--dry-run renders a single relay pod, it needs --cluster-host")
+				}
+				return up(kube, configPath, "", upOptions{batchSize: UP_BATCH_SIZE, drainTimeout: opts.drainTimeout, pod: &opts})
+			}
+			if opts.clusterHost == "" && !readStdin {
+				return fmt.Errorf("Required flag \"cluster-host\" not set")
+			}
+			if readStdin {
+				filter, err := newTargetFilter(include.Value(), exclude.Value())
+				if err != nil {
+					return err
+				}
+				return runStdin(kube, opts, os.Stdin, loopbackAliases, filter)
+			}
+			err = run(kube, opts)
 			return err
 		},
 	}
 
-	err := app.Run(os.Args)
-	if err != nil {
-		panic(err)
+	removeStaleExecutable()
+	trackCommands(app.Commands)
+	// errors of actions exit in ExitErrHandler, these are usage errors
+	if err := app.Run(os.Args); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(EXIT_ERROR)
 	}
 }
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+)
+
+// MAPPING_GROUP is the group of the tunnels given with -L, they share a relay pod
+const MAPPING_GROUP = "mappings"
+
+// parseMapping parses a port mapping like ssh -L, "[<address>:]<local port>:<host>:<port>"
+func parseMapping(mapping string) (tunnelConfig, error) {
+	parts := splitColons(mapping)
+	var t tunnelConfig
+	if len(parts) == 4 {
+		if net.ParseIP(trimBrackets(parts[0])) == nil {
+			return t, fmt.Errorf("invalid address %q in mapping %q", parts[0], mapping)
+		}
+		t.LocalAddress, parts = trimBrackets(parts[0]), parts[1:]
+	}
+	if len(parts) != 3 || parts[1] == "" {
+		return t, fmt.Errorf("invalid mapping %q, expected [<address>:]<local port>:<host>:<port>", mapping)
+	}
+	localPort, err := strconv.ParseUint(parts[0], 10, 16)
+	if err != nil || localPort == 0 {
+		return t, fmt.Errorf("invalid local port %q in mapping %q", parts[0], mapping)
+	}
+	port, err := strconv.ParseUint(parts[2], 10, 16)
+	if err != nil || port == 0 {
+		return t, fmt.Errorf("invalid port %q in mapping %q", parts[2], mapping)
+	}
+	t.LocalPort, t.ClusterHost, t.ClusterPort = uint(localPort), trimBrackets(parts[1]), uint(port)
+	return t, nil
+}
+
+// mappingTunnels turns port mappings into the tunnels of a group, named after
+// their hosts.
+func mappingTunnels(mappings []string, opts relayOptions) ([]tunnelConfig, error) {
+	var tunnels []tunnelConfig
+	names := map[string]bool{}
+	for _, m := range mappings {
+		t, err := parseMapping(m)
+		if err != nil {
+			return nil, err
+		}
+		t.Namespace, t.PodImage, t.pod = opts.namespace, opts.podImage, &opts
+		if opts.engine == ENGINE_GO_RELAY {
+			t.Engine = opts.engine
+		}
+		if t.LocalAddress == "" && opts.localAddress != LOOPBACK_ADDRESS {
+			t.LocalAddress = opts.localAddress
+		}
+		if opts.protocol == PROTOCOL_UDP {
+			t.Protocol = opts.protocol
+		}
+		o := opts
+		o.clusterHost = t.ClusterHost
+		name := sessionTunnel(o, "", 0).Name
+		t.Name = name
+		for i := 2; names[t.Name]; i++ {
+			t.Name = fmt.Sprintf("%s-%d", name, i)
+		}
+		names[t.Name] = true
+		tunnels = append(tunnels, t)
+	}
+	return tunnels, nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import "testing"
+
+func TestParseMapping(t *testing.T) {
+	tests := []struct {
+		mapping string
+		want    tunnelConfig
+		err     string
+	}{
+		{"5432:db:5432", tunnelConfig{LocalPort: 5432, ClusterHost: "db", ClusterPort: 5432}, ""},
+		{"15432:postgres.payments.svc:5432", tunnelConfig{LocalPort: 15432, ClusterHost: "postgres.payments.svc", ClusterPort: 5432}, ""},
+		{"0.0.0.0:5432:db:5432", tunnelConfig{LocalAddress: "0.0.0.0", LocalPort: 5432, ClusterHost: "db", ClusterPort: 5432}, ""},
+		{"[::1]:5432:[fd00::a]:5432", tunnelConfig{LocalAddress: "::1", LocalPort: 5432, ClusterHost: "fd00::a", ClusterPort: 5432}, ""},
+		{"5432:[fd00::a]:5432", tunnelConfig{LocalPort: 5432, ClusterHost: "fd00::a", ClusterPort: 5432}, ""},
+		{"localhost:5432:db:5432", tunnelConfig{}, "invalid address"},
+		{"5432:db", tunnelConfig{}, "invalid mapping"},
+		{"5432::5432", tunnelConfig{}, "invalid mapping"},
+		{"5432:fd00::a:5432", tunnelConfig{}, "invalid mapping"},
+		{"1:2:3:4:5", tunnelConfig{}, "invalid mapping"},
+		{"", tunnelConfig{}, "invalid mapping"},
+		{"0:db:5432", tunnelConfig{}, "invalid local port"},
+		{"x:db:5432", tunnelConfig{}, "invalid local port"},
+		{"65536:db:5432", tunnelConfig{}, "invalid local port"},
+		{"5432:db:", tunnelConfig{}, "invalid port"},
+		{"5432:db:0", tunnelConfig{}, "invalid port"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mapping, func(t *testing.T) {
+			got, err := parseMapping(tt.mapping)
+			checkError(t, err, tt.err)
+			if err == nil && got != tt.want {
+				t.Errorf("parseMapping(%q) = %+v, want %+v", tt.mapping, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMappingTunnelsInheritPodFlags(t *testing.T) {
+	opts := relayOptions{
+		localAddress:   LOOPBACK_ADDRESS,
+		podImage:       POD_IMAGE,
+		labels:         map[string]string{"team": "payments"},
+		serviceAccount: "relay",
+	}
+	tunnels, err := mappingTunnels([]string{"5432:db:5432", "6379:db:6379"}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tunnels) != 2 || tunnels[0].Name == tunnels[1].Name {
+		t.Fatalf("expected two uniquely named tunnels, got %+v", tunnels)
+	}
+	for _, tunnel := range tunnels {
+		o := tunnel.options()
+		if o.labels["team"] != "payments" || o.serviceAccount != "relay" {
+			t.Errorf("tunnel %q lost the pod flags: labels %v, service account %q", tunnel.Name, o.labels, o.serviceAccount)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// parseKeyValues parses repeated <key>=<value> flags, what names them in errors
+func parseKeyValues(terms []string, what string) (map[string]string, error) {
+	if len(terms) == 0 {
+		return nil, nil
+	}
+	values := map[string]string{}
+	for _, term := range terms {
+		parts := strings.SplitN(term, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid %s %q, expected <key>=<value>", what, term)
+		}
+		values[parts[0]] = parts[1]
+	}
+	return values, nil
+}
+
+// reserved tells whether kube-relay relies on a label or annotation
+func reserved(key string) bool {
+	return strings.HasPrefix(key, "kube-relay/") || key == LABEL_MANAGED_BY || key == LABEL_INSTANCE
+}
+
+// parseLabels parses the extra labels of the relay pod, e.g. for cost
+// allocation or network policies
+func parseLabels(terms []string) (map[string]string, error) {
+	labels, err := parseKeyValues(terms, "label")
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range labels {
+		if reserved(k) {
+			return nil, fmt.Errorf("label %q is set by kube-relay", k)
+		}
+		if errs := append(validation.IsQualifiedName(k), validation.IsValidLabelValue(v)...); len(errs) != 0 {
+			return nil, fmt.Errorf("invalid label %s=%s: %s", k, v, strings.Join(errs, ", "))
+		}
+	}
+	return labels, nil
+}
+
+// parseAnnotations parses the extra annotations of the relay pod, e.g. to opt
+// in or out of sidecar injection
+func parseAnnotations(terms []string) (map[string]string, error) {
+	annotations, err := parseKeyValues(terms, "annotation")
+	if err != nil {
+		return nil, err
+	}
+	for k := range annotations {
+		if reserved(k) {
+			return nil, fmt.Errorf("annotation %q is set by kube-relay", k)
+		}
+		if errs := validation.IsQualifiedName(k); len(errs) != 0 {
+			return nil, fmt.Errorf("invalid annotation %q: %s", k, strings.Join(errs, ", "))
+		}
+	}
+	return annotations, nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const STATSD_INTERVAL = 10 * time.Second
+
+// tunnelMetrics count the traffic of a tunnel, a nil value counts nothing
+type tunnelMetrics struct {
+	name   string
+	target string
+
+	connections int64
+	active      int64
+	dropped     int64
+	bytesIn     int64
+	bytesOut    int64
+}
+
+var metricsRegistry struct {
+	mu      sync.Mutex
+	tunnels []*tunnelMetrics
+}
+
+func registerMetrics(name string, target string) *tunnelMetrics {
+	m := &tunnelMetrics{name: name, target: target}
+	metricsRegistry.mu.Lock()
+	defer metricsRegistry.mu.Unlock()
+	metricsRegistry.tunnels = append(metricsRegistry.tunnels, m)
+	return m
+}
+
+func (m *tunnelMetrics) opened() {
+	if m != nil {
+		atomic.AddInt64(&m.connections, 1)
+		atomic.AddInt64(&m.active, 1)
+	}
+}
+
+func (m *tunnelMetrics) closed(in int64, out int64) {
+	if m != nil {
+		atomic.AddInt64(&m.active, -1)
+		atomic.AddInt64(&m.bytesIn, in)
+		atomic.AddInt64(&m.bytesOut, out)
+	}
+}
+
+func (m *tunnelMetrics) drop() {
+	if m != nil {
+		atomic.AddInt64(&m.dropped, 1)
+	}
+}
+
+// statsdOptions configure pushing tunnel metrics to a StatsD or DogStatsD
+// agent, for setups without a scraper.
+type statsdOptions struct {
+	address   string
+	prefix    string
+	dogstatsd bool
+}
+
+// startStatsd pushes the metrics of all tunnels periodically over udp.
+// Counters are sent as deltas since the last push, active connections as a
+// gauge. DogStatsD gets the tunnel and target as tags, plain StatsD in the
+// metric name.
+func startStatsd(opts statsdOptions) error {
+	if opts.address == "" {
+		return nil
+	}
+	conn, err := net.Dial("udp", opts.address)
+	if err != nil {
+		return err
+	}
+	last := map[*tunnelMetrics][4]int64{}
+	go func() {
+		for range time.Tick(STATSD_INTERVAL) {
+			metricsRegistry.mu.Lock()
+			tunnels := append([]*tunnelMetrics(nil), metricsRegistry.tunnels...)
+			metricsRegistry.mu.Unlock()
+
+			var packet bytes.Buffer
+			for _, m := range tunnels {
+				now := [4]int64{
+					atomic.LoadInt64(&m.connections),
+					atomic.LoadInt64(&m.dropped),
+					atomic.LoadInt64(&m.bytesIn),
+					atomic.LoadInt64(&m.bytesOut),
+				}
+				prev := last[m]
+				last[m] = now
+				for i, metric := range []string{"connections", "dropped", "bytes_in", "bytes_out"} {
+					packet.WriteString(opts.line(m, metric, now[i]-prev[i], "c"))
+				}
+				packet.WriteString(opts.line(m, "active", atomic.LoadInt64(&m.active), "g"))
+			}
+			if packet.Len() != 0 {
+				conn.Write(packet.Bytes())
+			}
+		}
+	}()
+	return nil
+}
+
+func (opts statsdOptions) line(m *tunnelMetrics, metric string, value int64, kind string) string {
+	if opts.dogstatsd {
+		return fmt.Sprintf("%s.%s:%d|%s|#tunnel:%s,target:%s\n", opts.prefix, metric, value, kind, m.name, m.target)
+	}
+	name := strings.NewReplacer(".", "_", ":", "_").Replace(m.name)
+	return fmt.Sprintf("%s.%s.%s:%d|%s\n", opts.prefix, name, metric, value, kind)
+}
@@ -0,0 +1,450 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// the go relay server accepts multiplexed sessions on this port of the pod
+const MUX_PORT = 9200
+
+// every stream may have this many bytes in flight, a receiver grants more as
+// it reads, so a slow stream doesn't stall the others of its session
+const MUX_WINDOW = 256 * 1024
+const MUX_MAX_FRAME = 32 * 1024
+const MUX_HEADER = 9
+
+// frames are a kind, a stream id and a length, followed by length bytes of
+// payload. A window frame carries the granted bytes in its length instead.
+const (
+	muxOpen byte = iota + 1
+	muxData
+	muxWindow
+	muxClose
+	muxReset
+)
+
+var errMuxReset = errors.New("stream reset by the relay")
+var errMuxClosed = errors.New("mux session closed")
+
+// muxSession carries many connections as streams over one connection, the
+// client opens streams to a port of the relay server, the server accepts them
+// with its accept handler
+type muxSession struct {
+	conn    net.Conn
+	accept  func(*muxStream)
+	writeMu sync.Mutex
+
+	mu      sync.Mutex
+	streams map[uint32]*muxStream
+	nextID  uint32
+	err     error
+}
+
+// newMuxSession starts a session, a client has no accept handler
+func newMuxSession(conn net.Conn, accept func(*muxStream)) *muxSession {
+	s := &muxSession{
+		conn:    conn,
+		accept:  accept,
+		streams: map[uint32]*muxStream{},
+		nextID:  1,
+	}
+	go s.read()
+	return s
+}
+
+func (s *muxSession) write(kind byte, id uint32, length uint32, payload []byte) error {
+	var header [MUX_HEADER]byte
+	header[0] = kind
+	binary.BigEndian.PutUint32(header[1:5], id)
+	binary.BigEndian.PutUint32(header[5:9], length)
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	buffers := net.Buffers{header[:], payload}
+	_, err := buffers.WriteTo(s.conn)
+	if err != nil {
+		go s.shutdown(err)
+	}
+	return err
+}
+
+// open opens a stream to a port of the relay server, data may follow right away
+func (s *muxSession) open(port uint16) (*muxStream, error) {
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return nil, s.err
+	}
+	st := newMuxStream(s, s.nextID, port)
+	s.streams[st.id] = st
+	s.nextID += 2
+	s.mu.Unlock()
+
+	payload := make([]byte, 2)
+	binary.BigEndian.PutUint16(payload, port)
+	if err := s.write(muxOpen, st.id, uint32(len(payload)), payload); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+func (s *muxSession) broken() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err != nil
+}
+
+func (s *muxSession) stream(id uint32) *muxStream {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.streams[id]
+}
+
+func (s *muxSession) remove(id uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.streams, id)
+}
+
+// shutdown ends the session and resets all of its streams
+func (s *muxSession) shutdown(err error) {
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return
+	}
+	s.err = fmt.Errorf("%w: %s", errMuxClosed, err)
+	streams := s.streams
+	s.streams = map[uint32]*muxStream{}
+	s.mu.Unlock()
+
+	s.conn.Close()
+	for _, st := range streams {
+		st.reset(s.err)
+	}
+}
+
+func (s *muxSession) close() {
+	s.shutdown(io.EOF)
+}
+
+func (s *muxSession) read() {
+	var header [MUX_HEADER]byte
+	for {
+		if _, err := io.ReadFull(s.conn, header[:]); err != nil {
+			s.shutdown(err)
+			return
+		}
+		kind, id, length := header[0], binary.BigEndian.Uint32(header[1:5]), binary.BigEndian.Uint32(header[5:9])
+		if kind != muxWindow && length > MUX_MAX_FRAME {
+			s.shutdown(fmt.Errorf("frame of %d bytes exceeds %d", length, MUX_MAX_FRAME))
+			return
+		}
+		var payload []byte
+		if kind != muxWindow && length != 0 {
+			payload = make([]byte, length)
+			if _, err := io.ReadFull(s.conn, payload); err != nil {
+				s.shutdown(err)
+				return
+			}
+		}
+
+		switch kind {
+		case muxOpen:
+			if s.accept == nil || len(payload) != 2 {
+				s.shutdown(fmt.Errorf("unexpected open of stream %d", id))
+				return
+			}
+			st := newMuxStream(s, id, binary.BigEndian.Uint16(payload))
+			s.mu.Lock()
+			s.streams[id] = st
+			s.mu.Unlock()
+			go s.accept(st)
+		case muxData:
+			// data of a stream closed here already is dropped
+			if st := s.stream(id); st != nil && !st.push(payload) {
+				s.shutdown(fmt.Errorf("stream %d exceeds its window", id))
+				return
+			}
+		case muxWindow:
+			if st := s.stream(id); st != nil {
+				st.grant(length)
+			}
+		case muxClose:
+			if st := s.stream(id); st != nil {
+				st.remoteClose()
+			}
+		case muxReset:
+			if st := s.stream(id); st != nil {
+				st.reset(errMuxReset)
+			}
+		default:
+			s.shutdown(fmt.Errorf("unknown frame kind %d", kind))
+			return
+		}
+	}
+}
+
+// muxStream is a connection carried by a session
+type muxStream struct {
+	session *muxSession
+	id      uint32
+	port    uint16
+
+	mu         sync.Mutex
+	cond       *sync.Cond
+	buf        bytes.Buffer
+	unacked    uint32
+	sendWindow uint32
+	remoteEOF  bool
+	writeDone  bool
+	closed     bool
+	err        error
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+	readTimer     *time.Timer
+	writeTimer    *time.Timer
+}
+
+func newMuxStream(s *muxSession, id uint32, port uint16) *muxStream {
+	st := &muxStream{session: s, id: id, port: port, sendWindow: MUX_WINDOW}
+	st.cond = sync.NewCond(&st.mu)
+	return st
+}
+
+func (st *muxStream) push(data []byte) bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if uint32(st.buf.Len())+st.unacked+uint32(len(data)) > MUX_WINDOW {
+		return false
+	}
+	if !st.closed {
+		st.buf.Write(data)
+		st.cond.Broadcast()
+	}
+	return true
+}
+
+func (st *muxStream) grant(n uint32) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.sendWindow += n
+	st.cond.Broadcast()
+}
+
+func (st *muxStream) remoteClose() {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.remoteEOF = true
+	st.cond.Broadcast()
+}
+
+func (st *muxStream) reset(err error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.err == nil {
+		st.err = err
+	}
+	st.cond.Broadcast()
+	st.session.remove(st.id)
+}
+
+func (st *muxStream) Read(b []byte) (int, error) {
+	st.mu.Lock()
+	for st.buf.Len() == 0 && !st.remoteEOF && st.err == nil && !st.closed && !expired(st.readDeadline) {
+		st.cond.Wait()
+	}
+	if st.buf.Len() != 0 {
+		n, _ := st.buf.Read(b)
+		st.unacked += uint32(n)
+		grant := uint32(0)
+		if st.unacked >= MUX_WINDOW/2 {
+			grant, st.unacked = st.unacked, 0
+		}
+		st.mu.Unlock()
+		if grant != 0 {
+			st.session.write(muxWindow, st.id, grant, nil)
+		}
+		return n, nil
+	}
+	defer st.mu.Unlock()
+	switch {
+	case st.err != nil:
+		return 0, st.err
+	case st.closed:
+		return 0, net.ErrClosed
+	case st.remoteEOF:
+		return 0, io.EOF
+	}
+	return 0, os.ErrDeadlineExceeded
+}
+
+func (st *muxStream) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) != 0 {
+		st.mu.Lock()
+		for st.sendWindow == 0 && st.err == nil && !st.writeDone && !expired(st.writeDeadline) {
+			st.cond.Wait()
+		}
+		switch {
+		case st.err != nil:
+			st.mu.Unlock()
+			return written, st.err
+		case st.writeDone:
+			st.mu.Unlock()
+			return written, net.ErrClosed
+		case expired(st.writeDeadline):
+			st.mu.Unlock()
+			return written, os.ErrDeadlineExceeded
+		}
+		n := len(b)
+		if n > int(st.sendWindow) {
+			n = int(st.sendWindow)
+		}
+		if n > MUX_MAX_FRAME {
+			n = MUX_MAX_FRAME
+		}
+		st.sendWindow -= uint32(n)
+		st.mu.Unlock()
+
+		if err := st.session.write(muxData, st.id, uint32(n), b[:n]); err != nil {
+			return written, err
+		}
+		written += n
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// CloseWrite ends the data sent on the stream, like a tcp half-close
+func (st *muxStream) CloseWrite() error {
+	st.mu.Lock()
+	if st.writeDone || st.err != nil {
+		st.mu.Unlock()
+		return nil
+	}
+	st.writeDone = true
+	st.cond.Broadcast()
+	st.mu.Unlock()
+	return st.session.write(muxClose, st.id, 0, nil)
+}
+
+// Close ends the stream, one the other side still sends on is reset
+func (st *muxStream) Close() error {
+	st.mu.Lock()
+	if st.closed {
+		st.mu.Unlock()
+		return nil
+	}
+	st.closed = true
+	kind := byte(0)
+	switch {
+	case st.err != nil:
+	case !st.remoteEOF:
+		kind = muxReset
+	case !st.writeDone:
+		kind = muxClose
+	}
+	st.writeDone = true
+	st.cond.Broadcast()
+	stopTimer(&st.readTimer)
+	stopTimer(&st.writeTimer)
+	st.mu.Unlock()
+
+	// later frames of the stream are dropped
+	st.session.remove(st.id)
+	if kind != 0 {
+		return st.session.write(kind, st.id, 0, nil)
+	}
+	return nil
+}
+
+func (st *muxStream) LocalAddr() net.Addr  { return st.session.conn.LocalAddr() }
+func (st *muxStream) RemoteAddr() net.Addr { return st.session.conn.RemoteAddr() }
+
+func (st *muxStream) SetDeadline(t time.Time) error {
+	st.SetReadDeadline(t)
+	return st.SetWriteDeadline(t)
+}
+
+func (st *muxStream) SetReadDeadline(t time.Time) error {
+	st.setDeadline(&st.readDeadline, &st.readTimer, t)
+	return nil
+}
+
+func (st *muxStream) SetWriteDeadline(t time.Time) error {
+	st.setDeadline(&st.writeDeadline, &st.writeTimer, t)
+	return nil
+}
+
+// setDeadline wakes up blocked reads or writes once the deadline passes, a
+// frame already being written to the session is not interrupted
+func (st *muxStream) setDeadline(deadline *time.Time, timer **time.Timer, t time.Time) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	*deadline = t
+	stopTimer(timer)
+	if d := time.Until(t); !t.IsZero() && d > 0 {
+		*timer = time.AfterFunc(d, func() {
+			st.mu.Lock()
+			defer st.mu.Unlock()
+			st.cond.Broadcast()
+		})
+	}
+	st.cond.Broadcast()
+}
+
+func stopTimer(timer **time.Timer) {
+	if *timer != nil {
+		(*timer).Stop()
+		*timer = nil
+	}
+}
+
+func expired(deadline time.Time) bool {
+	return !deadline.IsZero() && !time.Now().Before(deadline)
+}
+
+// muxDialer opens the connections of a tunnel as streams of one session over
+// a single forward to the go relay server, instead of a port-forward stream
+// per connection. A new session is set up once the forward changes or the
+// session breaks.
+type muxDialer struct {
+	port  uint16
+	token string
+
+	mu       sync.Mutex
+	upstream string
+	session  *muxSession
+}
+
+func (d *muxDialer) open(upstream string) (net.Conn, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.session == nil || d.upstream != upstream || d.session.broken() {
+		if d.session != nil {
+			d.session.close()
+		}
+		conn, err := dialUpstream(upstream, d.token)
+		if err != nil {
+			return nil, err
+		}
+		d.session, d.upstream = newMuxSession(conn, nil), upstream
+	}
+	return d.session.open(d.port)
+}
+
+// closeWrite half-closes a tcp connection or a stream
+func closeWrite(conn net.Conn) {
+	if c, ok := conn.(interface{ CloseWrite() error }); ok {
+		c.CloseWrite()
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// muxPair is a client and a server session over a pipe, the streams the
+// server accepts are passed on
+func muxPair(t *testing.T) (*muxSession, <-chan *muxStream) {
+	a, b := net.Pipe()
+	accepted := make(chan *muxStream, 1)
+	client := newMuxSession(a, nil)
+	server := newMuxSession(b, func(st *muxStream) { accepted <- st })
+	t.Cleanup(func() {
+		client.close()
+		server.close()
+	})
+	return client, accepted
+}
+
+func openStream(t *testing.T, client *muxSession, accepted <-chan *muxStream) (*muxStream, *muxStream) {
+	t.Helper()
+	st, err := client.open(80)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case remote := <-accepted:
+		if remote.port != 80 {
+			t.Fatalf("stream opened to port %d, want 80", remote.port)
+		}
+		return st, remote
+	case <-time.After(time.Second):
+		t.Fatal("stream was not accepted")
+	}
+	return nil, nil
+}
+
+func TestMuxStreamData(t *testing.T) {
+	client, accepted := muxPair(t)
+	st, remote := openStream(t, client, accepted)
+	if _, err := st.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(remote, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("got %q: %v", buf, err)
+	}
+	if _, err := remote.Write([]byte("pong")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(st, buf); err != nil || string(buf) != "pong" {
+		t.Fatalf("got %q: %v", buf, err)
+	}
+}
+
+func TestMuxStreamWindow(t *testing.T) {
+	client, accepted := muxPair(t)
+	st, remote := openStream(t, client, accepted)
+	data := bytes.Repeat([]byte("x"), 2*MUX_WINDOW)
+
+	// nothing is read on the other side, so the window runs out
+	st.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+	n, err := st.Write(data)
+	if !errors.Is(err, os.ErrDeadlineExceeded) || n != MUX_WINDOW {
+		t.Fatalf("wrote %d bytes: %v, want %d bytes and a deadline error", n, err, MUX_WINDOW)
+	}
+
+	// reading grants the window again and the rest goes through
+	st.SetWriteDeadline(time.Time{})
+	written := make(chan error, 1)
+	go func() {
+		_, err := st.Write(data[n:])
+		written <- err
+	}()
+	got := make([]byte, len(data))
+	if _, err := io.ReadFull(remote, got); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("read %d bytes: %v", len(got), err)
+	}
+	if err := <-written; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMuxStreamHalfClose(t *testing.T) {
+	client, accepted := muxPair(t)
+	st, remote := openStream(t, client, accepted)
+	if err := st.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.Write([]byte("late")); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("expected a write after the half-close to fail, got %v", err)
+	}
+	if _, err := remote.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected the end of the stream, got %v", err)
+	}
+
+	// the other direction still works until that side is closed too
+	if _, err := remote.Write([]byte("reply")); err != nil {
+		t.Fatal(err)
+	}
+	remote.Close()
+	got, err := io.ReadAll(st)
+	if err != nil || string(got) != "reply" {
+		t.Fatalf("got %q: %v", got, err)
+	}
+}
+
+func TestMuxStreamReset(t *testing.T) {
+	client, accepted := muxPair(t)
+	st, remote := openStream(t, client, accepted)
+
+	// closing a stream the other side may still send on resets it
+	st.Close()
+	if _, err := remote.Read(make([]byte, 1)); !errors.Is(err, errMuxReset) {
+		t.Fatalf("expected a reset, got %v", err)
+	}
+	if _, err := remote.Write([]byte("gone")); !errors.Is(err, errMuxReset) {
+		t.Errorf("expected a write to a reset stream to fail, got %v", err)
+	}
+
+	// a broken session resets all of its streams
+	st, remote = openStream(t, client, accepted)
+	client.close()
+	if _, err := st.Read(make([]byte, 1)); !errors.Is(err, errMuxClosed) {
+		t.Errorf("expected the session to be closed, got %v", err)
+	}
+	if _, err := remote.Read(make([]byte, 1)); !errors.Is(err, errMuxClosed) {
+		t.Errorf("expected the session to be closed, got %v", err)
+	}
+	if _, err := client.open(80); !errors.Is(err, errMuxClosed) {
+		t.Errorf("expected an open on a closed session to fail, got %v", err)
+	}
+}
+
+func TestMuxStreamReadDeadline(t *testing.T) {
+	client, accepted := muxPair(t)
+	st, remote := openStream(t, client, accepted)
+	st.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := st.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected a deadline error, got %v", err)
+	}
+	st.SetReadDeadline(time.Time{})
+	remote.Write([]byte("y"))
+	if _, err := st.Read(make([]byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+}
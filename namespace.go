@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// spawnWithFallback creates the relay pod in the first namespace that admits
+// it. Creation moves on to the next fallback namespace if it is forbidden,
+// which includes exceeded resource quotas and the admin allow list.
+func spawnWithFallback(rc *relayClient, namespace string, opts relayOptions) (string, string, error) {
+	defaults, err := rc.clusterDefaults()
+	if err != nil {
+		return namespace, "", err
+	}
+	namespaces := append([]string{namespace}, opts.namespaceFallback...)
+	for i, ns := range namespaces {
+		var name string
+		if defaults.allows(ns) {
+			name, err = spawn(rc.clientset, ns, opts, defaults)
+		} else {
+			err = namespaceNotAllowed(ns, defaults)
+		}
+		if err == nil {
+			if i != 0 {
+				opts.log.printf("Relay pod landed in fallback namespace %q\n", ns)
+			}
+			return ns, name, nil
+		}
+		var rErr *relayError
+		notAllowed := errors.As(err, &rErr) && rErr.Code == "NamespaceNotAllowed"
+		if !(k8serrors.IsForbidden(err) || notAllowed) || i == len(namespaces)-1 {
+			return ns, "", err
+		}
+		opts.log.printf("Cannot create pod in namespace %q, trying %q: %s\n", ns, namespaces[i+1], err)
+	}
+	return namespace, "", err
+}
+
+func namespaceNotAllowed(namespace string, defaults *clusterDefaults) error {
+	return &relayError{
+		Code:       "NamespaceNotAllowed",
+		Reason:     fmt.Sprintf("Relay pods are not allowed in namespace %q", namespace),
+		Resource:   fmt.Sprintf("ConfigMap/%s", DEFAULTS_NAME),
+		Suggestion: fmt.Sprintf("use one of the namespaces %s", strings.Join(defaults.allowedNamespaces, ", ")),
+		exitCode:   1,
+	}
+}
+
+// ensureNamespace creates the namespace if it doesn't exist, it tells whether
+// it was created by kube-relay.
+func ensureNamespace(client kubernetes.Interface, namespace string) (bool, error) {
+	_, err := client.CoreV1().Namespaces().Get(context.TODO(), namespace, metav1.GetOptions{})
+	if err == nil {
+		return false, nil
+	}
+	if !k8serrors.IsNotFound(err) {
+		return false, err
+	}
+	manifest := &v1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   namespace,
+			Labels: map[string]string{LABEL_MANAGED_BY: POD_NAME},
+		},
+	}
+	_, err = client.CoreV1().Namespaces().Create(context.TODO(), manifest, metav1.CreateOptions{})
+	if k8serrors.IsAlreadyExists(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	fmt.Printf("Created namespace %q\n", namespace)
+	return true, nil
+}
+
+func deleteNamespace(client kubernetes.Interface, namespace string) {
+	fmt.Printf("Delete namespace %q\n", namespace)
+	client.CoreV1().Namespaces().Delete(context.TODO(), namespace, metav1.DeleteOptions{})
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const LABEL_HOSTNAME = "kubernetes.io/hostname"
+const LABEL_ZONE = "topology.kubernetes.io/zone"
+
+// nearPod finds the pod behind a --near target, pod/<name> or <name> for a pod
+// and svc/<name> for the first ready endpoint of a service.
+func nearPod(client kubernetes.Interface, namespace string, target string) (*v1.Pod, error) {
+	name := strings.TrimPrefix(target, "pod/")
+	if strings.HasPrefix(target, "svc/") {
+		service := strings.TrimPrefix(target, "svc/")
+		endpoints, err := client.CoreV1().Endpoints(namespace).Get(context.TODO(), service, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		name = ""
+		for _, subset := range endpoints.Subsets {
+			for _, address := range subset.Addresses {
+				if address.TargetRef != nil && address.TargetRef.Kind == "Pod" {
+					name = address.TargetRef.Name
+					break
+				}
+			}
+		}
+		if name == "" {
+			return nil, fmt.Errorf("service %q has no ready pod endpoints", service)
+		}
+	}
+	return client.CoreV1().Pods(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+}
+
+// nearAffinity prefers the node of the target pod and then its zone, so chatty
+// protocols take no extra network hops. Preferences keep the relay schedulable
+// if the node is full.
+func nearAffinity(client kubernetes.Interface, namespace string, target string) (*v1.Affinity, error) {
+	pod, err := nearPod(client, namespace, target)
+	if err != nil {
+		return nil, err
+	}
+	if pod.Spec.NodeName == "" {
+		return nil, fmt.Errorf("pod %q of --near %s is not scheduled yet", pod.Name, target)
+	}
+
+	term := func(weight int32, key string, value string) v1.PreferredSchedulingTerm {
+		return v1.PreferredSchedulingTerm{
+			Weight: weight,
+			Preference: v1.NodeSelectorTerm{
+				MatchExpressions: []v1.NodeSelectorRequirement{
+					{Key: key, Operator: v1.NodeSelectorOpIn, Values: []string{value}},
+				},
+			},
+		}
+	}
+	hostname, zone := pod.Spec.NodeName, ""
+	node, err := client.CoreV1().Nodes().Get(context.TODO(), pod.Spec.NodeName, metav1.GetOptions{})
+	if err == nil {
+		if h, ok := node.Labels[LABEL_HOSTNAME]; ok {
+			hostname = h
+		}
+		zone = node.Labels[LABEL_ZONE]
+	}
+	terms := []v1.PreferredSchedulingTerm{term(100, LABEL_HOSTNAME, hostname)}
+	if zone != "" {
+		terms = append(terms, term(50, LABEL_ZONE, zone))
+	}
+	fmt.Printf("Placing relay near pod %q on node %q\n", pod.Name, pod.Spec.NodeName)
+
+	return &v1.Affinity{
+		NodeAffinity: &v1.NodeAffinity{
+			PreferredDuringSchedulingIgnoredDuringExecution: terms,
+		},
+	}, nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	apiv1 "k8s.io/api/core/v1"
+	utilrand "k8s.io/apimachinery/pkg/util/rand"
+)
+
+// a relay pod in the network of its node listens on ports of this range, below
+// the ephemeral ports of linux. The fixed ports of a relay pod would collide
+// with other relays on the node and with daemons like node-exporter on 9100.
+const HOST_PORT_BASE = 20000
+const HOST_PORT_RANGE = 12000
+
+// hostNetwork runs the relay pod in the network of its node, so daemons bound
+// to the node ip or its localhost are reachable, e.g. the kubelet. Services
+// are still resolved by the cluster dns.
+func hostNetwork(pod *apiv1.Pod) {
+	pod.Spec.HostNetwork = true
+	pod.Spec.DNSPolicy = apiv1.DNSClusterFirstWithHostNet
+}
+
+// pickHostPort picks the first of the consecutive ports of a relay pod in the
+// network of its node, one per target and the mux and control ports of the go
+// relay server, a block another relay or daemon uses already is unlikely
+func pickHostPort(targets int) int {
+	return HOST_PORT_BASE + utilrand.Intn(HOST_PORT_RANGE-targets-2)
+}
+
+// relayPort is the port of the first target of a relay pod, the others follow
+func (opts relayOptions) relayPort() int {
+	if opts.hostPort != 0 {
+		return opts.hostPort
+	}
+	return RELAY_PORT
+}
+
+// muxPort is the port of the multiplexed sessions of the go relay server
+func (opts relayOptions) muxPort() int {
+	if opts.hostPort != 0 {
+		return opts.hostPort + len(opts.targets())
+	}
+	return MUX_PORT
+}
+
+// controlPort is the port of the metrics and targets endpoint of the go relay
+// server
+func (opts relayOptions) controlPort() int {
+	if opts.hostPort != 0 {
+		return opts.hostPort + len(opts.targets()) + 1
+	}
+	return RELAY_CONTROL_PORT
+}
+
+// hostListen binds the forward listener of socat to localhost in the network
+// of the node, the node ip would expose it to everyone reaching the node.
+// Port forwards and the kubelet's probes connect through localhost.
+func hostListen(container *apiv1.Container) {
+	container.Args[0] += ",bind=" + LOOPBACK_ADDRESS
+	if probe := container.ReadinessProbe; probe != nil && probe.TCPSocket != nil {
+		probe.TCPSocket.Host = LOOPBACK_ADDRESS
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestHostNetworkPorts(t *testing.T) {
+	tests := []struct {
+		name string
+		opts relayOptions
+		args []string
+	}{
+		{"socat", relayOptions{engine: ENGINE_SOCAT, failover: []string{"db-2:5432"}}, nil},
+		{"go relay", relayOptions{engine: ENGINE_GO_RELAY, failover: []string{"db-2:5432"}}, []string{"--bind", "--control-port", "--read-only"}},
+		{"go relay with mux", relayOptions{engine: ENGINE_GO_RELAY, mux: true}, []string{"--mux-port", "--control-port"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := tt.opts
+			opts.name, opts.clusterHost, opts.clusterPort, opts.podImage = POD_NAME, "db-1", 5432, POD_IMAGE
+			opts.hostNetwork = true
+			opts.hostPort = pickHostPort(len(opts.targets()))
+			last := opts.controlPort()
+			if opts.hostPort < HOST_PORT_BASE || last >= HOST_PORT_BASE+HOST_PORT_RANGE {
+				t.Fatalf("ports %d-%d outside of the host port range", opts.hostPort, last)
+			}
+			manifest, err := relayManifest(opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !manifest.Spec.HostNetwork {
+				t.Fatalf("expected a host network pod")
+			}
+			var args []string
+			for _, c := range manifest.Spec.Containers {
+				args = append(args, c.Args...)
+			}
+			joined := strings.Join(args, " ")
+			for _, fixed := range []int{RELAY_PORT, RELAY_CONTROL_PORT, MUX_PORT} {
+				if strings.Contains(joined, strconv.Itoa(fixed)) {
+					t.Errorf("a host network relay uses the fixed port %d: %s", fixed, joined)
+				}
+			}
+			if !strings.Contains(joined, strconv.Itoa(opts.relayPort())) {
+				t.Errorf("expected the relay port %d in %s", opts.relayPort(), joined)
+			}
+			for _, a := range tt.args {
+				if !strings.Contains(joined, a) {
+					t.Errorf("expected %s in %s", a, joined)
+				}
+			}
+		})
+	}
+}
+
+func TestRelayServerReadOnly(t *testing.T) {
+	route, err := parseRelayRoute("9000=db-1:5432")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		readOnly bool
+		status   int
+		target   string
+	}{
+		{false, http.StatusNoContent, "db-2:5432"},
+		{true, http.StatusForbidden, "db-1:5432"},
+	}
+	for _, tt := range tests {
+		route.target.Store("db-1:5432")
+		s := &relayServer{routes: []*relayRoute{route}, readOnly: tt.readOnly, logs: json.NewEncoder(io.Discard)}
+		w := httptest.NewRecorder()
+		s.targets(w, httptest.NewRequest(http.MethodPut, "/targets/9000", strings.NewReader("db-2:5432")))
+		if w.Code != tt.status || route.currentTarget() != tt.target {
+			t.Errorf("read only %v: got %d and %s, want %d and %s", tt.readOnly, w.Code, route.currentTarget(), tt.status, tt.target)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
+	"sigs.k8s.io/yaml"
+)
+
+// podOverrides patch the generated relay pod with anything the flags don't
+// cover, like volumes, env or sidecars. A yaml or json object is a strategic
+// merge patch, a list of operations a json patch.
+type podOverrides struct {
+	strategic []byte
+	jsonPatch jsonpatch.Patch
+}
+
+func loadPodOverrides(path string) (*podOverrides, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	patch, err := yaml.YAMLToJSON(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pod overrides %s: %w", path, err)
+	}
+	if bytes.HasPrefix(bytes.TrimSpace(patch), []byte("[")) {
+		ops, err := jsonpatch.DecodePatch(patch)
+		if err != nil {
+			return nil, fmt.Errorf("invalid json patch in pod overrides %s: %w", path, err)
+		}
+		return &podOverrides{jsonPatch: ops}, nil
+	}
+	// the patch has to fit a pod, a typo shouldn't pass silently
+	if err := yaml.UnmarshalStrict(data, &apiv1.Pod{}); err != nil {
+		return nil, fmt.Errorf("invalid strategic merge patch in pod overrides %s: %w", path, err)
+	}
+	return &podOverrides{strategic: patch}, nil
+}
+
+// apply patches a pod manifest, no overrides leave it as it is
+func (o *podOverrides) apply(pod *apiv1.Pod) (*apiv1.Pod, error) {
+	if o == nil {
+		return pod, nil
+	}
+	original, err := json.Marshal(pod)
+	if err != nil {
+		return nil, err
+	}
+	var patched []byte
+	if o.jsonPatch != nil {
+		patched, err = o.jsonPatch.Apply(original)
+	} else {
+		patched, err = strategicpatch.StrategicMergePatch(original, o.strategic, apiv1.Pod{})
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot apply the pod overrides: %w", err)
+	}
+	result := &apiv1.Pod{}
+	if err := json.Unmarshal(patched, result); err != nil {
+		return nil, fmt.Errorf("pod overrides make an invalid pod: %w", err)
+	}
+	return result, nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/user"
+	"regexp"
+	"sort"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/rand"
+	"k8s.io/client-go/kubernetes"
+)
+
+// relay pods get a generated name, these labels tell whose they are and what
+// they relay to. LABEL_NAME keeps the name a pod was generated from, e.g. the
+// tunnel of a config file.
+const LABEL_NAME = "kube-relay/name"
+const LABEL_USER = "kube-relay/user"
+const LABEL_HOST = "kube-relay/host"
+const LABEL_PID = "kube-relay/pid"
+const LABEL_TARGET = "kube-relay/target"
+
+// ANNOTATION_TARGET keeps the target as host:port, the label can't hold a colon
+const ANNOTATION_TARGET = "kube-relay/target"
+
+var invalidLabelChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// labelValue turns a string into a valid label value
+func labelValue(s string) string {
+	s = invalidLabelChars.ReplaceAllString(s, "-")
+	if len(s) > 63 {
+		s = s[:63]
+	}
+	return strings.Trim(s, "-_.")
+}
+
+func currentUser() string {
+	if u, err := user.Current(); err == nil {
+		return labelValue(u.Username)
+	}
+	return ""
+}
+
+func currentHost() string {
+	host, _ := os.Hostname()
+	return labelValue(host)
+}
+
+// ownerLabels identify the relay pods of this process
+func ownerLabels() map[string]string {
+	return map[string]string{
+		LABEL_MANAGED_BY: POD_NAME,
+		LABEL_USER:       currentUser(),
+		LABEL_HOST:       currentHost(),
+		LABEL_PID:        fmt.Sprint(os.Getpid()),
+	}
+}
+
+// newInstance returns the instance label of a new relay, services and budgets
+// select the relay pod by it, as its name is only known once it is created
+func newInstance(name string) string {
+	if len(name) > 57 {
+		name = name[:57]
+	}
+	return fmt.Sprintf("%s-%s", name, rand.String(5))
+}
+
+// ownPods lists the relay pods generated from a name by this user on this
+// machine, the newest first
+func ownPods(client kubernetes.Interface, namespace string, name string) ([]v1.Pod, error) {
+	selector := labels.SelectorFromSet(map[string]string{
+		LABEL_MANAGED_BY: POD_NAME,
+		LABEL_NAME:       labelValue(name),
+		LABEL_USER:       currentUser(),
+		LABEL_HOST:       currentHost(),
+	})
+	list, err := client.CoreV1().Pods(namespace).List(context.TODO(), metav1.ListOptions{LabelSelector: selector.String()})
+	if err != nil {
+		return nil, err
+	}
+	pods := list.Items
+	sort.Slice(pods, func(i, j int) bool { return pods[j].CreationTimestamp.Before(&pods[i].CreationTimestamp) })
+	return pods, nil
+}
+
+// findPod resolves a name given by the user to a relay pod, either the pod of
+// that name or the newest own pod generated from it. Without a match the name
+// is returned, so lookups fail with not found.
+func findPod(client kubernetes.Interface, namespace string, name string) string {
+	if _, err := client.CoreV1().Pods(namespace).Get(context.TODO(), name, metav1.GetOptions{}); err == nil {
+		return name
+	}
+	pods, err := ownPods(client, namespace, name)
+	if err != nil || len(pods) == 0 {
+		return name
+	}
+	return pods[0].Name
+}
+
+// cleanupOwned deletes the relay pods of this process in a namespace, e.g. on
+// a signal, when the names of the pods are not at hand
+func cleanupOwned(client kubernetes.Interface, namespace string, log *logger) {
+	selector := labels.SelectorFromSet(ownerLabels())
+	list, err := client.CoreV1().Pods(namespace).List(context.TODO(), metav1.ListOptions{LabelSelector: selector.String()})
+	if err != nil {
+		return
+	}
+	for _, pod := range list.Items {
+		cleanup(client, namespace, pod.Name, log)
+	}
+}
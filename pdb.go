@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+
+	policyv1 "k8s.io/api/policy/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes"
+)
+
+const LABEL_INSTANCE = "app.kubernetes.io/instance"
+
+// createDisruptionBudget guards the relay pod against voluntary disruptions, a
+// node drain waits and warns instead of evicting it. The budget is owned by
+// the pod and garbage collected with it.
+func createDisruptionBudget(client kubernetes.Interface, namespace string, name string, log *logger) error {
+	pod, err := client.CoreV1().Pods(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	minAvailable := intstr.FromInt(1)
+	manifest := &policyv1.PodDisruptionBudget{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   name,
+			Labels: map[string]string{LABEL_MANAGED_BY: POD_NAME},
+			OwnerReferences: []metav1.OwnerReference{{
+				APIVersion: "v1",
+				Kind:       "Pod",
+				Name:       pod.Name,
+				UID:        pod.UID,
+			}},
+		},
+		Spec: policyv1.PodDisruptionBudgetSpec{
+			MinAvailable: &minAvailable,
+			Selector: &metav1.LabelSelector{
+				MatchLabels: map[string]string{LABEL_INSTANCE: pod.Labels[LABEL_INSTANCE]},
+			},
+		},
+	}
+	_, err = client.PolicyV1().PodDisruptionBudgets(namespace).Create(context.TODO(), manifest, metav1.CreateOptions{})
+	if err != nil {
+		return err
+	}
+	log.printf("Created pod disruption budget %q\n", name)
+	return nil
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/urfave/cli/v2"
+	apiv1 "k8s.io/api/core/v1"
+)
+
+const PING_NAME = POD_NAME + "-ping"
+const PING_TUNNEL_PORT = RELAY_PORT + 1
+
+// the ping pod connects to the target for every connection and answers ok, or
+// the error of socat. The script goes in the environment, socat would split
+// the options of the connect from the command.
+const PING_SCRIPT = `socat -u OPEN:/dev/null "$PING_TARGET,connect-timeout=$PING_TIMEOUT" 2>&1 && echo ok`
+
+type pingOptions struct {
+	target   string
+	count    int
+	interval time.Duration
+	timeout  time.Duration
+	podImage string
+	log      *logger
+}
+
+// pingPod answers on one port once it connected to the target, and right away
+// on the next, which times the tunnel alone
+func pingPod(opts pingOptions) *apiv1.Pod {
+	ping := apiv1.Container{
+		Name:  "ping",
+		Image: opts.podImage,
+		Args:  []string{fmt.Sprintf("TCP-LISTEN:%d,fork,reuseaddr", RELAY_PORT), "SYSTEM:eval $PING_SCRIPT"},
+		Env: []apiv1.EnvVar{
+			{Name: "PING_SCRIPT", Value: PING_SCRIPT},
+			{Name: "PING_TARGET", Value: socatAddress(PROTOCOL_TCP, opts.target)},
+			{Name: "PING_TIMEOUT", Value: strconv.FormatFloat(opts.timeout.Seconds(), 'f', -1, 64)},
+		},
+		SecurityContext: containerSecurity(),
+	}
+	tunnel := apiv1.Container{
+		Name:            "tunnel",
+		Image:           opts.podImage,
+		Args:            []string{fmt.Sprintf("TCP-LISTEN:%d,fork,reuseaddr", PING_TUNNEL_PORT), "SYSTEM:echo ok"},
+		SecurityContext: containerSecurity(),
+	}
+	manifest := relayPod(PING_NAME, newInstance(PING_NAME), time.Second, ping, tunnel)
+	manifest.Annotations = map[string]string{ANNOTATION_TARGET: opts.target}
+	return manifest
+}
+
+// pingPort opens a connection through a forward and waits for the answer of
+// the pod, it is the error of socat unless the answer is ok
+func pingPort(port uint, timeout time.Duration) (time.Duration, error) {
+	start := time.Now()
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(LOOPBACK_ADDRESS, fmt.Sprint(port)), timeout)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	// the pod takes up to the connect timeout itself
+	conn.SetReadDeadline(start.Add(2 * timeout))
+	answer, err := io.ReadAll(conn)
+	elapsed := time.Since(start)
+	if err != nil {
+		return elapsed, err
+	}
+	line := strings.TrimSpace(string(answer))
+	if line == "ok" {
+		return elapsed, nil
+	}
+	if line == "" {
+		return elapsed, fmt.Errorf("connection closed by the relay pod")
+	}
+	// socat prefixes its errors with a timestamp, the pid and the level
+	if i := strings.Index(line, " E "); i != -1 {
+		line = line[i+3:]
+	}
+	return elapsed, fmt.Errorf("%s", line)
+}
+
+// pingStats are min, avg, max and the standard deviation of a series
+type pingStats struct {
+	samples []time.Duration
+}
+
+func (s *pingStats) add(d time.Duration) {
+	s.samples = append(s.samples, d)
+}
+
+func (s *pingStats) String() string {
+	if len(s.samples) == 0 {
+		return "-"
+	}
+	min, max, sum := s.samples[0], s.samples[0], time.Duration(0)
+	for _, d := range s.samples {
+		if d < min {
+			min = d
+		}
+		if d > max {
+			max = d
+		}
+		sum += d
+	}
+	avg := float64(sum) / float64(len(s.samples))
+	var variance float64
+	for _, d := range s.samples {
+		variance += (float64(d) - avg) * (float64(d) - avg)
+	}
+	stddev := math.Sqrt(variance / float64(len(s.samples)))
+	ms := func(f float64) string { return strconv.FormatFloat(f/float64(time.Millisecond), 'f', 3, 64) }
+	return fmt.Sprintf("%s/%s/%s/%s ms", ms(float64(min)), ms(avg), ms(float64(max)), ms(stddev))
+}
+
+// pingLoop times connections to the target through the ping port, the tunnel
+// alone through the tunnel port and a request to the api server, so the
+// difference tells where time goes
+func pingLoop(rc *relayClient, opts pingOptions, port uint, tunnelPort uint, interrupt <-chan struct{}) {
+	var connect, tunnel, api, backend pingStats
+	sent, failed := 0, 0
+pings:
+	for opts.count == 0 || sent < opts.count {
+		if sent != 0 {
+			select {
+			case <-interrupt:
+				break pings
+			case <-time.After(opts.interval):
+			}
+		}
+		sent++
+		start := time.Now()
+		_, apiErr := rc.clientset.Discovery().ServerVersion()
+		apiTime := time.Since(start)
+		tunnelTime, tunnelErr := pingPort(tunnelPort, opts.timeout)
+		connectTime, err := pingPort(port, opts.timeout)
+		switch {
+		case apiErr != nil:
+			err = fmt.Errorf("api server: %s", apiErr)
+		case tunnelErr != nil:
+			err = fmt.Errorf("tunnel: %s", tunnelErr)
+		}
+		if err != nil {
+			failed++
+			fmt.Printf("%s: seq=%d failed after %s: %s\n", opts.target, sent, round(connectTime), err)
+			continue
+		}
+		backendTime := connectTime - tunnelTime
+		if backendTime < 0 {
+			backendTime = 0
+		}
+		connect.add(connectTime)
+		tunnel.add(tunnelTime)
+		api.add(apiTime)
+		backend.add(backendTime)
+		fmt.Printf("%s: seq=%d time=%s tunnel=%s backend=%s api=%s\n", opts.target, sent, round(connectTime), round(tunnelTime), round(backendTime), round(apiTime))
+	}
+
+	fmt.Printf("\n--- %s ping statistics ---\n", opts.target)
+	fmt.Printf("%d connections, %d failed\n", sent, failed)
+	fmt.Printf("connect min/avg/max/stddev = %s\n", &connect)
+	fmt.Printf("tunnel  min/avg/max/stddev = %s\n", &tunnel)
+	fmt.Printf("backend min/avg/max/stddev = %s\n", &backend)
+	fmt.Printf("api     min/avg/max/stddev = %s\n", &api)
+}
+
+func round(d time.Duration) time.Duration {
+	return d.Round(10 * time.Microsecond)
+}
+
+// ping starts a ping pod and times connections to the target through it until
+// the count is reached or it is interrupted
+func ping(kube *kubeOptions, opts pingOptions) error {
+	namespace, rc, err := connect(kube)
+	if err != nil {
+		return err
+	}
+	defaults, err := rc.clusterDefaults()
+	if err != nil {
+		return err
+	}
+	if !defaults.allows(namespace) {
+		return namespaceNotAllowed(namespace, defaults)
+	}
+
+	// an interrupt while pinging prints the statistics, before that it only
+	// deletes the pod
+	var mu sync.Mutex
+	var pinging bool
+	interrupt := make(chan struct{})
+	ctrlc := make(chan os.Signal, 1)
+	signal.Notify(ctrlc, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(ctrlc)
+	go func() {
+		<-ctrlc
+		mu.Lock()
+		defer mu.Unlock()
+		if pinging {
+			close(interrupt)
+			return
+		}
+		cleanupOwned(rc.clientset, namespace, opts.log)
+		recordTelemetryExit(errInterrupted)
+		os.Exit(1)
+	}()
+
+	name, err := createPod(rc.clientset, namespace, pingPod(opts), defaults, opts.log)
+	if err != nil {
+		return withExitCode(err, EXIT_POD_CREATE)
+	}
+	defer cleanup(rc.clientset, namespace, name, opts.log)
+	if err := wait(rc, namespace, name, WAIT_FOR_RUNNING, SCHEDULE_TIMEOUT, WAIT_TIMEOUT, opts.log); err != nil {
+		reportStartup(rc.clientset, namespace, name, opts.log)
+		return withExitCode(err, EXIT_POD_START)
+	}
+
+	stop := make(chan struct{})
+	tunnelPort, tunnelErr := make(chan uint, 1), make(chan error, 1)
+	go func() {
+		tunnelErr <- forwardUntil(rc, namespace, name, 0, PING_TUNNEL_PORT, stop, func(port uint) error {
+			tunnelPort <- port
+			return nil
+		})
+	}()
+	done := false
+	err = forwardUntil(rc, namespace, name, 0, RELAY_PORT, stop, func(port uint) error {
+		defer close(stop)
+		var tunnel uint
+		select {
+		case tunnel = <-tunnelPort:
+		case err := <-tunnelErr:
+			tunnelErr <- err
+			return nil
+		}
+		mu.Lock()
+		pinging = true
+		mu.Unlock()
+		fmt.Printf("PING %s through pod %q\n", opts.target, name)
+		pingLoop(rc, opts, port, tunnel, interrupt)
+		done = true
+		return nil
+	})
+	if err == nil && !done {
+		select {
+		case err = <-tunnelErr:
+		default:
+		}
+		if err == nil {
+			err = fmt.Errorf("the forward to the ping pod ended before the run")
+		}
+	}
+	if err != nil {
+		return withExitCode(err, EXIT_FORWARD_LOST)
+	}
+	return nil
+}
+
+func pingCommand(kube *kubeOptions) *cli.Command {
+	opts := pingOptions{log: &logger{out: os.Stderr}}
+	var quiet bool
+
+	return &cli.Command{
+		Name:      "ping",
+		Usage:     "time tcp connections to a cluster host through a relay pod, the tunnel and the api server",
+		ArgsUsage: "<host>:<port>",
+		Flags: []cli.Flag{
+			&cli.IntFlag{
+				Name:        "count",
+				Aliases:     []string{"c"},
+				Usage:       "stop after this many connections, 0 pings until interrupted",
+				Value:       5,
+				Destination: &opts.count,
+			},
+			&cli.DurationFlag{
+				Name:        "interval",
+				Aliases:     []string{"i"},
+				Usage:       "wait between connections",
+				Value:       time.Second,
+				Destination: &opts.interval,
+			},
+			&cli.DurationFlag{
+				Name:        "timeout",
+				Usage:       "how long the relay pod waits for the target to accept",
+				Value:       5 * time.Second,
+				Destination: &opts.timeout,
+			},
+			&cli.StringFlag{
+				Name:        "pod-image",
+				Usage:       "image of the ping pod, it needs socat",
+				Value:       POD_IMAGE,
+				Destination: &opts.podImage,
+			},
+			&cli.BoolFlag{
+				Name:        "quiet",
+				Aliases:     []string{"q"},
+				Usage:       "do not print progress to stderr",
+				Destination: &quiet,
+			},
+		},
+		Action: func(c *cli.Context) error {
+			if !c.Args().Present() {
+				return fmt.Errorf("missing target")
+			}
+			opts.target = c.Args().First()
+			host, port, err := net.SplitHostPort(opts.target)
+			if err != nil || host == "" {
+				return fmt.Errorf("invalid target %q, expected <host>:<port>", opts.target)
+			}
+			if p, err := strconv.ParseUint(port, 10, 16); err != nil || p == 0 {
+				return fmt.Errorf("invalid port %q in target %q", port, opts.target)
+			}
+			if opts.count < 0 || opts.interval < 0 || opts.timeout <= 0 {
+				return fmt.Errorf("--count and --interval need positive values or 0, --timeout a positive one")
+			}
+			if quiet {
+				opts.log.out = io.Discard
+			}
+			return ping(kube, opts)
+		},
+	}
+}
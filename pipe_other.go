@@ -0,0 +1,13 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"fmt"
+	"net"
+)
+
+func listenPipe(path string) (net.Listener, error) {
+	return nil, fmt.Errorf("named pipes are only supported on windows, use --local-socket")
+}
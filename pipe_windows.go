@@ -0,0 +1,190 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+const PIPE_BUFFER = 64 * 1024
+
+type pipeAddr string
+
+func (a pipeAddr) Network() string { return "pipe" }
+func (a pipeAddr) String() string  { return string(a) }
+
+// pipeListener accepts the clients of a named pipe, there is always a pipe
+// instance waiting for the next client
+type pipeListener struct {
+	name *uint16
+	addr pipeAddr
+	sa   *windows.SecurityAttributes
+
+	mu     sync.Mutex
+	next   windows.Handle
+	closed bool
+}
+
+// listenPipe creates a named pipe only the user may open and no remote
+// client, it fails if the pipe exists already
+func listenPipe(path string) (net.Listener, error) {
+	name, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return nil, err
+	}
+	user, err := windows.GetCurrentProcessToken().GetTokenUser()
+	if err != nil {
+		return nil, err
+	}
+	sd, err := windows.SecurityDescriptorFromString(fmt.Sprintf("D:P(A;;GA;;;%s)", user.User.Sid))
+	if err != nil {
+		return nil, err
+	}
+	sa := &windows.SecurityAttributes{SecurityDescriptor: sd}
+	sa.Length = uint32(unsafe.Sizeof(*sa))
+	l := &pipeListener{name: name, addr: pipeAddr(path), sa: sa}
+	if l.next, err = l.create(true); err != nil {
+		if err == windows.ERROR_ACCESS_DENIED {
+			return nil, fmt.Errorf("named pipe %s is already in use", path)
+		}
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *pipeListener) create(first bool) (windows.Handle, error) {
+	flags := uint32(windows.PIPE_ACCESS_DUPLEX | windows.FILE_FLAG_OVERLAPPED)
+	if first {
+		flags |= windows.FILE_FLAG_FIRST_PIPE_INSTANCE
+	}
+	mode := uint32(windows.PIPE_TYPE_BYTE | windows.PIPE_READMODE_BYTE | windows.PIPE_WAIT | windows.PIPE_REJECT_REMOTE_CLIENTS)
+	return windows.CreateNamedPipe(l.name, flags, mode, windows.PIPE_UNLIMITED_INSTANCES, PIPE_BUFFER, PIPE_BUFFER, 0, l.sa)
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	l.mu.Lock()
+	handle, closed := l.next, l.closed
+	l.mu.Unlock()
+	if closed {
+		return nil, net.ErrClosed
+	}
+
+	_, err := overlapped(handle, func(done *uint32, o *windows.Overlapped) error {
+		return windows.ConnectNamedPipe(handle, o)
+	})
+	// the client may connect before the pipe waits for it
+	if err == windows.ERROR_PIPE_CONNECTED {
+		err = nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	// close closed the handle already
+	if l.closed {
+		return nil, net.ErrClosed
+	}
+	next, nErr := l.create(false)
+	if nErr != nil {
+		windows.CloseHandle(handle)
+		l.closed = true
+		return nil, nErr
+	}
+	l.next = next
+	if err != nil {
+		windows.CloseHandle(handle)
+		return nil, err
+	}
+	return &pipeConn{handle: handle, addr: l.addr}, nil
+}
+
+func (l *pipeListener) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return nil
+	}
+	l.closed = true
+	windows.CancelIoEx(l.next, nil)
+	return windows.CloseHandle(l.next)
+}
+
+func (l *pipeListener) Addr() net.Addr {
+	return l.addr
+}
+
+// overlapped runs an overlapped operation on a handle and waits for it, so
+// reads and writes of a pipe don't block each other
+func overlapped(handle windows.Handle, op func(done *uint32, o *windows.Overlapped) error) (int, error) {
+	event, err := windows.CreateEvent(nil, 1, 0, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer windows.CloseHandle(event)
+	o := &windows.Overlapped{HEvent: event}
+	var done uint32
+	err = op(&done, o)
+	if err == windows.ERROR_IO_PENDING {
+		err = windows.GetOverlappedResult(handle, o, &done, true)
+	}
+	return int(done), err
+}
+
+// pipeConn is a client of a named pipe
+type pipeConn struct {
+	handle    windows.Handle
+	addr      pipeAddr
+	closeOnce sync.Once
+}
+
+func (c *pipeConn) Read(b []byte) (int, error) {
+	n, err := overlapped(c.handle, func(done *uint32, o *windows.Overlapped) error {
+		return windows.ReadFile(c.handle, b, done, o)
+	})
+	if err == nil && n == 0 && len(b) != 0 {
+		return 0, io.EOF
+	}
+	return n, pipeError(err)
+}
+
+func (c *pipeConn) Write(b []byte) (int, error) {
+	n, err := overlapped(c.handle, func(done *uint32, o *windows.Overlapped) error {
+		return windows.WriteFile(c.handle, b, done, o)
+	})
+	return n, pipeError(err)
+}
+
+// pipeError maps a disconnected client to the end of the stream and a read
+// or write cancelled by close to a closed connection
+func pipeError(err error) error {
+	switch err {
+	case windows.ERROR_BROKEN_PIPE, windows.ERROR_PIPE_NOT_CONNECTED:
+		return io.EOF
+	case windows.ERROR_OPERATION_ABORTED:
+		return net.ErrClosed
+	}
+	return err
+}
+
+func (c *pipeConn) Close() error {
+	err := error(nil)
+	c.closeOnce.Do(func() {
+		windows.CancelIoEx(c.handle, nil)
+		err = windows.CloseHandle(c.handle)
+	})
+	return err
+}
+
+func (c *pipeConn) LocalAddr() net.Addr  { return c.addr }
+func (c *pipeConn) RemoteAddr() net.Addr { return c.addr }
+
+// deadlines are not needed, the tunnel closes connections instead
+func (c *pipeConn) SetDeadline(time.Time) error      { return nil }
+func (c *pipeConn) SetReadDeadline(time.Time) error  { return nil }
+func (c *pipeConn) SetWriteDeadline(time.Time) error { return nil }
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+	"sigs.k8s.io/yaml"
+)
+
+// parseNodeSelector parses node selector terms given as key=value
+func parseNodeSelector(terms []string) (map[string]string, error) {
+	return parseKeyValues(terms, "node selector")
+}
+
+// parseToleration parses a toleration like the taints of kubectl taint,
+// "<key>[=<value>][:<effect>]". Without a value any value is tolerated,
+// without an effect any effect.
+func parseToleration(toleration string) (v1.Toleration, error) {
+	s := toleration
+	t := v1.Toleration{Operator: v1.TolerationOpExists}
+	if i := strings.LastIndex(s, ":"); i != -1 {
+		t.Effect, s = v1.TaintEffect(s[i+1:]), s[:i]
+		switch t.Effect {
+		case v1.TaintEffectNoSchedule, v1.TaintEffectPreferNoSchedule, v1.TaintEffectNoExecute:
+		default:
+			return t, fmt.Errorf("invalid effect %q in toleration, expected NoSchedule, PreferNoSchedule or NoExecute", t.Effect)
+		}
+	}
+	parts := strings.SplitN(s, "=", 2)
+	t.Key = parts[0]
+	if len(parts) == 2 {
+		t.Operator, t.Value = v1.TolerationOpEqual, parts[1]
+	}
+	// a second colon is left in the key or value, neither may hold one
+	if t.Key == "" || strings.Contains(s, ":") {
+		return t, fmt.Errorf("invalid toleration %q, expected <key>[=<value>][:<effect>]", toleration)
+	}
+	return t, nil
+}
+
+// loadAffinity reads the affinity of the relay pod from a yaml or json file
+func loadAffinity(path string) (*v1.Affinity, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	affinity := &v1.Affinity{}
+	if err := yaml.UnmarshalStrict(data, affinity); err != nil {
+		return nil, fmt.Errorf("invalid affinity %s: %w", path, err)
+	}
+	return affinity, nil
+}
+
+const SCHEDULE_TIMEOUT = time.Minute
+
+// nodeSummary tells how many nodes could take the relay pod and why the others
+// can't. The scheduler skips cordoned nodes, NoSchedule tainted nodes the pod
+// doesn't tolerate and nodes its node selector doesn't match. ok is false if
+// nodes can't be listed, which ordinary users often may not.
+func nodeSummary(client kubernetes.Interface, spec *v1.PodSpec) (schedulable int, summary string, ok bool) {
+	nodes, err := client.CoreV1().Nodes().List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		return 0, "", false
+	}
+	selector := labels.SelectorFromSet(spec.NodeSelector)
+	reasons := map[string]int{}
+	var order []string
+	count := func(reason string) {
+		if reasons[reason] == 0 {
+			order = append(order, reason)
+		}
+		reasons[reason]++
+	}
+	for _, n := range nodes.Items {
+		switch {
+		case spec.NodeName != "" && n.Name != spec.NodeName:
+			count("not the chosen node")
+		// a pod with a node name bypasses the scheduler, so cordons and
+		// taints don't keep it off
+		case n.Spec.Unschedulable && spec.NodeName == "":
+			count("cordoned")
+		case !nodeReady(n):
+			count("not ready")
+		case noScheduleTaint(n, spec.Tolerations) != "" && spec.NodeName == "":
+			count(fmt.Sprintf("tainted %s", noScheduleTaint(n, spec.Tolerations)))
+		case !selector.Matches(labels.Set(n.Labels)):
+			count("not matching the node selector")
+		default:
+			schedulable++
+		}
+	}
+	parts := []string{fmt.Sprintf("%d/%d nodes schedulable", schedulable, len(nodes.Items))}
+	for _, reason := range order {
+		parts = append(parts, fmt.Sprintf("%d %s", reasons[reason], reason))
+	}
+	return schedulable, strings.Join(parts, ", "), true
+}
+
+func nodeReady(n v1.Node) bool {
+	for _, c := range n.Status.Conditions {
+		if c.Type == v1.NodeReady {
+			return c.Status == v1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// noScheduleTaint returns the first taint of a node that keeps the pod away
+func noScheduleTaint(n v1.Node, tolerations []v1.Toleration) string {
+	for _, t := range n.Spec.Taints {
+		if t.Effect != v1.TaintEffectNoSchedule && t.Effect != v1.TaintEffectNoExecute {
+			continue
+		}
+		if !tolerates(tolerations, &t) {
+			return t.Key
+		}
+	}
+	return ""
+}
+
+func tolerates(tolerations []v1.Toleration, taint *v1.Taint) bool {
+	for i := range tolerations {
+		if tolerations[i].ToleratesTaint(taint) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkNodes fails before creating the relay pod if no node can take it
+func checkNodes(client kubernetes.Interface, spec *v1.PodSpec) error {
+	schedulable, summary, ok := nodeSummary(client, spec)
+	if !ok || schedulable != 0 {
+		return nil
+	}
+	return &relayError{
+		Code:       "NoSchedulableNodes",
+		Reason:     fmt.Sprintf("No node can run the relay pod: %s", summary),
+		Suggestion: "uncordon a node, wait for the cluster to scale up or adjust --node-selector and --toleration",
+		exitCode:   1,
+	}
+}
+
+func unschedulableMessage(pod *v1.Pod) string {
+	for _, c := range pod.Status.Conditions {
+		if c.Type == v1.PodScheduled && c.Status == v1.ConditionFalse && c.Reason == v1.PodReasonUnschedulable {
+			return c.Message
+		}
+	}
+	return ""
+}
+
+func unschedulableError(client kubernetes.Interface, pod *v1.Pod, timeout time.Duration) error {
+	reason := fmt.Sprintf("Pod %q could not be scheduled within %s: %s", pod.Name, timeout, unschedulableMessage(pod))
+	if _, summary, ok := nodeSummary(client, &pod.Spec); ok {
+		reason = fmt.Sprintf("%s (%s)", reason, summary)
+	}
+	return &relayError{
+		Code:       "Unschedulable",
+		Reason:     reason,
+		Resource:   fmt.Sprintf("pods/%s", pod.Name),
+		Suggestion: "check taints, node selectors and free capacity, or raise --schedule-timeout",
+		exitCode:   1,
+	}
+}
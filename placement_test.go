@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+func TestParseToleration(t *testing.T) {
+	tests := []struct {
+		in   string
+		want v1.Toleration
+		err  string
+	}{
+		{"dedicated", v1.Toleration{Key: "dedicated", Operator: v1.TolerationOpExists}, ""},
+		{"dedicated=relay", v1.Toleration{Key: "dedicated", Operator: v1.TolerationOpEqual, Value: "relay"}, ""},
+		{"dedicated=relay:NoSchedule", v1.Toleration{Key: "dedicated", Operator: v1.TolerationOpEqual, Value: "relay", Effect: v1.TaintEffectNoSchedule}, ""},
+		{"dedicated:NoExecute", v1.Toleration{Key: "dedicated", Operator: v1.TolerationOpExists, Effect: v1.TaintEffectNoExecute}, ""},
+		{"dedicated=:PreferNoSchedule", v1.Toleration{Key: "dedicated", Operator: v1.TolerationOpEqual, Effect: v1.TaintEffectPreferNoSchedule}, ""},
+		{"node.kubernetes.io/unreachable:NoExecute", v1.Toleration{Key: "node.kubernetes.io/unreachable", Operator: v1.TolerationOpExists, Effect: v1.TaintEffectNoExecute}, ""},
+		{"", v1.Toleration{}, "invalid toleration"},
+		{"=relay", v1.Toleration{}, "invalid toleration"},
+		{":NoSchedule", v1.Toleration{}, "invalid toleration"},
+		{"dedicated:", v1.Toleration{}, "invalid effect"},
+		{"dedicated=relay:noschedule", v1.Toleration{}, "invalid effect"},
+		{"dedicated=relay:NoSchedule:NoExecute", v1.Toleration{}, "invalid toleration"},
+		{"dedicated:NoSchedule:NoExecute", v1.Toleration{}, "invalid toleration"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := parseToleration(tt.in)
+			checkError(t, err, tt.err)
+			if err == nil && got != tt.want {
+				t.Errorf("parseToleration(%q) = %+v, want %+v", tt.in, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/term"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+)
+
+const SPINNER_INTERVAL = 100 * time.Millisecond
+
+var spinnerFrames = []string{"|", "/", "-", "\\"}
+
+// WAIT_PROGRESS_INTERVAL is how often a wait without a spinner tells it
+// still goes on
+const WAIT_PROGRESS_INTERVAL = 10 * time.Second
+
+// the steps of a starting pod: scheduled, pulling the image, started
+var progressReasons = map[string]bool{
+	"Scheduled": true,
+	"Pulling":   true,
+	"Pulled":    true,
+	"Started":   true,
+}
+
+// progress reports what happens while the relay pod starts, so a slow image
+// pull on a cold node does not look like a hang. On a terminal it also shows a
+// spinner with the elapsed time.
+type progress struct {
+	mu     sync.Mutex
+	start  time.Time
+	tty    bool
+	log    *logger
+	state  string
+	cancel context.CancelFunc
+	done   sync.WaitGroup
+}
+
+func startProgress(client kubernetes.Interface, namespace string, name string, uid types.UID, log *logger) *progress {
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &progress{
+		start:  time.Now(),
+		tty:    term.IsTerminal(int(os.Stdout.Fd())) && !log.prefixed() && log.writer() == os.Stdout,
+		log:    log,
+		cancel: cancel,
+	}
+
+	selector := fmt.Sprintf("involvedObject.kind=Pod,involvedObject.name=%s,involvedObject.uid=%s", name, uid)
+	eventWatch, err := client.CoreV1().Events(namespace).Watch(ctx, metav1.ListOptions{FieldSelector: selector})
+	if err == nil {
+		p.done.Add(1)
+		go func() {
+			defer p.done.Done()
+			defer eventWatch.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case e, ok := <-eventWatch.ResultChan():
+					if !ok {
+						return
+					}
+					if event, ok := e.Object.(*v1.Event); ok && progressReasons[event.Reason] {
+						p.printf("%s (%s)\n", event.Message, p.elapsed())
+					}
+				}
+			}
+		}()
+	}
+
+	if !p.tty {
+		p.done.Add(1)
+		go func() {
+			defer p.done.Done()
+			ticker := time.NewTicker(WAIT_PROGRESS_INTERVAL)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+					p.mu.Lock()
+					state := p.state
+					p.mu.Unlock()
+					p.printf("Still waiting for pod %q, %s (%s)\n", name, state, p.elapsed())
+				}
+			}
+		}()
+	}
+	if p.tty {
+		p.done.Add(1)
+		go func() {
+			defer p.done.Done()
+			ticker := time.NewTicker(SPINNER_INTERVAL)
+			defer ticker.Stop()
+			for i := 0; ; i++ {
+				select {
+				case <-ctx.Done():
+					p.printf("")
+					return
+				case <-ticker.C:
+					p.mu.Lock()
+					fmt.Printf("\r\033[K%s Waiting for pod %q (%s)", spinnerFrames[i%len(spinnerFrames)], name, p.elapsed())
+					p.mu.Unlock()
+				}
+			}
+		}()
+	}
+	return p
+}
+
+// observe keeps the latest state of the pod for progress messages
+func (p *progress) observe(pod *v1.Pod) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.state = podState(pod)
+}
+
+// podState describes how far a starting pod got
+func podState(pod *v1.Pod) string {
+	for _, c := range pod.Status.Conditions {
+		if c.Type == v1.PodScheduled && c.Status != v1.ConditionTrue {
+			return "not scheduled yet"
+		}
+	}
+	if pod.Spec.NodeName == "" {
+		return "not scheduled yet"
+	}
+	for _, cs := range pod.Status.ContainerStatuses {
+		if w := cs.State.Waiting; w != nil {
+			return fmt.Sprintf("container %q is %s", cs.Name, w.Reason)
+		}
+	}
+	return fmt.Sprintf("%s on node %q", pod.Status.Phase, pod.Spec.NodeName)
+}
+
+func (p *progress) elapsed() string {
+	return time.Since(p.start).Round(time.Second).String()
+}
+
+// printf prints a line, clearing the spinner first
+func (p *progress) printf(format string, a ...interface{}) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.tty {
+		fmt.Print("\r\033[K")
+	}
+	if format != "" {
+		p.log.printf(format, a...)
+	}
+}
+
+func (p *progress) stop() {
+	p.cancel()
+	p.done.Wait()
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+const PROXY_SOCKS = "socks"
+
+// proxyHandshake reads which target a proxy client asks for, it returns the
+// target as host:port and a reply confirming the connection to the client.
+type proxyHandshake func(client net.Conn) (string, []byte, error)
+
+var proxyHandshakes = map[string]proxyHandshake{
+	PROXY_SOCKS: socksHandshake,
+	PROXY_HTTP:  httpConnectHandshake,
+	PROXY_ROUTE: routeHandshake,
+}
+
+// serveProxy serves a proxy on the local port whose connections are made from
+// the relay pod, socat in the relay pod connects to the target a client asks
+// for, so any host resolvable in the cluster can be reached. ready is called
+// with the local port once the proxy listens.
+func serveProxy(rc *relayClient, namespace string, name string, opts relayOptions, ready func(uint) error) error {
+	handshake := proxyHandshakes[opts.proxy]
+	listener, err := net.Listen("tcp", net.JoinHostPort(opts.localAddress, fmt.Sprint(opts.localPort)))
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+	opts.log.printf("%s proxy listening on %s\n", opts.proxy, listener.Addr())
+	if opts.proxy == PROXY_ROUTE {
+		if err := addRoutes(opts.routes, opts.localPort, apiServerHost(rc)); err != nil {
+			removeRoutes(opts.localPort)
+			return err
+		}
+		defer removeRoutes(opts.localPort)
+	}
+	metrics := registerMetrics(name, opts.proxy)
+	if ready != nil {
+		if err := ready(uint(listener.Addr().(*net.TCPAddr).Port)); err != nil {
+			return err
+		}
+	}
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		client, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer client.Close()
+			target, reply, err := handshake(client)
+			if err != nil {
+				metrics.drop()
+				opts.log.printf("Dropped %s proxy client %s: %s\n", opts.proxy, client.RemoteAddr(), err)
+				return
+			}
+			if _, err := client.Write(reply); err != nil {
+				return
+			}
+			metrics.opened()
+			counted := &countingConn{Conn: client}
+			command := []string{"socat", "-", socatAddress(PROTOCOL_TCP, target)}
+			err = execStream(rc, namespace, name, command, counted, counted)
+			metrics.closed(atomic.LoadInt64(&counted.read), atomic.LoadInt64(&counted.written))
+			if err != nil {
+				opts.log.printf("Connection to %s failed: %s\n", target, err)
+			}
+		}()
+	}
+}
+
+// countingConn counts the bytes passing a connection
+type countingConn struct {
+	net.Conn
+	read    int64
+	written int64
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddInt64(&c.read, int64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddInt64(&c.written, int64(n))
+	return n, err
+}
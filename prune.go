@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/urfave/cli/v2"
+	v1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/duration"
+)
+
+const PRUNE_OLDER_THAN = 24 * time.Hour
+
+// orphaned tells why a relay pod has no relay anymore, if it has none. Pods of
+// this machine are orphans once their process is gone, pods of other machines
+// once they are older than olderThan. Pods of a running process are kept at
+// any age.
+func orphaned(pod v1.Pod, olderThan time.Duration) string {
+	if pod.DeletionTimestamp != nil {
+		return ""
+	}
+	// the age of a pod only counts when its process can't be checked
+	if pod.Labels[LABEL_USER] == currentUser() && pod.Labels[LABEL_HOST] == currentHost() {
+		if pid, err := strconv.Atoi(pod.Labels[LABEL_PID]); err == nil {
+			if processRunning(pid) {
+				return ""
+			}
+			return fmt.Sprintf("process %d is gone", pid)
+		}
+	}
+	if age := time.Since(pod.CreationTimestamp.Time); olderThan > 0 && age > olderThan {
+		return fmt.Sprintf("older than %s", duration.HumanDuration(olderThan))
+	}
+	return ""
+}
+
+// prune deletes orphaned relay pods, e.g. left behind by a crashed laptop
+func prune(kube *kubeOptions, allNamespaces bool, olderThan time.Duration, dryRun bool) error {
+	namespace, rc, err := connect(kube)
+	if err != nil {
+		return err
+	}
+	if allNamespaces {
+		namespace = metav1.NamespaceAll
+	}
+	selector := fmt.Sprintf("%s=%s", LABEL_MANAGED_BY, POD_NAME)
+	pods, err := rc.clientset.CoreV1().Pods(namespace).List(context.TODO(), metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return err
+	}
+
+	pruned := 0
+	for _, pod := range pods.Items {
+		reason := orphaned(pod, olderThan)
+		if reason == "" {
+			continue
+		}
+		pruned++
+		if dryRun {
+			fmt.Printf("Would delete pod %q in namespace %q, %s\n", pod.Name, pod.Namespace, reason)
+			continue
+		}
+		err := rc.clientset.CoreV1().Pods(pod.Namespace).Delete(context.TODO(), pod.Name, metav1.DeleteOptions{})
+		if err != nil && !k8serrors.IsNotFound(err) {
+			return err
+		}
+		fmt.Printf("Delete pod %q in namespace %q, %s\n", pod.Name, pod.Namespace, reason)
+	}
+	if pruned == 0 {
+		fmt.Println("No orphaned relay pods found")
+	}
+	return nil
+}
+
+func pruneCommand(kube *kubeOptions) *cli.Command {
+	var allNamespaces, dryRun bool
+	var olderThan time.Duration
+
+	return &cli.Command{
+		Name:  "prune",
+		Usage: "delete orphaned relay pods, whose process is gone or which are older than a threshold",
+		Flags: []cli.Flag{
+			&cli.BoolFlag{
+				Name:        "all-namespaces",
+				Aliases:     []string{"A"},
+				Usage:       "prune the relay pods of all namespaces",
+				Destination: &allNamespaces,
+			},
+			&cli.DurationFlag{
+				Name:        "older-than",
+				Usage:       "prune relay pods of any owner older than this, 0 only prunes pods of dead processes on this machine",
+				Value:       PRUNE_OLDER_THAN,
+				Destination: &olderThan,
+			},
+			&cli.BoolFlag{
+				Name:        "dry-run",
+				Usage:       "only print the pods that would be deleted",
+				Destination: &dryRun,
+			},
+		},
+		Action: func(c *cli.Context) error {
+			return prune(kube, allNamespaces, olderThan, dryRun)
+		},
+	}
+}
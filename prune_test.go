@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestOrphaned(t *testing.T) {
+	exited := exec.Command(os.Args[0], "-test.run=^$")
+	if err := exited.Run(); err != nil {
+		t.Fatal(err)
+	}
+	gone := exited.Process.Pid
+
+	day := 24 * time.Hour
+	tests := []struct {
+		name   string
+		host   string
+		pid    string
+		age    time.Duration
+		orphan bool
+	}{
+		{"running process", currentHost(), fmt.Sprint(os.Getpid()), 0, false},
+		{"old relay of a running process", currentHost(), fmt.Sprint(os.Getpid()), 3 * day, false},
+		{"process gone", currentHost(), fmt.Sprint(gone), 0, true},
+		{"no pid, young", currentHost(), "", 0, false},
+		{"no pid, old", currentHost(), "", 3 * day, true},
+		{"other machine, young", "elsewhere", fmt.Sprint(os.Getpid()), 0, false},
+		{"other machine, old", "elsewhere", fmt.Sprint(os.Getpid()), 3 * day, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := v1.Pod{ObjectMeta: metav1.ObjectMeta{
+				Labels:            map[string]string{LABEL_USER: currentUser(), LABEL_HOST: tt.host, LABEL_PID: tt.pid},
+				CreationTimestamp: metav1.NewTime(time.Now().Add(-tt.age - time.Minute)),
+			}}
+			if reason := orphaned(pod, PRUNE_OLDER_THAN); (reason != "") != tt.orphan {
+				t.Errorf("orphaned() = %q, expected an orphan: %v", reason, tt.orphan)
+			}
+		})
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// what has to be true before a tunnel counts as ready
+const (
+	WAIT_FOR_RUNNING   = "running"
+	WAIT_FOR_CONDITION = "condition"
+	WAIT_FOR_PROBE     = "probe"
+	WAIT_FOR_NONE      = "none"
+)
+
+const READY_PROBE_INTERVAL = time.Second
+const READY_PROBE_ATTEMPTS = 30
+
+func validateWaitFor(mode string) error {
+	switch mode {
+	case WAIT_FOR_RUNNING, WAIT_FOR_CONDITION, WAIT_FOR_PROBE, WAIT_FOR_NONE:
+		return nil
+	}
+	return fmt.Errorf("invalid --wait-for %q, expected running, condition, probe or none", mode)
+}
+
+// podReady waits for the Ready condition, without the readiness probe of
+// WAIT_FOR_CONDITION it means all relay containers are up
+func podReady(pod *v1.Pod) bool {
+	if pod.Status.Phase != v1.PodRunning {
+		return false
+	}
+	for _, c := range pod.Status.Conditions {
+		if c.Type == v1.PodReady {
+			return c.Status == v1.ConditionTrue
+		}
+	}
+	return false
+}
+
+func readyState(mode string) string {
+	if mode == WAIT_FOR_CONDITION {
+		return "ready"
+	}
+	return "running"
+}
+
+func probeCommand(command string, localAddress string, localPort uint) *exec.Cmd {
+	cmd := exec.Command("sh", "-c", command)
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", command)
+	}
+	cmd.Env = append(os.Environ(),
+		fmt.Sprintf("%s=%s", ENV_RELAY_HOST, localAddress),
+		fmt.Sprintf("%s=%d", ENV_RELAY_PORT, localPort),
+	)
+	cmd.Stderr = os.Stderr
+	return cmd
+}
+
+// probeTunnel checks the backend through the forward until it answers, with a
+// tcp probe or, if given, an application level command. The command gets the
+// local address in KUBE_RELAY_HOST and the port in KUBE_RELAY_PORT.
+func probeTunnel(localAddress string, localPort uint, command string, log *logger) error {
+	localAddress = dialAddress(localAddress)
+	address := joinHostPort(localAddress, localPort)
+	var err error
+	for i := 0; i < READY_PROBE_ATTEMPTS; i++ {
+		if command != "" {
+			err = probeCommand(command, localAddress, localPort).Run()
+		} else {
+			var reachable bool
+			reachable, err = probeBackend(address)
+			if err == nil && !reachable {
+				err = fmt.Errorf("backend is unreachable")
+			}
+		}
+		if err == nil {
+			log.printf("Tunnel on %s is ready\n", address)
+			return nil
+		}
+		time.Sleep(READY_PROBE_INTERVAL)
+	}
+	return &relayError{
+		Code:       "ProbeFailed",
+		Reason:     fmt.Sprintf("Readiness probe through %s failed: %s", address, err),
+		Suggestion: "check the cluster host and port, or the probe command",
+		exitCode:   1,
+	}
+}
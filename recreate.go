@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// podRef refers to the pod behind the forwards of a relay. Once it is evicted
+// or deleted, e.g. by a node drain or a preemption, respawn creates a
+// replacement for the old pod and the forwards re-attach to it. Without
+// respawn the relay ends instead.
+type podRef struct {
+	rc        *relayClient
+	namespace string
+	log       *logger
+	respawn   func(old string) (string, error)
+
+	mu         sync.Mutex
+	name       string
+	generation int
+	lost       chan struct{}
+	stop       chan struct{}
+	done       chan struct{}
+	endOnce    sync.Once
+}
+
+func newPodRef(rc *relayClient, namespace string, name string, log *logger, respawn func(old string) (string, error)) *podRef {
+	p := &podRef{rc: rc, namespace: namespace, name: name, log: log, respawn: respawn, done: make(chan struct{})}
+	p.watch()
+	return p
+}
+
+// end stops the forwards to the pod for good, e.g. when a reload removes the
+// tunnel, they end without an error
+func (p *podRef) end() {
+	p.endOnce.Do(func() { close(p.done) })
+}
+
+func (p *podRef) ended() bool {
+	select {
+	case <-p.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// current returns the name and generation of the pod, and a channel closed
+// once it is lost
+func (p *podRef) current() (string, int, <-chan struct{}) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.name, p.generation, p.lost
+}
+
+// watch closes lost once the current pod is deleting or failed, or the pod
+// ref ended, so forwards end right away instead of on their next connection
+func (p *podRef) watch() {
+	lost, stop, done := make(chan struct{}), make(chan struct{}), p.done
+	p.lost, p.stop = lost, stop
+	updates, _, cancel := p.rc.watchPod(p.namespace, p.name)
+	go func() {
+		defer cancel()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-done:
+				close(lost)
+				return
+			case pod := <-updates:
+				if pod.DeletionTimestamp != nil || pod.Status.Phase == v1.PodFailed {
+					close(lost)
+					return
+				}
+			}
+		}
+	}()
+}
+
+func (p *podRef) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	close(p.stop)
+}
+
+// replaceable tells whether a pod failure is fixed by a new pod
+func (p *podRef) replaceable(err error) bool {
+	var rErr *relayError
+	return p.respawn != nil && errors.As(err, &rErr) && rErr.Code == "PodMissing"
+}
+
+// replace spawns a replacement for the pod of the given generation, unless a
+// forward to another port of the pod did so already
+func (p *podRef) replace(generation int, reason error) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if generation != p.generation {
+		return nil
+	}
+	p.log.printf("%s, recreating it\n", reason)
+	name, err := p.respawn(p.name)
+	if err != nil {
+		return fmt.Errorf("cannot recreate the relay pod: %w", err)
+	}
+	close(p.stop)
+	p.name = name
+	p.generation++
+	p.watch()
+	p.log.printf("Recreated relay pod %q\n", name)
+	go podEvent(p.rc, p.namespace, name, "Recreated", fmt.Sprintf("Recreated the relay pod, the previous one was lost: %s", reason))
+	return nil
+}
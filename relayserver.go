@@ -0,0 +1,474 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+// the control endpoint of the go relay server, only reachable through a
+// port-forward since it listens on the localhost of the pod
+const RELAY_CONTROL_PORT = 9100
+const RELAY_DIAL_TIMEOUT = 10 * time.Second
+
+// relayRoute is a port of the relay server and the target its connections go
+// to, the target can be changed while the server runs
+type relayRoute struct {
+	port     int
+	protocol string
+	target   atomic.Value
+
+	connections int64
+	active      int64
+	failed      int64
+	bytesIn     int64
+	bytesOut    int64
+}
+
+func (r *relayRoute) currentTarget() string {
+	return r.target.Load().(string)
+}
+
+// parseRelayRoute parses <port>=<host:port>, or <port>=udp:<host:port> for
+// the framed datagrams of a udp tunnel
+func parseRelayRoute(s string) (*relayRoute, error) {
+	i := strings.Index(s, "=")
+	if i == -1 {
+		return nil, fmt.Errorf("invalid target %q, use <port>=<host:port>", s)
+	}
+	port, err := strconv.Atoi(s[:i])
+	if err != nil || port <= 0 || port > 65535 {
+		return nil, fmt.Errorf("invalid port in target %q", s)
+	}
+	r := &relayRoute{port: port, protocol: PROTOCOL_TCP}
+	target := s[i+1:]
+	if strings.HasPrefix(target, PROTOCOL_UDP+":") {
+		r.protocol, target = PROTOCOL_UDP, strings.TrimPrefix(target, PROTOCOL_UDP+":")
+	}
+	if err := validateRelayTarget(target); err != nil {
+		return nil, err
+	}
+	r.target.Store(target)
+	return r, nil
+}
+
+func validateRelayTarget(target string) error {
+	if _, _, err := net.SplitHostPort(target); err != nil {
+		return fmt.Errorf("invalid target %q, use <host:port>", target)
+	}
+	return nil
+}
+
+// connectionLog is a structured log line of the relay server
+type connectionLog struct {
+	Time       string `json:"time"`
+	Event      string `json:"event"`
+	ID         uint64 `json:"id,omitempty"`
+	Port       int    `json:"port"`
+	Client     string `json:"client,omitempty"`
+	User       string `json:"user,omitempty"`
+	Target     string `json:"target"`
+	BytesIn    int64  `json:"bytesIn,omitempty"`
+	BytesOut   int64  `json:"bytesOut,omitempty"`
+	DurationMs int64  `json:"durationMs,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// relayServer is the go relay server run in the relay pod by --engine
+// go-relay. One process serves all targets of the pod, logs every connection
+// as json and counts its traffic.
+type relayServer struct {
+	routes   []*relayRoute
+	tokens   *tokenStore
+	readOnly bool
+	nextID   uint64
+	open     sync.WaitGroup
+
+	logMu sync.Mutex
+	logs  *json.Encoder
+}
+
+func (s *relayServer) log(entry connectionLog) {
+	entry.Time = time.Now().UTC().Format(time.RFC3339Nano)
+	s.logMu.Lock()
+	defer s.logMu.Unlock()
+	s.logs.Encode(entry)
+}
+
+func (s *relayServer) route(port int) *relayRoute {
+	for _, r := range s.routes {
+		if r.port == port {
+			return r
+		}
+	}
+	return nil
+}
+
+func (s *relayServer) serve(listener net.Listener, route *relayRoute) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		s.open.Add(1)
+		go func() {
+			defer s.open.Done()
+			user, ok := s.authenticate(conn, route.port)
+			switch {
+			case ok && route.protocol == PROTOCOL_UDP:
+				s.handleUDP(conn, route, user)
+			case ok:
+				s.handle(conn, route, user)
+			}
+		}()
+	}
+}
+
+// authenticate reads the token of a connection when the server has tokens,
+// a connection without a valid one is logged and closed
+func (s *relayServer) authenticate(conn net.Conn, port int) (string, bool) {
+	if s.tokens == nil {
+		return "", true
+	}
+	token, err := readToken(conn)
+	if err == nil {
+		if user, ok := s.tokens.user(token); ok {
+			return user, true
+		}
+		err = fmt.Errorf("unknown or revoked token")
+	}
+	s.log(connectionLog{Event: "denied", Port: port, Client: conn.RemoteAddr().String(), Error: err.Error()})
+	conn.Close()
+	return "", false
+}
+
+func (s *relayServer) handle(client net.Conn, route *relayRoute, user string) {
+	defer client.Close()
+	id := atomic.AddUint64(&s.nextID, 1)
+	target := route.currentTarget()
+	entry := connectionLog{ID: id, Port: route.port, Client: client.RemoteAddr().String(), User: user, Target: target}
+	start := time.Now()
+	server, err := net.DialTimeout("tcp", target, RELAY_DIAL_TIMEOUT)
+	if err != nil {
+		atomic.AddInt64(&route.failed, 1)
+		entry.Event, entry.Error = "failed", err.Error()
+		s.log(entry)
+		return
+	}
+	defer server.Close()
+	atomic.AddInt64(&route.connections, 1)
+	atomic.AddInt64(&route.active, 1)
+	defer atomic.AddInt64(&route.active, -1)
+	entry.Event = "open"
+	s.log(entry)
+
+	// bytes are counted as they pass, so metrics of long connections move
+	done := make(chan struct{})
+	go func() {
+		io.Copy(&countingWriter{w: server, n: &route.bytesIn, total: &entry.BytesIn}, client)
+		server.(*net.TCPConn).CloseWrite()
+		close(done)
+	}()
+	io.Copy(&countingWriter{w: client, n: &route.bytesOut, total: &entry.BytesOut}, server)
+	closeWrite(client)
+	<-done
+
+	entry.Event, entry.DurationMs = "close", time.Since(start).Milliseconds()
+	s.log(entry)
+}
+
+// handleUDP sends the framed datagrams of a connection to the target and the
+// replies back framed, until the client closes the session
+func (s *relayServer) handleUDP(client net.Conn, route *relayRoute, user string) {
+	defer client.Close()
+	id := atomic.AddUint64(&s.nextID, 1)
+	target := route.currentTarget()
+	entry := connectionLog{ID: id, Port: route.port, Client: client.RemoteAddr().String(), User: user, Target: PROTOCOL_UDP + ":" + target}
+	start := time.Now()
+	server, err := net.DialTimeout("udp", target, RELAY_DIAL_TIMEOUT)
+	if err != nil {
+		atomic.AddInt64(&route.failed, 1)
+		entry.Event, entry.Error = "failed", err.Error()
+		s.log(entry)
+		return
+	}
+	atomic.AddInt64(&route.connections, 1)
+	atomic.AddInt64(&route.active, 1)
+	defer atomic.AddInt64(&route.active, -1)
+	entry.Event = "open"
+	s.log(entry)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// closing the socket ends the replies too
+		defer server.Close()
+		buf := make([]byte, UDP_MAX_DATAGRAM)
+		for {
+			datagram, err := readDatagram(client, buf)
+			if err != nil {
+				return
+			}
+			if _, err := server.Write(datagram); err == nil {
+				atomic.AddInt64(&route.bytesIn, int64(len(datagram)))
+				atomic.AddInt64(&entry.BytesIn, int64(len(datagram)))
+			}
+		}
+	}()
+	buf := make([]byte, UDP_MAX_DATAGRAM)
+	for {
+		n, err := server.Read(buf)
+		if errors.Is(err, net.ErrClosed) {
+			break
+		}
+		// e.g. an icmp port unreachable of an earlier datagram
+		if err != nil {
+			continue
+		}
+		if err := writeDatagram(client, buf[:n]); err != nil {
+			server.Close()
+			break
+		}
+		atomic.AddInt64(&route.bytesOut, int64(n))
+		atomic.AddInt64(&entry.BytesOut, int64(n))
+	}
+	client.Close()
+	<-done
+
+	entry.Event, entry.DurationMs = "close", time.Since(start).Milliseconds()
+	s.log(entry)
+}
+
+// countingWriter adds what it writes to a shared counter and its own total
+type countingWriter struct {
+	w     io.Writer
+	n     *int64
+	total *int64
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	atomic.AddInt64(c.n, int64(n))
+	atomic.AddInt64(c.total, int64(n))
+	return n, err
+}
+
+// metrics writes the counters of all routes in the prometheus text format
+func (s *relayServer) metrics(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, m := range []struct {
+		name  string
+		kind  string
+		value func(r *relayRoute) int64
+	}{
+		{"kube_relay_connections_total", "counter", func(r *relayRoute) int64 { return atomic.LoadInt64(&r.connections) }},
+		{"kube_relay_connections_active", "gauge", func(r *relayRoute) int64 { return atomic.LoadInt64(&r.active) }},
+		{"kube_relay_connections_failed_total", "counter", func(r *relayRoute) int64 { return atomic.LoadInt64(&r.failed) }},
+		{"kube_relay_bytes_in_total", "counter", func(r *relayRoute) int64 { return atomic.LoadInt64(&r.bytesIn) }},
+		{"kube_relay_bytes_out_total", "counter", func(r *relayRoute) int64 { return atomic.LoadInt64(&r.bytesOut) }},
+	} {
+		fmt.Fprintf(w, "# TYPE %s %s\n", m.name, m.kind)
+		for _, r := range s.routes {
+			fmt.Fprintf(w, "%s{port=\"%d\",target=%q} %d\n", m.name, r.port, r.currentTarget(), m.value(r))
+		}
+	}
+}
+
+// targets lists the targets by port, PUT /targets/<port> with a host:port
+// body points new connections of a port to another target
+func (s *relayServer) targets(w http.ResponseWriter, req *http.Request) {
+	if req.Method == http.MethodGet && req.URL.Path == "/targets" {
+		targets := map[string]string{}
+		for _, r := range s.routes {
+			targets[strconv.Itoa(r.port)] = r.currentTarget()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(targets)
+		return
+	}
+	if req.Method != http.MethodPut {
+		http.Error(w, "use GET /targets or PUT /targets/<port>", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.readOnly {
+		http.Error(w, "the targets of this relay server are read only", http.StatusForbidden)
+		return
+	}
+	port, err := strconv.Atoi(strings.TrimPrefix(req.URL.Path, "/targets/"))
+	route := s.route(port)
+	if err != nil || route == nil {
+		http.Error(w, "unknown port", http.StatusNotFound)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(req.Body, 1024))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	target := strings.TrimSpace(string(body))
+	if err := validateRelayTarget(target); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	route.target.Store(target)
+	s.log(connectionLog{Event: "target", Port: port, Target: target})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// serveMux accepts multiplexed sessions, every stream of a session is a
+// connection to the route of the port it opens. A session is authenticated
+// once, its streams belong to the same user.
+func (s *relayServer) serveMux(listener net.Listener, port int) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			user, ok := s.authenticate(conn, port)
+			if !ok {
+				return
+			}
+			newMuxSession(conn, func(st *muxStream) {
+				route := s.route(int(st.port))
+				if route == nil {
+					st.Close()
+					return
+				}
+				s.open.Add(1)
+				defer s.open.Done()
+				s.handle(st, route, user)
+			})
+		}()
+	}
+}
+
+// runRelayServer listens on the ports of all routes until SIGTERM, then it
+// stops accepting and waits for open connections to end, the grace period
+// of the pod bounds the wait. A mux port of 0 disables multiplexing. With
+// tokens every connection has to start with the token of a user, read only
+// refuses to move targets.
+func runRelayServer(routes []*relayRoute, bind string, controlPort int, muxPort int, tokens *tokenStore, readOnly bool) error {
+	sort.Slice(routes, func(i, j int) bool { return routes[i].port < routes[j].port })
+	s := &relayServer{routes: routes, tokens: tokens, readOnly: readOnly, logs: json.NewEncoder(os.Stdout)}
+	var listeners []net.Listener
+	for _, r := range routes {
+		listener, err := net.Listen("tcp", net.JoinHostPort(bind, strconv.Itoa(r.port)))
+		if err != nil {
+			return err
+		}
+		listeners = append(listeners, listener)
+		go s.serve(listener, r)
+	}
+	if muxPort != 0 {
+		listener, err := net.Listen("tcp", net.JoinHostPort(bind, strconv.Itoa(muxPort)))
+		if err != nil {
+			return err
+		}
+		listeners = append(listeners, listener)
+		go s.serveMux(listener, muxPort)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, _ *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/metrics", s.metrics)
+	mux.HandleFunc("/targets", s.targets)
+	mux.HandleFunc("/targets/", s.targets)
+	control, err := net.Listen("tcp", net.JoinHostPort(LOOPBACK_ADDRESS, strconv.Itoa(controlPort)))
+	if err != nil {
+		return err
+	}
+	go http.Serve(control, mux)
+
+	term := make(chan os.Signal, 1)
+	signal.Notify(term, syscall.SIGTERM, os.Interrupt)
+	<-term
+	for _, l := range listeners {
+		l.Close()
+	}
+	s.open.Wait()
+	return nil
+}
+
+func relayServerCommand() *cli.Command {
+	var targets cli.StringSlice
+	var bind string
+	var controlPort int
+	var muxPort int
+	var tokensPath string
+	var readOnly bool
+
+	return &cli.Command{
+		Name:   "relay-server",
+		Usage:  "run the go relay server, the relay pod of --engine go-relay runs it",
+		Hidden: true,
+		Flags: []cli.Flag{
+			&cli.StringSliceFlag{
+				Name:        "target",
+				Usage:       "relay connections to a port to a target, <port>=<host:port>, repeat it for several ports",
+				Required:    true,
+				Destination: &targets,
+			},
+			&cli.StringFlag{
+				Name:        "bind",
+				Usage:       "address the ports listen on, all addresses by default",
+				Destination: &bind,
+			},
+			&cli.IntFlag{
+				Name:        "control-port",
+				Usage:       "port of the metrics and targets endpoint on the localhost of the pod",
+				Value:       RELAY_CONTROL_PORT,
+				Destination: &controlPort,
+			},
+			&cli.IntFlag{
+				Name:        "mux-port",
+				Usage:       "accept multiplexed sessions on this port, their streams open the ports of the targets",
+				Destination: &muxPort,
+			},
+			&cli.StringFlag{
+				Name:        "tokens",
+				Usage:       "require a token of a user in this file on every connection, lines of <user>:<sha256 hex>, e.g. a mounted secret",
+				Destination: &tokensPath,
+			},
+			&cli.BoolFlag{
+				Name:        "read-only",
+				Usage:       "refuse PUT /targets, e.g. when the localhost is shared with a node",
+				Destination: &readOnly,
+			},
+		},
+		Action: func(c *cli.Context) error {
+			var routes []*relayRoute
+			for _, t := range targets.Value() {
+				r, err := parseRelayRoute(t)
+				if err != nil {
+					return err
+				}
+				routes = append(routes, r)
+			}
+			var tokens *tokenStore
+			if tokensPath != "" {
+				var err error
+				if tokens, err = loadTokens(tokensPath); err != nil {
+					return err
+				}
+			}
+			return runRelayServer(routes, bind, controlPort, muxPort, tokens, readOnly)
+		},
+	}
+}
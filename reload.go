@@ -0,0 +1,260 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// RELOAD_SETTLE lets an editor finish writing the config before it is read
+const RELOAD_SETTLE = 200 * time.Millisecond
+
+// runningTunnel is a tunnel of a group with its own relay pod
+type runningTunnel struct {
+	config tunnelConfig
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+// tunnelRunner runs a relay pod per tunnel. At most batchSize tunnels are
+// starting at a time, so large groups don't hit api priority and fairness
+// limits or namespace quotas all at once. Tunnels are started and stopped one
+// by one, so a reload leaves the untouched ones alone.
+type tunnelRunner struct {
+	rc        *relayClient
+	namespace string
+	status    *groupStatus
+	starting  chan struct{}
+	wg        sync.WaitGroup
+
+	mu      sync.Mutex
+	running map[string]*runningTunnel
+	failed  []bool
+}
+
+func newTunnelRunner(rc *relayClient, namespace string, status *groupStatus, batchSize int) *tunnelRunner {
+	if batchSize < 1 {
+		batchSize = 1
+	}
+	return &tunnelRunner{
+		rc:        rc,
+		namespace: namespace,
+		status:    status,
+		starting:  make(chan struct{}, batchSize),
+		running:   map[string]*runningTunnel{},
+	}
+}
+
+func (r *tunnelRunner) start(t tunnelConfig) {
+	rt := &runningTunnel{config: t, stop: make(chan struct{}), done: make(chan struct{})}
+	r.mu.Lock()
+	r.running[t.Name] = rt
+	r.mu.Unlock()
+
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		defer close(rt.done)
+		select {
+		case r.starting <- struct{}{}:
+		case <-rt.stop:
+			r.status.finish(t.Name, nil)
+			return
+		}
+		var started sync.Once
+		release := func() { started.Do(func() { <-r.starting }) }
+		defer release()
+
+		o := t.options()
+		o.log = r.status.logger(t.Name)
+		o.session = r.status.session
+		o.shutdown = r.status.shutdown
+		o.stop = rt.stop
+		err := relay(r.rc, r.namespace, o, func(uint) error {
+			release()
+			r.status.set(t.Name, "up")
+			return nil
+		})
+		failed := r.status.finish(t.Name, err)
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.failed = append(r.failed, failed)
+		if r.running[t.Name] == rt {
+			delete(r.running, t.Name)
+		}
+	}()
+}
+
+// stop ends a tunnel and waits until its relay pod is deleted
+func (r *tunnelRunner) stop(name string) {
+	r.mu.Lock()
+	rt, ok := r.running[name]
+	delete(r.running, name)
+	r.mu.Unlock()
+	if !ok {
+		return
+	}
+	close(rt.stop)
+	<-rt.done
+}
+
+// wait blocks until all tunnels ended and tells which of them failed
+func (r *tunnelRunner) wait() []bool {
+	r.wg.Wait()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.failed
+}
+
+// reload applies a changed config: tunnels that are gone are stopped, new
+// ones started and changed ones restarted. Tunnels that ended, e.g. as they
+// failed, are started again.
+func (r *tunnelRunner) reload(tunnels []tunnelConfig) {
+	// the runner must not run out of tunnels while one is restarted
+	r.wg.Add(1)
+	defer r.wg.Done()
+
+	wanted := map[string]tunnelConfig{}
+	for _, t := range tunnels {
+		wanted[t.Name] = t
+	}
+	var stopped []string
+	r.mu.Lock()
+	for name, rt := range r.running {
+		if t, ok := wanted[name]; !ok || t != rt.config {
+			stopped = append(stopped, name)
+		}
+	}
+	var started []tunnelConfig
+	for _, t := range tunnels {
+		if rt, ok := r.running[t.Name]; !ok || rt.config != t {
+			started = append(started, t)
+		}
+	}
+	r.mu.Unlock()
+	if len(stopped) == 0 && len(started) == 0 {
+		fmt.Println("Reloaded the config, nothing changed")
+		return
+	}
+
+	var wg sync.WaitGroup
+	for _, name := range stopped {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			r.stop(name)
+		}(name)
+	}
+	wg.Wait()
+	r.status.update(tunnels)
+	for _, t := range started {
+		o := t.options()
+		if _, err := checkLocalPort(o.localAddress, o.localPort, false); err != nil {
+			r.status.set(t.Name, fmt.Sprintf("failed: %s", err))
+			continue
+		}
+		r.start(t)
+	}
+	fmt.Printf("Reloaded the config, stopped %d and started %d tunnels\n", len(stopped), len(started))
+}
+
+// watchReloads reloads the config on SIGHUP and, with opts.watch, whenever
+// the file changes. An invalid config keeps the running tunnels. The returned
+// function stops watching.
+func watchReloads(opts upOptions, runner *tunnelRunner) (func(), error) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	var changes <-chan struct{}
+	var watcher *fsnotify.Watcher
+	if opts.watch != "" {
+		var err error
+		if watcher, changes, err = watchFile(opts.watch); err != nil {
+			return nil, err
+		}
+	}
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-hup:
+			case <-changes:
+			}
+			tunnels, err := opts.reload()
+			if err == nil {
+				err = prepareTunnels(tunnels, opts.loopbackAlias)
+			}
+			if err != nil {
+				fmt.Printf("Keeping the running tunnels, cannot reload the config: %s\n", err)
+				continue
+			}
+			runner.reload(tunnels)
+		}
+	}()
+	return func() {
+		signal.Stop(hup)
+		if watcher != nil {
+			watcher.Close()
+		}
+		close(done)
+	}, nil
+}
+
+// watchFile signals changes of a file. It watches the directory, as editors
+// often replace a file instead of writing it, and waits for writes to settle.
+func watchFile(path string) (*fsnotify.Watcher, <-chan struct{}, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, nil, err
+	}
+	path = filepath.Clean(path)
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		watcher.Close()
+		return nil, nil, err
+	}
+	changes := make(chan struct{}, 1)
+	go func() {
+		var settle <-chan time.Time
+		for {
+			select {
+			case e, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(e.Name) == path && e.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) != 0 {
+					settle = time.After(RELOAD_SETTLE)
+				}
+			case _, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+			case <-settle:
+				settle = nil
+				select {
+				case changes <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}()
+	return watcher, changes, nil
+}
+
+// ignoreReloads tells that a single pod can't be reloaded, its containers
+// are fixed
+func ignoreReloads() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			fmt.Println("Cannot reload the config of a single pod tunnel, restart it to apply changes")
+		}
+	}()
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	apiv1 "k8s.io/api/core/v1"
+)
+
+// a cluster host unix:<path> is a unix socket on the node of the relay pod
+const SOCKET_PREFIX = "unix:"
+const SOCKET_VOLUME = "node-socket"
+
+// socketTarget returns the path of a unix socket target
+func socketTarget(host string) (string, bool) {
+	if !strings.HasPrefix(host, SOCKET_PREFIX) {
+		return "", false
+	}
+	return strings.TrimPrefix(host, SOCKET_PREFIX), true
+}
+
+func validateSocketPath(p string) error {
+	if !path.IsAbs(p) || path.Clean(p) != p || strings.Contains(p, ",") {
+		return fmt.Errorf("invalid socket %q, expected unix:<absolute path>", p)
+	}
+	return nil
+}
+
+// mountSocket mounts a unix socket of the node into the relay containers.
+// socat connects to it as root, sockets of node agents rarely admit others,
+// but still without any capabilities.
+func mountSocket(pod *apiv1.Pod, socket string) {
+	socketType := apiv1.HostPathSocket
+	pod.Spec.Volumes = append(pod.Spec.Volumes, apiv1.Volume{
+		Name: SOCKET_VOLUME,
+		VolumeSource: apiv1.VolumeSource{
+			HostPath: &apiv1.HostPathVolumeSource{Path: socket, Type: &socketType},
+		},
+	})
+	for i := range pod.Spec.Containers {
+		c := &pod.Spec.Containers[i]
+		c.VolumeMounts = append(c.VolumeMounts, apiv1.VolumeMount{Name: SOCKET_VOLUME, MountPath: socket})
+	}
+	root, nonRoot := int64(0), false
+	pod.Spec.SecurityContext.RunAsNonRoot = &nonRoot
+	pod.Spec.SecurityContext.RunAsUser = &root
+	pod.Spec.SecurityContext.RunAsGroup = &root
+}
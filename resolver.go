@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// A resolver plugin is an executable mapping a logical target name to a
+// location in the cluster. It receives a resolverRequest as json on stdin and
+// prints a resolverResponse as json to stdout, a non-zero exit fails the relay.
+type resolverRequest struct {
+	Target string `json:"target"`
+}
+
+type resolverResponse struct {
+	Host      string `json:"host"`
+	Port      uint   `json:"port,omitempty"`
+	Namespace string `json:"namespace,omitempty"`
+}
+
+func resolveTarget(plugin string, target string) (*resolverResponse, error) {
+	request, err := json.Marshal(resolverRequest{Target: target})
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := exec.Command(plugin)
+	cmd.Stdin = bytes.NewReader(request)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("resolver %s failed for %q: %w", plugin, target, err)
+	}
+
+	var response resolverResponse
+	if err := json.Unmarshal(out, &response); err != nil {
+		return nil, fmt.Errorf("resolver %s returned invalid json: %w", plugin, err)
+	}
+	response.Host = strings.TrimSpace(response.Host)
+	if response.Host == "" {
+		return nil, fmt.Errorf("resolver %s returned no host for %q", plugin, target)
+	}
+	return &response, nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// relayResources are the quantities of the resource flags, keyed by flag name
+type relayResources map[string]string
+
+var resourceFlags = []struct {
+	flag     string
+	resource apiv1.ResourceName
+	limit    bool
+}{
+	{"cpu-request", apiv1.ResourceCPU, false},
+	{"cpu-limit", apiv1.ResourceCPU, true},
+	{"memory-request", apiv1.ResourceMemory, false},
+	{"memory-limit", apiv1.ResourceMemory, true},
+}
+
+// requirements of the relay containers, so the pod passes LimitRange and
+// ResourceQuota admission in namespaces that require them
+func (r relayResources) requirements() (apiv1.ResourceRequirements, error) {
+	var req apiv1.ResourceRequirements
+	for _, f := range resourceFlags {
+		value := r[f.flag]
+		if value == "" {
+			continue
+		}
+		q, err := resource.ParseQuantity(value)
+		if err != nil {
+			return req, fmt.Errorf("invalid --%s %q: %w", f.flag, value, err)
+		}
+		list := &req.Requests
+		if f.limit {
+			list = &req.Limits
+		}
+		if *list == nil {
+			*list = apiv1.ResourceList{}
+		}
+		(*list)[f.resource] = q
+	}
+	return req, nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+const RETRY_BACKOFF = time.Second
+const RETRY_MAX_BACKOFF = 30 * time.Second
+
+// a lost forward is re-established with at least RECONNECT_RETRIES attempts,
+// it counts as stable once it stayed up for RECONNECT_STABLE
+const RECONNECT_RETRIES = 10
+const RECONNECT_STABLE = 30 * time.Second
+
+// retryPolicy is how often a step of a relay is attempted again
+type retryPolicy struct {
+	retries int
+	backoff time.Duration
+	log     *logger
+}
+
+// permanentError ends retries, e.g. once a forward was up
+type permanentError struct {
+	error
+}
+
+func (e permanentError) Unwrap() error {
+	return e.error
+}
+
+// retryable tells apart errors that may pass from those that need the user
+func retryable(err error) bool {
+	var rErr *relayError
+	var pErr permanentError
+	if errors.As(err, &rErr) || errors.As(err, &pErr) {
+		return false
+	}
+	return !(k8serrors.IsForbidden(err) ||
+		k8serrors.IsUnauthorized(err) ||
+		k8serrors.IsInvalid(err) ||
+		k8serrors.IsAlreadyExists(err) ||
+		k8serrors.IsBadRequest(err))
+}
+
+// do runs attempt until it succeeds or fails for good, the backoff doubles
+// after every attempt.
+func (p retryPolicy) do(what string, attempt func() error) error {
+	backoff := p.backoff
+	if backoff <= 0 {
+		backoff = RETRY_BACKOFF
+	}
+	for i := 0; ; i++ {
+		err := attempt()
+		if err == nil || i >= p.retries || !retryable(err) {
+			var pErr permanentError
+			if errors.As(err, &pErr) {
+				return pErr.error
+			}
+			return err
+		}
+		p.log.printf("Failed to %s, retrying in %s (%d/%d): %s\n", what, backoff, i+1, p.retries, err)
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > RETRY_MAX_BACKOFF {
+			backoff = RETRY_MAX_BACKOFF
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes"
+)
+
+// REVERSE_POOL is how many connections wait in the relay pod for a cluster client
+const REVERSE_POOL = 4
+const REVERSE_REDIAL = time.Second
+
+// reverseArgs make socat accept a connection through the forward and then wait
+// for a cluster client on the cluster port. Every waiting connection has its
+// own listener, reuseport lets them share the cluster port.
+func reverseArgs(port int, clusterPort uint) []string {
+	return []string{
+		fmt.Sprintf("TCP-LISTEN:%d,fork,reuseaddr", port),
+		fmt.Sprintf("TCP-LISTEN:%d,reuseaddr,reuseport", clusterPort),
+	}
+}
+
+// createReverseService points a service at the cluster port of the relay pod,
+// the service is owned by the pod and garbage collected with it.
+func createReverseService(client kubernetes.Interface, namespace string, name string, service string, clusterPort uint, log *logger) error {
+	pod, err := client.CoreV1().Pods(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	manifest := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   service,
+			Labels: map[string]string{LABEL_MANAGED_BY: POD_NAME},
+			OwnerReferences: []metav1.OwnerReference{{
+				APIVersion: "v1",
+				Kind:       "Pod",
+				Name:       pod.Name,
+				UID:        pod.UID,
+			}},
+		},
+		Spec: v1.ServiceSpec{
+			Selector: map[string]string{LABEL_INSTANCE: pod.Labels[LABEL_INSTANCE]},
+			Ports: []v1.ServicePort{{
+				Port:       int32(clusterPort),
+				TargetPort: intstr.FromInt(int(clusterPort)),
+			}},
+		},
+	}
+	_, err = client.CoreV1().Services(namespace).Create(context.TODO(), manifest, metav1.CreateOptions{})
+	if err != nil {
+		return err
+	}
+	log.printf("Created service %q\n", service)
+	return nil
+}
+
+// serveReverse keeps a pool of connections waiting in the relay pod. Once a
+// cluster client connects and sends its first bytes, the connection is passed
+// to the local port and the pool is topped up. Protocols where the server
+// speaks first are not supported, as the relay pod has no way to announce a
+// client.
+func serveReverse(rc *relayClient, pod *podRef, opts relayOptions, policy retryPolicy, ready func(uint) error) error {
+	tunnel := newTunnelListener(opts.queueTimeout, []string{joinHostPort(opts.localAddress, opts.localPort)}, opts.log)
+	name, _, _ := pod.current()
+	tunnel.metrics = registerMetrics(name, tunnel.targets[0])
+	opts.shutdown.register(tunnel)
+	opts.log.printf("Forwarding from pod %q port %d -> %s\n", name, opts.clusterPort, tunnel.targets[0])
+	for i := 0; i < REVERSE_POOL; i++ {
+		go tunnel.waitReverse()
+	}
+
+	var announced bool
+	return forwardTarget(rc, pod, opts.relayPort(), policy, opts.log, func(port uint) error {
+		if port == 0 {
+			tunnel.setUpstream(0, "")
+			return nil
+		}
+		tunnel.setUpstream(0, fmt.Sprintf("127.0.0.1:%d", port))
+		if announced || ready == nil {
+			return nil
+		}
+		announced = true
+		return ready(opts.localPort)
+	})
+}
+
+// waitReverse keeps one connection waiting in the relay pod at a time
+func (t *tunnelListener) waitReverse() {
+	for {
+		server, err := t.dial(0)
+		if err != nil {
+			time.Sleep(REVERSE_REDIAL)
+			continue
+		}
+		first := make([]byte, 32<<10)
+		n, err := server.Read(first)
+		if err != nil {
+			server.Close()
+			continue
+		}
+		go t.handleReverse(server, first[:n])
+	}
+}
+
+func (t *tunnelListener) handleReverse(server net.Conn, first []byte) {
+	atomic.AddInt32(&t.open, 1)
+	defer atomic.AddInt32(&t.open, -1)
+	defer server.Close()
+	local, err := net.Dial("tcp", t.targets[0])
+	if err != nil {
+		t.metrics.drop()
+		t.log.printf("Dropped a cluster connection, the local port refuses it: %s\n", err)
+		return
+	}
+	defer local.Close()
+	t.metrics.opened()
+	if _, err := local.Write(first); err != nil {
+		t.metrics.closed(0, 0)
+		return
+	}
+
+	sent := int64(len(first))
+	done := make(chan struct{})
+	go func() {
+		n, _ := io.Copy(local, server)
+		sent += n
+		local.(*net.TCPConn).CloseWrite()
+		close(done)
+	}()
+	received, _ := io.Copy(server, local)
+	server.(*net.TCPConn).CloseWrite()
+	<-done
+	t.metrics.closed(sent, received)
+}
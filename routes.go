@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+)
+
+const PROXY_ROUTE = "route"
+
+func validateRoutes(cidrs []string) error {
+	for _, cidr := range cidrs {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return fmt.Errorf("invalid route %q: %w", cidr, err)
+		}
+	}
+	return nil
+}
+
+// routeHandshake passes a connection redirected to the local port on to the
+// address the client originally connected to.
+func routeHandshake(client net.Conn) (string, []byte, error) {
+	target, err := originalDestination(client)
+	return target, nil, err
+}
+
+// apiServerHost is the host of the api server, so routes can exempt it
+func apiServerHost(rc *relayClient) string {
+	u, err := url.Parse(rc.config.Host)
+	if err != nil {
+		return ""
+	}
+	return u.Hostname()
+}
+
+// exemptAddresses are the ipv4 addresses of the api server host, a name is
+// resolved so its traffic is not redirected into the relay when it falls into
+// a routed cidr
+func exemptAddresses(host string, lookup func(string) ([]string, error)) ([]string, error) {
+	if host == "" {
+		return nil, nil
+	}
+	addrs := []string{host}
+	if net.ParseIP(host) == nil {
+		var err error
+		if addrs, err = lookup(host); err != nil {
+			return nil, fmt.Errorf("cannot resolve the api server %q to exempt it from the routes: %w", host, err)
+		}
+	}
+	var exempt []string
+	for _, addr := range addrs {
+		// the nat rules are iptables, not ip6tables
+		if ip := net.ParseIP(addr); ip != nil && ip.To4() != nil {
+			exempt = append(exempt, ip.String())
+		}
+	}
+	return exempt, nil
+}
@@ -0,0 +1,86 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+
+	"golang.org/x/sys/unix"
+)
+
+func routeChain(port uint) string {
+	return fmt.Sprintf("KUBE-RELAY-%d", port)
+}
+
+func iptables(args ...string) error {
+	cmd := exec.Command("sudo", append([]string{"iptables", "-t", "nat"}, args...)...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("iptables %v: %w", args, err)
+	}
+	return nil
+}
+
+// addRoutes redirects outgoing tcp connections to the cidrs to the local
+// port, with nat rules in a chain of their own. Every address of the api server
+// is exempt, so the forward itself is not redirected.
+func addRoutes(cidrs []string, port uint, apiServer string) error {
+	fmt.Printf("Routing %v through the relay pod, this needs sudo\n", cidrs)
+	exempt, err := exemptAddresses(apiServer, net.LookupHost)
+	if err != nil {
+		return err
+	}
+	chain := routeChain(port)
+	if err := iptables("-N", chain); err != nil {
+		return err
+	}
+	for _, ip := range exempt {
+		if err := iptables("-A", chain, "-d", ip, "-j", "RETURN"); err != nil {
+			return err
+		}
+	}
+	for _, cidr := range cidrs {
+		if err := iptables("-A", chain, "-p", "tcp", "-d", cidr, "-j", "REDIRECT", "--to-ports", strconv.Itoa(int(port))); err != nil {
+			return err
+		}
+	}
+	return iptables("-I", "OUTPUT", "1", "-j", chain)
+}
+
+// removeRoutes deletes the nat rules of addRoutes, it is best effort
+func removeRoutes(port uint) {
+	chain := routeChain(port)
+	iptables("-D", "OUTPUT", "-j", chain)
+	iptables("-F", chain)
+	iptables("-X", chain)
+}
+
+// originalDestination is the address a redirected connection was meant for
+func originalDestination(conn net.Conn) (string, error) {
+	raw, err := conn.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		return "", err
+	}
+	var mreq *unix.IPv6Mreq
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		mreq, sockErr = unix.GetsockoptIPv6Mreq(int(fd), unix.SOL_IP, unix.SO_ORIGINAL_DST)
+	})
+	if err == nil {
+		err = sockErr
+	}
+	if err != nil {
+		return "", fmt.Errorf("no original destination: %w", err)
+	}
+	// the option returns a sockaddr_in: family, port, address
+	addr := mreq.Multiaddr
+	ip := net.IPv4(addr[4], addr[5], addr[6], addr[7])
+	port := binary.BigEndian.Uint16(addr[2:4])
+	return net.JoinHostPort(ip.String(), strconv.Itoa(int(port))), nil
+}
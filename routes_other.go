@@ -0,0 +1,19 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"fmt"
+	"net"
+)
+
+func addRoutes(cidrs []string, port uint, apiServer string) error {
+	return fmt.Errorf("--route is only supported on linux")
+}
+
+func removeRoutes(port uint) {}
+
+func originalDestination(conn net.Conn) (string, error) {
+	return "", fmt.Errorf("no original destination on this platform")
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestExemptAddresses(t *testing.T) {
+	lookup := func(host string) ([]string, error) {
+		if host == "api.example.com" {
+			return []string{"10.96.0.1", "fd00::1", "10.96.0.2"}, nil
+		}
+		return nil, errors.New("no such host")
+	}
+	tests := []struct {
+		host string
+		want []string
+		err  string
+	}{
+		{"", nil, ""},
+		{"192.168.49.2", []string{"192.168.49.2"}, ""},
+		{"::1", nil, ""},
+		{"api.example.com", []string{"10.96.0.1", "10.96.0.2"}, ""},
+		{"missing.example.com", nil, "cannot resolve the api server"},
+	}
+	for _, test := range tests {
+		got, err := exemptAddresses(test.host, lookup)
+		checkError(t, err, test.err)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("exemptAddresses(%q) = %v, want %v", test.host, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+const SCAN_NAME = POD_NAME + "-scan"
+const SCAN_CONCURRENCY = 32
+
+// the well known ports and the usual ports of databases, brokers and web
+// servers above them
+const SCAN_PORTS = "1-1024,1433,1521,2181,2375,2379,3000,3306,4222,5000,5432,5601,5672,6379,6443,7000,8000,8080,8081,8443,8888,9000,9042,9090,9092,9093,9200,9300,11211,15672,27017"
+
+// SCAN_SCRIPT connects to the ports in its arguments, a batch at a time, and
+// prints the ones that accept
+const SCAN_SCRIPT = `address=$1 timeout=$2 batch=$3
+shift 3
+n=0
+for port; do
+	(socat -u OPEN:/dev/null "$address$port,connect-timeout=$timeout" 2>/dev/null && echo "$port") &
+	n=$((n + 1))
+	if [ "$n" -ge "$batch" ]; then
+		wait
+		n=0
+	fi
+done
+wait`
+
+type scanOptions struct {
+	host        string
+	ports       []int
+	timeout     time.Duration
+	concurrency int
+	newPod      bool
+	podImage    string
+	log         *logger
+}
+
+// parsePorts parses a list of ports and ranges like 80,443,8000-8100
+func parsePorts(s string) ([]int, error) {
+	seen := map[int]bool{}
+	var ports []int
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		from, to := part, part
+		if i := strings.Index(part, "-"); i != -1 {
+			from, to = part[:i], part[i+1:]
+		}
+		first, err := strconv.ParseUint(from, 10, 16)
+		if err != nil || first == 0 {
+			return nil, fmt.Errorf("invalid port %q", part)
+		}
+		last, err := strconv.ParseUint(to, 10, 16)
+		if err != nil || last < first {
+			return nil, fmt.Errorf("invalid port range %q", part)
+		}
+		for p := int(first); p <= int(last); p++ {
+			if !seen[p] {
+				seen[p] = true
+				ports = append(ports, p)
+			}
+		}
+	}
+	return ports, nil
+}
+
+// scan connects to the ports of a host from a relay pod
+func scan(kube *kubeOptions, opts scanOptions) error {
+	namespace, rc, err := connect(kube)
+	if err != nil {
+		return err
+	}
+	name, done, err := probeFrom(rc, namespace, probePod(SCAN_NAME, opts.podImage, opts.host), opts.newPod, opts.log)
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	// the port is appended to the address in the pod
+	address := strings.TrimSuffix(socatAddress(PROTOCOL_TCP, net.JoinHostPort(opts.host, "0")), "0")
+	command := []string{"sh", "-c", SCAN_SCRIPT, "sh", address,
+		strconv.FormatFloat(opts.timeout.Seconds(), 'f', -1, 64), strconv.Itoa(opts.concurrency)}
+	for _, p := range opts.ports {
+		command = append(command, strconv.Itoa(p))
+	}
+	opts.log.printf("Scanning %d ports of %s\n", len(opts.ports), opts.host)
+	start := time.Now()
+	out := new(bytes.Buffer)
+	if err := execStream(rc, namespace, name, command, nil, out); err != nil {
+		return err
+	}
+
+	var open []int
+	for _, line := range strings.Fields(out.String()) {
+		if p, err := strconv.Atoi(line); err == nil {
+			open = append(open, p)
+		}
+	}
+	sort.Ints(open)
+	for _, p := range open {
+		fmt.Printf("%d/tcp open\n", p)
+	}
+	fmt.Printf("Scanned %d ports of %s in %s, %d open\n", len(opts.ports), opts.host, time.Since(start).Round(time.Millisecond), len(open))
+	return nil
+}
+
+func scanCommand(kube *kubeOptions) *cli.Command {
+	opts := scanOptions{log: &logger{out: os.Stderr}}
+	var ports string
+	var quiet bool
+
+	return &cli.Command{
+		Name:      "scan",
+		Usage:     "probe ports of a cluster host from a relay pod and print the open ones",
+		ArgsUsage: "<host>",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:        "ports",
+				Aliases:     []string{"p"},
+				Usage:       "ports and ranges to probe, e.g. 80,443,8000-8100",
+				Value:       SCAN_PORTS,
+				DefaultText: "1-1024 and common service ports",
+				Destination: &ports,
+			},
+			&cli.DurationFlag{
+				Name:        "timeout",
+				Usage:       "how long to wait for a port to accept",
+				Value:       time.Second,
+				Destination: &opts.timeout,
+			},
+			&cli.IntFlag{
+				Name:        "concurrency",
+				Usage:       "ports probed at once",
+				Value:       SCAN_CONCURRENCY,
+				Destination: &opts.concurrency,
+			},
+			&cli.BoolFlag{
+				Name:        "new-pod",
+				Usage:       "scan from a new relay pod, instead of a running one of yours",
+				Destination: &opts.newPod,
+			},
+			&cli.StringFlag{
+				Name:        "pod-image",
+				Usage:       "image of a new relay pod, it needs socat",
+				Value:       POD_IMAGE,
+				Destination: &opts.podImage,
+			},
+			&cli.BoolFlag{
+				Name:        "quiet",
+				Aliases:     []string{"q"},
+				Usage:       "do not print progress to stderr",
+				Destination: &quiet,
+			},
+		},
+		Action: func(c *cli.Context) error {
+			if !c.Args().Present() {
+				return fmt.Errorf("missing host")
+			}
+			opts.host = trimBrackets(c.Args().First())
+			var err error
+			if opts.ports, err = parsePorts(ports); err != nil {
+				return err
+			}
+			if opts.timeout <= 0 || opts.concurrency <= 0 {
+				return fmt.Errorf("--timeout and --concurrency need positive values")
+			}
+			if quiet {
+				opts.log.out = io.Discard
+			}
+			return scan(kube, opts)
+		},
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+
+	apiv1 "k8s.io/api/core/v1"
+)
+
+// the relay runs as nobody, the default image would run as root otherwise
+const RUN_AS_USER = 65534
+
+// podSecurity and containerSecurity make the relay pod pass the restricted Pod
+// Security Standard, which many managed clusters enforce.
+func podSecurity() *apiv1.PodSecurityContext {
+	nonRoot, user := true, int64(RUN_AS_USER)
+	return &apiv1.PodSecurityContext{
+		RunAsNonRoot:   &nonRoot,
+		RunAsUser:      &user,
+		RunAsGroup:     &user,
+		SeccompProfile: &apiv1.SeccompProfile{Type: apiv1.SeccompProfileTypeRuntimeDefault},
+	}
+}
+
+func containerSecurity() *apiv1.SecurityContext {
+	escalation := false
+	return &apiv1.SecurityContext{
+		AllowPrivilegeEscalation: &escalation,
+		Capabilities:             &apiv1.Capabilities{Drop: []apiv1.Capability{"ALL"}},
+	}
+}
+
+// allowPort lets the unprivileged relay listen on a privileged port, e.g.
+// the cluster port of a reverse relay. The sysctl is a safe one, the
+// restricted standard allows it.
+func allowPort(pod *apiv1.Pod, port uint) {
+	if port >= PRIVILEGED_PORTS {
+		return
+	}
+	pod.Spec.SecurityContext.Sysctls = append(pod.Spec.SecurityContext.Sysctls, apiv1.Sysctl{
+		Name:  "net.ipv4.ip_unprivileged_port_start",
+		Value: fmt.Sprint(port),
+	})
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+const RELEASE_REPO = "mkulke/kube-relay"
+const CHECKSUMS_ASSET = "checksums.txt"
+const SIGNATURE_ASSET = "checksums.txt.sig"
+
+// set at build time with -ldflags "-X main.version=... -X main.releasePublicKey=..."
+var version = "dev"
+
+// base64 encoded ed25519 key the release checksums are signed with, a build
+// without it only updates with --insecure-skip-verify
+var releasePublicKey = ""
+
+type releaseAsset struct {
+	Name string `json:"name"`
+	URL  string `json:"browser_download_url"`
+}
+
+type release struct {
+	TagName    string         `json:"tag_name"`
+	Prerelease bool           `json:"prerelease"`
+	Assets     []releaseAsset `json:"assets"`
+}
+
+func (r *release) asset(name string) (string, bool) {
+	for _, a := range r.Assets {
+		if a.Name == name {
+			return a.URL, true
+		}
+	}
+	return "", false
+}
+
+var updateClient = &http.Client{Timeout: 5 * time.Minute}
+
+func download(url string) ([]byte, error) {
+	resp, err := updateClient.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+func latestRelease(channel string) (*release, error) {
+	switch channel {
+	case "stable":
+		data, err := download(fmt.Sprintf("https://api.github.com/repos/%s/releases/latest", RELEASE_REPO))
+		if err != nil {
+			return nil, err
+		}
+		var r release
+		return &r, json.Unmarshal(data, &r)
+	case "prerelease":
+		data, err := download(fmt.Sprintf("https://api.github.com/repos/%s/releases", RELEASE_REPO))
+		if err != nil {
+			return nil, err
+		}
+		var releases []release
+		if err := json.Unmarshal(data, &releases); err != nil {
+			return nil, err
+		}
+		if len(releases) == 0 {
+			return nil, fmt.Errorf("no releases found")
+		}
+		return &releases[0], nil
+	}
+	return nil, fmt.Errorf("unknown release channel %q", channel)
+}
+
+func assetName() string {
+	name := fmt.Sprintf("kube-relay_%s_%s", runtime.GOOS, runtime.GOARCH)
+	if runtime.GOOS == "windows" {
+		name += ".exe"
+	}
+	return name
+}
+
+// verifyChecksum looks up the artifact in a sha256sum style checksums file
+func verifyChecksum(checksums []byte, name string, artifact []byte) error {
+	sum := sha256.Sum256(artifact)
+	scanner := bufio.NewScanner(bytes.NewReader(checksums))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 || strings.TrimPrefix(fields[1], "*") != name {
+			continue
+		}
+		if fields[0] != hex.EncodeToString(sum[:]) {
+			return fmt.Errorf("checksum mismatch for %s", name)
+		}
+		return nil
+	}
+	return fmt.Errorf("no checksum for %s", name)
+}
+
+func verifySignature(publicKey string, checksums []byte, signature []byte) error {
+	key, err := base64.StdEncoding.DecodeString(publicKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return fmt.Errorf("invalid release public key")
+	}
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(signature)))
+	if err != nil {
+		return fmt.Errorf("invalid signature encoding: %w", err)
+	}
+	if !ed25519.Verify(ed25519.PublicKey(key), checksums, sig) {
+		return fmt.Errorf("signature of %s does not match the release key", CHECKSUMS_ASSET)
+	}
+	return nil
+}
+
+// verifyRelease checks the signature of the checksums of a release, nil for
+// an unsigned one. Without a built in key only --insecure-skip-verify updates.
+func verifyRelease(publicKey string, checksums []byte, signature []byte, insecureSkipVerify bool) error {
+	switch {
+	case publicKey != "" && signature == nil:
+		return fmt.Errorf("not signed")
+	case publicKey != "":
+		return verifySignature(publicKey, checksums, signature)
+	case insecureSkipVerify:
+		fmt.Fprintln(os.Stderr, "Skipping the signature verification, only the checksum is verified")
+		return nil
+	}
+	return fmt.Errorf("this build has no release key to verify the update with, install a release build or pass --insecure-skip-verify")
+}
+
+// replaceExecutable writes the new binary next to the running one and renames
+// it into place, so a failed update never leaves a truncated binary behind.
+func replaceExecutable(binary []byte) (string, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	exe, err = filepath.EvalSymlinks(exe)
+	if err != nil {
+		return "", err
+	}
+	info, err := os.Stat(exe)
+	if err != nil {
+		return "", err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(exe), ".kube-relay-update-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(binary); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+	if err := os.Chmod(tmp.Name(), info.Mode().Perm()); err != nil {
+		return "", err
+	}
+
+	// windows refuses to overwrite a running executable, but allows renaming it
+	old := exe + ".old"
+	os.Remove(old)
+	if err := os.Rename(exe, old); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp.Name(), exe); err != nil {
+		os.Rename(old, exe)
+		return "", err
+	}
+	// windows keeps the running binary open, the next start removes it
+	if err := os.Remove(old); err != nil && runtime.GOOS != "windows" {
+		fmt.Fprintf(os.Stderr, "Cannot remove the previous binary %s: %s\n", old, err)
+	}
+	return exe, nil
+}
+
+// removeStaleExecutable removes the binary a self-update on windows left
+// behind, it was still running then
+func removeStaleExecutable() {
+	if runtime.GOOS != "windows" {
+		return
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return
+	}
+	if exe, err = filepath.EvalSymlinks(exe); err != nil {
+		return
+	}
+	old := exe + ".old"
+	if _, err := os.Stat(old); err != nil {
+		return
+	}
+	if err := os.Remove(old); err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot remove the previous binary %s: %s\n", old, err)
+	}
+}
+
+func selfUpdate(channel string, checkOnly bool, insecureSkipVerify bool) error {
+	r, err := latestRelease(channel)
+	if err != nil {
+		return err
+	}
+	if r.TagName == version {
+		fmt.Printf("kube-relay %s is up to date\n", version)
+		return nil
+	}
+	fmt.Printf("Found release %s (current %s)\n", r.TagName, version)
+	if checkOnly {
+		return nil
+	}
+
+	name := assetName()
+	binaryURL, ok := r.asset(name)
+	if !ok {
+		return fmt.Errorf("release %s has no artifact %s", r.TagName, name)
+	}
+	checksumsURL, ok := r.asset(CHECKSUMS_ASSET)
+	if !ok {
+		return fmt.Errorf("release %s has no %s", r.TagName, CHECKSUMS_ASSET)
+	}
+
+	checksums, err := download(checksumsURL)
+	if err != nil {
+		return err
+	}
+	var signature []byte
+	if signatureURL, ok := r.asset(SIGNATURE_ASSET); ok && releasePublicKey != "" {
+		if signature, err = download(signatureURL); err != nil {
+			return err
+		}
+	}
+	if err := verifyRelease(releasePublicKey, checksums, signature, insecureSkipVerify); err != nil {
+		return fmt.Errorf("release %s: %w", r.TagName, err)
+	}
+
+	binary, err := download(binaryURL)
+	if err != nil {
+		return err
+	}
+	if err := verifyChecksum(checksums, name, binary); err != nil {
+		return err
+	}
+
+	exe, err := replaceExecutable(binary)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Updated %s to %s\n", exe, r.TagName)
+	return nil
+}
+
+func selfUpdateCommand() *cli.Command {
+	var channel string
+	var checkOnly bool
+	var insecureSkipVerify bool
+
+	return &cli.Command{
+		Name:  "self-update",
+		Usage: "replace the binary with the latest release",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:        "channel",
+				Value:       "stable",
+				Usage:       "release channel (stable or prerelease)",
+				Destination: &channel,
+			},
+			&cli.BoolFlag{
+				Name:        "check",
+				Usage:       "only report whether an update is available",
+				Destination: &checkOnly,
+			},
+			&cli.BoolFlag{
+				Name:        "insecure-skip-verify",
+				Usage:       "update without a signature check, in builds without a release key",
+				Destination: &insecureSkipVerify,
+			},
+		},
+		Action: func(c *cli.Context) error {
+			return selfUpdate(channel, checkOnly, insecureSkipVerify)
+		},
+	}
+}
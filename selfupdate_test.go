@@ -0,0 +1,91 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestVerifyChecksum(t *testing.T) {
+	artifact := []byte("binary")
+	sum := sha256.Sum256(artifact)
+	good := hex.EncodeToString(sum[:])
+	bad := strings.Repeat("0", len(good))
+
+	tests := []struct {
+		name      string
+		checksums string
+		err       string
+	}{
+		{"match", fmt.Sprintf("%s  kube-relay_linux_amd64\n", good), ""},
+		{"binary mode", fmt.Sprintf("%s *kube-relay_linux_amd64\n", good), ""},
+		{"among others", fmt.Sprintf("%s  kube-relay_darwin_arm64\n%s  kube-relay_linux_amd64\n", bad, good), ""},
+		{"mismatch", fmt.Sprintf("%s  kube-relay_linux_amd64\n", bad), "checksum mismatch"},
+		{"missing", fmt.Sprintf("%s  kube-relay_darwin_arm64\n", good), "no checksum"},
+		{"malformed line", fmt.Sprintf("%s\n", good), "no checksum"},
+		{"empty", "", "no checksum"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := verifyChecksum([]byte(tt.checksums), "kube-relay_linux_amd64", artifact)
+			checkError(t, err, tt.err)
+		})
+	}
+}
+
+func TestVerifyRelease(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherPublic, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := base64.StdEncoding.EncodeToString(public)
+	checksums := []byte("abc  kube-relay_linux_amd64\n")
+	signature := []byte(base64.StdEncoding.EncodeToString(ed25519.Sign(private, checksums)) + "\n")
+
+	tests := []struct {
+		name      string
+		key       string
+		checksums []byte
+		signature []byte
+		insecure  bool
+		err       string
+	}{
+		{"signed", key, checksums, signature, false, ""},
+		{"unsigned release", key, checksums, nil, false, "not signed"},
+		{"unsigned release insecure", key, checksums, nil, true, "not signed"},
+		{"tampered checksums", key, []byte("def  kube-relay_linux_amd64\n"), signature, false, "does not match"},
+		{"other key", base64.StdEncoding.EncodeToString(otherPublic), checksums, signature, false, "does not match"},
+		{"signature not base64", key, checksums, []byte("not base64!"), false, "invalid signature encoding"},
+		{"invalid key", "c2hvcnQ=", checksums, signature, false, "invalid release public key"},
+		{"no key", "", checksums, signature, false, "no release key"},
+		{"no key insecure", "", checksums, nil, true, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := verifyRelease(tt.key, tt.checksums, tt.signature, tt.insecure)
+			checkError(t, err, tt.err)
+		})
+	}
+}
+
+// checkError fails unless err contains want, an empty want expects no error
+func checkError(t *testing.T, err error, want string) {
+	t.Helper()
+	switch {
+	case want == "" && err != nil:
+		t.Fatalf("unexpected error: %s", err)
+	case want != "" && err == nil:
+		t.Fatalf("expected an error containing %q", want)
+	case want != "" && !strings.Contains(err.Error(), want):
+		t.Fatalf("expected an error containing %q, got %q", want, err)
+	}
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/urfave/cli/v2"
+	"sigs.k8s.io/yaml"
+)
+
+// SESSION_NAME_MAX leaves room for suffixes within the 63 characters of a pod name
+const SESSION_NAME_MAX = 40
+
+// session records the active tunnels of a process in a file of the config
+// format, so `resume` can bring them back after a reboot or a crash. Tunnels
+// that end on their own are dropped, a shutdown keeps them.
+type session struct {
+	mu      sync.Mutex
+	path    string
+	tunnels map[string]tunnelConfig
+	kept    bool
+}
+
+func sessionDir() (string, error) {
+	dir, err := configDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "sessions"), nil
+}
+
+// newSession returns the session of this process, nil if there is no config
+// dir, a session is best effort.
+func newSession() *session {
+	dir, err := sessionDir()
+	if err != nil {
+		return nil
+	}
+	return &session{
+		path:    filepath.Join(dir, fmt.Sprintf("%d.yaml", os.Getpid())),
+		tunnels: map[string]tunnelConfig{},
+	}
+}
+
+// sessionTunnel describes a relay as a tunnel of the config format, a relay
+// with the default pod name is named after its cluster host.
+func sessionTunnel(opts relayOptions, namespace string, localPort uint) tunnelConfig {
+	name := strings.TrimPrefix(opts.name, POD_NAME+"-")
+	if name == opts.name {
+		host := opts.clusterHost
+		if net.ParseIP(host) == nil {
+			host = strings.Split(host, ".")[0]
+		}
+		name = sanitizeName(host)
+	}
+	t := tunnelConfig{
+		Name:        name,
+		Namespace:   namespace,
+		ClusterHost: opts.clusterHost,
+		ClusterPort: opts.clusterPort,
+		LocalPort:   localPort,
+	}
+	if opts.localAddress != LOOPBACK_ADDRESS {
+		t.LocalAddress = opts.localAddress
+	}
+	if opts.engine == ENGINE_GO_RELAY {
+		t.Engine = opts.engine
+	}
+	if opts.podImage != POD_IMAGE && opts.podImage != goRelayImage() {
+		t.PodImage = opts.podImage
+	}
+	if opts.protocol == PROTOCOL_UDP {
+		t.Protocol = opts.protocol
+	}
+	return t
+}
+
+func (s *session) add(key string, t tunnelConfig) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tunnels[key] = t
+	s.save()
+}
+
+func (s *session) remove(key string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.kept {
+		return
+	}
+	delete(s.tunnels, key)
+	s.save()
+}
+
+// keep freezes the session on shutdown, before the relay pods are deleted
+func (s *session) keep() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.kept = true
+}
+
+func (s *session) save() {
+	if len(s.tunnels) == 0 {
+		os.Remove(s.path)
+		return
+	}
+	var config relayConfig
+	for _, t := range s.tunnels {
+		config.Tunnels = append(config.Tunnels, t)
+	}
+	sort.Slice(config.Tunnels, func(i, j int) bool { return config.Tunnels[i].Name < config.Tunnels[j].Name })
+	data, err := yaml.Marshal(config)
+	if err != nil {
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return
+	}
+	os.WriteFile(s.path, data, 0600)
+}
+
+// loadSessions collects the tunnels of all saved sessions, or only of those
+// whose process is still running, names are made unique across sessions. It
+// returns the session files it read.
+func loadSessions(running bool) ([]tunnelConfig, []string, error) {
+	dir, err := sessionDir()
+	if err != nil {
+		return nil, nil, err
+	}
+	paths, err := filepath.Glob(filepath.Join(dir, "*.yaml"))
+	if err != nil {
+		return nil, nil, err
+	}
+	var tunnels []tunnelConfig
+	var read []string
+	names := map[string]bool{}
+	for _, path := range paths {
+		if running {
+			pid, err := strconv.Atoi(strings.TrimSuffix(filepath.Base(path), ".yaml"))
+			if err != nil || !processRunning(pid) {
+				continue
+			}
+		}
+		read = append(read, path)
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		var config relayConfig
+		if err := yaml.UnmarshalStrict(data, &config); err != nil {
+			return nil, nil, fmt.Errorf("invalid session %s: %w", path, err)
+		}
+		for _, t := range config.Tunnels {
+			name := t.Name
+			for i := 2; names[t.Name]; i++ {
+				t.Name = fmt.Sprintf("%s-%d", name, i)
+			}
+			names[t.Name] = true
+			tunnels = append(tunnels, t)
+		}
+	}
+	return tunnels, read, nil
+}
+
+// processRunning tells whether a process exists, on windows finding a process
+// fails if it doesn't.
+func processRunning(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	if runtime.GOOS == "windows" {
+		return true
+	}
+	return p.Signal(syscall.Signal(0)) == nil
+}
+
+// sanitizeName turns a host into a tunnel name that makes a valid pod name
+func sanitizeName(host string) string {
+	name := strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		if r >= 'A' && r <= 'Z' {
+			return r + 'a' - 'A'
+		}
+		return '-'
+	}, host)
+	if len(name) > SESSION_NAME_MAX {
+		name = name[:SESSION_NAME_MAX]
+	}
+	name = strings.Trim(name, "-")
+	if name == "" {
+		return "tunnel"
+	}
+	return name
+}
+
+// resume re-establishes the tunnels of saved sessions with new relay pods
+func resume(kube *kubeOptions, opts upOptions) error {
+	tunnels, paths, err := loadSessions(false)
+	if err != nil {
+		return err
+	}
+	if len(tunnels) == 0 {
+		return fmt.Errorf("no saved session to resume")
+	}
+	// the tunnels are saved again by this process
+	for _, path := range paths {
+		os.Remove(path)
+	}
+	return upTunnels(kube, "session", tunnels, opts)
+}
+
+func resumeCommand(kube *kubeOptions) *cli.Command {
+	var opts upOptions
+	return &cli.Command{
+		Name:  "resume",
+		Usage: "re-establish the tunnels that were active on shutdown or crash",
+		Flags: []cli.Flag{
+			&cli.IntFlag{
+				Name:        "batch-size",
+				Value:       UP_BATCH_SIZE,
+				Usage:       "number of relay pods starting at a time",
+				Destination: &opts.batchSize,
+			},
+		},
+		Action: func(c *cli.Context) error {
+			return resume(kube, opts)
+		},
+	}
+}
+
+// export writes the tunnels of running sessions in the format of the config
+// file, so an ad-hoc setup can be shared and started with `up`.
+func export(w io.Writer, group string) error {
+	tunnels, _, err := loadSessions(true)
+	if err != nil {
+		return err
+	}
+	if len(tunnels) == 0 {
+		return fmt.Errorf("no running tunnels to export")
+	}
+	for i := range tunnels {
+		tunnels[i].Group = group
+	}
+	data, err := yaml.Marshal(relayConfig{Tunnels: tunnels})
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+func exportCommand() *cli.Command {
+	var group string
+	return &cli.Command{
+		Name:  "export",
+		Usage: "print the running tunnels as config file",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:        "group",
+				Usage:       "group of the exported tunnels",
+				Destination: &group,
+			},
+		},
+		Action: func(c *cli.Context) error {
+			return export(os.Stdout, group)
+		},
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/urfave/cli/v2"
+	"golang.org/x/term"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/remotecommand"
+)
+
+const DEBUG_CONTAINER_TIMEOUT = time.Minute
+const RESIZE_POLL_INTERVAL = 250 * time.Millisecond
+
+// terminalSize reports the size of the local terminal whenever it changes,
+// polling keeps it portable to platforms without SIGWINCH.
+type terminalSize struct {
+	fd   int
+	last remotecommand.TerminalSize
+}
+
+func (t *terminalSize) Next() *remotecommand.TerminalSize {
+	for {
+		width, height, err := term.GetSize(t.fd)
+		if err != nil {
+			return nil
+		}
+		size := remotecommand.TerminalSize{Width: uint16(width), Height: uint16(height)}
+		if size != t.last {
+			t.last = size
+			return &size
+		}
+		time.Sleep(RESIZE_POLL_INTERVAL)
+	}
+}
+
+// addDebugContainer adds an ephemeral container sharing the process namespace
+// of the relay container, for tools the socat image lacks.
+func addDebugContainer(rc *relayClient, pod *v1.Pod, image string) (string, error) {
+	name := fmt.Sprintf("debug-%d", time.Now().Unix())
+	pod.Spec.EphemeralContainers = append(pod.Spec.EphemeralContainers, v1.EphemeralContainer{
+		EphemeralContainerCommon: v1.EphemeralContainerCommon{
+			Name:            name,
+			Image:           image,
+			Command:         []string{"sh"},
+			Stdin:           true,
+			TTY:             true,
+			SecurityContext: ephemeralSecurity(),
+		},
+		TargetContainerName: pod.Spec.Containers[0].Name,
+	})
+	pods := rc.clientset.CoreV1().Pods(pod.Namespace)
+	_, err := pods.UpdateEphemeralContainers(context.TODO(), pod.Name, pod, metav1.UpdateOptions{})
+	if err != nil {
+		return "", err
+	}
+	fmt.Printf("Added debug container %q to pod %q\n", name, pod.Name)
+
+	deadline := time.Now().Add(DEBUG_CONTAINER_TIMEOUT)
+	for time.Now().Before(deadline) {
+		p, err := pods.Get(context.TODO(), pod.Name, metav1.GetOptions{})
+		if err != nil {
+			return "", err
+		}
+		for _, s := range p.Status.EphemeralContainerStatuses {
+			if s.Name == name && s.State.Running != nil {
+				return name, nil
+			}
+		}
+		time.Sleep(time.Second)
+	}
+	return "", fmt.Errorf("debug container %q did not start within %s", name, DEBUG_CONTAINER_TIMEOUT)
+}
+
+// shell opens an interactive shell in the relay pod, to check the target from
+// the network vantage point of the relay.
+func shell(kube *kubeOptions, name string, image string) error {
+	namespace, rc, err := connect(kube)
+	if err != nil {
+		return err
+	}
+	name = findPod(rc.clientset, namespace, name)
+	pod, err := rc.clientset.CoreV1().Pods(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	if pod.Status.Phase != v1.PodRunning {
+		return fmt.Errorf("pod %q is %s, not running", name, pod.Status.Phase)
+	}
+	container := pod.Spec.Containers[0].Name
+	if image != "" {
+		container, err = addDebugContainer(rc, pod, image)
+		if err != nil {
+			return err
+		}
+	}
+
+	fd := int(os.Stdin.Fd())
+	tty := term.IsTerminal(fd)
+	executor, err := executor(rc, namespace, name, &v1.PodExecOptions{
+		Container: container,
+		Command:   []string{"sh"},
+		Stdin:     true,
+		Stdout:    true,
+		Stderr:    !tty,
+		TTY:       tty,
+	})
+	if err != nil {
+		return err
+	}
+	options := remotecommand.StreamOptions{Stdin: os.Stdin, Stdout: os.Stdout, Tty: tty}
+	if tty {
+		state, err := term.MakeRaw(fd)
+		if err != nil {
+			return err
+		}
+		defer term.Restore(fd, state)
+		options.TerminalSizeQueue = &terminalSize{fd: fd}
+	} else {
+		options.Stderr = os.Stderr
+	}
+	return executor.Stream(options)
+}
+
+func shellCommand(kube *kubeOptions) *cli.Command {
+	var image string
+
+	return &cli.Command{
+		Name:      "shell",
+		Usage:     "open a shell in a running relay pod, e.g. to run nc or nslookup from its network",
+		ArgsUsage: "[name]",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:        "image",
+				Usage:       "run the shell in an ephemeral debug container with this image, e.g. nicolaka/netshoot",
+				Destination: &image,
+			},
+		},
+		Action: func(c *cli.Context) error {
+			name := POD_NAME
+			if c.Args().Present() {
+				name = c.Args().First()
+			}
+			return shell(kube, name, image)
+		},
+	}
+}
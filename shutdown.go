@@ -0,0 +1,91 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const SHUTDOWN_POLL_INTERVAL = 100 * time.Millisecond
+
+// shutdown drains the tunnels of a relay on a signal. They stop accepting
+// connections and the open ones get a grace period to finish, e.g. database
+// transactions, before the forward is closed and the relay pod deleted.
+type shutdown struct {
+	mu       sync.Mutex
+	tunnels  []*tunnelListener
+	cleanups []func()
+}
+
+// atExit registers a cleanup the exit on a signal would skip otherwise, it
+// runs after the drain
+func (s *shutdown) atExit(f func()) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cleanups = append(s.cleanups, f)
+}
+
+func (s *shutdown) cleanup() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	cleanups := s.cleanups
+	s.mu.Unlock()
+	for _, f := range cleanups {
+		f()
+	}
+}
+
+func (s *shutdown) register(t *tunnelListener) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tunnels = append(s.tunnels, t)
+}
+
+func (s *shutdown) open() int32 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var open int32
+	for _, t := range s.tunnels {
+		open += atomic.LoadInt32(&t.open)
+	}
+	return open
+}
+
+// drain closes the local listeners and waits up to timeout for the open
+// connections to finish
+func (s *shutdown) drain(timeout time.Duration, log *logger) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	for _, t := range s.tunnels {
+		t.close()
+	}
+	s.mu.Unlock()
+
+	open := s.open()
+	if open == 0 {
+		return
+	}
+	if timeout <= 0 {
+		timeout = DRAIN_TIMEOUT
+	}
+	log.printf("Waiting up to %s for %d open connections to finish\n", timeout, open)
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if s.open() == 0 {
+			log.printf("All connections finished\n")
+			return
+		}
+		time.Sleep(SHUTDOWN_POLL_INTERVAL)
+	}
+	log.printf("Closing %d connections, they didn't finish within %s\n", s.open(), timeout)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+const PIPE_PREFIX = `\\.\pipe\`
+
+// checkLocalSocket verifies the socket path can be listened on before any pod
+// is created. A socket left behind by a crashed relay is removed, one that is
+// still served fails.
+func checkLocalSocket(path string) error {
+	if _, err := os.Lstat(path); os.IsNotExist(err) {
+		return nil
+	}
+	if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+		conn.Close()
+		return &relayError{
+			Code:       "LocalSocketInUse",
+			Reason:     fmt.Sprintf("Local socket %s is already in use", path),
+			Suggestion: "pick another path with --local-socket",
+			exitCode:   1,
+		}
+	}
+	return os.Remove(path)
+}
+
+// listenSocket listens on a unix socket instead of a local port, only the
+// user may connect to it. The socket is removed once the listener closes.
+func listenSocket(path string, queueTimeout time.Duration, targets []string, log *logger) (*tunnelListener, error) {
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return serveListener(listener, queueTimeout, targets, log), nil
+}
+
+// pipePath is the path of a named pipe, a bare name gets the pipe prefix
+func pipePath(name string) string {
+	if strings.HasPrefix(name, PIPE_PREFIX) {
+		return name
+	}
+	return PIPE_PREFIX + name
+}
+
+func serveListener(listener net.Listener, queueTimeout time.Duration, targets []string, log *logger) *tunnelListener {
+	t := newTunnelListener(queueTimeout, targets, log)
+	t.listeners = []net.Listener{listener}
+	go t.serve(listener)
+	return t
+}
+
+// listenLocal listens on the local side of a relay, its socket, its named
+// pipe or its address
+func listenLocal(opts relayOptions, targets []string) (*tunnelListener, error) {
+	if opts.localSocket != "" {
+		return listenSocket(opts.localSocket, opts.queueTimeout, targets, opts.log)
+	}
+	if opts.localPipe != "" {
+		listener, err := listenPipe(pipePath(opts.localPipe))
+		if err != nil {
+			return nil, err
+		}
+		return serveListener(listener, opts.queueTimeout, targets, opts.log), nil
+	}
+	address := opts.localAddress
+	if address == "" {
+		address = LOOPBACK_ADDRESS
+	}
+	if opts.protocol == PROTOCOL_UDP {
+		return listenUDPTunnel(address, opts.localPort, opts.queueTimeout, targets, opts.log)
+	}
+	return listenTunnel(address, opts.localPort, opts.queueTimeout, targets, opts.log)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+const (
+	SOCKS_VERSION          = 5
+	SOCKS_NO_AUTH          = 0
+	SOCKS_NO_METHOD        = 0xff
+	SOCKS_CONNECT          = 1
+	SOCKS_ADDR_IPV4        = 1
+	SOCKS_ADDR_DOMAIN      = 3
+	SOCKS_ADDR_IPV6        = 4
+	SOCKS_SUCCEEDED        = 0
+	SOCKS_NOT_SUPPORTED    = 7
+	SOCKS_ADDR_UNSUPPORTED = 8
+)
+
+// socksReply is a reply to a connect request, the bound address is unknown
+// as the connection is made from the relay pod.
+func socksReply(code byte) []byte {
+	return []byte{SOCKS_VERSION, code, 0, SOCKS_ADDR_IPV4, 0, 0, 0, 0, 0, 0}
+}
+
+// socksHandshake negotiates a SOCKS5 connect without authentication, hosts
+// are passed on unresolved so that they resolve in the cluster.
+func socksHandshake(client net.Conn) (string, []byte, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(client, header); err != nil {
+		return "", nil, err
+	}
+	if header[0] != SOCKS_VERSION {
+		return "", nil, fmt.Errorf("unsupported socks version %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(client, methods); err != nil {
+		return "", nil, err
+	}
+	method := byte(SOCKS_NO_METHOD)
+	for _, m := range methods {
+		if m == SOCKS_NO_AUTH {
+			method = SOCKS_NO_AUTH
+		}
+	}
+	if _, err := client.Write([]byte{SOCKS_VERSION, method}); err != nil {
+		return "", nil, err
+	}
+	if method == SOCKS_NO_METHOD {
+		return "", nil, fmt.Errorf("client needs authentication")
+	}
+
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(client, request); err != nil {
+		return "", nil, err
+	}
+	if request[1] != SOCKS_CONNECT {
+		client.Write(socksReply(SOCKS_NOT_SUPPORTED))
+		return "", nil, fmt.Errorf("unsupported socks command %d", request[1])
+	}
+	var host string
+	switch request[3] {
+	case SOCKS_ADDR_IPV4, SOCKS_ADDR_IPV6:
+		ip := make([]byte, net.IPv4len)
+		if request[3] == SOCKS_ADDR_IPV6 {
+			ip = make([]byte, net.IPv6len)
+		}
+		if _, err := io.ReadFull(client, ip); err != nil {
+			return "", nil, err
+		}
+		host = net.IP(ip).String()
+	case SOCKS_ADDR_DOMAIN:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(client, length); err != nil {
+			return "", nil, err
+		}
+		domain := make([]byte, length[0])
+		if _, err := io.ReadFull(client, domain); err != nil {
+			return "", nil, err
+		}
+		host = string(domain)
+	default:
+		client.Write(socksReply(SOCKS_ADDR_UNSUPPORTED))
+		return "", nil, fmt.Errorf("unsupported socks address type %d", request[3])
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(client, port); err != nil {
+		return "", nil, err
+	}
+	target := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port))))
+	return target, socksReply(SOCKS_SUCCEEDED), nil
+}
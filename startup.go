@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/duration"
+	"k8s.io/client-go/kubernetes"
+)
+
+const WAIT_TIMEOUT = 5 * time.Minute
+
+const STARTUP_EVENTS = 10
+const STARTUP_LOG_LINES = 20
+
+// startupTimeout is the error of a relay pod that didn't become ready in time
+func startupTimeout(name string, pod *v1.Pod, timeout time.Duration) error {
+	state := "it was not seen yet"
+	if pod != nil {
+		state = podState(pod)
+	}
+	return &relayError{
+		Code:       "StartupTimeout",
+		Reason:     fmt.Sprintf("Pod %q did not become ready within %s, %s", name, timeout, state),
+		Resource:   fmt.Sprintf("pods/%s", name),
+		Suggestion: "check the events of the pod or raise --wait-timeout",
+		exitCode:   1,
+	}
+}
+
+// reportStartup prints the recent events and container logs of a relay pod
+// that didn't come up, e.g. FailedScheduling or a pull error, so there is no
+// need to turn to kubectl. Whatever can't be fetched is left out.
+func reportStartup(client kubernetes.Interface, namespace string, name string, log *logger) {
+	selector := fmt.Sprintf("involvedObject.kind=Pod,involvedObject.name=%s", name)
+	events, err := client.CoreV1().Events(namespace).List(context.TODO(), metav1.ListOptions{FieldSelector: selector})
+	if err == nil && len(events.Items) != 0 {
+		items := events.Items
+		sort.Slice(items, func(i, j int) bool { return eventTime(items[i]).Before(eventTime(items[j])) })
+		if len(items) > STARTUP_EVENTS {
+			items = items[len(items)-STARTUP_EVENTS:]
+		}
+		log.printf("Events of pod %q:\n", name)
+		for _, e := range items {
+			age := duration.HumanDuration(time.Since(eventTime(e)))
+			log.printf("  %s ago\t%s\t%s: %s\n", age, e.Type, e.Reason, strings.TrimSpace(e.Message))
+		}
+	}
+
+	pod, err := client.CoreV1().Pods(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+	if err != nil {
+		return
+	}
+	for _, cs := range pod.Status.ContainerStatuses {
+		logs := containerLogs(client, pod, cs.Name, false)
+		if logs == "" && cs.RestartCount > 0 {
+			logs = containerLogs(client, pod, cs.Name, true)
+		}
+		if logs == "" {
+			continue
+		}
+		log.printf("Logs of container %q:\n", cs.Name)
+		for _, line := range strings.Split(logs, "\n") {
+			log.printf("  %s\n", line)
+		}
+	}
+}
+
+func eventTime(e v1.Event) time.Time {
+	if !e.LastTimestamp.IsZero() {
+		return e.LastTimestamp.Time
+	}
+	if !e.EventTime.IsZero() {
+		return e.EventTime.Time
+	}
+	return e.CreationTimestamp.Time
+}
+
+func containerLogs(client kubernetes.Interface, pod *v1.Pod, container string, previous bool) string {
+	tail := int64(STARTUP_LOG_LINES)
+	logs, err := client.CoreV1().Pods(pod.Namespace).GetLogs(pod.Name, &v1.PodLogOptions{
+		Container: container,
+		Previous:  previous,
+		TailLines: &tail,
+	}).DoRaw(context.TODO())
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(logs))
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/urfave/cli/v2"
+	v1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// exit codes of the status command, so scripts can tell which part of a tunnel is broken
+const (
+	STATUS_OK                  = 0
+	STATUS_ERROR               = 1
+	STATUS_POD_MISSING         = 2
+	STATUS_POD_NOT_RUNNING     = 3
+	STATUS_FORWARD_DOWN        = 4
+	STATUS_BACKEND_UNREACHABLE = 5
+)
+
+const STATUS_PROBE_TIMEOUT = 2 * time.Second
+
+// probeBackend opens a connection through the local forward. socat closes the
+// stream right away when it cannot connect to the cluster host, so an early EOF
+// means the backend is unreachable, while an idle or talking connection is fine.
+func probeBackend(address string) (bool, error) {
+	conn, err := net.DialTimeout("tcp", address, STATUS_PROBE_TIMEOUT)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(STATUS_PROBE_TIMEOUT))
+	buf := make([]byte, 1)
+	_, err = conn.Read(buf)
+	var netErr net.Error
+	if err == nil || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return true, nil
+	}
+	return false, nil
+}
+
+func status(kube *kubeOptions, name string, localAddress string, localPort uint) error {
+	namespace, rc, err := connect(kube)
+	if err != nil {
+		return asRelayError(err)
+	}
+	return checkRelay(rc.clientset, namespace, name, localAddress, localPort)
+}
+
+// groupHealth checks every tunnel of a group and fails with the first broken one
+func groupHealth(kube *kubeOptions, configPath string, group string) error {
+	config, err := loadConfig(configPath)
+	if err != nil {
+		return asRelayError(err)
+	}
+	tunnels, err := config.group(group)
+	if err != nil {
+		return asRelayError(err)
+	}
+	namespace, rc, err := connect(kube)
+	if err != nil {
+		return asRelayError(err)
+	}
+
+	var first error
+	for _, t := range tunnels {
+		fmt.Printf("Tunnel %q:\n", t.Name)
+		err := checkRelay(rc.clientset, tunnelNamespace(t, namespace), t.podName(), t.options().localAddress, t.LocalPort)
+		if err != nil {
+			fmt.Println(err)
+			if first == nil {
+				first = err
+			}
+		}
+	}
+	if first != nil {
+		rErr := *asRelayError(first)
+		rErr.Reason = fmt.Sprintf("Group %q is unhealthy: %s", group, rErr.Reason)
+		return &rErr
+	}
+	fmt.Printf("Group %q is healthy\n", group)
+	return nil
+}
+
+func checkRelay(clientset kubernetes.Interface, namespace string, name string, localAddress string, localPort uint) error {
+	name = findPod(clientset, namespace, name)
+	resource := fmt.Sprintf("pods/%s", name)
+	pod, err := clientset.CoreV1().Pods(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		return &relayError{
+			Code:       "PodMissing",
+			Reason:     fmt.Sprintf("Pod %q not found in namespace %q", name, namespace),
+			Resource:   resource,
+			Suggestion: "start a relay with kube-relay --cluster-host",
+			exitCode:   STATUS_POD_MISSING,
+		}
+	}
+	if err != nil {
+		return asRelayError(err)
+	}
+	if pod.Status.Phase != v1.PodRunning {
+		return &relayError{
+			Code:       "PodNotRunning",
+			Reason:     fmt.Sprintf("Pod %q is %s", name, pod.Status.Phase),
+			Resource:   resource,
+			Suggestion: "inspect the pod with kubectl describe",
+			exitCode:   STATUS_POD_NOT_RUNNING,
+		}
+	}
+	fmt.Printf("Pod %q is running\n", name)
+
+	address := joinHostPort(dialAddress(localAddress), localPort)
+	reachable, err := probeBackend(address)
+	if err != nil {
+		return &relayError{
+			Code:       "ForwardDown",
+			Reason:     fmt.Sprintf("Forward on %s is down: %s", address, err),
+			Resource:   resource,
+			Suggestion: "restart kube-relay or check the local port",
+			exitCode:   STATUS_FORWARD_DOWN,
+		}
+	}
+	fmt.Printf("Forward on %s is alive\n", address)
+	if !reachable {
+		return &relayError{
+			Code:       "BackendUnreachable",
+			Reason:     "Backend is unreachable from the relay pod",
+			Resource:   resource,
+			Suggestion: "check the cluster host and port of the relay",
+			exitCode:   STATUS_BACKEND_UNREACHABLE,
+		}
+	}
+	fmt.Println("Backend is reachable")
+	return nil
+}
+
+func statusCommand(kube *kubeOptions, configPath *string) *cli.Command {
+	var localPort uint
+	var localAddress string
+	var group string
+
+	return &cli.Command{
+		Name:      "status",
+		Usage:     "check the health of a running relay, exit code tells which part is broken",
+		ArgsUsage: "[name]",
+		Description: fmt.Sprintf(
+			"exit codes: %d healthy, %d error, %d pod missing, %d pod not running, %d forward down, %d backend unreachable",
+			STATUS_OK, STATUS_ERROR, STATUS_POD_MISSING, STATUS_POD_NOT_RUNNING, STATUS_FORWARD_DOWN, STATUS_BACKEND_UNREACHABLE,
+		),
+		Flags: []cli.Flag{
+			&cli.UintFlag{
+				Name:        "local-port",
+				Aliases:     []string{"l"},
+				Value:       1999,
+				Usage:       "local tcp port of the forward",
+				Destination: &localPort,
+			},
+			&cli.StringFlag{
+				Name:        "address",
+				Value:       LOOPBACK_ADDRESS,
+				Usage:       "local address of the forward, the --address it was started with",
+				Destination: &localAddress,
+			},
+			&cli.StringFlag{
+				Name:        "group",
+				Aliases:     []string{"g"},
+				Usage:       "check all tunnels of a group from the config file",
+				Destination: &group,
+			},
+		},
+		Action: func(c *cli.Context) error {
+			if group != "" {
+				return groupHealth(kube, *configPath, group)
+			}
+			name := POD_NAME
+			if c.Args().Present() {
+				name = c.Args().First()
+			}
+			address, err := parseLocalAddress(localAddress)
+			if err != nil {
+				return asRelayError(err)
+			}
+			return status(kube, name, address, localPort)
+		},
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// parseTargetLine parses "<host>[:<port>] [<local port>]", a host may be given
+// as svc/<name> for a service in the relay namespace, an ipv6 host with a
+// port in brackets.
+func parseTargetLine(line string, defaultPort uint) (string, uint, uint, error) {
+	fields := strings.Fields(line)
+	if len(fields) > 2 {
+		return "", 0, 0, fmt.Errorf("expected a target and an optional local port")
+	}
+	host, p := splitHostPort(strings.TrimPrefix(fields[0], "svc/"))
+	port := defaultPort
+	if p != "" {
+		parsed, err := strconv.ParseUint(p, 10, 16)
+		if err != nil || parsed == 0 {
+			return "", 0, 0, fmt.Errorf("invalid port %q", p)
+		}
+		port = uint(parsed)
+	}
+	if host == "" {
+		return "", 0, 0, fmt.Errorf("missing host")
+	}
+	var localPort uint
+	if len(fields) == 2 {
+		p, err := strconv.ParseUint(fields[1], 10, 16)
+		if err != nil {
+			return "", 0, 0, fmt.Errorf("invalid local port %q", fields[1])
+		}
+		localPort = uint(p)
+	}
+	return host, port, localPort, nil
+}
+
+// runStdin establishes a tunnel for every target read from in, as they come
+// in. Without a local port a free one is picked and reported. Loopback aliases
+// give every tunnel its own local address, targets the filter rejects are skipped.
+func runStdin(kube *kubeOptions, opts relayOptions, in io.Reader, loopbackAliases bool, filter *targetFilter) error {
+	namespace, rc, err := connect(kube)
+	if err != nil {
+		return err
+	}
+
+	var mu sync.Mutex
+	opts.session = newSession()
+	opts.shutdown = &shutdown{}
+	ctrlc := make(chan os.Signal, 1)
+	signal.Notify(ctrlc, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctrlc
+		println("received sigterm, draining connections, again to exit right away...")
+		go func() {
+			<-ctrlc
+			os.Exit(1)
+		}()
+		opts.session.keep()
+		opts.shutdown.drain(opts.drainTimeout, nil)
+		var drained sync.WaitGroup
+		for _, ns := range append([]string{namespace}, opts.namespaceFallback...) {
+			drained.Add(1)
+			go func(ns string) {
+				defer drained.Done()
+				cleanupOwned(rc.clientset, ns, nil)
+			}(ns)
+		}
+		drained.Wait()
+		recordTelemetryExit(errInterrupted)
+		os.Exit(1)
+	}()
+
+	var wg sync.WaitGroup
+	failed, count := 0, 0
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		t := opts
+		t.failover = nil
+		t.clusterHost, t.clusterPort, t.localPort, err = parseTargetLine(line, opts.clusterPort)
+		if err == nil {
+			var admitted bool
+			admitted, err = filter.admits(rc, namespace, t.clusterHost)
+			if err == nil && !admitted {
+				continue
+			}
+		}
+		if err == nil && loopbackAliases {
+			t.localAddress, err = loopbackAlias(count)
+			if err == nil {
+				err = ensureLoopbackAlias(t.localAddress)
+			}
+		}
+		if err == nil && t.localPort != 0 {
+			_, err = checkLocalPort(t.localAddress, t.localPort, false)
+		}
+		if err != nil {
+			fmt.Printf("Skip target %q: %s\n", line, err)
+			continue
+		}
+		count++
+		t.name = fmt.Sprintf("%s-%d", POD_NAME, count)
+		t.log = newLogger(t.name, count-1, len(POD_NAME)+3)
+
+		wg.Add(1)
+		go func(t relayOptions) {
+			defer wg.Done()
+			target := t.target()
+			err := relay(rc, namespace, t, func(port uint) error {
+				t.log.printf("Tunnel to %s is up on %s\n", target, joinHostPort(t.localAddress, port))
+				return nil
+			})
+			if err != nil {
+				t.log.printf("Tunnel to %s failed: %s\n", target, err)
+				mu.Lock()
+				failed++
+				mu.Unlock()
+			}
+		}(t)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	wg.Wait()
+
+	if failed != 0 {
+		return fmt.Errorf("%d of %d tunnels from stdin failed", failed, count)
+	}
+	return nil
+}
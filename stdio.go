@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+
+	"github.com/urfave/cli/v2"
+)
+
+// stdio relays stdin and stdout to a cluster host instead of a local port,
+// like netcat, e.g. as ProxyCommand of ssh. The output of kube-relay itself
+// goes to stderr, as stdout belongs to the connection.
+func stdio(kube *kubeOptions, opts relayOptions, target string) error {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return fmt.Errorf("invalid target %q, expected <host>:<port>", target)
+	}
+	clusterPort, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || clusterPort == 0 {
+		return fmt.Errorf("invalid port %q in target %q", port, target)
+	}
+	opts.clusterHost, opts.clusterPort = host, uint(clusterPort)
+
+	namespace, rc, err := connect(kube)
+	if err != nil {
+		return err
+	}
+	opts.name = fmt.Sprintf("%s-stdio", POD_NAME)
+	opts.instance = newInstance(opts.name)
+
+	ctrlc := make(chan os.Signal, 1)
+	signal.Notify(ctrlc, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	go func() {
+		<-ctrlc
+		cleanupOwned(rc.clientset, namespace, opts.log)
+		recordTelemetryExit(errInterrupted)
+		os.Exit(1)
+	}()
+
+	policy := retryPolicy{retries: opts.retries, backoff: opts.retryBackoff, log: opts.log}
+	var name string
+	primary := namespace
+	err = policy.do("create the relay pod", func() error {
+		var err error
+		namespace, name, err = spawnWithFallback(rc, primary, opts)
+		return err
+	})
+	if err != nil {
+		return withExitCode(err, EXIT_POD_CREATE)
+	}
+	defer cleanup(rc.clientset, namespace, name, opts.log)
+	err = policy.do("wait for the relay pod", func() error {
+		return wait(rc, namespace, name, WAIT_FOR_RUNNING, opts.scheduleTimeout, WAIT_TIMEOUT, opts.log)
+	})
+	if err != nil {
+		reportStartup(rc.clientset, namespace, name, opts.log)
+		return withExitCode(err, EXIT_POD_START)
+	}
+	command := []string{"socat", "-", socatAddress(PROTOCOL_TCP, target)}
+	return withExitCode(execStream(rc, namespace, name, command, os.Stdin, os.Stdout), EXIT_FORWARD_LOST)
+}
+
+func stdioCommand(kube *kubeOptions) *cli.Command {
+	opts := relayOptions{podImage: POD_IMAGE, log: &logger{out: os.Stderr}}
+	var quiet bool
+	return &cli.Command{
+		Name:      "stdio",
+		Usage:     "relay stdin and stdout to a cluster host, e.g. as ProxyCommand of ssh",
+		ArgsUsage: "<host>:<port>",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:        "pod-image",
+				Usage:       "image of the relay pod, it needs socat",
+				Value:       POD_IMAGE,
+				Destination: &opts.podImage,
+			},
+			&cli.IntFlag{
+				Name:        "retries",
+				Usage:       "how often to retry creating and waiting for the relay pod",
+				Destination: &opts.retries,
+			},
+			&cli.BoolFlag{
+				Name:        "quiet",
+				Aliases:     []string{"q"},
+				Usage:       "do not print progress to stderr",
+				Destination: &quiet,
+			},
+		},
+		Action: func(c *cli.Context) error {
+			if !c.Args().Present() {
+				return fmt.Errorf("missing target")
+			}
+			if quiet {
+				opts.log.out = io.Discard
+			}
+			return stdio(kube, opts, c.Args().First())
+		},
+	}
+}
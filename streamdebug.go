@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/httpstream"
+	"k8s.io/apimachinery/pkg/util/runtime"
+)
+
+var streamConnections int64
+
+// streamLog prints a timestamped stream diagnostic if --debug-streams is set
+func (rc *relayClient) streamLog(format string, args ...interface{}) {
+	if rc.debugStreams {
+		fmt.Fprintf(os.Stderr, "%s streams: %s\n", time.Now().Format("15:04:05.000000"), fmt.Sprintf(format, args...))
+	}
+}
+
+// enableStreamDebugging also logs the errors client-go hands to its runtime
+// error handlers, like failed copies or lost connections.
+func (rc *relayClient) enableStreamDebugging() {
+	rc.debugStreams = true
+	runtime.ErrorHandlers = append(runtime.ErrorHandlers, func(err error) {
+		rc.streamLog("error: %s", err)
+	})
+}
+
+// debugDialer logs the lifecycle of upgraded connections and their streams
+type debugDialer struct {
+	httpstream.Dialer
+	rc  *relayClient
+	url string
+}
+
+func (d debugDialer) Dial(protocols ...string) (httpstream.Connection, string, error) {
+	id := atomic.AddInt64(&streamConnections, 1)
+	d.rc.streamLog("conn %d: dial %s (%v)", id, d.url, protocols)
+	start := time.Now()
+	conn, protocol, err := d.Dialer.Dial(protocols...)
+	if err != nil {
+		d.rc.streamLog("conn %d: dial failed after %s: %s", id, time.Since(start), err)
+		return nil, "", err
+	}
+	d.rc.streamLog("conn %d: upgraded to %s in %s", id, protocol, time.Since(start))
+	go func() {
+		<-conn.CloseChan()
+		d.rc.streamLog("conn %d: closed after %s", id, time.Since(start))
+	}()
+	return &debugConnection{Connection: conn, rc: d.rc, id: id}, protocol, nil
+}
+
+type debugConnection struct {
+	httpstream.Connection
+	rc *relayClient
+	id int64
+}
+
+func (c *debugConnection) CreateStream(headers http.Header) (httpstream.Stream, error) {
+	stream, err := c.Connection.CreateStream(headers)
+	kind, port := headers.Get("streamType"), headers.Get("port")
+	if err != nil {
+		c.rc.streamLog("conn %d: creating %s stream for port %s failed: %s", c.id, kind, port, err)
+		return nil, err
+	}
+	s := &debugStream{Stream: stream, conn: c, label: fmt.Sprintf("conn %d stream %d (%s, port %s, request %s)", c.id, stream.Identifier(), kind, port, headers.Get("requestID"))}
+	c.rc.streamLog("%s: created", s.label)
+	return s, nil
+}
+
+func (c *debugConnection) Close() error {
+	c.rc.streamLog("conn %d: close", c.id)
+	return c.Connection.Close()
+}
+
+type debugStream struct {
+	httpstream.Stream
+	conn  *debugConnection
+	label string
+	read  int64
+	wrote int64
+}
+
+func (s *debugStream) Read(p []byte) (int, error) {
+	n, err := s.Stream.Read(p)
+	atomic.AddInt64(&s.read, int64(n))
+	if err != nil && !errors.Is(err, io.EOF) {
+		s.conn.rc.streamLog("%s: read error: %s", s.label, err)
+	}
+	return n, err
+}
+
+func (s *debugStream) Write(p []byte) (int, error) {
+	n, err := s.Stream.Write(p)
+	atomic.AddInt64(&s.wrote, int64(n))
+	if err != nil {
+		s.conn.rc.streamLog("%s: write error: %s", s.label, err)
+	}
+	return n, err
+}
+
+func (s *debugStream) Close() error {
+	s.conn.rc.streamLog("%s: close, %d bytes read, %d written", s.label, atomic.LoadInt64(&s.read), atomic.LoadInt64(&s.wrote))
+	return s.Stream.Close()
+}
+
+func (s *debugStream) Reset() error {
+	s.conn.rc.streamLog("%s: reset, %d bytes read, %d written", s.label, atomic.LoadInt64(&s.read), atomic.LoadInt64(&s.wrote))
+	return s.Stream.Reset()
+}
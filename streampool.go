@@ -0,0 +1,183 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// pooled connections are replaced after this age, targets that greet first
+// like mysql only wait so long for a login
+const STREAM_POOL_MAX_AGE = 5 * time.Second
+const STREAM_POOL_RETRY = time.Second
+const STREAM_POOL_PROBE = time.Millisecond
+
+// streamPool keeps connections through the forward of the primary target open
+// ahead of time. The port-forward sets up its streams as a connection comes
+// in, so a new local connection that gets a pooled one skips that setup.
+type streamPool struct {
+	size  int
+	token string
+
+	mu       sync.Mutex
+	upstream string
+	idle     []pooledConn
+	dialing  int
+	closed   bool
+}
+
+type pooledConn struct {
+	conn  net.Conn
+	since time.Time
+}
+
+// newStreamPool starts a pool of size connections, it fills once the forward
+// is up
+func newStreamPool(size int, token string) *streamPool {
+	p := &streamPool{size: size, token: token}
+	go func() {
+		ticker := time.NewTicker(STREAM_POOL_MAX_AGE / 2)
+		defer ticker.Stop()
+		for range ticker.C {
+			if !p.expire() {
+				return
+			}
+			p.fill()
+		}
+	}()
+	return p
+}
+
+// reset moves the pool to a new forward, pooled connections go with the old one
+func (p *streamPool) reset(upstream string) {
+	p.mu.Lock()
+	idle := p.idle
+	p.upstream, p.idle = upstream, nil
+	p.mu.Unlock()
+	for _, c := range idle {
+		c.conn.Close()
+	}
+	p.fill()
+}
+
+// get returns a pooled connection to upstream, or nil if there is none
+func (p *streamPool) get(upstream string) net.Conn {
+	defer p.fill()
+	for {
+		p.mu.Lock()
+		if p.upstream != upstream || len(p.idle) == 0 {
+			p.mu.Unlock()
+			return nil
+		}
+		c := p.idle[0]
+		p.idle = p.idle[1:]
+		p.mu.Unlock()
+
+		if time.Since(c.since) > STREAM_POOL_MAX_AGE {
+			c.conn.Close()
+			continue
+		}
+		if conn := probeConn(c.conn); conn != nil {
+			return conn
+		}
+	}
+}
+
+func (p *streamPool) fill() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for !p.closed && p.upstream != "" && len(p.idle)+p.dialing < p.size {
+		p.dialing++
+		go p.dial(p.upstream)
+	}
+}
+
+func (p *streamPool) dial(upstream string) {
+	conn, err := dialUpstream(upstream, p.token)
+	p.mu.Lock()
+	p.dialing--
+	if err != nil {
+		p.mu.Unlock()
+		time.AfterFunc(STREAM_POOL_RETRY, p.fill)
+		return
+	}
+	if p.closed || p.upstream != upstream {
+		p.mu.Unlock()
+		conn.Close()
+		return
+	}
+	p.idle = append(p.idle, pooledConn{conn: conn, since: time.Now()})
+	p.mu.Unlock()
+}
+
+// expire closes the connections pooled for too long, it is false once the
+// pool is closed
+func (p *streamPool) expire() bool {
+	p.mu.Lock()
+	var expired []pooledConn
+	idle := p.idle[:0]
+	for _, c := range p.idle {
+		if time.Since(c.since) > STREAM_POOL_MAX_AGE {
+			expired = append(expired, c)
+		} else {
+			idle = append(idle, c)
+		}
+	}
+	p.idle = idle
+	closed := p.closed
+	p.mu.Unlock()
+	for _, c := range expired {
+		c.conn.Close()
+	}
+	return !closed
+}
+
+func (p *streamPool) close() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	idle := p.idle
+	p.closed, p.idle = true, nil
+	p.mu.Unlock()
+	for _, c := range idle {
+		c.conn.Close()
+	}
+}
+
+// probeConn checks a pooled connection is still open, the port-forward closes
+// it if its streams failed. What the target sent already is kept.
+func probeConn(conn net.Conn) net.Conn {
+	buf := make([]byte, 4096)
+	conn.SetReadDeadline(time.Now().Add(STREAM_POOL_PROBE))
+	n, err := conn.Read(buf)
+	conn.SetReadDeadline(time.Time{})
+	if n != 0 {
+		return &prefixConn{Conn: conn, prefix: buf[:n]}
+	}
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return conn
+	}
+	conn.Close()
+	return nil
+}
+
+// prefixConn is a connection with data read from it already in front
+type prefixConn struct {
+	net.Conn
+	prefix []byte
+}
+
+func (c *prefixConn) Read(b []byte) (int, error) {
+	if len(c.prefix) != 0 {
+		n := copy(b, c.prefix)
+		c.prefix = c.prefix[n:]
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *prefixConn) CloseWrite() error {
+	closeWrite(c.Conn)
+	return nil
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+const TELEMETRY_SHOWN_EVENTS = 5
+
+// errInterrupted is the error class of a run ended by a signal
+var errInterrupted = &relayError{Code: "Interrupted", Reason: "interrupted by a signal", exitCode: EXIT_ERROR}
+
+// telemetryTracker is the command of this run, for the exits without a context
+// at hand. A run is recorded once, whichever way it ends first.
+type telemetryTracker struct {
+	mu      sync.Mutex
+	once    sync.Once
+	context *cli.Context
+}
+
+var telemetryRun = &telemetryTracker{}
+
+// telemetry is off unless a user explicitly enables it. Every event is appended
+// to a local log before it is sent, so users can always see what left the machine.
+type telemetrySettings struct {
+	Enabled  bool   `json:"enabled"`
+	Endpoint string `json:"endpoint,omitempty"`
+}
+
+// telemetryEvent only carries names of commands and flags, never their values
+type telemetryEvent struct {
+	Version string   `json:"version"`
+	OS      string   `json:"os"`
+	Arch    string   `json:"arch"`
+	Command string   `json:"command"`
+	Flags   []string `json:"flags,omitempty"`
+	Error   string   `json:"error,omitempty"`
+}
+
+func configDir() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "kube-relay"), nil
+}
+
+func telemetryPaths() (string, string, error) {
+	dir, err := configDir()
+	if err != nil {
+		return "", "", err
+	}
+	return filepath.Join(dir, "telemetry.json"), filepath.Join(dir, "telemetry.log"), nil
+}
+
+func loadTelemetry() telemetrySettings {
+	var settings telemetrySettings
+	path, _, err := telemetryPaths()
+	if err != nil {
+		return settings
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return settings
+	}
+	json.Unmarshal(data, &settings)
+	return settings
+}
+
+func saveTelemetry(settings telemetrySettings) error {
+	path, _, err := telemetryPaths()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(settings, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0600)
+}
+
+func newTelemetryEvent(c *cli.Context, err error) telemetryEvent {
+	command := c.Command.Name
+	if command == "" {
+		command = "relay"
+	}
+	primary := map[string]bool{}
+	for _, flags := range [][]cli.Flag{c.App.Flags, c.Command.Flags} {
+		for _, f := range flags {
+			primary[f.Names()[0]] = true
+		}
+	}
+	var flags []string
+	for _, name := range c.FlagNames() {
+		if primary[name] {
+			flags = append(flags, name)
+		}
+	}
+	sort.Strings(flags)
+	event := telemetryEvent{
+		Version: version,
+		OS:      runtime.GOOS,
+		Arch:    runtime.GOARCH,
+		Command: command,
+		Flags:   flags,
+	}
+	if err != nil {
+		event.Error = asRelayError(err).Code
+	}
+	return event
+}
+
+// trackTelemetry remembers the command of this run
+func trackTelemetry(c *cli.Context) {
+	telemetryRun.mu.Lock()
+	defer telemetryRun.mu.Unlock()
+	telemetryRun.context = c
+}
+
+// trackCommands makes every command remember itself before it runs
+func trackCommands(commands []*cli.Command) {
+	for _, cmd := range commands {
+		trackCommands(cmd.Subcommands)
+		before := cmd.Before
+		cmd.Before = func(c *cli.Context) error {
+			trackTelemetry(c)
+			if before != nil {
+				return before(c)
+			}
+			return nil
+		}
+	}
+}
+
+// recordTelemetryExit records the command of this run before an exit that
+// skips the hooks of the app, e.g. on a signal
+func recordTelemetryExit(err error) {
+	telemetryRun.mu.Lock()
+	c := telemetryRun.context
+	telemetryRun.mu.Unlock()
+	if c != nil {
+		recordTelemetry(c, err)
+	}
+}
+
+// recordTelemetry records a run once, it never fails a command, problems
+// logging or sending are ignored
+func recordTelemetry(c *cli.Context, err error) {
+	telemetryRun.once.Do(func() {
+		sendTelemetry(c, err)
+	})
+}
+
+func sendTelemetry(c *cli.Context, err error) {
+	settings := loadTelemetry()
+	if !settings.Enabled {
+		return
+	}
+	data, mErr := json.Marshal(newTelemetryEvent(c, err))
+	if mErr != nil {
+		return
+	}
+
+	_, logPath, pErr := telemetryPaths()
+	if pErr != nil {
+		return
+	}
+	f, oErr := os.OpenFile(logPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if oErr != nil {
+		return
+	}
+	fmt.Fprintln(f, string(data))
+	f.Close()
+
+	if settings.Endpoint == "" {
+		return
+	}
+	client := &http.Client{Timeout: 2 * time.Second}
+	resp, sErr := client.Post(settings.Endpoint, "application/json", bytes.NewReader(data))
+	if sErr == nil {
+		resp.Body.Close()
+	}
+}
+
+func telemetryStatus() error {
+	settings := loadTelemetry()
+	_, logPath, err := telemetryPaths()
+	if err != nil {
+		return err
+	}
+	if !settings.Enabled {
+		fmt.Println("Telemetry is disabled")
+		return nil
+	}
+	endpoint := settings.Endpoint
+	if endpoint == "" {
+		endpoint = "none, events are only logged locally"
+	}
+	fmt.Printf("Telemetry is enabled\nEndpoint: %s\nLog: %s\n", endpoint, logPath)
+
+	f, err := os.Open(logPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var events []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		events = append(events, scanner.Text())
+	}
+	if len(events) > TELEMETRY_SHOWN_EVENTS {
+		events = events[len(events)-TELEMETRY_SHOWN_EVENTS:]
+	}
+	if len(events) > 0 {
+		fmt.Println("Last events:")
+	}
+	for _, e := range events {
+		fmt.Println(e)
+	}
+	return nil
+}
+
+func telemetryCommand() *cli.Command {
+	var endpoint string
+
+	return &cli.Command{
+		Name:  "telemetry",
+		Usage: "control opt-in anonymous usage telemetry",
+		Subcommands: []*cli.Command{
+			{
+				Name:  "status",
+				Usage: "show whether telemetry is enabled and what was sent",
+				Action: func(c *cli.Context) error {
+					return telemetryStatus()
+				},
+			},
+			{
+				Name:  "enable",
+				Usage: "send anonymous feature usage and error classes",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:        "endpoint",
+						Usage:       "url events are posted to, without one they are only logged locally",
+						Destination: &endpoint,
+					},
+				},
+				Action: func(c *cli.Context) error {
+					err := saveTelemetry(telemetrySettings{Enabled: true, Endpoint: endpoint})
+					if err != nil {
+						return err
+					}
+					fmt.Println("Telemetry enabled")
+					return nil
+				},
+			},
+			{
+				Name:  "disable",
+				Usage: "stop sending telemetry",
+				Action: func(c *cli.Context) error {
+					err := saveTelemetry(telemetrySettings{})
+					if err != nil {
+						return err
+					}
+					fmt.Println("Telemetry disabled")
+					return nil
+				},
+			},
+		},
+	}
+}
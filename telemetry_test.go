@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/urfave/cli/v2"
+)
+
+func TestRecordTelemetryOnce(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		exit    error
+		command string
+		err     string
+	}{
+		{"successful command", []string{"kube-relay", "version"}, nil, "version", ""},
+		{"successful relay", []string{"kube-relay"}, nil, "relay", ""},
+		{"interrupted command", []string{"kube-relay", "version"}, errInterrupted, "version", "Interrupted"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			t.Setenv("HOME", dir)
+			t.Setenv("XDG_CONFIG_HOME", dir)
+			t.Setenv("AppData", dir)
+			if err := saveTelemetry(telemetrySettings{Enabled: true}); err != nil {
+				t.Fatal(err)
+			}
+			telemetryRun = &telemetryTracker{}
+
+			app := &cli.App{
+				Name:   "kube-relay",
+				Before: func(c *cli.Context) error { trackTelemetry(c); return nil },
+				After:  func(c *cli.Context) error { recordTelemetryExit(nil); return nil },
+				Action: func(c *cli.Context) error { return nil },
+				Commands: []*cli.Command{{
+					Name: "version",
+					Action: func(c *cli.Context) error {
+						// a signal exits before the hooks of the app
+						if tt.exit != nil {
+							recordTelemetryExit(tt.exit)
+						}
+						return nil
+					},
+				}},
+			}
+			trackCommands(app.Commands)
+			if err := app.Run(tt.args); err != nil {
+				t.Fatal(err)
+			}
+
+			_, logPath, err := telemetryPaths()
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := os.ReadFile(logPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+			if len(lines) != 1 {
+				t.Fatalf("expected one event, got %d: %s", len(lines), data)
+			}
+			var event telemetryEvent
+			if err := json.Unmarshal([]byte(lines[0]), &event); err != nil {
+				t.Fatal(err)
+			}
+			if event.Command != tt.command || event.Error != tt.err {
+				t.Errorf("recorded command %q with error %q, want %q with %q", event.Command, event.Error, tt.command, tt.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+// every connection to a go relay server with tokens starts with this line,
+// multiplexed sessions once
+const TOKEN_PREAMBLE = "KUBE-RELAY-TOKEN "
+const TOKEN_PREAMBLE_LIMIT = 512
+const TOKEN_TIMEOUT = 10 * time.Second
+const TOKEN_ENV = "KUBE_RELAY_TOKEN"
+
+// tokenStore are the users of a shared relay server by the sha256 of their
+// token. The file is read again once it changed, so removing a line of the
+// mounted secret revokes a token without a restart.
+type tokenStore struct {
+	path string
+
+	mu       sync.Mutex
+	modified time.Time
+	users    map[string]string
+}
+
+func loadTokens(path string) (*tokenStore, error) {
+	s := &tokenStore{path: path}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.read(info.ModTime()); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *tokenStore) read(modified time.Time) error {
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return err
+	}
+	users, err := parseTokens(string(data))
+	if err != nil {
+		return fmt.Errorf("%s: %w", s.path, err)
+	}
+	s.users, s.modified = users, modified
+	return nil
+}
+
+// parseTokens parses lines of <user>:<sha256 hex of the token>, empty lines
+// and comments are skipped
+func parseTokens(data string) (map[string]string, error) {
+	users := map[string]string{}
+	for i, line := range strings.Split(data, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		sep := strings.LastIndex(line, ":")
+		if sep <= 0 {
+			return nil, fmt.Errorf("invalid line %d, expected <user>:<sha256 hex>", i+1)
+		}
+		hash := strings.ToLower(line[sep+1:])
+		if b, err := hex.DecodeString(hash); err != nil || len(b) != sha256.Size {
+			return nil, fmt.Errorf("invalid hash in line %d, expected 64 hex digits", i+1)
+		}
+		users[hash] = line[:sep]
+	}
+	return users, nil
+}
+
+// user is the user of a token. A file that can't be read anymore denies
+// everyone, rather than keeping tokens that may have been revoked.
+func (s *tokenStore) user(token string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	info, err := os.Stat(s.path)
+	if err != nil {
+		s.users, s.modified = nil, time.Time{}
+	} else if !info.ModTime().Equal(s.modified) {
+		if err := s.read(info.ModTime()); err != nil {
+			s.users, s.modified = nil, time.Time{}
+		}
+	}
+	sum := sha256.Sum256([]byte(token))
+	user, ok := s.users[hex.EncodeToString(sum[:])]
+	return user, ok
+}
+
+// readToken reads the preamble of a connection. It reads byte by byte, so
+// nothing after the preamble is consumed.
+func readToken(conn net.Conn) (string, error) {
+	conn.SetReadDeadline(time.Now().Add(TOKEN_TIMEOUT))
+	defer conn.SetReadDeadline(time.Time{})
+	var line []byte
+	b := make([]byte, 1)
+	for len(line) < TOKEN_PREAMBLE_LIMIT {
+		if _, err := conn.Read(b); err != nil {
+			return "", err
+		}
+		if b[0] == '\n' {
+			if !strings.HasPrefix(string(line), TOKEN_PREAMBLE) {
+				return "", fmt.Errorf("no token preamble")
+			}
+			return strings.TrimSpace(strings.TrimPrefix(string(line), TOKEN_PREAMBLE)), nil
+		}
+		line = append(line, b[0])
+	}
+	return "", fmt.Errorf("token preamble longer than %d bytes", TOKEN_PREAMBLE_LIMIT)
+}
+
+// validateToken checks a token fits in the preamble
+func validateToken(token string) error {
+	if strings.ContainsAny(token, " \t\r\n") || len(TOKEN_PREAMBLE)+len(token) >= TOKEN_PREAMBLE_LIMIT {
+		return fmt.Errorf("invalid --token, it must not contain whitespace and be shorter than %d bytes", TOKEN_PREAMBLE_LIMIT-len(TOKEN_PREAMBLE))
+	}
+	return nil
+}
+
+// dialUpstream connects to a forward, with a token the preamble goes first
+func dialUpstream(upstream string, token string) (net.Conn, error) {
+	conn, err := net.Dial("tcp", upstream)
+	if err != nil || token == "" {
+		return conn, err
+	}
+	if _, err := fmt.Fprintf(conn, "%s%s\n", TOKEN_PREAMBLE, token); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func tokenCommand() *cli.Command {
+	return &cli.Command{
+		Name:      "token",
+		Usage:     "create an access token for a shared go relay server and print its line of the tokens file",
+		ArgsUsage: "<user>",
+		Action: func(c *cli.Context) error {
+			user := c.Args().First()
+			if user == "" || strings.ContainsAny(user, ": \t\r\n") {
+				return fmt.Errorf("missing or invalid user, it must not contain colons or whitespace")
+			}
+			b := make([]byte, 32)
+			if _, err := rand.Read(b); err != nil {
+				return err
+			}
+			token := hex.EncodeToString(b)
+			sum := sha256.Sum256([]byte(token))
+			fmt.Printf("Token: %s\n", token)
+			fmt.Printf("Line for the tokens file: %s:%s\n", user, hex.EncodeToString(sum[:]))
+			return nil
+		},
+	}
+}
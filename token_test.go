@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func tokenLine(user string, token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return user + ":" + hex.EncodeToString(sum[:]) + "\n"
+}
+
+func TestParseTokens(t *testing.T) {
+	hash := tokenLine("", "secret")[1:65]
+	tests := []struct {
+		name  string
+		data  string
+		users int
+		err   string
+	}{
+		{"one user", "alice:" + hash, 1, ""},
+		{"comments and blank lines", "# team\n\nalice:" + hash + "\n", 1, ""},
+		{"upper case hash", "alice:" + string(bytes.ToUpper([]byte(hash))), 1, ""},
+		{"empty", "", 0, ""},
+		{"no user", ":" + hash, 0, "invalid line 1"},
+		{"no colon", hash, 0, "invalid line 1"},
+		{"short hash", "alice:abc", 0, "invalid hash in line 1"},
+		{"not hex", "alice:" + hash[:63] + "z", 0, "invalid hash in line 1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			users, err := parseTokens(tt.data)
+			checkError(t, err, tt.err)
+			if err == nil && len(users) != tt.users {
+				t.Errorf("expected %d users, got %v", tt.users, users)
+			}
+		})
+	}
+}
+
+func TestReadToken(t *testing.T) {
+	tests := []struct {
+		name  string
+		sent  string
+		token string
+		rest  string
+		err   string
+	}{
+		{"token", "KUBE-RELAY-TOKEN abc\nGET /", "abc", "GET /", ""},
+		{"crlf", "KUBE-RELAY-TOKEN abc\r\n", "abc", "", ""},
+		{"no preamble", "GET / HTTP/1.1\n", "", "", "no token preamble"},
+		{"too long", "KUBE-RELAY-TOKEN " + string(bytes.Repeat([]byte("a"), TOKEN_PREAMBLE_LIMIT)), "", "", "longer than"},
+		{"closed early", "KUBE-RELAY-TOK", "", "", "EOF"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			go func() {
+				client.Write([]byte(tt.sent))
+				client.Close()
+			}()
+			defer server.Close()
+			token, err := readToken(server)
+			checkError(t, err, tt.err)
+			if err != nil {
+				return
+			}
+			rest, _ := io.ReadAll(server)
+			if token != tt.token || string(rest) != tt.rest {
+				t.Errorf("readToken = %q with %q left, want %q with %q", token, rest, tt.token, tt.rest)
+			}
+		})
+	}
+}
+
+func TestTokenStoreRevocation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens")
+	write := func(data string, modified time.Time) {
+		if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, modified, modified); err != nil {
+			t.Fatal(err)
+		}
+	}
+	start := time.Now().Add(-time.Hour)
+	write(tokenLine("alice", "a")+tokenLine("bob", "b"), start)
+	store, err := loadTokens(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []struct {
+		name  string
+		data  string
+		token string
+		user  string
+		ok    bool
+	}{
+		{"alice", "", "a", "alice", true},
+		{"bob", "", "b", "bob", true},
+		{"unknown", "", "c", "", false},
+		{"bob revoked", tokenLine("alice", "a"), "b", "", false},
+		{"alice kept", "", "a", "alice", true},
+		{"broken file", "alice", "a", "", false},
+	}
+	for i, s := range steps {
+		if s.data != "" {
+			write(s.data, start.Add(time.Duration(i)*time.Minute))
+		}
+		if user, ok := store.user(s.token); user != s.user || ok != s.ok {
+			t.Errorf("%s: user = %q, %v, want %q, %v", s.name, user, ok, s.user, s.ok)
+		}
+	}
+	os.Remove(path)
+	if _, ok := store.user("a"); ok {
+		t.Errorf("a removed tokens file still lets users in")
+	}
+}
+
+func TestRelayServerTokens(t *testing.T) {
+	echo, err := net.Listen("tcp", net.JoinHostPort(LOOPBACK_ADDRESS, "0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	path := filepath.Join(t.TempDir(), "tokens")
+	if err := os.WriteFile(path, []byte(tokenLine("alice", "a")), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	tokens, err := loadTokens(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	route, err := parseRelayRoute("1=" + echo.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	logs := new(bytes.Buffer)
+	s := &relayServer{routes: []*relayRoute{route}, tokens: tokens, logs: json.NewEncoder(logs)}
+	listener, err := net.Listen("tcp", net.JoinHostPort(LOOPBACK_ADDRESS, "0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go s.serve(listener, route)
+
+	tests := []struct {
+		name  string
+		token string
+		echo  bool
+	}{
+		{"valid token", "a", true},
+		{"wrong token", "b", false},
+		{"no token", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := dialUpstream(listener.Addr().String(), tt.token)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(TOKEN_TIMEOUT + 5*time.Second))
+			// without a token the first line has to look like a preamble
+			if _, err := conn.Write([]byte("ping\n")); err != nil {
+				t.Fatal(err)
+			}
+			got := make([]byte, 5)
+			_, err = io.ReadFull(conn, got)
+			if tt.echo && (err != nil || string(got) != "ping\n") {
+				t.Errorf("expected the echo, got %q: %v", got, err)
+			}
+			if !tt.echo && err == nil {
+				t.Errorf("expected the connection to be closed, got %q", got)
+			}
+		})
+	}
+	s.logMu.Lock()
+	defer s.logMu.Unlock()
+	if !bytes.Contains(logs.Bytes(), []byte(`"user":"alice"`)) || !bytes.Contains(logs.Bytes(), []byte(`"event":"denied"`)) {
+		t.Errorf("expected logs with the user and denials, got %s", logs)
+	}
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const QUEUE_TIMEOUT = 10 * time.Second
+
+// tunnelListener owns the local port of a tunnel, so it stays open while the
+// forward behind it is re-established. Connections arriving meanwhile are held
+// for up to queueTimeout instead of being refused. With failover targets there
+// is an upstream per target and a breaker picks the active one.
+type tunnelListener struct {
+	listeners    []net.Listener
+	packetConns  []net.PacketConn
+	port         uint
+	queueTimeout time.Duration
+	breaker      *breaker
+	metrics      *tunnelMetrics
+	log          *logger
+	targets      []string
+	// open counts the connections being handled, for draining
+	open int32
+	// with endpoints connections go to the endpoints of a service, exec is
+	// how they get there through the relay pod
+	endpoints *endpointWatcher
+	exec      func(command []string, conn net.Conn) error
+	// with via every connection is the stdio of this command, exec'd in an
+	// existing pod
+	via []string
+	// with mux connections are streams of a session over the first forward
+	mux *muxDialer
+	// pool keeps connections through the first forward open ahead of time
+	pool *streamPool
+	// token starts every connection to a shared go relay server
+	token string
+
+	mu        sync.Mutex
+	upstreams []string
+	changed   chan struct{}
+	refusing  []bool
+}
+
+// listenTunnel listens on the local address, a local port of 0 picks a free
+// one. The default loopback address is accompanied by its ipv6 counterpart.
+// There is an upstream per target.
+func listenTunnel(address string, localPort uint, queueTimeout time.Duration, targets []string, log *logger) (*tunnelListener, error) {
+	listener, err := net.Listen("tcp", net.JoinHostPort(address, fmt.Sprint(localPort)))
+	if err != nil {
+		return nil, err
+	}
+	t := newTunnelListener(queueTimeout, targets, log)
+	t.listeners = []net.Listener{listener}
+	t.port = uint(listener.Addr().(*net.TCPAddr).Port)
+	if address == LOOPBACK_ADDRESS {
+		if listener6, err := net.Listen("tcp", fmt.Sprintf("[::1]:%d", t.port)); err == nil {
+			t.listeners = append(t.listeners, listener6)
+		}
+	}
+	for _, l := range t.listeners {
+		go t.serve(l)
+	}
+	return t, nil
+}
+
+func newTunnelListener(queueTimeout time.Duration, targets []string, log *logger) *tunnelListener {
+	if queueTimeout <= 0 {
+		queueTimeout = QUEUE_TIMEOUT
+	}
+	return &tunnelListener{
+		queueTimeout: queueTimeout,
+		log:          log,
+		targets:      targets,
+		upstreams:    make([]string, len(targets)),
+		changed:      make(chan struct{}),
+		refusing:     make([]bool, len(targets)),
+	}
+}
+
+// setUpstream points a target of the tunnel at a forward, an empty address
+// holds new connections until the next one is up.
+func (t *tunnelListener) setUpstream(target int, address string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.upstreams[target] = address
+	close(t.changed)
+	t.changed = make(chan struct{})
+	if target == 0 && t.pool != nil {
+		t.pool.reset(address)
+	}
+}
+
+func (t *tunnelListener) close() {
+	t.pool.close()
+	for _, l := range t.listeners {
+		l.Close()
+	}
+	for _, c := range t.packetConns {
+		c.Close()
+	}
+}
+
+// addresses are the local addresses the tunnel listens on
+func (t *tunnelListener) addresses() []net.Addr {
+	var addrs []net.Addr
+	for _, l := range t.listeners {
+		addrs = append(addrs, l.Addr())
+	}
+	for _, c := range t.packetConns {
+		addrs = append(addrs, c.LocalAddr())
+	}
+	return addrs
+}
+
+func (t *tunnelListener) serve(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		atomic.AddInt32(&t.open, 1)
+		go t.handle(conn)
+	}
+}
+
+// dial connects to the forward of a target, waiting for one while it is down
+func (t *tunnelListener) dial(target int) (net.Conn, error) {
+	deadline := time.After(t.queueTimeout)
+	for {
+		t.mu.Lock()
+		upstream, changed := t.upstreams[target], t.changed
+		t.mu.Unlock()
+
+		if upstream != "" && target == 0 && t.pool != nil {
+			if conn := t.pool.get(upstream); conn != nil {
+				return conn, nil
+			}
+		}
+		if upstream != "" && t.mux != nil {
+			conn, err := t.mux.open(upstream)
+			if err == nil {
+				return conn, nil
+			}
+		} else if upstream != "" {
+			conn, err := dialUpstream(upstream, t.token)
+			if err == nil {
+				return conn, nil
+			}
+		}
+		select {
+		case <-changed:
+		case <-deadline:
+			return nil, fmt.Errorf("no forward within %s", t.queueTimeout)
+		}
+	}
+}
+
+func (t *tunnelListener) handle(client net.Conn) {
+	defer atomic.AddInt32(&t.open, -1)
+	defer client.Close()
+	if t.endpoints != nil {
+		t.handleEndpoint(client)
+		return
+	}
+	if t.via != nil {
+		t.handleVia(client)
+		return
+	}
+	target := 0
+	if t.breaker != nil {
+		target = t.breaker.pick()
+	}
+	server, err := t.dial(target)
+	if err != nil {
+		t.metrics.drop()
+		println("dropped connection from", client.RemoteAddr().String()+":", err.Error())
+		return
+	}
+	defer server.Close()
+	t.metrics.opened()
+
+	var sent int64
+	clientDone := make(chan struct{})
+	go func() {
+		sent, _ = io.Copy(server, client)
+		closeWrite(server)
+		close(clientDone)
+	}()
+	received, _ := io.Copy(client, server)
+	defer func() {
+		client.Close()
+		server.Close()
+		<-clientDone
+		t.metrics.closed(sent, received)
+	}()
+
+	// the relay closes connections it could not pass on before any data
+	refused := false
+	select {
+	case <-clientDone:
+	default:
+		refused = received == 0
+	}
+	t.backend(target, refused)
+}
+
+// backend records whether the target accepted a connection of the relay pod,
+// a refusing target is reported once until it accepts again.
+func (t *tunnelListener) backend(target int, refused bool) {
+	if t.breaker != nil {
+		if refused {
+			t.breaker.failed(target)
+		} else {
+			t.breaker.succeeded(target)
+		}
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if refused && !t.refusing[target] {
+		t.log.printf("Target %s closed a connection of the relay pod without any data, it may not accept connections\n", t.targets[target])
+	}
+	if !refused && t.refusing[target] {
+		t.log.printf("Target %s accepts connections again\n", t.targets[target])
+	}
+	t.refusing[target] = refused
+}
+
+// serveTunnel forwards the local port to ports of the relay pod until the pod
+// can't be reached anymore, a lost forward is re-established. The first port
+// is the primary target, the others are failover targets. ready is called
+// with the local port once the first forward is up.
+func serveTunnel(rc *relayClient, pod *podRef, remotePorts []int, opts relayOptions, policy retryPolicy, ready func(uint) error) error {
+	var targets []string
+	for _, t := range opts.targets()[:len(remotePorts)] {
+		targets = append(targets, t.target())
+	}
+	tunnel, err := listenLocal(opts, targets)
+	if err != nil {
+		return err
+	}
+	defer tunnel.close()
+	opts.shutdown.register(tunnel)
+	for _, addr := range tunnel.addresses() {
+		opts.log.printf("Forwarding from %s -> %d\n", addr, remotePorts[0])
+	}
+	name, _, _ := pod.current()
+	tunnel.metrics = registerMetrics(name, opts.target())
+	if len(remotePorts) > 1 {
+		tunnel.breaker = newBreaker(rc, pod, opts.targets(), opts.log)
+	}
+	tunnel.token = opts.token
+	if opts.streamPool > 0 {
+		tunnel.pool = newStreamPool(opts.streamPool, opts.token)
+	}
+	// with mux the only forward goes to the mux port of the go relay server
+	if opts.mux {
+		tunnel.mux = &muxDialer{port: uint16(remotePorts[0]), token: opts.token}
+		remotePorts = []int{opts.muxPort()}
+	}
+	if opts.endpoints != nil {
+		tunnel.endpoints = opts.endpoints
+		tunnel.exec = func(command []string, conn net.Conn) error {
+			name, _, _ := pod.current()
+			return execStream(rc, pod.namespace, name, command, conn, conn)
+		}
+	}
+
+	var once sync.Once
+	announce := func() error {
+		err := error(nil)
+		once.Do(func() {
+			if ready != nil {
+				err = ready(tunnel.port)
+			}
+		})
+		return err
+	}
+	errs := make(chan error, len(remotePorts))
+	for i, remotePort := range remotePorts {
+		go func(i int, remotePort int) {
+			errs <- forwardTarget(rc, pod, remotePort, policy, opts.log, func(port uint) error {
+				if port == 0 {
+					tunnel.setUpstream(i, "")
+					return nil
+				}
+				tunnel.setUpstream(i, fmt.Sprintf("127.0.0.1:%d", port))
+				if i != 0 {
+					return nil
+				}
+				return announce()
+			})
+		}(i, remotePort)
+	}
+	err = <-errs
+	// the forwards to the failover ports end with the first, else they would
+	// replace the pod the relay deletes next. A single port may share its pod
+	// with the tunnels of a group, which go on.
+	if len(remotePorts) > 1 {
+		pod.end()
+		for range remotePorts[1:] {
+			<-errs
+		}
+	}
+	return err
+}
+
+// forwardTarget keeps a forward to a port of the relay pod up, up is called
+// with the local port of every new forward and with 0 once it is lost. A lost
+// forward is re-established right away, if it drops again within
+// RECONNECT_STABLE the next attempt backs off exponentially. A lost pod is
+// replaced if the relay pod allows it.
+func forwardTarget(rc *relayClient, pod *podRef, remotePort int, policy retryPolicy, log *logger, up func(uint) error) error {
+	var drops int
+	for {
+		name, generation, lost := pod.current()
+		var establishedAt time.Time
+		err := policy.do("establish the forward", func() error {
+			established := false
+			err := forwardUntil(rc, pod.namespace, name, 0, remotePort, lost, func(port uint) error {
+				established = true
+				establishedAt = time.Now()
+				return up(port)
+			})
+			if err != nil && established {
+				return permanentError{err}
+			}
+			return err
+		})
+		up(0)
+		if pod.ended() {
+			return nil
+		}
+		if pErr := podFailure(rc.clientset, pod.namespace, name); pErr != nil {
+			rc.streamLog("forward to port %d ended with the pod: %s", remotePort, pErr)
+			if !pod.replaceable(pErr) {
+				return pErr
+			}
+			if err := pod.replace(generation, pErr); err != nil {
+				return err
+			}
+			drops = 0
+			continue
+		}
+		if err != nil {
+			rc.streamLog("forward to port %d given up: %s", remotePort, err)
+			return fmt.Errorf("cannot forward to pod %q through the api server: %w", name, err)
+		}
+		if time.Since(establishedAt) >= RECONNECT_STABLE {
+			drops = 0
+		}
+		delay := reconnectDelay(drops)
+		drops++
+		rc.streamLog("resuming the forward to port %d in %s", remotePort, delay)
+		log.printf("Lost the connection to the api server, re-establishing the forward to pod %q port %d\n", name, remotePort)
+		time.Sleep(delay)
+		// the api server may be gone for a while, e.g. during an upgrade
+		if policy.retries < RECONNECT_RETRIES {
+			policy.retries = RECONNECT_RETRIES
+		}
+	}
+}
+
+// reconnectDelay is the backoff before re-establishing a forward that dropped
+// drops times in a row
+func reconnectDelay(drops int) time.Duration {
+	if drops == 0 {
+		return 0
+	}
+	delay := RETRY_BACKOFF
+	for i := 1; i < drops && delay < RETRY_MAX_BACKOFF; i++ {
+		delay *= 2
+	}
+	if delay > RETRY_MAX_BACKOFF {
+		delay = RETRY_MAX_BACKOFF
+	}
+	return delay
+}
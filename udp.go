@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const PROTOCOL_TCP = "tcp"
+const PROTOCOL_UDP = "udp"
+
+const UDP_SESSION_TIMEOUT = time.Minute
+const UDP_MAX_DATAGRAM = 65535
+
+func validateProtocol(protocol string) error {
+	if protocol != PROTOCOL_TCP && protocol != PROTOCOL_UDP {
+		return fmt.Errorf("invalid protocol %q, expected %s or %s", protocol, PROTOCOL_TCP, PROTOCOL_UDP)
+	}
+	return nil
+}
+
+// writeDatagram frames a datagram by its length in two bytes, like dns over
+// tcp, so it keeps its boundaries in the stream of a forward
+func writeDatagram(w io.Writer, b []byte) error {
+	frame := make([]byte, 2+len(b))
+	binary.BigEndian.PutUint16(frame, uint16(len(b)))
+	copy(frame[2:], b)
+	_, err := w.Write(frame)
+	return err
+}
+
+// readDatagram reads a datagram framed by writeDatagram into buf, which holds
+// UDP_MAX_DATAGRAM bytes
+func readDatagram(r io.Reader, buf []byte) ([]byte, error) {
+	var length [2]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return nil, err
+	}
+	b := buf[:binary.BigEndian.Uint16(length[:])]
+	_, err := io.ReadFull(r, b)
+	return b, err
+}
+
+// udpSession carries the datagrams of a local udp client over a connection
+// through the forward, the go relay server in the relay pod sends every
+// framed datagram to the cluster host and the replies back.
+type udpSession struct {
+	server net.Conn
+
+	mu   sync.Mutex
+	last time.Time
+	sent int64
+}
+
+func (s *udpSession) touch(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.last = time.Now()
+	s.sent += int64(n)
+}
+
+func (s *udpSession) idle() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return time.Since(s.last) >= UDP_SESSION_TIMEOUT
+}
+
+// listenUDPTunnel is listenTunnel for udp, every client address gets its own
+// connection through the forward until it is idle for UDP_SESSION_TIMEOUT.
+func listenUDPTunnel(address string, localPort uint, queueTimeout time.Duration, targets []string, log *logger) (*tunnelListener, error) {
+	conn, err := net.ListenPacket("udp", net.JoinHostPort(address, fmt.Sprint(localPort)))
+	if err != nil {
+		return nil, err
+	}
+	t := newTunnelListener(queueTimeout, targets, log)
+	t.packetConns = []net.PacketConn{conn}
+	t.port = uint(conn.LocalAddr().(*net.UDPAddr).Port)
+	go t.serveUDP(conn)
+	return t, nil
+}
+
+func (t *tunnelListener) serveUDP(conn net.PacketConn) {
+	var mu sync.Mutex
+	sessions := map[string]*udpSession{}
+	buf := make([]byte, UDP_MAX_DATAGRAM)
+	for {
+		n, client, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		mu.Lock()
+		s, ok := sessions[client.String()]
+		mu.Unlock()
+		if !ok {
+			server, err := t.dial(0)
+			if err != nil {
+				t.metrics.drop()
+				println("dropped datagram from", client.String()+":", err.Error())
+				continue
+			}
+			server.(*net.TCPConn).SetNoDelay(true)
+			t.metrics.opened()
+			s = &udpSession{server: server}
+			mu.Lock()
+			sessions[client.String()] = s
+			mu.Unlock()
+			go func(client net.Addr) {
+				received := t.replyUDP(conn, client, s)
+				mu.Lock()
+				delete(sessions, client.String())
+				mu.Unlock()
+				s.server.Close()
+				s.mu.Lock()
+				defer s.mu.Unlock()
+				t.metrics.closed(s.sent, received)
+			}(client)
+		}
+		s.touch(n)
+		if err := writeDatagram(s.server, buf[:n]); err != nil {
+			s.server.Close()
+		}
+	}
+}
+
+// replyUDP passes replies to the client until the session fails or is idle,
+// it returns the number of bytes received.
+func (t *tunnelListener) replyUDP(conn net.PacketConn, client net.Addr, s *udpSession) int64 {
+	// an idle session is closed from aside, a read deadline could split a frame
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		ticker := time.NewTicker(UDP_SESSION_TIMEOUT / 4)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if s.idle() {
+					s.server.Close()
+					return
+				}
+			}
+		}
+	}()
+	var received int64
+	buf := make([]byte, UDP_MAX_DATAGRAM)
+	for {
+		datagram, err := readDatagram(s.server, buf)
+		if err != nil {
+			return received
+		}
+		received += int64(len(datagram))
+		s.touch(0)
+		conn.WriteTo(datagram, client)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDatagramFraming(t *testing.T) {
+	tests := []struct {
+		name      string
+		datagrams [][]byte
+	}{
+		{"one", [][]byte{[]byte("query")}},
+		{"back to back", [][]byte{[]byte("first"), []byte("second"), []byte("third")}},
+		{"empty", [][]byte{{}, []byte("after an empty one")}},
+		{"largest", [][]byte{bytes.Repeat([]byte{0xff}, UDP_MAX_DATAGRAM)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stream := new(bytes.Buffer)
+			for _, d := range tt.datagrams {
+				if err := writeDatagram(stream, d); err != nil {
+					t.Fatal(err)
+				}
+			}
+			buf := make([]byte, UDP_MAX_DATAGRAM)
+			for i, want := range tt.datagrams {
+				got, err := readDatagram(stream, buf)
+				if err != nil || !bytes.Equal(got, want) {
+					t.Fatalf("datagram %d: got %d bytes, want %d: %v", i, len(got), len(want), err)
+				}
+			}
+			if _, err := readDatagram(stream, buf); err != io.EOF {
+				t.Errorf("expected the end of the stream, got %v", err)
+			}
+		})
+	}
+	if _, err := readDatagram(bytes.NewReader([]byte{0, 5, 'a'}), make([]byte, UDP_MAX_DATAGRAM)); err != io.ErrUnexpectedEOF {
+		t.Errorf("expected a truncated frame to fail, got %v", err)
+	}
+}
+
+func TestRelayServerUDP(t *testing.T) {
+	echo, err := net.ListenPacket("udp", net.JoinHostPort(LOOPBACK_ADDRESS, "0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, UDP_MAX_DATAGRAM)
+		for {
+			n, addr, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	route, err := parseRelayRoute("1=udp:" + echo.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if route.protocol != PROTOCOL_UDP || route.currentTarget() != echo.LocalAddr().String() {
+		t.Fatalf("unexpected route %s to %s", route.protocol, route.currentTarget())
+	}
+	listener, err := net.Listen("tcp", net.JoinHostPort(LOOPBACK_ADDRESS, "0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	s := &relayServer{routes: []*relayRoute{route}, logs: json.NewEncoder(io.Discard)}
+	go s.serve(listener, route)
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	// sent at once the datagrams share a read of the relay server
+	sent := [][]byte{[]byte("first query"), []byte("second"), []byte("third query")}
+	stream := new(bytes.Buffer)
+	for _, d := range sent {
+		writeDatagram(stream, d)
+	}
+	if _, err := conn.Write(stream.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, UDP_MAX_DATAGRAM)
+	for _, want := range sent {
+		got, err := readDatagram(conn, buf)
+		if err != nil || !bytes.Equal(got, want) {
+			t.Fatalf("got %q, want %q: %v", got, want, err)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+
+	apiv1 "k8s.io/api/core/v1"
+	utilexec "k8s.io/client-go/util/exec"
+)
+
+const DEFAULT_CONTAINER_ANNOTATION = "kubectl.kubernetes.io/default-container"
+
+// viaContainer is the container of a pod connections are exec'd in, the given
+// one, else the default container of the pod or its first one
+func viaContainer(pod *apiv1.Pod, name string) (string, error) {
+	if name == "" {
+		name = pod.Annotations[DEFAULT_CONTAINER_ANNOTATION]
+	}
+	if name == "" && len(pod.Spec.Containers) != 0 {
+		return pod.Spec.Containers[0].Name, nil
+	}
+	var names []string
+	for _, c := range pod.Spec.Containers {
+		if c.Name == name {
+			return name, nil
+		}
+		names = append(names, c.Name)
+	}
+	return "", &relayError{
+		Code:       "ContainerNotFound",
+		Reason:     fmt.Sprintf("Pod %q has no container %q", pod.Name, name),
+		Resource:   fmt.Sprintf("pods/%s", pod.Name),
+		Suggestion: fmt.Sprintf("pick one of %s with --via-container", strings.Join(names, ", ")),
+		exitCode:   1,
+	}
+}
+
+// viaCommand is the command relaying a connection from inside a container,
+// socat if the image has it, else nc
+func viaCommand(rc *relayClient, namespace string, pod string, container string, target string) ([]string, error) {
+	if err := execContainer(rc, namespace, pod, container, []string{"socat", "-V"}, nil, io.Discard); err == nil {
+		return []string{"socat", "-", socatAddress(PROTOCOL_TCP, target)}, nil
+	}
+	// some nc variants exit non-zero on -h, only a missing binary counts
+	err := execContainer(rc, namespace, pod, container, []string{"nc", "-h"}, nil, io.Discard)
+	var exit utilexec.ExitError
+	if err == nil || (errors.As(err, &exit) && exit.ExitStatus() != 126 && exit.ExitStatus() != 127) {
+		host, port := splitHostPort(target)
+		return []string{"nc", host, port}, nil
+	}
+	return nil, &relayError{
+		Code:       "RelayToolMissing",
+		Reason:     fmt.Sprintf("Container %q of pod %q has neither socat nor nc", container, pod),
+		Resource:   fmt.Sprintf("pods/%s", pod),
+		Suggestion: "pick another container with --via-container, or drop --via for a relay pod",
+		exitCode:   1,
+	}
+}
+
+// serveVia relays through a pod that exists already, every connection runs
+// socat or nc in one of its containers over exec. It needs the right to exec
+// into the pod only, not to create pods.
+func serveVia(rc *relayClient, namespace string, opts relayOptions, ready func(uint) error) error {
+	pod, err := existingPod(rc, namespace, "via", opts.via)
+	if err != nil {
+		return err
+	}
+	container, err := viaContainer(pod, opts.viaContainer)
+	if err != nil {
+		return err
+	}
+	command, err := viaCommand(rc, namespace, pod.Name, container, opts.target())
+	if err != nil {
+		return err
+	}
+
+	tunnel, err := listenLocal(opts, []string{opts.target()})
+	if err != nil {
+		return err
+	}
+	defer tunnel.close()
+	opts.shutdown.register(tunnel)
+	for _, addr := range tunnel.addresses() {
+		opts.log.printf("Forwarding from %s -> %s through %s in container %q of pod %q\n", addr, opts.target(), command[0], container, pod.Name)
+	}
+	tunnel.metrics = registerMetrics(pod.Name, opts.target())
+	tunnel.via = command
+	tunnel.exec = func(command []string, conn net.Conn) error {
+		return execContainer(rc, namespace, pod.Name, container, command, conn, conn)
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	gone := make(chan error, 1)
+	watchTargetPod(rc, namespace, pod.Name, stop, func(err error) { gone <- err })
+	if ready != nil {
+		if err := ready(tunnel.port); err != nil {
+			return err
+		}
+	}
+	select {
+	case err := <-gone:
+		return err
+	case <-opts.stop:
+		return nil
+	}
+}
+
+// handleVia passes a connection to the stdio of the relay command in the pod
+func (t *tunnelListener) handleVia(client net.Conn) {
+	t.metrics.opened()
+	counted := &countingConn{Conn: client}
+	err := t.exec(t.via, counted)
+	t.metrics.closed(atomic.LoadInt64(&counted.read), atomic.LoadInt64(&counted.written))
+	if err != nil {
+		t.log.printf("Connection to %s failed: %s\n", t.targets[0], err)
+	}
+}
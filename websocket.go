@@ -0,0 +1,162 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/websocket"
+	"k8s.io/apimachinery/pkg/util/httpstream"
+	spdystream "k8s.io/apimachinery/pkg/util/httpstream/spdy"
+	"k8s.io/client-go/rest"
+)
+
+const TRANSPORT_AUTO = "auto"
+const TRANSPORT_WEBSOCKET = "websocket"
+const TRANSPORT_SPDY = "spdy"
+
+// the api server tunnels spdy through a websocket with this subprotocol prefix
+const WEBSOCKET_TUNNEL_PREFIX = "SPDY/3.1+"
+const WEBSOCKET_DIAL_TIMEOUT = 30 * time.Second
+
+func validateTransport(transport string) error {
+	switch transport {
+	case TRANSPORT_AUTO, TRANSPORT_WEBSOCKET, TRANSPORT_SPDY:
+		return nil
+	}
+	return fmt.Errorf("unknown --transport %q, use %s, %s or %s", transport, TRANSPORT_AUTO, TRANSPORT_WEBSOCKET, TRANSPORT_SPDY)
+}
+
+// websocketDialer upgrades a port-forward to spdy tunneled through a websocket,
+// which passes gateways and http/2 load balancers that break the spdy
+// upgrade. Api servers from kubernetes 1.30 on support it.
+type websocketDialer struct {
+	rc  *relayClient
+	url *url.URL
+}
+
+func (d websocketDialer) Dial(protocols ...string) (httpstream.Connection, string, error) {
+	var tunneled []string
+	for _, p := range protocols {
+		tunneled = append(tunneled, WEBSOCKET_TUNNEL_PREFIX+p)
+	}
+	upgrader := &websocketUpgrader{tlsConfig: d.rc.tlsConfig, protocols: tunneled}
+	// the wrappers add the credentials of the kubeconfig to the upgrade
+	wrapper, err := rest.HTTPWrappersForConfig(d.rc.config, upgrader)
+	if err != nil {
+		return nil, "", err
+	}
+	req, err := http.NewRequest(http.MethodGet, d.url.String(), nil)
+	if err != nil {
+		return nil, "", err
+	}
+	if _, err := wrapper.RoundTrip(req); err != nil {
+		return nil, "", err
+	}
+	conn, err := spdystream.NewClientConnectionWithPings(upgrader.conn, d.rc.keepalive)
+	if err != nil {
+		upgrader.conn.Close()
+		return nil, "", err
+	}
+	return conn, strings.TrimPrefix(upgrader.conn.Config().Protocol[0], WEBSOCKET_TUNNEL_PREFIX), nil
+}
+
+// upgradeError is a failed websocket handshake, the api server or a proxy in
+// front of it doesn't support websocket port-forwards
+type upgradeError struct {
+	err error
+}
+
+func (e *upgradeError) Error() string {
+	return fmt.Sprintf("websocket upgrade failed: %s", e.err)
+}
+
+func (e *upgradeError) Unwrap() error {
+	return e.err
+}
+
+// websocketUpgrader is the round tripper under the credential wrappers, it
+// performs the websocket handshake and keeps the connection
+type websocketUpgrader struct {
+	tlsConfig *tls.Config
+	protocols []string
+	conn      *websocket.Conn
+}
+
+func (u *websocketUpgrader) RoundTrip(req *http.Request) (*http.Response, error) {
+	address, scheme := req.URL.Host, "ws"
+	if req.URL.Port() == "" {
+		address = net.JoinHostPort(req.URL.Hostname(), "80")
+	}
+	dialer := &net.Dialer{Timeout: WEBSOCKET_DIAL_TIMEOUT}
+	var conn net.Conn
+	var err error
+	if req.URL.Scheme == "https" {
+		if req.URL.Port() == "" {
+			address = net.JoinHostPort(req.URL.Hostname(), "443")
+		}
+		scheme = "wss"
+		config := u.tlsConfig.Clone()
+		if config == nil {
+			config = &tls.Config{}
+		}
+		if config.ServerName == "" {
+			config.ServerName = req.URL.Hostname()
+		}
+		conn, err = tls.DialWithDialer(dialer, "tcp", address, config)
+	} else {
+		conn, err = dialer.Dial("tcp", address)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	location := *req.URL
+	location.Scheme = scheme
+	config := &websocket.Config{
+		Location: &location,
+		Origin:   req.URL,
+		Protocol: u.protocols,
+		Version:  websocket.ProtocolVersionHybi13,
+		Header:   req.Header.Clone(),
+	}
+	conn.SetDeadline(time.Now().Add(WEBSOCKET_DIAL_TIMEOUT))
+	ws, err := websocket.NewClient(config, conn)
+	if err != nil {
+		conn.Close()
+		return nil, &upgradeError{err}
+	}
+	conn.SetDeadline(time.Time{})
+	// spdy frames go in binary messages
+	ws.PayloadType = websocket.BinaryFrame
+	u.conn = ws
+	return &http.Response{StatusCode: http.StatusSwitchingProtocols, Body: http.NoBody, Request: req}, nil
+}
+
+// fallbackDialer tries a websocket port-forward first and sticks to spdy once
+// the upgrade fails, for api servers before kubernetes 1.30 or proxies that
+// don't pass websockets
+type fallbackDialer struct {
+	websocket httpstream.Dialer
+	spdy      httpstream.Dialer
+	rc        *relayClient
+}
+
+func (d fallbackDialer) Dial(protocols ...string) (httpstream.Connection, string, error) {
+	if atomic.LoadInt32(&d.rc.spdyOnly) == 0 {
+		conn, protocol, err := d.websocket.Dial(protocols...)
+		var upgrade *upgradeError
+		if !errors.As(err, &upgrade) {
+			return conn, protocol, err
+		}
+		atomic.StoreInt32(&d.rc.spdyOnly, 1)
+		d.rc.streamLog("falling back to spdy: %s", err)
+	}
+	return d.spdy.Dial(protocols...)
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"sync"
+)
+
+// the command run by the exec wrapper finds the tunnel in these variables
+const ENV_RELAY_ADDR = "KUBE_RELAY_ADDR"
+const ENV_RELAY_HOST = "KUBE_RELAY_HOST"
+const ENV_RELAY_PORT = "KUBE_RELAY_PORT"
+
+// wrapCommand returns a ready func starting the command once the tunnel is up.
+// When the command exits, done is called with its exit code.
+func wrapCommand(args []string, address string, done func(code int)) func(uint) error {
+	var once sync.Once
+	return func(port uint) error {
+		var err error
+		once.Do(func() {
+			cmd := exec.Command(args[0], args[1:]...)
+			cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+			cmd.Env = append(os.Environ(),
+				fmt.Sprintf("%s=%s", ENV_RELAY_ADDR, net.JoinHostPort(address, fmt.Sprint(port))),
+				fmt.Sprintf("%s=%s", ENV_RELAY_HOST, address),
+				fmt.Sprintf("%s=%d", ENV_RELAY_PORT, port),
+			)
+			if err = cmd.Start(); err != nil {
+				err = permanentError{fmt.Errorf("cannot run %q: %w", args[0], err)}
+				return
+			}
+			go func() {
+				code := 0
+				if err := cmd.Wait(); err != nil {
+					var exitErr *exec.ExitError
+					code = 1
+					if errors.As(err, &exitErr) && exitErr.ExitCode() > 0 {
+						code = exitErr.ExitCode()
+					}
+				}
+				done(code)
+			}()
+		})
+		return err
+	}
+}